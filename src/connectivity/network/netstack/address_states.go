@@ -0,0 +1,131 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"fmt"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+// addressState is the lifecycle state of an address assigned to a NIC,
+// following the address states described in RFC 4862 section 5.4.
+type addressState int
+
+const (
+	// addressStateTentative is the state of an address whose uniqueness is
+	// still being verified by Duplicate Address Detection.
+	addressStateTentative addressState = iota
+
+	// addressStateAssigned is the state of an address that may be used
+	// freely.
+	addressStateAssigned
+
+	// addressStateDeprecated is the state of an address whose preferred
+	// lifetime has expired; it remains usable but is not preferred for new
+	// communications.
+	addressStateDeprecated
+
+	// addressStateInvalid is the state of an address whose valid lifetime
+	// has expired; it may no longer be used.
+	addressStateInvalid
+)
+
+func (s addressState) String() string {
+	switch s {
+	case addressStateTentative:
+		return "tentative"
+	case addressStateAssigned:
+		return "assigned"
+	case addressStateDeprecated:
+		return "deprecated"
+	case addressStateInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// addressStateKey identifies an address assigned to a NIC.
+type addressStateKey struct {
+	nicID tcpip.NICID
+	addr  tcpip.Address
+}
+
+// addressStateMap records the lifecycle state of addresses as reported by the
+// stack's NDP dispatcher. The stack tracks address state internally but does
+// not expose it, so the netstack keeps this view for clients that need to
+// distinguish, say, a tentative address from an assigned one.
+//
+// Entries for invalidated addresses are retained (the stack removes such
+// addresses from the NIC itself) so that clients can distinguish invalidation
+// from removal; they are dropped when the NIC is removed.
+type addressStateMap struct {
+	mu struct {
+		sync.Mutex
+		states map[addressStateKey]addressState
+	}
+}
+
+func (m *addressStateMap) set(nicid tcpip.NICID, addr tcpip.Address, state addressState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mu.states == nil {
+		m.mu.states = make(map[addressStateKey]addressState)
+	}
+	m.mu.states[addressStateKey{nicID: nicid, addr: addr}] = state
+}
+
+func (m *addressStateMap) remove(nicid tcpip.NICID, addr tcpip.Address) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mu.states, addressStateKey{nicID: nicid, addr: addr})
+}
+
+// removeNIC drops the states recorded for all addresses on the given NIC.
+func (m *addressStateMap) removeNIC(nicid tcpip.NICID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.mu.states {
+		if key.nicID == nicid {
+			delete(m.mu.states, key)
+		}
+	}
+}
+
+func (m *addressStateMap) get(nicid tcpip.NICID, addr tcpip.Address) (addressState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.mu.states[addressStateKey{nicID: nicid, addr: addr}]
+	return state, ok
+}
+
+// getAddressState returns the lifecycle state of addr on the NIC identified
+// by nicid, or false if the address is not known to the NIC.
+//
+// Addresses added outside the tracked paths fall back to a state derived from
+// the stack: an IPv6 address without a recorded DAD result is still
+// tentative, while every other address is assigned as soon as it is added.
+func (ns *Netstack) getAddressState(nicid tcpip.NICID, addr tcpip.Address) (addressState, bool) {
+	if state, ok := ns.addressStates.get(nicid, addr); ok {
+		return state, true
+	}
+
+	nicInfo, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		return 0, false
+	}
+	for _, a := range nicInfo.ProtocolAddresses {
+		if a.AddressWithPrefix.Address == addr {
+			if a.Protocol == ipv6.ProtocolNumber {
+				return addressStateTentative, true
+			}
+			return addressStateAssigned, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"sync"
+
+	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// Directed-broadcast support. The stack only delivers packets addressed to
+// one of a NIC's assigned addresses, so IPv4 directed (subnet) broadcasts
+// are dropped by default. Acceptance is implemented by assigning the
+// subnet-broadcast address of each of the NIC's IPv4 subnets to the NIC
+// while the setting is enabled. Because the broadcast address is then local
+// to the NIC, directed broadcasts are delivered and never forwarded to
+// other interfaces; while the setting is disabled and IP forwarding is
+// enabled they follow the normal forwarding path instead.
+
+// directedBroadcastState tracks, per NIC, whether directed broadcasts are
+// accepted and which broadcast addresses have been assigned to implement
+// that.
+type directedBroadcastState struct {
+	mu struct {
+		sync.Mutex
+		enabled map[tcpip.NICID]bool
+		added   map[tcpip.NICID][]tcpip.Address
+	}
+}
+
+// setInterfaceDirectedBroadcast enables or disables acceptance of IPv4
+// directed broadcasts on the NIC and returns whether the NIC was found.
+func (ns *Netstack) setInterfaceDirectedBroadcast(nicid tcpip.NICID, enabled bool) bool {
+	if _, ok := ns.stack.NICInfo()[nicid]; !ok {
+		return false
+	}
+	st := &ns.directedBroadcast
+	st.mu.Lock()
+	if st.mu.enabled == nil {
+		st.mu.enabled = make(map[tcpip.NICID]bool)
+	}
+	st.mu.enabled[nicid] = enabled
+	st.mu.Unlock()
+	ns.refreshDirectedBroadcast(nicid)
+	return true
+}
+
+// getInterfaceDirectedBroadcast returns the NIC's directed-broadcast
+// setting and whether the NIC was found.
+func (ns *Netstack) getInterfaceDirectedBroadcast(nicid tcpip.NICID) (bool, bool) {
+	if _, ok := ns.stack.NICInfo()[nicid]; !ok {
+		return false, false
+	}
+	st := &ns.directedBroadcast
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.mu.enabled[nicid], true
+}
+
+// refreshDirectedBroadcast reconciles the broadcast addresses assigned to
+// the NIC with its current IPv4 subnets and directed-broadcast setting. It
+// must be called whenever either changes.
+func (ns *Netstack) refreshDirectedBroadcast(nicid tcpip.NICID) {
+	info, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		return
+	}
+
+	st := &ns.directedBroadcast
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	want := make(map[tcpip.Address]struct{})
+	if st.mu.enabled[nicid] {
+		for _, pa := range info.ProtocolAddresses {
+			if pa.Protocol != ipv4.ProtocolNumber {
+				continue
+			}
+			// RFC 3021 point-to-point subnets have no broadcast address.
+			if pa.AddressWithPrefix.PrefixLen >= 31 {
+				continue
+			}
+			want[pa.AddressWithPrefix.Subnet().Broadcast()] = struct{}{}
+		}
+	}
+
+	var keep []tcpip.Address
+	for _, addr := range st.mu.added[nicid] {
+		if _, ok := want[addr]; ok {
+			keep = append(keep, addr)
+			delete(want, addr)
+		} else if err := ns.stack.RemoveAddress(nicid, addr); err != nil && err != tcpip.ErrBadLocalAddress {
+			_ = syslog.Warnf("NIC %d: failed to remove broadcast address %s: %s", nicid, addr, err)
+			keep = append(keep, addr)
+		}
+	}
+	for addr := range want {
+		if err := ns.stack.AddAddress(nicid, ipv4.ProtocolNumber, addr); err != nil && err != tcpip.ErrDuplicateAddress {
+			_ = syslog.Warnf("NIC %d: failed to add broadcast address %s: %s", nicid, addr, err)
+			continue
+		}
+		keep = append(keep, addr)
+	}
+	if len(keep) == 0 {
+		delete(st.mu.added, nicid)
+	} else {
+		if st.mu.added == nil {
+			st.mu.added = make(map[tcpip.NICID][]tcpip.Address)
+		}
+		st.mu.added[nicid] = keep
+	}
+}
@@ -14,6 +14,7 @@ import (
 	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
 
 	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 const (
@@ -224,6 +225,71 @@ func (cache *cacheInfo) insertNegative(question dnsmessage.Question, msg dnsmess
 	})
 }
 
+// CacheEntry describes the addresses cached for a domain name.
+type CacheEntry struct {
+	// Name is the domain name the addresses were resolved for, e.g.
+	// "example.com.".
+	Name string
+
+	// Addresses holds the addresses the name resolved to.
+	Addresses []tcpip.Address
+
+	// TTL is the time remaining until the entry expires. When a name has
+	// multiple records the soonest expiry is reported.
+	TTL time.Duration
+}
+
+// entries returns a snapshot of the unexpired address records in the cache.
+func (cache *cacheInfo) entries() []CacheEntry {
+	now := timeNow()
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	entries := make([]CacheEntry, 0, len(cache.mu.m))
+	for name, cached := range cache.mu.m {
+		entry := CacheEntry{Name: name.String()}
+		for _, e := range cached {
+			ttl := e.ttd.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+			switch body := e.rr.Body.(type) {
+			case *dnsmessage.AResource:
+				entry.Addresses = append(entry.Addresses, tcpip.Address(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				entry.Addresses = append(entry.Addresses, tcpip.Address(body.AAAA[:]))
+			default:
+				continue
+			}
+			if entry.TTL == 0 || ttl < entry.TTL {
+				entry.TTL = ttl
+			}
+		}
+		if len(entry.Addresses) != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// flush removes every entry from the cache.
+func (cache *cacheInfo) flush() {
+	cache.mu.Lock()
+	cache.mu.m = make(map[dnsmessage.Name][]cacheEntry)
+	cache.mu.numEntries = 0
+	cache.mu.Unlock()
+}
+
+// flushName removes every entry for name from the cache; flushing a name that
+// is not cached is a no-op.
+func (cache *cacheInfo) flushName(name dnsmessage.Name) {
+	cache.mu.Lock()
+	if entries, ok := cache.mu.m[name]; ok {
+		cache.mu.numEntries -= len(entries)
+		delete(cache.mu.m, name)
+	}
+	cache.mu.Unlock()
+}
+
 // Removes every expired/dangling entry from the cache.
 func (cache *cacheInfo) prune() {
 	now := timeNow()
@@ -507,3 +507,41 @@ func TestNegativeUpdate(t *testing.T) {
 		wantName:     exampleQuestion.Name,
 	})
 }
+
+// Tests that flushing removes only the requested name, and that flushing the
+// whole cache removes everything.
+func TestFlush(t *testing.T) {
+	cache := makeCache()
+	cache.insertAll([]dnsmessage.Resource{
+		makeTypeAResource(example, 5, [4]byte{127, 0, 0, 1}),
+		makeTypeAResource(fooExample, 5, [4]byte{127, 0, 0, 2}),
+	})
+
+	name, err := dnsmessage.NewName(example)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.flushName(name)
+
+	entries := cache.entries()
+	if len(entries) != 1 || entries[0].Name != fooExample {
+		t.Errorf("got cache.entries() = %+v, want only %q", entries, fooExample)
+	}
+	if got, want := cache.mu.numEntries, 1; got != want {
+		t.Errorf("got numEntries = %d, want = %d", got, want)
+	}
+
+	// Flushing a name that is not cached is a no-op.
+	cache.flushName(name)
+	if got, want := cache.mu.numEntries, 1; got != want {
+		t.Errorf("got numEntries = %d, want = %d", got, want)
+	}
+
+	cache.flush()
+	if got := cache.entries(); len(got) != 0 {
+		t.Errorf("got cache.entries() = %+v after flush, want none", got)
+	}
+	if got, want := cache.mu.numEntries, 0; got != want {
+		t.Errorf("got numEntries = %d, want = %d", got, want)
+	}
+}
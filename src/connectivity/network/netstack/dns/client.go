@@ -388,6 +388,31 @@ func (c *Client) SetResolver(resolver Resolver) {
 	c.config.mu.resolver = resolver
 }
 
+// GetCacheEntries returns a snapshot of the client's DNS cache.
+func (c *Client) GetCacheEntries() []CacheEntry {
+	return c.cache.entries()
+}
+
+// FlushCache removes every entry from the client's DNS cache.
+func (c *Client) FlushCache() {
+	c.cache.flush()
+}
+
+// FlushCacheEntry removes the entries for name from the client's DNS cache.
+// Flushing a name that is not cached is a no-op.
+func (c *Client) FlushCacheEntry(name string) {
+	// Cached names are fully qualified.
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		// A name that cannot be parsed cannot be cached.
+		return
+	}
+	c.cache.flushName(n)
+}
+
 // LookupIP returns a list of IP addresses that are registered for the give domain name.
 func (c *Client) LookupIP(name string) (addrs []tcpip.Address, err error) {
 	if !isDomainName(name) {
@@ -31,11 +31,16 @@ func ToTCPIPAddress(addr netfidl.IpAddress) tcpip.Address {
 }
 
 func ToNetIpAddress(addr tcpip.Address) netfidl.IpAddress {
-	switch l := len(addr); l {
-	case net.IPv4len:
+	// An IPv4-mapped IPv6 address (::ffff:a.b.c.d) names an IPv4 endpoint;
+	// dual-stack sockets produce them. As in util.Parse, the IPv4 form is
+	// canonical, so the mapped form converts to the IPv4 variant; callers
+	// that need to restore the mapped form use ToV4MappedAddress.
+	if v4 := net.IP(addr).To4(); v4 != nil {
 		var ipv4 netfidl.Ipv4Address
-		copy(ipv4.Addr[:], addr)
+		copy(ipv4.Addr[:], v4)
 		return netfidl.IpAddressWithIpv4(ipv4)
+	}
+	switch l := len(addr); l {
 	case net.IPv6len:
 		var ipv6 netfidl.Ipv6Address
 		copy(ipv6.Addr[:], addr)
@@ -45,6 +50,15 @@ func ToNetIpAddress(addr tcpip.Address) netfidl.IpAddress {
 	}
 }
 
+// ToV4MappedAddress returns the IPv4-mapped IPv6 form (::ffff:a.b.c.d) of an
+// IPv4 address, inverting the unmapping performed by ToNetIpAddress.
+func ToV4MappedAddress(addr tcpip.Address) tcpip.Address {
+	if l := len(addr); l != net.IPv4len {
+		panic(fmt.Sprintf("invalid IPv4 address length = %d: %x", l, addr))
+	}
+	return tcpip.Address(net.IP(addr).To16())
+}
+
 func ToNetSocketAddress(addr tcpip.FullAddress) netfidl.SocketAddress {
 	var out netfidl.SocketAddress
 	switch l := len(addr.Addr); l {
@@ -78,10 +92,44 @@ func ToNetSocketAddress(addr tcpip.FullAddress) netfidl.SocketAddress {
 	return out
 }
 
-func ToTCPIPSubnet(sn netfidl.Subnet) tcpip.Subnet {
+// FromNetSocketAddress is the inverse of ToNetSocketAddress. The zone index
+// of an IPv6 address names the NIC; as in ToNetSocketAddress it is only
+// meaningful for link-local addresses (see RFC 4007 section 6) and is
+// ignored otherwise.
+func FromNetSocketAddress(addr netfidl.SocketAddress) tcpip.FullAddress {
+	var out tcpip.FullAddress
+	switch tag := addr.Which(); tag {
+	case netfidl.SocketAddressIpv4:
+		out.Addr = tcpip.Address(addr.Ipv4.Address.Addr[:])
+		out.Port = addr.Ipv4.Port
+	case netfidl.SocketAddressIpv6:
+		out.Addr = tcpip.Address(addr.Ipv6.Address.Addr[:])
+		out.Port = addr.Ipv6.Port
+		if header.IsV6LinkLocalAddress(out.Addr) || header.IsV6LinkLocalMulticastAddress(out.Addr) {
+			out.NIC = tcpip.NICID(addr.Ipv6.ZoneIndex)
+		}
+	default:
+		panic(fmt.Sprintf("invalid socket address tag = %d", tag))
+	}
+	return out
+}
+
+// ToTCPIPSubnetChecked is like ToTCPIPSubnet, but returns an error instead of
+// panicking when the subnet cannot be expressed, e.g. because its prefix
+// length is out of range for the address family.
+func ToTCPIPSubnetChecked(sn netfidl.Subnet) (tcpip.Subnet, error) {
 	a := toNet(sn.Addr)
+	if l := int(sn.PrefixLen); l > len(a)*8 {
+		return tcpip.Subnet{}, fmt.Errorf("prefix length %d is out of range for a %d-byte address", l, len(a))
+	}
 	m := net.CIDRMask(int(sn.PrefixLen), len(a)*8)
-	subnet, err := tcpip.NewSubnet(tcpip.Address(a.Mask(m)), tcpip.AddressMask(m))
+	return tcpip.NewSubnet(tcpip.Address(a.Mask(m)), tcpip.AddressMask(m))
+}
+
+// ToTCPIPSubnet panics on malformed input; callers handling input that has not
+// already been validated should use ToTCPIPSubnetChecked.
+func ToTCPIPSubnet(sn netfidl.Subnet) tcpip.Subnet {
+	subnet, err := ToTCPIPSubnetChecked(sn)
 	if err != nil {
 		panic(err)
 	}
@@ -98,8 +146,17 @@ func TcpipRouteToForwardingEntry(route tcpip.Route) stack.ForwardingEntry {
 	// There are two types of destinations: link-local and next-hop.
 	//   If a route has a gateway, use that as the next-hop, and ignore the NIC.
 	//   Otherwise, it is considered link-local, and use the NIC.
+	//
+	// As in ToNetSocketAddress, a link-local next hop is ambiguous without
+	// its zone (the same address may be used across different links), so the
+	// NIC is preserved alongside it. See RFC 4007 section 6 for more details.
 	if len(route.Gateway) == 0 {
 		forwardingEntry.Destination.SetDeviceId(uint64(route.NIC))
+	} else if (header.IsV6LinkLocalAddress(route.Gateway) || header.IsV6LinkLocalMulticastAddress(route.Gateway)) && route.NIC != 0 {
+		forwardingEntry.Destination.SetScopedNextHop(stack.ScopedNextHop{
+			NextHop:  ToNetIpAddress(route.Gateway),
+			DeviceId: uint64(route.NIC),
+		})
 	} else {
 		forwardingEntry.Destination.SetNextHop(ToNetIpAddress(route.Gateway))
 	}
@@ -115,6 +172,39 @@ func ForwardingEntryToTcpipRoute(forwardingEntry stack.ForwardingEntry) tcpip.Ro
 		route.NIC = tcpip.NICID(forwardingEntry.Destination.DeviceId)
 	case stack.ForwardingDestinationNextHop:
 		route.Gateway = ToTCPIPAddress(forwardingEntry.Destination.NextHop)
+	case stack.ForwardingDestinationScopedNextHop:
+		route.Gateway = ToTCPIPAddress(forwardingEntry.Destination.ScopedNextHop.NextHop)
+		// Mirroring ToNetSocketAddress, the zone is only meaningful for
+		// non-global addresses.
+		if header.IsV6LinkLocalAddress(route.Gateway) || header.IsV6LinkLocalMulticastAddress(route.Gateway) {
+			route.NIC = tcpip.NICID(forwardingEntry.Destination.ScopedNextHop.DeviceId)
+		}
 	}
 	return route
 }
+
+// TcpipRouteToString renders a route in the canonical human-readable form
+// used by CLI tooling: the destination subnet in CIDR notation, "via" the
+// next hop when the route has a gateway, and "dev" the NIC when the route
+// names one, e.g. "10.0.0.0/24 via 192.168.1.1 dev 3". A link-local next hop
+// is qualified with its zone, e.g. "fe80::1%2".
+func TcpipRouteToString(route tcpip.Route) string {
+	s := fmt.Sprintf("%s/%d", net.IP(route.Destination.ID()), route.Destination.Prefix())
+	if len(route.Gateway) != 0 {
+		s += fmt.Sprintf(" via %s", net.IP(route.Gateway))
+		if header.IsV6LinkLocalAddress(route.Gateway) && route.NIC != 0 {
+			s += fmt.Sprintf("%%%d", route.NIC)
+		}
+	}
+	if route.NIC != 0 {
+		s += fmt.Sprintf(" dev %d", route.NIC)
+	}
+	return s
+}
+
+// ForwardingEntryToString renders a forwarding entry in the same canonical
+// form as TcpipRouteToString, distinguishing next-hop entries ("via") from
+// on-link device entries ("dev").
+func ForwardingEntryToString(forwardingEntry stack.ForwardingEntry) string {
+	return TcpipRouteToString(ForwardingEntryToTcpipRoute(forwardingEntry))
+}
@@ -59,6 +59,31 @@ func TestToFIDLIPAddressIPv6(t *testing.T) {
 	}
 }
 
+func TestToFIDLIPAddressIPv4MappedIPv6(t *testing.T) {
+	from := tcpip.Address(net.ParseIP("::ffff:192.168.0.1"))
+	if got, want := len(from), net.IPv6len; got != want {
+		t.Fatalf("got address length = %d, want = %d", got, want)
+	}
+	to := ToNetIpAddress(from)
+	expected := fidlnet.IpAddress{}
+	expected.SetIpv4(fidlnet.Ipv4Address{Addr: [4]uint8{192, 168, 0, 1}})
+	if to != expected {
+		t.Fatalf("Expected:\n %v\nActual:\n %v", expected, to)
+	}
+}
+
+func TestToV4MappedAddress(t *testing.T) {
+	from := util.Parse("192.168.0.1")
+	to := ToV4MappedAddress(from)
+	expected := tcpip.Address(net.ParseIP("::ffff:192.168.0.1"))
+	if to != expected {
+		t.Fatalf("Expected:\n %v\nActual:\n %v", expected, to)
+	}
+	if got, want := ToNetIpAddress(to), ToNetIpAddress(from); got != want {
+		t.Fatalf("Expected mapped form to round trip:\n %v\nActual:\n %v", want, got)
+	}
+}
+
 func TestToFIDLIPAddressEmptyInvalid(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -118,8 +143,58 @@ func TestToTCPIPSubnet(t *testing.T) {
 	}
 }
 
+func TestToTCPIPSubnetChecked(t *testing.T) {
+	netSubnet := fidlnet.Subnet{
+		PrefixLen: 24,
+	}
+	netSubnet.Addr.SetIpv4(fidlnet.Ipv4Address{Addr: [4]uint8{192, 168, 0, 0}})
+	subnet, err := ToTCPIPSubnetChecked(netSubnet)
+	if err != nil {
+		t.Fatalf("got ToTCPIPSubnetChecked(%#v) = (_, %s), want = (_, nil)", netSubnet, err)
+	}
+	if got, want := subnet, ToTCPIPSubnet(netSubnet); got != want {
+		t.Errorf("got ToTCPIPSubnetChecked(%#v) = %s, want = %s", netSubnet, got, want)
+	}
+
+	netSubnet.PrefixLen = 33
+	if subnet, err := ToTCPIPSubnetChecked(netSubnet); err == nil {
+		t.Errorf("got ToTCPIPSubnetChecked(%#v) = (%s, nil), want = (_, non-nil)", netSubnet, subnet)
+	}
+}
+
+func TestNetSocketAddressRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		addr tcpip.FullAddress
+		// wantNIC is the NIC expected to survive the round trip; the zone
+		// index is only carried for link-local addresses.
+		wantNIC tcpip.NICID
+	}{
+		{name: "IPv4", addr: tcpip.FullAddress{Addr: util.Parse("192.168.0.1"), Port: 8080}},
+		{name: "IPv4-port-0", addr: tcpip.FullAddress{Addr: util.Parse("192.168.0.1")}},
+		{name: "global-IPv6", addr: tcpip.FullAddress{NIC: 5, Addr: util.Parse("2001:db8::1"), Port: 53}},
+		{name: "link-local-IPv6", addr: tcpip.FullAddress{NIC: 5, Addr: util.Parse("fe80::1"), Port: 53}, wantNIC: 5},
+		{name: "link-local-multicast-IPv6", addr: tcpip.FullAddress{NIC: 5, Addr: util.Parse("ff02::1"), Port: 53}, wantNIC: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			converted := ToNetSocketAddress(tc.addr)
+			if converted.Which() == fidlnet.SocketAddressIpv6 {
+				if got, want := converted.Ipv6.ZoneIndex, uint64(tc.wantNIC); got != want {
+					t.Errorf("got ZoneIndex = %d, want = %d", got, want)
+				}
+			}
+			want := tc.addr
+			want.NIC = tc.wantNIC
+			if got := FromNetSocketAddress(converted); got != want {
+				t.Errorf("got FromNetSocketAddress(ToNetSocketAddress(%+v)) = %+v, want = %+v", tc.addr, got, want)
+			}
+		})
+	}
+}
+
 func TestForwardingEntryAndTcpipRouteConversions(t *testing.T) {
 	const gateway = "efghijklmnopqrst"
+	const linkLocalGateway = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
 
 	destination, err := tcpip.NewSubnet("\xab\xcd\x00\x00", "\xff\xff\xe0\x00")
 	if err != nil {
@@ -147,6 +222,21 @@ func TestForwardingEntryAndTcpipRouteConversions(t *testing.T) {
 				Destination: destination,
 				Gateway:     gateway,
 			}},
+		// A link-local next hop is ambiguous without its zone; the NIC must
+		// survive the round trip.
+		{dest: func() stack.ForwardingDestination {
+			var dest stack.ForwardingDestination
+			dest.SetScopedNextHop(stack.ScopedNextHop{
+				NextHop:  ToNetIpAddress(linkLocalGateway),
+				DeviceId: 789,
+			})
+			return dest
+		}(),
+			want: tcpip.Route{
+				Destination: destination,
+				Gateway:     linkLocalGateway,
+				NIC:         789,
+			}},
 	} {
 		fe := stack.ForwardingEntry{
 			Subnet: fidlnet.Subnet{
@@ -166,6 +256,63 @@ func TestForwardingEntryAndTcpipRouteConversions(t *testing.T) {
 	}
 }
 
+func TestForwardingEntryToString(t *testing.T) {
+	v4Destination, err := tcpip.NewSubnet(util.Parse("10.0.0.0"), tcpip.AddressMask(net.CIDRMask(24, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6Destination, err := tcpip.NewSubnet(util.Parse("2001:db8::"), tcpip.AddressMask(net.CIDRMask(32, 128)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		route tcpip.Route
+		want  string
+	}{
+		{
+			name: "on-link",
+			route: tcpip.Route{
+				Destination: v4Destination,
+				NIC:         3,
+			},
+			want: "10.0.0.0/24 dev 3",
+		},
+		{
+			name: "next-hop",
+			route: tcpip.Route{
+				Destination: v4Destination,
+				Gateway:     util.Parse("192.168.1.1"),
+			},
+			want: "10.0.0.0/24 via 192.168.1.1",
+		},
+		{
+			name: "IPv6 link-local next-hop with zone",
+			route: tcpip.Route{
+				Destination: v6Destination,
+				Gateway:     util.Parse("fe80::1"),
+				NIC:         2,
+			},
+			want: "2001:db8::/32 via fe80::1%2 dev 2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := TcpipRouteToString(tc.route); got != tc.want {
+				t.Errorf("got TcpipRouteToString(%+v) = %q, want = %q", tc.route, got, tc.want)
+			}
+			// A forwarding entry names either a next hop or a device, so routes
+			// carrying both cannot round-trip through the FIDL representation.
+			if len(tc.route.Gateway) != 0 && tc.route.NIC != 0 {
+				return
+			}
+			fe := TcpipRouteToForwardingEntry(tc.route)
+			if got := ForwardingEntryToString(fe); got != tc.want {
+				t.Errorf("got ForwardingEntryToString(%+v) = %q, want = %q", fe, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestToNetSocketAddress(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -493,12 +493,17 @@ func (impl *socketInfoMapInspectImpl) GetChild(childName string) inspectInner {
 		return nil
 	}
 	if ep, ok := impl.value.Load(zx.Handle(id)); ok {
-		return &socketInfoInspectImpl{
+		child := socketInfoInspectImpl{
 			name:  childName,
 			info:  ep.Info(),
 			state: ep.State(),
 			stats: ep.Stats(),
 		}
+		// The map key is the endpoint's data-plane handle; for stream
+		// sockets that is the netstack's end of the zircon socket carrying
+		// the payload bytes.
+		child.occupancy, child.hasOccupancy = readSocketOccupancy(zx.Handle(id), ep)
+		return &child
 	}
 	return nil
 }
@@ -510,6 +515,10 @@ type socketInfoInspectImpl struct {
 	info  tcpip.EndpointInfo
 	state uint32
 	stats tcpip.EndpointStats
+	// occupancy is only meaningful when hasOccupancy is set; it is absent
+	// for endpoints whose data plane is not a zircon socket.
+	occupancy    socketOccupancy
+	hasOccupancy bool
 }
 
 func (impl *socketInfoInspectImpl) ReadData() inspect.Object {
@@ -571,9 +580,24 @@ func (impl *socketInfoInspectImpl) ReadData() inspect.Object {
 		properties = append(properties, inspect.Property{Key: "HardError", Value: inspect.PropertyValueWithStr(hardError.String())})
 	}
 
+	// Labeled so that readers can tell bytes still queued in the gVisor
+	// endpoint from bytes already in transit in the zircon socket between
+	// the netstack and the client; the latter are invisible to the
+	// endpoint's own counters.
+	var metrics []inspect.Metric
+	if impl.hasOccupancy {
+		metrics = []inspect.Metric{
+			{Key: "RxBytesInGvisorQueue", Value: inspect.MetricValueWithUintValue(impl.occupancy.rxBytesInGvisorQueue)},
+			{Key: "RxBytesInTransitInZirconSocket", Value: inspect.MetricValueWithUintValue(impl.occupancy.rxBytesInZxSocket)},
+			{Key: "TxBytesInTransitInZirconSocket", Value: inspect.MetricValueWithUintValue(impl.occupancy.txBytesInZxSocket)},
+			{Key: "TxBytesInGvisorQueue", Value: inspect.MetricValueWithUintValue(impl.occupancy.txBytesInGvisorQueue)},
+		}
+	}
+
 	return inspect.Object{
 		Name:       impl.name,
 		Properties: properties,
+		Metrics:    metrics,
 	}
 }
 
@@ -23,7 +23,7 @@ var _ dhcp.ClientWithCtx = (*clientImpl)(nil)
 func (di *clientImpl) Start(fidl.Context) (dhcp.ClientStartResult, error) {
 	var r dhcp.ClientStartResult
 
-	nicInfo, ok := di.ns.stack.NICInfo()[di.nicid]
+	nicInfo, ok := di.ns.NICInfo()[di.nicid]
 	if !ok {
 		// The interface this client represents no longer exists; error so the bindings close our end of the channel.
 		return r, fmt.Errorf("NIC ID %d no longer present", di.nicid)
@@ -39,7 +39,7 @@ func (di *clientImpl) Start(fidl.Context) (dhcp.ClientStartResult, error) {
 func (di *clientImpl) Stop(fidl.Context) (dhcp.ClientStopResult, error) {
 	r := dhcp.ClientStopResult{}
 
-	nicInfo, ok := di.ns.stack.NICInfo()[di.nicid]
+	nicInfo, ok := di.ns.NICInfo()[di.nicid]
 	if !ok {
 		// The interface this client represents no longer exists; error so the bindings close our end of the channel.
 		return r, fmt.Errorf("NIC ID %d no longer present", di.nicid)
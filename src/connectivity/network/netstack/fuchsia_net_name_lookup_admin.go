@@ -67,3 +67,32 @@ func (dns *nameLookupAdminImpl) GetDnsServers(fidl.Context) ([]net.SocketAddress
 	}
 	return servers, nil
 }
+
+func (dns *nameLookupAdminImpl) GetDnsCacheEntries(fidl.Context) ([]name.CacheEntry, error) {
+	cacheEntries := dns.ns.dnsClient.GetCacheEntries()
+	entries := make([]name.CacheEntry, 0, len(cacheEntries))
+	for _, e := range cacheEntries {
+		addresses := make([]net.IpAddress, 0, len(e.Addresses))
+		for _, a := range e.Addresses {
+			addresses = append(addresses, fidlconv.ToNetIpAddress(a))
+		}
+		entries = append(entries, name.CacheEntry{
+			Name:      e.Name,
+			Addresses: addresses,
+			Ttl:       e.TTL.Nanoseconds(),
+		})
+	}
+	return entries, nil
+}
+
+func (dns *nameLookupAdminImpl) FlushDnsCacheEntry(_ fidl.Context, domain string) error {
+	syslog.InfoTf(tag, "flushing DNS cache entry for %s", domain)
+	dns.ns.dnsClient.FlushCacheEntry(domain)
+	return nil
+}
+
+func (dns *nameLookupAdminImpl) FlushDnsCache(fidl.Context) error {
+	syslog.InfoTf(tag, "flushing DNS cache")
+	dns.ns.dnsClient.FlushCache()
+	return nil
+}
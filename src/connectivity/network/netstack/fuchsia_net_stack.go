@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"sort"
 	"syscall/zx/fidl"
+	"time"
 
 	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
 
@@ -25,8 +26,10 @@ import (
 	"fidl/fuchsia/net/name"
 	"fidl/fuchsia/net/stack"
 	"fidl/fuchsia/netstack"
+	"fidl/fuchsia/posix/socket"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -93,7 +96,7 @@ func getInterfaceInfo(nicInfo tcpipstack.NICInfo) stack.InterfaceInfo {
 }
 
 func (ns *Netstack) getNetInterfaces() []stack.InterfaceInfo {
-	nicInfos := ns.stack.NICInfo()
+	nicInfos := ns.NICInfo()
 	out := make([]stack.InterfaceInfo, 0, len(nicInfos))
 	for _, nicInfo := range nicInfos {
 		out = append(out, getInterfaceInfo(nicInfo))
@@ -156,6 +159,11 @@ func (ns *Netstack) delInterface(id uint64) stack.StackDelEthernetInterfaceResul
 		return result
 	}
 
+	// Reset connections routed through the interface before tearing it down
+	// so that peers observe the teardown instead of waiting for the dead
+	// connections to time out.
+	ns.abortNICEndpoints(tcpip.NICID(id))
+
 	ifs := nicInfo.Context.(*ifState)
 	if err := ifs.controller.Close(); err != nil {
 		syslog.Errorf("ifs.controller.Close() failed (NIC: %d): %v", id, err)
@@ -163,6 +171,15 @@ func (ns *Netstack) delInterface(id uint64) stack.StackDelEthernetInterfaceResul
 		return result
 	}
 
+	ns.addressStates.removeNIC(tcpip.NICID(id))
+	ns.mu.Lock()
+	delete(ns.mu.nicNames, tcpip.NICID(id))
+	ns.mu.Unlock()
+
+	if c := ns.interfaceWatchers; c != nil {
+		c.NotifyInterfacesChanged()
+	}
+
 	result.SetResponse(stack.StackDelEthernetInterfaceResponse{})
 	return result
 }
@@ -170,7 +187,7 @@ func (ns *Netstack) delInterface(id uint64) stack.StackDelEthernetInterfaceResul
 func (ns *Netstack) getInterface(id uint64) stack.StackGetInterfaceInfoResult {
 	var result stack.StackGetInterfaceInfoResult
 
-	nicInfo, ok := ns.stack.NICInfo()[tcpip.NICID(id)]
+	nicInfo, ok := ns.NICInfo()[tcpip.NICID(id)]
 	if !ok {
 		result.SetErr(stack.ErrorNotFound)
 		return result
@@ -182,6 +199,51 @@ func (ns *Netstack) getInterface(id uint64) stack.StackGetInterfaceInfoResult {
 	return result
 }
 
+func (ns *Netstack) getInterfaceByName(name string) stack.StackGetInterfaceInfoByNameResult {
+	var result stack.StackGetInterfaceInfoByNameResult
+
+	for _, nicInfo := range ns.NICInfo() {
+		if nicInfo.Name == name {
+			result.SetResponse(stack.StackGetInterfaceInfoByNameResponse{
+				Info: getInterfaceInfo(nicInfo),
+			})
+			return result
+		}
+	}
+
+	result.SetErr(stack.ErrorNotFound)
+	return result
+}
+
+func (ns *Netstack) getMulticastMemberships(id uint64) stack.StackGetMulticastMembershipsResult {
+	var result stack.StackGetMulticastMembershipsResult
+
+	if _, ok := ns.stack.NICInfo()[tcpip.NICID(id)]; !ok {
+		result.SetErr(stack.ErrorNotFound)
+		return result
+	}
+
+	counts := ns.multicastMemberships.nicMemberships(tcpip.NICID(id))
+	groups := make([]tcpip.Address, 0, len(counts))
+	for group := range counts {
+		groups = append(groups, group)
+	}
+	// Ensure deterministic API response.
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i] < groups[j]
+	})
+
+	memberships := make([]stack.MulticastMembership, 0, len(groups))
+	for _, group := range groups {
+		memberships = append(memberships, stack.MulticastMembership{
+			Group:       fidlconv.ToNetIpAddress(group),
+			SocketCount: counts[group],
+		})
+	}
+	result.SetResponse(stack.StackGetMulticastMembershipsResponse{Memberships: memberships})
+	return result
+}
+
 func (ns *Netstack) enableInterface(id uint64) stack.StackEnableInterfaceResult {
 	var result stack.StackEnableInterfaceResult
 
@@ -222,6 +284,61 @@ func (ns *Netstack) disableInterface(id uint64) stack.StackDisableInterfaceResul
 	return result
 }
 
+func (ns *Netstack) setInterfaceName(id uint64, name string) stack.StackSetInterfaceNameResult {
+	var result stack.StackSetInterfaceNameResult
+
+	nicInfos := ns.NICInfo()
+	if _, ok := nicInfos[tcpip.NICID(id)]; !ok {
+		result.SetErr(stack.ErrorNotFound)
+		return result
+	}
+
+	if len(name) == 0 || len(name) > int(socket.InterfaceNameLength) {
+		result.SetErr(stack.ErrorInvalidArgs)
+		return result
+	}
+	for nicid, nicInfo := range nicInfos {
+		if nicid != tcpip.NICID(id) && nicInfo.Name == name {
+			result.SetErr(stack.ErrorInvalidArgs)
+			return result
+		}
+	}
+
+	ns.mu.Lock()
+	if ns.mu.nicNames == nil {
+		ns.mu.nicNames = make(map[tcpip.NICID]string)
+	}
+	ns.mu.nicNames[tcpip.NICID(id)] = name
+	ns.mu.Unlock()
+
+	ns.onInterfacesChanged()
+
+	result.SetResponse(stack.StackSetInterfaceNameResponse{})
+	return result
+}
+
+func (ns *Netstack) setInterfaceMtu(id uint64, mtu uint32) stack.StackSetInterfaceMtuResult {
+	var result stack.StackSetInterfaceMtuResult
+
+	nicInfo, ok := ns.stack.NICInfo()[tcpip.NICID(id)]
+	if !ok {
+		result.SetErr(stack.ErrorNotFound)
+		return result
+	}
+
+	ifs := nicInfo.Context.(*ifState)
+	if mtu < header.IPv6MinimumMTU || mtu > ifs.mtuEndpoint.hardwareMTU() {
+		result.SetErr(stack.ErrorInvalidArgs)
+		return result
+	}
+	ifs.mtuEndpoint.setMTU(mtu)
+
+	ns.onInterfacesChanged()
+
+	result.SetResponse(stack.StackSetInterfaceMtuResponse{})
+	return result
+}
+
 func toProtocolAddr(ifAddr net.Subnet) tcpip.ProtocolAddress {
 	protocolAddr := tcpip.ProtocolAddress{
 		AddressWithPrefix: tcpip.AddressWithPrefix{
@@ -291,6 +408,33 @@ func (ns *Netstack) delInterfaceAddr(id uint64, ifAddr net.Subnet) stack.StackDe
 	return result
 }
 
+func (ns *Netstack) getInterfaceAddressState(id uint64, addr net.IpAddress) stack.StackGetInterfaceAddressStateResult {
+	var result stack.StackGetInterfaceAddressStateResult
+
+	state, ok := ns.getAddressState(tcpip.NICID(id), fidlconv.ToTCPIPAddress(addr))
+	if !ok {
+		result.SetErr(stack.ErrorNotFound)
+		return result
+	}
+
+	var addressState stack.AddressState
+	switch state {
+	case addressStateTentative:
+		addressState = stack.AddressStateTentative
+	case addressStateAssigned:
+		addressState = stack.AddressStateAssigned
+	case addressStateDeprecated:
+		addressState = stack.AddressStateDeprecated
+	case addressStateInvalid:
+		addressState = stack.AddressStateInvalid
+	default:
+		panic(fmt.Sprintf("unknown address state %s", state))
+	}
+
+	result.SetResponse(stack.StackGetInterfaceAddressStateResponse{State: addressState})
+	return result
+}
+
 func (ns *Netstack) getForwardingTable() []stack.ForwardingEntry {
 	ert := ns.GetExtendedRouteTable()
 	entries := make([]stack.ForwardingEntry, 0, len(ert))
@@ -338,6 +482,15 @@ func (ns *Netstack) addForwardingEntry(entry stack.ForwardingEntry) stack.StackA
 		return result
 	}
 
+	// ForwardingEntryToTcpipRoute converts the subnet with the panicking
+	// ToTCPIPSubnet; check it first so malformed input surfaces as an error
+	// rather than a crash.
+	if _, err := fidlconv.ToTCPIPSubnetChecked(entry.Subnet); err != nil {
+		syslog.Errorf("invalid subnet in forwarding entry %+v: %s", entry, err)
+		result.SetErr(stack.ErrorInvalidArgs)
+		return result
+	}
+
 	if err := ns.AddRoute(fidlconv.ForwardingEntryToTcpipRoute(entry), metricNotSet, false /* not dynamic */); err != nil {
 		syslog.Errorf("adding forwarding entry %+v to route table failed: %s", entry, err)
 		result.SetErr(stack.ErrorInvalidArgs)
@@ -355,7 +508,14 @@ func (ns *Netstack) delForwardingEntry(subnet net.Subnet) stack.StackDelForwardi
 		return result
 	}
 
-	if err := ns.DelRoute(tcpip.Route{Destination: fidlconv.ToTCPIPSubnet(subnet)}); err != nil {
+	destination, err := fidlconv.ToTCPIPSubnetChecked(subnet)
+	if err != nil {
+		syslog.Errorf("invalid subnet %+v: %s", subnet, err)
+		result.SetErr(stack.ErrorInvalidArgs)
+		return result
+	}
+
+	if err := ns.DelRoute(tcpip.Route{Destination: destination}); err != nil {
 		syslog.Errorf("deleting forwarding entry %+v from route table failed: %s", subnet, err)
 		result.SetErr(stack.ErrorNotFound)
 		return result
@@ -364,6 +524,27 @@ func (ns *Netstack) delForwardingEntry(subnet net.Subnet) stack.StackDelForwardi
 	return result
 }
 
+func (ns *Netstack) replaceForwardingTable(id uint64, entries []stack.ForwardingEntry) stack.StackReplaceForwardingTableResult {
+	var result stack.StackReplaceForwardingTableResult
+
+	rs := make([]tcpip.Route, 0, len(entries))
+	for _, entry := range entries {
+		if !validateSubnet(entry.Subnet) {
+			result.SetErr(stack.ErrorInvalidArgs)
+			return result
+		}
+		rs = append(rs, fidlconv.ForwardingEntryToTcpipRoute(entry))
+	}
+
+	if err := ns.ReplaceRoutes(tcpip.NICID(id), rs, metricNotSet); err != nil {
+		syslog.Errorf("replacing forwarding table for NIC %d failed: %s", id, err)
+		result.SetErr(stack.ErrorInvalidArgs)
+		return result
+	}
+	result.SetResponse(stack.StackReplaceForwardingTableResponse{})
+	return result
+}
+
 func (ni *stackImpl) AddEthernetInterface(_ fidl.Context, topologicalPath string, device ethernet.DeviceWithCtxInterface) (stack.StackAddEthernetInterfaceResult, error) {
 	var result stack.StackAddEthernetInterfaceResult
 
@@ -395,6 +576,64 @@ func (ni *stackImpl) GetInterfaceInfo(_ fidl.Context, id uint64) (stack.StackGet
 	return ni.ns.getInterface(id), nil
 }
 
+func (ni *stackImpl) GetInterfaceInfoByName(_ fidl.Context, name string) (stack.StackGetInterfaceInfoByNameResult, error) {
+	return ni.ns.getInterfaceByName(name), nil
+}
+
+func (ni *stackImpl) GetMulticastMemberships(_ fidl.Context, id uint64) (stack.StackGetMulticastMembershipsResult, error) {
+	return ni.ns.getMulticastMemberships(id), nil
+}
+
+func (ni *stackImpl) GetInterfaceRates(_ fidl.Context, id uint64) (stack.StackGetInterfaceRatesResult, error) {
+	rates, ok := ni.ns.rateSampler.rates(tcpip.NICID(id))
+	if !ok {
+		return stack.StackGetInterfaceRatesResultWithErr(stack.ErrorNotFound), nil
+	}
+	return stack.StackGetInterfaceRatesResultWithResponse(stack.StackGetInterfaceRatesResponse{
+		Rates: stack.InterfaceRates{
+			Valid:              rates.valid,
+			RxBytesPerSecond:   rates.rxBytesPerSecond,
+			RxPacketsPerSecond: rates.rxPacketsPerSecond,
+			TxBytesPerSecond:   rates.txBytesPerSecond,
+			TxPacketsPerSecond: rates.txPacketsPerSecond,
+		},
+	}), nil
+}
+
+func (ni *stackImpl) GetInterfaceStats(_ fidl.Context, id uint64) (stack.StackGetInterfaceStatsResult, error) {
+	nicInfo, ok := ni.ns.stack.NICInfo()[tcpip.NICID(id)]
+	if !ok {
+		return stack.StackGetInterfaceStatsResultWithErr(stack.ErrorNotFound), nil
+	}
+	s := nicInfo.Stats
+	return stack.StackGetInterfaceStatsResultWithResponse(stack.StackGetInterfaceStatsResponse{
+		Stats: stack.InterfaceStats{
+			RxPackets: s.Rx.Packets.Value(),
+			RxBytes:   s.Rx.Bytes.Value(),
+			TxPackets: s.Tx.Packets.Value(),
+			TxBytes:   s.Tx.Bytes.Value(),
+			RxDropped: s.DisabledRx.Packets.Value(),
+		},
+	}), nil
+}
+
+func (ni *stackImpl) SetInterfaceDirectedBroadcast(_ fidl.Context, id uint64, enabled bool) (stack.StackSetInterfaceDirectedBroadcastResult, error) {
+	if !ni.ns.setInterfaceDirectedBroadcast(tcpip.NICID(id), enabled) {
+		return stack.StackSetInterfaceDirectedBroadcastResultWithErr(stack.ErrorNotFound), nil
+	}
+	return stack.StackSetInterfaceDirectedBroadcastResultWithResponse(stack.StackSetInterfaceDirectedBroadcastResponse{}), nil
+}
+
+func (ni *stackImpl) GetInterfaceDirectedBroadcast(_ fidl.Context, id uint64) (stack.StackGetInterfaceDirectedBroadcastResult, error) {
+	enabled, ok := ni.ns.getInterfaceDirectedBroadcast(tcpip.NICID(id))
+	if !ok {
+		return stack.StackGetInterfaceDirectedBroadcastResultWithErr(stack.ErrorNotFound), nil
+	}
+	return stack.StackGetInterfaceDirectedBroadcastResultWithResponse(stack.StackGetInterfaceDirectedBroadcastResponse{
+		Enabled: enabled,
+	}), nil
+}
+
 func (ni *stackImpl) EnableInterface(_ fidl.Context, id uint64) (stack.StackEnableInterfaceResult, error) {
 	return ni.ns.enableInterface(id), nil
 }
@@ -403,6 +642,14 @@ func (ni *stackImpl) DisableInterface(_ fidl.Context, id uint64) (stack.StackDis
 	return ni.ns.disableInterface(id), nil
 }
 
+func (ni *stackImpl) SetInterfaceName(_ fidl.Context, id uint64, name string) (stack.StackSetInterfaceNameResult, error) {
+	return ni.ns.setInterfaceName(id, name), nil
+}
+
+func (ni *stackImpl) SetInterfaceMtu(_ fidl.Context, id uint64, mtu uint32) (stack.StackSetInterfaceMtuResult, error) {
+	return ni.ns.setInterfaceMtu(id, mtu), nil
+}
+
 func (ni *stackImpl) AddInterfaceAddress(_ fidl.Context, id uint64, addr net.Subnet) (stack.StackAddInterfaceAddressResult, error) {
 	return ni.ns.addInterfaceAddr(id, addr), nil
 }
@@ -411,6 +658,10 @@ func (ni *stackImpl) DelInterfaceAddress(_ fidl.Context, id uint64, addr net.Sub
 	return ni.ns.delInterfaceAddr(id, addr), nil
 }
 
+func (ni *stackImpl) GetInterfaceAddressState(_ fidl.Context, id uint64, addr net.IpAddress) (stack.StackGetInterfaceAddressStateResult, error) {
+	return ni.ns.getInterfaceAddressState(id, addr), nil
+}
+
 func (ni *stackImpl) GetForwardingTable(fidl.Context) ([]stack.ForwardingEntry, error) {
 	return ni.ns.getForwardingTable(), nil
 }
@@ -423,6 +674,10 @@ func (ni *stackImpl) DelForwardingEntry(_ fidl.Context, subnet net.Subnet) (stac
 	return ni.ns.delForwardingEntry(subnet), nil
 }
 
+func (ni *stackImpl) ReplaceForwardingTable(_ fidl.Context, id uint64, entries []stack.ForwardingEntry) (stack.StackReplaceForwardingTableResult, error) {
+	return ni.ns.replaceForwardingTable(id, entries), nil
+}
+
 func (ni *stackImpl) EnablePacketFilter(_ fidl.Context, id uint64) (stack.StackEnablePacketFilterResult, error) {
 	nicInfo, ok := ni.ns.stack.NICInfo()[tcpip.NICID(id)]
 
@@ -471,10 +726,39 @@ func (ni *stackImpl) DisableIpForwarding(fidl.Context) error {
 	return nil
 }
 
+func (ni *stackImpl) SetTcpConnectionLimits(_ fidl.Context, limits stack.TcpConnectionLimits) error {
+	ni.ns.tcpConnLimits.set(limits.MaxConnections, limits.MaxHalfOpen)
+	return nil
+}
+
+func (ni *stackImpl) GetTcpConnectionLimits(fidl.Context) (stack.TcpConnectionLimits, error) {
+	maxConnections, maxHalfOpen := ni.ns.tcpConnLimits.get()
+	return stack.TcpConnectionLimits{
+		MaxConnections: maxConnections,
+		MaxHalfOpen:    maxHalfOpen,
+	}, nil
+}
+
+func (ni *stackImpl) SetTcpDelayedAckTimeout(_ fidl.Context, timeoutNs int64) (stack.StackSetTcpDelayedAckTimeoutResult, error) {
+	if err := ni.ns.setTCPDelayedACKTimeout(time.Duration(timeoutNs)); err != nil {
+		syslog.Warnf("SetTcpDelayedAckTimeout(%d): %s", timeoutNs, err)
+		return stack.StackSetTcpDelayedAckTimeoutResultWithErr(stack.ErrorInvalidArgs), nil
+	}
+	return stack.StackSetTcpDelayedAckTimeoutResultWithResponse(stack.StackSetTcpDelayedAckTimeoutResponse{}), nil
+}
+
+func (ni *stackImpl) GetTcpDelayedAckTimeout(fidl.Context) (int64, error) {
+	return int64(ni.ns.tcpDelayedACKTimeout()), nil
+}
+
 func (ni *stackImpl) GetDnsServerWatcher(ctx_ fidl.Context, watcher name.DnsServerWatcherWithCtxInterfaceRequest) error {
 	return ni.dnsWatchers.Bind(watcher)
 }
 
+func (ni *stackImpl) GetInterfaceWatcher(_ fidl.Context, watcher stack.InterfaceWatcherWithCtxInterfaceRequest) error {
+	return ni.ns.interfaceWatchers.Bind(watcher)
+}
+
 type logImpl struct {
 	logger *syslog.Logger
 }
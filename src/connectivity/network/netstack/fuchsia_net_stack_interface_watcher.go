@@ -0,0 +1,203 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall/zx/fidl"
+
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/link"
+	"go.fuchsia.dev/fuchsia/src/lib/component"
+	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
+
+	"fidl/fuchsia/net/stack"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// interfaceWatchState is the per-interface state a watcher diffs between
+// calls. Rapid changes are naturally coalesced because only the state at the
+// time of the call is observed.
+type interfaceWatchState struct {
+	administrativeStatus stack.AdministrativeStatus
+	physicalStatus       stack.PhysicalStatus
+}
+
+// interfaceWatchStates snapshots the state of all installed interfaces.
+func (ns *Netstack) interfaceWatchStates() map[tcpip.NICID]interfaceWatchState {
+	nicInfos := ns.stack.NICInfo()
+	states := make(map[tcpip.NICID]interfaceWatchState, len(nicInfos))
+	for id, nicInfo := range nicInfos {
+		ifs := nicInfo.Context.(*ifState)
+		ifs.mu.Lock()
+		state := ifs.mu.state
+		ifs.mu.Unlock()
+
+		// TODO(fxbug.dev/52383): distinguish between enabled and link up.
+		ws := interfaceWatchState{
+			administrativeStatus: stack.AdministrativeStatusDisabled,
+			physicalStatus:       stack.PhysicalStatusDown,
+		}
+		if state == link.StateStarted {
+			ws.administrativeStatus = stack.AdministrativeStatusEnabled
+			ws.physicalStatus = stack.PhysicalStatusUp
+		}
+		states[id] = ws
+	}
+	return states
+}
+
+func interfaceStatesEqual(a, b map[tcpip.NICID]interfaceWatchState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, state := range a {
+		if other, ok := b[id]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}
+
+// diffInterfaceStates computes the events that take a watcher from last to
+// current, sorted by interface identifier.
+func diffInterfaceStates(last, current map[tcpip.NICID]interfaceWatchState) []stack.InterfaceWatchEvent {
+	events := make([]stack.InterfaceWatchEvent, 0, len(current)+len(last))
+	for id, state := range current {
+		if old, ok := last[id]; !ok || old != state {
+			events = append(events, stack.InterfaceWatchEvent{
+				Id:                   uint64(id),
+				Presence:             stack.PresenceStatusAdded,
+				AdministrativeStatus: state.administrativeStatus,
+				PhysicalStatus:       state.physicalStatus,
+			})
+		}
+	}
+	for id := range last {
+		if _, ok := current[id]; !ok {
+			events = append(events, stack.InterfaceWatchEvent{
+				Id:                   uint64(id),
+				Presence:             stack.PresenceStatusRemoved,
+				AdministrativeStatus: stack.AdministrativeStatusDisabled,
+				PhysicalStatus:       stack.PhysicalStatusDown,
+			})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+	return events
+}
+
+type interfaceWatcher struct {
+	ns        *Netstack
+	broadcast *broadcastChannel
+	mu        struct {
+		sync.Mutex
+		isHanging bool
+		isDead    bool
+		// lastObserved is nil until the first call has delivered its
+		// snapshot.
+		lastObserved map[tcpip.NICID]interfaceWatchState
+	}
+}
+
+var _ stack.InterfaceWatcherWithCtx = (*interfaceWatcher)(nil)
+
+func (w *interfaceWatcher) WatchInterfaces(ctx fidl.Context) ([]stack.InterfaceWatchEvent, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.mu.isHanging {
+		return nil, fmt.Errorf("interfaceWatcher: not allowed to watch twice")
+	}
+
+	states := w.ns.interfaceWatchStates()
+	for !w.mu.isDead && w.mu.lastObserved != nil && interfaceStatesEqual(states, w.mu.lastObserved) {
+		w.mu.isHanging = true
+
+		w.mu.Unlock()
+
+		var err error
+		select {
+		case <-w.broadcast.getChannel():
+		case <-ctx.Done():
+			err = fmt.Errorf("context cancelled during hanging get: %w", ctx.Err())
+		}
+		w.mu.Lock()
+
+		w.mu.isHanging = false
+
+		if err != nil {
+			w.mu.isDead = true
+			return nil, err
+		}
+
+		states = w.ns.interfaceWatchStates()
+	}
+
+	if w.mu.isDead {
+		return nil, fmt.Errorf("interfaceWatcher: watcher killed")
+	}
+
+	events := diffInterfaceStates(w.mu.lastObserved, states)
+	// Store the last observed states to compare in subsequent calls.
+	w.mu.lastObserved = states
+	return events, nil
+}
+
+type interfaceWatcherCollection struct {
+	ns        *Netstack
+	broadcast broadcastChannel
+}
+
+// newInterfaceWatcherCollection creates a new interfaceWatcherCollection
+// observing the interfaces installed in ns. Callers are responsible for
+// calling NotifyInterfacesChanged when the set of interfaces or their status
+// changes.
+func newInterfaceWatcherCollection(ns *Netstack) *interfaceWatcherCollection {
+	collection := interfaceWatcherCollection{
+		ns: ns,
+	}
+	collection.broadcast.mu.channel = make(chan struct{})
+	return &collection
+}
+
+// Bind binds a new fuchsia.net.stack.InterfaceWatcher request to the
+// collection of watchers and starts serving on its channel.
+func (c *interfaceWatcherCollection) Bind(request stack.InterfaceWatcherWithCtxInterfaceRequest) error {
+	go func() {
+		watcher := interfaceWatcher{
+			ns:        c.ns,
+			broadcast: &c.broadcast,
+		}
+
+		defer func() {
+			watcher.mu.Lock()
+			watcher.mu.isDead = true
+			watcher.mu.Unlock()
+			watcher.broadcast.broadcast()
+		}()
+
+		stub := stack.InterfaceWatcherWithCtxStub{
+			Impl: &watcher,
+		}
+		component.ServeExclusive(context.Background(), &stub, request.Channel, func(err error) {
+			_ = syslog.WarnTf(tag, "%s", err)
+		})
+	}()
+
+	return nil
+}
+
+// NotifyInterfacesChanged notifies all bound
+// fuchsia.net.stack.InterfaceWatchers that the set of interfaces or their
+// status has changed.
+func (c *interfaceWatcherCollection) NotifyInterfacesChanged() {
+	c.broadcast.broadcast()
+}
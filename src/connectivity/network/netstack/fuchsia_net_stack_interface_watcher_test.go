@@ -0,0 +1,95 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fidl/fuchsia/net/stack"
+
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func bindInterfaceWatcher(t *testing.T, collection *interfaceWatcherCollection) *stack.InterfaceWatcherWithCtxInterface {
+	request, watcher, err := stack.NewInterfaceWatcherWithCtxInterfaceRequest()
+	if err != nil {
+		t.Fatalf("failed to create InterfaceWatcher channel pair: %s", err)
+	}
+	if err := collection.Bind(request); err != nil {
+		t.Fatalf("failed to bind watcher: %s", err)
+	}
+	return watcher
+}
+
+func TestInterfaceWatcher(t *testing.T) {
+	ns := newNetstack(t)
+	ns.interfaceWatchers = newInterfaceWatcherCollection(ns)
+
+	watcher := bindInterfaceWatcher(t, ns.interfaceWatchers)
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	// The first call returns a snapshot; with no interfaces installed it is
+	// empty.
+	events, err := watcher.WatchInterfaces(context.Background())
+	if err != nil {
+		t.Fatalf("failed to call WatchInterfaces: %s", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("got WatchInterfaces() = %+v with no interfaces, want = []", events)
+	}
+
+	type watchResult struct {
+		events []stack.InterfaceWatchEvent
+		err    error
+	}
+
+	c := make(chan watchResult)
+	go func() {
+		events, err := watcher.WatchInterfaces(context.Background())
+		c <- watchResult{
+			events: events,
+			err:    err,
+		}
+	}()
+
+	select {
+	case res := <-c:
+		t.Fatalf("WatchInterfaces finished too early with %+v. Should've blocked.", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Adding an interface unblocks the watcher with an event for it.
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	var res watchResult
+	select {
+	case res = <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the interface event")
+	}
+	if res.err != nil {
+		t.Fatalf("failed to call WatchInterfaces: %s", res.err)
+	}
+	if len(res.events) != 1 {
+		t.Fatalf("got WatchInterfaces() = %+v, want a single event", res.events)
+	}
+	nicid := ns.stack.CheckLocalAddress(0, ipv4.ProtocolNumber, ipv4Loopback)
+	if nicid == 0 {
+		t.Fatalf("stack.CheckLocalAddress(0, ipv4, %s) failed", ipv4Loopback)
+	}
+	event := res.events[0]
+	if got, want := event.Id, uint64(nicid); got != want {
+		t.Errorf("got event.Id = %d, want = %d", got, want)
+	}
+	if got, want := event.Presence, stack.PresenceStatusAdded; got != want {
+		t.Errorf("got event.Presence = %s, want = %s", got, want)
+	}
+}
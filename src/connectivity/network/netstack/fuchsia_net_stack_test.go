@@ -7,7 +7,9 @@ package netstack
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/fidlconv"
 
@@ -20,6 +22,10 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 func TestValidateIPAddressMask(t *testing.T) {
@@ -259,6 +265,290 @@ func TestFuchsiaNetStack(t *testing.T) {
 	})
 }
 
+func TestTcpDelayedAckTimeout(t *testing.T) {
+	ns := newNetstack(t)
+	ni := stackImpl{ns: ns}
+
+	// The stack's default is in effect until a timeout is set.
+	if got, err := ni.GetTcpDelayedAckTimeout(context.Background()); err != nil {
+		t.Fatalf("GetTcpDelayedAckTimeout(): %s", err)
+	} else if got != 0 {
+		t.Errorf("got GetTcpDelayedAckTimeout() = %d, want = 0", got)
+	}
+
+	timeout := 40 * time.Millisecond
+	result, err := ni.SetTcpDelayedAckTimeout(context.Background(), int64(timeout))
+	if err != nil {
+		t.Fatalf("SetTcpDelayedAckTimeout(%s): %s", timeout, err)
+	}
+	if result.Which() == stack.StackSetTcpDelayedAckTimeoutResultErr {
+		t.Fatalf("got SetTcpDelayedAckTimeout(%s) = Err(%s)", timeout, result.Err)
+	}
+	if got, err := ni.GetTcpDelayedAckTimeout(context.Background()); err != nil {
+		t.Fatalf("GetTcpDelayedAckTimeout(): %s", err)
+	} else if got != int64(timeout) {
+		t.Errorf("got GetTcpDelayedAckTimeout() = %d, want = %d", got, int64(timeout))
+	}
+
+	// Out-of-range values are rejected and leave the previous setting in
+	// place.
+	for _, invalid := range []time.Duration{0, -time.Millisecond, time.Second} {
+		result, err := ni.SetTcpDelayedAckTimeout(context.Background(), int64(invalid))
+		if err != nil {
+			t.Fatalf("SetTcpDelayedAckTimeout(%s): %s", invalid, err)
+		}
+		if result.Which() != stack.StackSetTcpDelayedAckTimeoutResultErr || result.Err != stack.ErrorInvalidArgs {
+			t.Errorf("got SetTcpDelayedAckTimeout(%s) = %#v, want = Err(%s)", invalid, result, stack.ErrorInvalidArgs)
+		}
+	}
+	if got, err := ni.GetTcpDelayedAckTimeout(context.Background()); err != nil {
+		t.Fatalf("GetTcpDelayedAckTimeout(): %s", err)
+	} else if got != int64(timeout) {
+		t.Errorf("got GetTcpDelayedAckTimeout() = %d, want = %d", got, int64(timeout))
+	}
+}
+
+func TestGetMulticastMemberships(t *testing.T) {
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni := stackImpl{ns: ns}
+
+	newUDPEndpoint := func() tcpip.Endpoint {
+		t.Helper()
+		wq := new(waiter.Queue)
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint() = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		return ep
+	}
+
+	const group = tcpip.Address("\xe0\x00\x00\x01")
+	membership := multicastMembership{nicID: ifs.nicid, group: group}
+
+	ep1, ep2 := newUDPEndpoint(), newUDPEndpoint()
+	ns.multicastMemberships.add(ep1, membership)
+	ns.multicastMemberships.add(ep2, membership)
+
+	result, err := ni.GetMulticastMemberships(context.Background(), uint64(ifs.nicid))
+	if err != nil {
+		t.Fatalf("GetMulticastMemberships(_) = %s", err)
+	}
+	want := stack.StackGetMulticastMembershipsResultWithResponse(stack.StackGetMulticastMembershipsResponse{
+		Memberships: []stack.MulticastMembership{
+			{Group: fidlconv.ToNetIpAddress(group), SocketCount: 2},
+		},
+	})
+	if diff := cmp.Diff(want, result, cmpopts.IgnoreTypes(struct{}{})); diff != "" {
+		t.Fatalf("GetMulticastMemberships(_): (-want +got)\n%s", diff)
+	}
+
+	// A socket going away drops its membership from the count.
+	ns.multicastMemberships.removeEndpoint(ep1)
+	result, err = ni.GetMulticastMemberships(context.Background(), uint64(ifs.nicid))
+	if err != nil {
+		t.Fatalf("GetMulticastMemberships(_) = %s", err)
+	}
+	if got := result.Response.Memberships[0].SocketCount; got != 1 {
+		t.Errorf("got SocketCount = %d, want = 1", got)
+	}
+
+	// An unknown NIC is an error.
+	result, err = ni.GetMulticastMemberships(context.Background(), uint64(ifs.nicid)+1)
+	if err != nil {
+		t.Fatalf("GetMulticastMemberships(_) = %s", err)
+	}
+	if result.Which() != stack.StackGetMulticastMembershipsResultErr || result.Err != stack.ErrorNotFound {
+		t.Errorf("got GetMulticastMemberships(unknown NIC) = %#v, want = %s", result, stack.ErrorNotFound)
+	}
+}
+
+func TestGetInterfaceStats(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	ni := stackImpl{ns: ns}
+
+	nicid := ns.stack.CheckLocalAddress(0, ipv4.ProtocolNumber, ipv4Loopback)
+	if nicid == 0 {
+		t.Fatalf("stack.CheckLocalAddress(0, ipv4, %s) failed", ipv4Loopback)
+	}
+
+	getStats := func() stack.InterfaceStats {
+		t.Helper()
+		result, err := ni.GetInterfaceStats(context.Background(), uint64(nicid))
+		if err != nil {
+			t.Fatalf("GetInterfaceStats(%d): %s", nicid, err)
+		}
+		if result.Which() == stack.StackGetInterfaceStatsResultErr {
+			t.Fatalf("got GetInterfaceStats(%d) = Err(%s)", nicid, result.Err)
+		}
+		return result.Response.Stats
+	}
+	before := getStats()
+
+	// Push a few datagrams through the loopback interface; each counts once
+	// on each side of the NIC.
+	wq := new(waiter.Queue)
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	const packets = 3
+	for i := 0; i < packets; i++ {
+		if _, _, err := ep.Write(tcpip.SlicePayload("stats"), tcpip.WriteOptions{To: &local}); err != nil {
+			t.Fatalf("Write(_, {To: %+v}) = %s", local, err)
+		}
+	}
+	select {
+	case <-inCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the packets to arrive")
+	}
+
+	after := getStats()
+	if got, want := after.TxPackets-before.TxPackets, uint64(packets); got < want {
+		t.Errorf("got TxPackets delta = %d, want >= %d", got, want)
+	}
+	if got, want := after.RxPackets-before.RxPackets, uint64(packets); got < want {
+		t.Errorf("got RxPackets delta = %d, want >= %d", got, want)
+	}
+	if after.TxBytes <= before.TxBytes {
+		t.Errorf("got TxBytes = %d after sending, want > %d", after.TxBytes, before.TxBytes)
+	}
+	if after.RxBytes <= before.RxBytes {
+		t.Errorf("got RxBytes = %d after receiving, want > %d", after.RxBytes, before.RxBytes)
+	}
+
+	// An unknown NIC is an error.
+	result, err := ni.GetInterfaceStats(context.Background(), uint64(nicid)+42)
+	if err != nil {
+		t.Fatalf("GetInterfaceStats(_): %s", err)
+	}
+	if result.Which() != stack.StackGetInterfaceStatsResultErr || result.Err != stack.ErrorNotFound {
+		t.Errorf("got GetInterfaceStats(unknown NIC) = %#v, want = Err(%s)", result, stack.ErrorNotFound)
+	}
+}
+
+func TestGetInterfaceInfoByName(t *testing.T) {
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni := stackImpl{ns: ns}
+
+	result, err := ni.GetInterfaceInfoByName(context.Background(), testDeviceName)
+	if err != nil {
+		t.Fatalf("GetInterfaceInfoByName(%q): %s", testDeviceName, err)
+	}
+	if result.Which() == stack.StackGetInterfaceInfoByNameResultErr {
+		t.Fatalf("got GetInterfaceInfoByName(%q) = Err(%s)", testDeviceName, result.Err)
+	}
+	info := result.Response.Info
+	if got, want := info.Id, uint64(ifs.nicid); got != want {
+		t.Errorf("got Id = %d, want = %d", got, want)
+	}
+	if got, want := info.Properties.Name, testDeviceName; got != want {
+		t.Errorf("got Name = %q, want = %q", got, want)
+	}
+
+	// The match is exact and case-sensitive.
+	for _, name := range []string{"unknowndevice", strings.ToUpper(testDeviceName), testDeviceName[:len(testDeviceName)-1]} {
+		result, err := ni.GetInterfaceInfoByName(context.Background(), name)
+		if err != nil {
+			t.Fatalf("GetInterfaceInfoByName(%q): %s", name, err)
+		}
+		if result.Which() != stack.StackGetInterfaceInfoByNameResultErr || result.Err != stack.ErrorNotFound {
+			t.Errorf("got GetInterfaceInfoByName(%q) = %#v, want = Err(%s)", name, result, stack.ErrorNotFound)
+		}
+	}
+}
+
+func TestSetInterfaceMtu(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	ni := stackImpl{ns: ns}
+
+	nicid := ns.stack.CheckLocalAddress(0, ipv4.ProtocolNumber, ipv4Loopback)
+	if nicid == 0 {
+		t.Fatalf("stack.CheckLocalAddress(0, ipv4, %s) failed", ipv4Loopback)
+	}
+	nicInfo, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		t.Fatalf("stack.NICInfo()[%d]: %s", nicid, tcpip.ErrUnknownNICID)
+	}
+	ifs := nicInfo.Context.(*ifState)
+	hardwareMTU := ifs.mtuEndpoint.hardwareMTU()
+
+	getMtu := func() uint32 {
+		t.Helper()
+		result, err := ni.GetInterfaceInfo(context.Background(), uint64(nicid))
+		if err != nil {
+			t.Fatalf("GetInterfaceInfo(%d): %s", nicid, err)
+		}
+		if result.Which() == stack.StackGetInterfaceInfoResultErr {
+			t.Fatalf("got GetInterfaceInfo(%d) = Err(%s)", nicid, result.Err)
+		}
+		return result.Response.Info.Properties.Mtu
+	}
+	setMtu := func(id uint64, mtu uint32) stack.StackSetInterfaceMtuResult {
+		t.Helper()
+		result, err := ni.SetInterfaceMtu(context.Background(), id, mtu)
+		if err != nil {
+			t.Fatalf("SetInterfaceMtu(%d, %d): %s", id, mtu, err)
+		}
+		return result
+	}
+
+	// A valid MTU takes effect and is reported back.
+	const mtu = 1400
+	if result := setMtu(uint64(nicid), mtu); result.Which() == stack.StackSetInterfaceMtuResultErr {
+		t.Fatalf("got SetInterfaceMtu(%d, %d) = Err(%s)", nicid, mtu, result.Err)
+	}
+	if got := getMtu(); got != mtu {
+		t.Errorf("got MTU = %d, want = %d", got, mtu)
+	}
+
+	// Out-of-range values are rejected and leave the setting in place.
+	for _, invalid := range []uint32{0, header.IPv6MinimumMTU - 1, hardwareMTU + 1} {
+		result := setMtu(uint64(nicid), invalid)
+		if result.Which() != stack.StackSetInterfaceMtuResultErr || result.Err != stack.ErrorInvalidArgs {
+			t.Errorf("got SetInterfaceMtu(%d, %d) = %#v, want = Err(%s)", nicid, invalid, result, stack.ErrorInvalidArgs)
+		}
+	}
+	if got := getMtu(); got != mtu {
+		t.Errorf("got MTU = %d, want = %d", got, mtu)
+	}
+
+	// An unknown NIC is an error.
+	result := setMtu(uint64(nicid)+42, mtu)
+	if result.Which() != stack.StackSetInterfaceMtuResultErr || result.Err != stack.ErrorNotFound {
+		t.Errorf("got SetInterfaceMtu(unknown NIC, %d) = %#v, want = Err(%s)", mtu, result, stack.ErrorNotFound)
+	}
+}
+
 func TestDnsServerWatcher(t *testing.T) {
 	ns := newNetstack(t)
 	watcherCollection := newDnsServerWatcherCollection(ns.dnsClient)
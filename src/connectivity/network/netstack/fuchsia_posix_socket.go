@@ -19,6 +19,8 @@ import (
 	"syscall/zx/fidl"
 	"syscall/zx/zxsocket"
 	"syscall/zx/zxwait"
+	"time"
+	"unsafe"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/fidlconv"
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/link"
@@ -52,17 +54,97 @@ import (
 */
 import "C"
 
+// soRecvCmsgBufSize is a Fuchsia-local, read-only socket option at
+// SOL_SOCKET level reporting the maximum number of control-message bytes a
+// receive on the socket may produce given its currently-enabled cmsg
+// options, so that clients can size RecvMsg's controlLen without over- or
+// under-allocating. The number lies outside the range Linux assigns to
+// SO_* options.
+const soRecvCmsgBufSize = 200
+
+// soReadableBytes is a Fuchsia-local, read-only socket option at SOL_SOCKET
+// level backing the FIONREAD ioctl: the number of bytes currently readable —
+// the size of the next datagram for datagram sockets, the total queued bytes
+// for stream sockets. Like soRecvCmsgBufSize, the number lies outside the
+// range Linux assigns to SO_* options.
+const soReadableBytes = 201
+
+// Control message space requirements, each the CMSG_SPACE of the payload on
+// a 64-bit kernel: a 16 byte cmsghdr plus the payload padded to 8 bytes.
+const (
+	cmsgSpaceTimestamp = 32 // SCM_TIMESTAMP carrying a struct timeval.
+	cmsgSpacePktInfo   = 32 // IP_PKTINFO carrying a struct in_pktinfo.
+	cmsgSpaceTOS       = 24 // IP_TOS carrying a single byte.
+	cmsgSpaceTClass    = 24 // IPV6_TCLASS carrying an int.
+	cmsgSpaceTTL       = 24 // IP_TTL carrying an int.
+	cmsgSpaceHopLimit  = 24 // IPV6_HOPLIMIT carrying an int.
+)
+
+// The highest SO_PRIORITY Linux permits without CAP_NET_ADMIN (TC_PRIO_BESTEFFORT
+// through TC_PRIO_INTERACTIVE_BULK).
+const soPriorityMax = 6
+
 // endpoint is the base structure that models all network sockets.
 type endpoint struct {
 	// TODO(fxb/37419): Remove TransitionalBase after methods landed.
 	*io.NodeWithCtxTransitionalBase
 
 	wq *waiter.Queue
-	ep tcpip.Endpoint
+
+	// atomicEp holds the tcpip.Endpoint backing this socket. Rebinding an
+	// unconnected datagram socket to a new local address (see rebind.go)
+	// replaces it while the send, sockopt and address paths are reading it,
+	// so all access goes through loadEp/storeEp rather than a plain field
+	// read.
+	atomicEp atomic.Value
 
 	mu struct {
 		sync.Mutex
 		sockOptTimestamp bool
+		// sockOptTimestampNs is sockOptTimestamp's SO_TIMESTAMPNS sibling:
+		// when set, received datagrams carry an SCM_TIMESTAMPNS control
+		// message at nanosecond resolution. The two options are tracked
+		// independently; when both are set the nanosecond variant wins.
+		sockOptTimestampNs bool
+		// sockOptMark holds the socket's SO_MARK value. The stack does not
+		// yet attach it to outgoing packets; it is kept here so that a
+		// policy-routing layer can consume it once tcpip.WriteOptions can
+		// carry a mark, and so that userspace can be developed against the
+		// option in the meantime.
+		sockOptMark uint32
+		// sockOptPriority holds the socket's SO_PRIORITY value, attached to
+		// outgoing packets for the link's queue discipline to order by.
+		// Today's links each have a single fifo and transmit in order, so
+		// the priority is a stored-and-retrievable hint; a QoS-capable link
+		// consults it when enqueuing for transmit.
+		sockOptPriority uint32
+		// sockOptTxQueueHint holds the socket's SO_TXREHASH value, a hint
+		// naming the transmit queue the socket's packets should be steered
+		// to. Links with a single transmit queue (all of them, today)
+		// ignore the hint; a multiqueue link consults it when enqueuing
+		// for transmit.
+		sockOptTxQueueHint uint32
+		// sockOptRcvLowat holds the socket's SO_RCVLOWAT value. loopRead
+		// holds received stream data back from the zircon socket until at
+		// least this many bytes are available, so that the client is not
+		// signalled readable below the watermark.
+		sockOptRcvLowat int32
+		// sockOptLinger holds the socket's SO_LINGER setting, consulted
+		// when the socket closes: a positive timeout bounds how long close
+		// waits for unsent data to drain, and an enabled zero timeout
+		// turns close into an abortive reset.
+		sockOptLinger struct {
+			enabled bool
+			timeout time.Duration
+		}
+		// sockOptRcvTimeo and sockOptSndTimeo hold the socket's
+		// SO_RCVTIMEO and SO_SNDTIMEO settings; zero means no timeout.
+		// Datagram sockets enforce them by bounding the waits in RecvMsg
+		// and SendMsg. Stream sockets block in the client over the zircon
+		// socket, so the client enforces the deadline itself using the
+		// value it reads back.
+		sockOptRcvTimeo time.Duration
+		sockOptSndTimeo time.Duration
 	}
 
 	// wg tracks the running handler goroutines.
@@ -74,6 +156,18 @@ type endpoint struct {
 	ns *Netstack
 }
 
+// loadEp returns the stack endpoint backing this socket.
+func (ep *endpoint) loadEp() tcpip.Endpoint {
+	return ep.atomicEp.Load().(tcpip.Endpoint)
+}
+
+// storeEp replaces the stack endpoint backing this socket. The replacement
+// must have the same concrete type as the stored endpoint; rebinding always
+// creates it with the same transport protocol, which guarantees that.
+func (ep *endpoint) storeEp(e tcpip.Endpoint) {
+	ep.atomicEp.Store(e)
+}
+
 func (ep *endpoint) Sync(fidl.Context) (int32, error) {
 	syslog.VLogTf(syslog.DebugVerbosity, "Sync", "%p", ep)
 
@@ -83,13 +177,24 @@ func (ep *endpoint) Sync(fidl.Context) (int32, error) {
 func (ep *endpoint) GetAttr(fidl.Context) (int32, io.NodeAttributes, error) {
 	syslog.VLogTf(syslog.DebugVerbosity, "GetAttr", "%p", ep)
 
-	return 0, io.NodeAttributes{}, &zx.Error{Status: zx.ErrNotSupported, Text: fmt.Sprintf("%T", ep)}
+	// Sockets have no backing storage; only the mode is meaningful, so that
+	// fstat reports S_IFSOCK.
+	return int32(zx.ErrOk), io.NodeAttributes{
+		Mode:      io.ModeTypeSocket,
+		Id:        io.InoUnknown,
+		LinkCount: 1,
+	}, nil
 }
 
 func (ep *endpoint) SetAttr(_ fidl.Context, flags uint32, attributes io.NodeAttributes) (int32, error) {
 	syslog.VLogTf(syslog.DebugVerbosity, "SetAttr", "%p", ep)
 
-	return 0, &zx.Error{Status: zx.ErrNotSupported, Text: fmt.Sprintf("%T", ep)}
+	// Sockets have no timestamps to update; accept the mutable fields as a
+	// no-op so that generic fdio code can call this unconditionally.
+	if flags&^(io.NodeAttributeFlagCreationTime|io.NodeAttributeFlagModificationTime) != 0 {
+		return int32(zx.ErrInvalidArgs), nil
+	}
+	return int32(zx.ErrOk), nil
 }
 
 func (ep *endpoint) Bind(_ fidl.Context, sockaddr []uint8) (socket.BaseSocketBindResult, error) {
@@ -97,12 +202,12 @@ func (ep *endpoint) Bind(_ fidl.Context, sockaddr []uint8) (socket.BaseSocketBin
 	if err != nil {
 		return socket.BaseSocketBindResultWithErr(tcpipErrorToCode(tcpip.ErrBadAddress)), nil
 	}
-	if err := ep.ep.Bind(addr); err != nil {
+	if err := ep.loadEp().Bind(addr); err != nil {
 		return socket.BaseSocketBindResultWithErr(tcpipErrorToCode(err)), nil
 	}
 
 	{
-		localAddr, err := ep.ep.GetLocalAddress()
+		localAddr, err := ep.loadEp().GetLocalAddress()
 		if err != nil {
 			panic(err)
 		}
@@ -113,15 +218,24 @@ func (ep *endpoint) Bind(_ fidl.Context, sockaddr []uint8) (socket.BaseSocketBin
 }
 
 func (ep *endpoint) Connect(_ fidl.Context, sockaddr []uint8) (socket.BaseSocketConnectResult, error) {
-	addr, err := decodeAddr(sockaddr)
-	if err != nil {
-		return socket.BaseSocketConnectResultWithErr(tcpipErrorToCode(tcpip.ErrBadAddress)), nil
+	var addr tcpip.FullAddress
+	// Linux dissolves a datagram socket's association when connect is
+	// called with AF_UNSPEC, inspecting only the family tag: a zero-length
+	// or family-only sockaddr is accepted, and any bytes that follow the
+	// tag are ignored.
+	disconnect := len(sockaddr) < 2 || binary.LittleEndian.Uint16(sockaddr) == C.AF_UNSPEC
+	if !disconnect {
+		var err error
+		addr, err = decodeAddr(sockaddr)
+		if err != nil {
+			return socket.BaseSocketConnectResultWithErr(tcpipErrorToCode(tcpip.ErrBadAddress)), nil
+		}
+		// NB: We can't just compare the length to zero because that would
+		// mishandle the IPv6-mapped IPv4 unspecified address.
+		disconnect = addr.Port == 0 && (len(addr.Addr) == 0 || net.IP(addr.Addr).IsUnspecified())
 	}
-	// NB: We can't just compare the length to zero because that would
-	// mishandle the IPv6-mapped IPv4 unspecified address.
-	disconnect := addr.Port == 0 && (len(addr.Addr) == 0 || net.IP(addr.Addr).IsUnspecified())
 	if disconnect {
-		if err := ep.ep.Disconnect(); err != nil {
+		if err := ep.loadEp().Disconnect(); err != nil {
 			return socket.BaseSocketConnectResultWithErr(tcpipErrorToCode(err)), nil
 		}
 	} else {
@@ -131,9 +245,9 @@ func (ep *endpoint) Connect(_ fidl.Context, sockaddr []uint8) (socket.BaseSocket
 				return socket.BaseSocketConnectResultWithErr(tcpipErrorToCode(tcpip.ErrAddressFamilyNotSupported)), nil
 			}
 		}
-		if err := ep.ep.Connect(addr); err != nil {
+		if err := ep.loadEp().Connect(addr); err != nil {
 			if err == tcpip.ErrConnectStarted {
-				localAddr, err := ep.ep.GetLocalAddress()
+				localAddr, err := ep.loadEp().GetLocalAddress()
 				if err != nil {
 					panic(err)
 				}
@@ -144,7 +258,7 @@ func (ep *endpoint) Connect(_ fidl.Context, sockaddr []uint8) (socket.BaseSocket
 	}
 
 	{
-		localAddr, err := ep.ep.GetLocalAddress()
+		localAddr, err := ep.loadEp().GetLocalAddress()
 		if err != nil {
 			panic(err)
 		}
@@ -152,7 +266,7 @@ func (ep *endpoint) Connect(_ fidl.Context, sockaddr []uint8) (socket.BaseSocket
 		if disconnect {
 			syslog.VLogTf(syslog.DebugVerbosity, "connect", "%p: local=%+v, remote=disconnected", ep, localAddr)
 		} else {
-			remoteAddr, err := ep.ep.GetRemoteAddress()
+			remoteAddr, err := ep.loadEp().GetRemoteAddress()
 			if err != nil {
 				panic(err)
 			}
@@ -164,7 +278,7 @@ func (ep *endpoint) Connect(_ fidl.Context, sockaddr []uint8) (socket.BaseSocket
 }
 
 func (ep *endpoint) GetSockName(fidl.Context) (socket.BaseSocketGetSockNameResult, error) {
-	addr, err := ep.ep.GetLocalAddress()
+	addr, err := ep.loadEp().GetLocalAddress()
 	if err != nil {
 		return socket.BaseSocketGetSockNameResultWithErr(tcpipErrorToCode(err)), nil
 	}
@@ -174,7 +288,7 @@ func (ep *endpoint) GetSockName(fidl.Context) (socket.BaseSocketGetSockNameResul
 }
 
 func (ep *endpoint) GetPeerName(fidl.Context) (socket.BaseSocketGetPeerNameResult, error) {
-	addr, err := ep.ep.GetRemoteAddress()
+	addr, err := ep.loadEp().GetRemoteAddress()
 	if err != nil {
 		return socket.BaseSocketGetPeerNameResultWithErr(tcpipErrorToCode(err)), nil
 	}
@@ -184,17 +298,120 @@ func (ep *endpoint) GetPeerName(fidl.Context) (socket.BaseSocketGetPeerNameResul
 }
 
 func (ep *endpoint) SetSockOpt(_ fidl.Context, level, optName int16, optVal []uint8) (socket.BaseSocketSetSockOptResult, error) {
-	if level == C.SOL_SOCKET && optName == C.SO_TIMESTAMP {
+	if level == C.SOL_SOCKET && (optName == C.SO_TIMESTAMP || optName == C.SO_TIMESTAMPNS) {
+		if len(optVal) < sizeOfInt32 {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+
+		v := binary.LittleEndian.Uint32(optVal)
+		ep.mu.Lock()
+		if optName == C.SO_TIMESTAMP {
+			ep.mu.sockOptTimestamp = v != 0
+		} else {
+			ep.mu.sockOptTimestampNs = v != 0
+		}
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_MARK {
+		if len(optVal) < sizeOfInt32 {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+		// Linux requires CAP_NET_ADMIN to set a mark. Fuchsia does not yet
+		// convey per-client capabilities on the socket provider, so marking is
+		// granted to the netstack as a whole.
+		if !ep.ns.socketMarksAllowed {
+			return socket.BaseSocketSetSockOptResultWithErr(C.EPERM), nil
+		}
+
+		v := binary.LittleEndian.Uint32(optVal)
+		ep.mu.Lock()
+		ep.mu.sockOptMark = v
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_PRIORITY {
+		if len(optVal) < sizeOfInt32 {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+
+		v := binary.LittleEndian.Uint32(optVal)
+		// Linux requires CAP_NET_ADMIN for priorities outside 0 through 6;
+		// per-client capabilities are not conveyed on the socket provider,
+		// so the privileged range is rejected outright.
+		if int32(v) < 0 || v > soPriorityMax {
+			return socket.BaseSocketSetSockOptResultWithErr(C.EPERM), nil
+		}
+		ep.mu.Lock()
+		ep.mu.sockOptPriority = v
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_TXREHASH {
 		if len(optVal) < sizeOfInt32 {
 			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
 		}
 
 		v := binary.LittleEndian.Uint32(optVal)
 		ep.mu.Lock()
-		ep.mu.sockOptTimestamp = v != 0
+		ep.mu.sockOptTxQueueHint = v
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_RCVLOWAT {
+		if len(optVal) < sizeOfInt32 {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+
+		v := int32(binary.LittleEndian.Uint32(optVal))
+		// Linux floors the watermark at one byte and caps it at the receive
+		// buffer size; a watermark larger than the buffer could never be
+		// reached and the socket would never signal readable.
+		if v < 1 {
+			v = 1
+		}
+		if size, err := ep.loadEp().GetSockOptInt(tcpip.ReceiveBufferSizeOption); err == nil && v > int32(size) {
+			v = int32(size)
+		}
+		ep.mu.Lock()
+		ep.mu.sockOptRcvLowat = v
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_LINGER {
+		// struct linger is two C ints: l_onoff and l_linger (seconds).
+		if len(optVal) < 2*sizeOfInt32 {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+
+		onoff := binary.LittleEndian.Uint32(optVal)
+		seconds := int32(binary.LittleEndian.Uint32(optVal[sizeOfInt32:]))
+		if seconds < 0 {
+			seconds = 0
+		}
+		ep.mu.Lock()
+		ep.mu.sockOptLinger.enabled = onoff != 0
+		ep.mu.sockOptLinger.timeout = time.Duration(seconds) * time.Second
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && (optName == C.SO_RCVTIMEO || optName == C.SO_SNDTIMEO) {
+		// struct timeval is two C longs: tv_sec and tv_usec.
+		if len(optVal) < C.sizeof_struct_timeval {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+
+		sec := int64(binary.LittleEndian.Uint64(optVal))
+		usec := int64(binary.LittleEndian.Uint64(optVal[8:]))
+		if sec < 0 || usec < 0 || usec >= int64(time.Second/time.Microsecond) {
+			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(tcpip.ErrInvalidOptionValue)), nil
+		}
+		d := time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+		ep.mu.Lock()
+		if optName == C.SO_RCVTIMEO {
+			ep.mu.sockOptRcvTimeo = d
+		} else {
+			ep.mu.sockOptSndTimeo = d
+		}
 		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && (optName == soRecvCmsgBufSize || optName == soReadableBytes) {
+		// The Fuchsia-local options are read-only views of socket state;
+		// they cannot be set.
+		return socket.BaseSocketSetSockOptResultWithErr(C.EINVAL), nil
+	} else if level == C.SOL_TCP && optName == C.TCP_QUICKACK && ep.transProto != tcp.ProtocolNumber {
+		// TCP_QUICKACK controls delayed ACKs, which only exist on TCP
+		// connections.
+		return socket.BaseSocketSetSockOptResultWithErr(C.EINVAL), nil
 	} else {
-		if err := SetSockOpt(ep.ep, ep.ns, level, optName, optVal); err != nil {
+		if err := SetSockOpt(ep.loadEp(), ep.ns, level, optName, optVal); err != nil {
 			return socket.BaseSocketSetSockOptResultWithErr(tcpipErrorToCode(err)), nil
 		}
 	}
@@ -203,19 +420,102 @@ func (ep *endpoint) SetSockOpt(_ fidl.Context, level, optName int16, optVal []ui
 	return socket.BaseSocketSetSockOptResultWithResponse(socket.BaseSocketSetSockOptResponse{}), nil
 }
 
+// maxControlMessageSize returns the number of control-message bytes a
+// receive on the socket may produce: the sum of the space needed by each
+// enabled cmsg option. The value changes as options are enabled and
+// disabled.
+func (ep *endpoint) maxControlMessageSize() uint32 {
+	var size uint32
+	ep.mu.Lock()
+	if ep.mu.sockOptTimestamp || ep.mu.sockOptTimestampNs {
+		size += cmsgSpaceTimestamp
+	}
+	ep.mu.Unlock()
+	if v, err := ep.loadEp().GetSockOptBool(tcpip.ReceiveTOSOption); err == nil && v {
+		size += cmsgSpaceTOS
+	}
+	if v, err := ep.loadEp().GetSockOptBool(tcpip.ReceiveIPPacketInfoOption); err == nil && v {
+		size += cmsgSpacePktInfo
+	}
+	if v, err := ep.loadEp().GetSockOptBool(tcpip.ReceiveTClassOption); err == nil && v {
+		size += cmsgSpaceTClass
+	}
+	if v, err := ep.loadEp().GetSockOptBool(tcpip.ReceiveTTLOption); err == nil && v {
+		size += cmsgSpaceTTL
+	}
+	if v, err := ep.loadEp().GetSockOptBool(tcpip.ReceiveHopLimitOption); err == nil && v {
+		size += cmsgSpaceHopLimit
+	}
+	return size
+}
+
 func (ep *endpoint) GetSockOpt(_ fidl.Context, level, optName int16) (socket.BaseSocketGetSockOptResult, error) {
 	var val interface{}
-	if level == C.SOL_SOCKET && optName == C.SO_TIMESTAMP {
+	if level == C.SOL_SOCKET && (optName == C.SO_TIMESTAMP || optName == C.SO_TIMESTAMPNS) {
 		ep.mu.Lock()
-		if ep.mu.sockOptTimestamp {
-			val = int32(1)
-		} else {
-			val = int32(0)
+		v := ep.mu.sockOptTimestamp
+		if optName == C.SO_TIMESTAMPNS {
+			v = ep.mu.sockOptTimestampNs
+		}
+		ep.mu.Unlock()
+		val = boolToInt32(v)
+	} else if level == C.SOL_SOCKET && optName == C.SO_MARK {
+		ep.mu.Lock()
+		val = int32(ep.mu.sockOptMark)
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_PRIORITY {
+		ep.mu.Lock()
+		val = int32(ep.mu.sockOptPriority)
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_TXREHASH {
+		if !ep.txQueueSteeringAvailable() {
+			return socket.BaseSocketGetSockOptResultWithErr(C.EOPNOTSUPP), nil
+		}
+		ep.mu.Lock()
+		val = int32(ep.mu.sockOptTxQueueHint)
+		ep.mu.Unlock()
+	} else if level == C.SOL_SOCKET && optName == C.SO_RCVLOWAT {
+		ep.mu.Lock()
+		v := ep.mu.sockOptRcvLowat
+		ep.mu.Unlock()
+		if v == 0 {
+			v = 1
+		}
+		val = v
+	} else if level == C.SOL_SOCKET && optName == C.SO_LINGER {
+		ep.mu.Lock()
+		linger := ep.mu.sockOptLinger
+		ep.mu.Unlock()
+		b := make([]byte, 2*sizeOfInt32)
+		if linger.enabled {
+			binary.LittleEndian.PutUint32(b, 1)
+		}
+		binary.LittleEndian.PutUint32(b[sizeOfInt32:], uint32(linger.timeout/time.Second))
+		val = b
+	} else if level == C.SOL_SOCKET && (optName == C.SO_RCVTIMEO || optName == C.SO_SNDTIMEO) {
+		ep.mu.Lock()
+		d := ep.mu.sockOptRcvTimeo
+		if optName == C.SO_SNDTIMEO {
+			d = ep.mu.sockOptSndTimeo
 		}
 		ep.mu.Unlock()
+		b := make([]byte, C.sizeof_struct_timeval)
+		binary.LittleEndian.PutUint64(b, uint64(d/time.Second))
+		binary.LittleEndian.PutUint64(b[8:], uint64((d%time.Second)/time.Microsecond))
+		val = b
+	} else if level == C.SOL_SOCKET && optName == soRecvCmsgBufSize {
+		val = int32(ep.maxControlMessageSize())
+	} else if level == C.SOL_SOCKET && optName == soReadableBytes {
+		v, err := ep.loadEp().GetSockOptInt(tcpip.ReceiveQueueSizeOption)
+		if err != nil {
+			return socket.BaseSocketGetSockOptResultWithErr(tcpipErrorToCode(err)), nil
+		}
+		val = int32(v)
+	} else if level == C.SOL_TCP && optName == C.TCP_QUICKACK && ep.transProto != tcp.ProtocolNumber {
+		return socket.BaseSocketGetSockOptResultWithErr(C.EINVAL), nil
 	} else {
 		var err *tcpip.Error
-		val, err = GetSockOpt(ep.ep, ep.ns, ep.netProto, ep.transProto, level, optName)
+		val, err = GetSockOpt(ep.loadEp(), ep.ns, ep.netProto, ep.transProto, level, optName)
 		if err != nil {
 			return socket.BaseSocketGetSockOptResultWithErr(tcpipErrorToCode(err)), nil
 		}
@@ -237,6 +537,33 @@ func (ep *endpoint) GetSockOpt(_ fidl.Context, level, optName int16) (socket.Bas
 	}), nil
 }
 
+// txQueueSteeringAvailable reports whether the socket's transmit-queue hint
+// can be honored. A socket that is not yet associated with a NIC may be
+// steered once it is bound or connected; a socket whose NIC's link has a
+// single transmit queue cannot be steered.
+func (ep *endpoint) txQueueSteeringAvailable() bool {
+	var nicid tcpip.NICID
+	switch t := ep.loadEp().Info().(type) {
+	case *tcp.EndpointInfo:
+		nicid = t.RegisterNICID
+	case *stack.TransportEndpointInfo:
+		nicid = t.RegisterNICID
+	}
+	if nicid == 0 {
+		return true
+	}
+	nicInfo, ok := ep.ns.stack.NICInfo()[nicid]
+	if !ok {
+		return true
+	}
+	ifs, ok := nicInfo.Context.(*ifState)
+	if !ok {
+		return true
+	}
+	_, ok = ifs.controller.(link.TxQueueSteering)
+	return ok
+}
+
 type boolWithMutex struct {
 	mu struct {
 		sync.Mutex
@@ -244,6 +571,13 @@ type boolWithMutex struct {
 	}
 }
 
+// The slot an endpoint holds in ns.tcpConnLimits; see connSlot below.
+const (
+	connSlotNone = iota
+	connSlotHalfOpen
+	connSlotEstablished
+)
+
 // endpointWithSocket implements a network socket that uses a zircon socket for
 // its data plane. This structure creates a pair of goroutines which are
 // responsible for moving data and signals between the underlying
@@ -272,6 +606,10 @@ type endpointWithSocket struct {
 	// resources once - the first time it was closed.
 	closeOnce uint32
 
+	// connSlot records which slot, if any, this endpoint holds in
+	// ns.tcpConnLimits. Accessed atomically.
+	connSlot uint32
+
 	// entry is used to register callback for error and closing events.
 	entry waiter.Entry
 }
@@ -290,7 +628,6 @@ func newEndpointWithSocket(ep tcpip.Endpoint, wq *waiter.Queue, transProto tcpip
 
 	eps := &endpointWithSocket{
 		endpoint: endpoint{
-			ep:         ep,
 			wq:         wq,
 			transProto: transProto,
 			netProto:   netProto,
@@ -303,6 +640,7 @@ func newEndpointWithSocket(ep tcpip.Endpoint, wq *waiter.Queue, transProto tcpip
 		loopPollDone:  make(chan struct{}),
 		closing:       make(chan struct{}),
 	}
+	eps.storeEp(ep)
 
 	// Register a callback for error and closing events from gVisor to
 	// trigger a close of the endpoint.
@@ -329,7 +667,7 @@ func newEndpointWithSocket(ep tcpip.Endpoint, wq *waiter.Queue, transProto tcpip
 
 			if obs&sigs&zx.SignalSocketWriteDisabled != 0 {
 				sigs ^= zx.SignalSocketWriteDisabled
-				if err := eps.ep.Shutdown(tcpip.ShutdownRead); err != nil && err != tcpip.ErrNotConnected {
+				if err := eps.loadEp().Shutdown(tcpip.ShutdownRead); err != nil && err != tcpip.ErrNotConnected {
 					panic(err)
 				}
 			}
@@ -376,13 +714,51 @@ type endpointWithEvent struct {
 		sync.Mutex
 		readView buffer.View
 		sender   tcpip.FullAddress
+		control  tcpip.ControlMessages
 	}
 
 	local, peer zx.Handle
 
 	incoming boolWithMutex
 
+	// linkLayer is set for AF_PACKET sockets, whose sender addresses are
+	// link-layer addresses delivered to clients as sockaddr_ll.
+	linkLayer bool
+
 	entry waiter.Entry
+
+	// reuseport records this socket's membership in a reuseport group, if
+	// any; see reuseportGroupMap. Written on bind and read when the socket
+	// is destroyed.
+	reuseport struct {
+		key reuseportKey
+		id  uint64
+	}
+}
+
+// Bind wraps endpoint.Bind to register datagram sockets bound with
+// SO_REUSEPORT in the reuseport group for their local address.
+func (epe *endpointWithEvent) Bind(ctx fidl.Context, sockaddr []uint8) (socket.BaseSocketBindResult, error) {
+	result, err := epe.endpoint.Bind(ctx, sockaddr)
+	if err != nil || result.Which() != socket.BaseSocketBindResultResponse {
+		return result, err
+	}
+	if epe.transProto == udp.ProtocolNumber && epe.reuseport.id == 0 {
+		if reuse, err := epe.loadEp().GetSockOptBool(tcpip.ReusePortOption); err == nil && reuse {
+			localAddr, err := epe.loadEp().GetLocalAddress()
+			if err != nil {
+				panic(err)
+			}
+			epe.reuseport.key = reuseportKey{
+				netProto:   epe.netProto,
+				transProto: epe.transProto,
+				addr:       localAddr.Addr,
+				port:       localAddr.Port,
+			}
+			epe.reuseport.id = epe.ns.reuseportGroups.add(epe.reuseport.key, epe.loadEp())
+		}
+	}
+	return result, err
 }
 
 func (epe *endpointWithEvent) Describe(fidl.Context) (io.NodeInfo, error) {
@@ -412,7 +788,7 @@ func (epe *endpointWithEvent) Shutdown(_ fidl.Context, how int16) (socket.Datagr
 	default:
 		return socket.DatagramSocketShutdownResultWithErr(C.EINVAL), nil
 	}
-	if err := epe.ep.Shutdown(flags); err != nil {
+	if err := epe.loadEp().Shutdown(flags); err != nil {
 		return socket.DatagramSocketShutdownResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	if flags&tcpip.ShutdownRead != 0 {
@@ -424,6 +800,25 @@ func (epe *endpointWithEvent) Shutdown(_ fidl.Context, how int16) (socket.Datagr
 	return socket.DatagramSocketShutdownResultWithResponse(socket.DatagramSocketShutdownResponse{}), nil
 }
 
+func (epe *endpointWithEvent) GetSockOpt(ctx fidl.Context, level, optName int16) (socket.BaseSocketGetSockOptResult, error) {
+	if level == C.SOL_SOCKET && optName == soReadableBytes {
+		// A datagram held after a MSG_PEEK read has already been dequeued
+		// from the endpoint, so the endpoint's receive queue size no longer
+		// accounts for it.
+		epe.mu.Lock()
+		peeked := len(epe.mu.readView)
+		epe.mu.Unlock()
+		if peeked != 0 {
+			b := make([]byte, sizeOfInt32)
+			binary.LittleEndian.PutUint32(b, uint32(peeked))
+			return socket.BaseSocketGetSockOptResultWithResponse(socket.BaseSocketGetSockOptResponse{
+				Optval: b,
+			}), nil
+		}
+	}
+	return epe.endpoint.GetSockOpt(ctx, level, optName)
+}
+
 const localSignalClosing = zx.SignalUser1
 
 // close destroys the endpoint and releases associated resources.
@@ -439,6 +834,25 @@ func (eps *endpointWithSocket) close(loopDone ...<-chan struct{}) {
 		return
 	}
 
+	eps.endpoint.mu.Lock()
+	linger := eps.endpoint.mu.sockOptLinger
+	eps.endpoint.mu.Unlock()
+
+	if linger.enabled && linger.timeout > 0 {
+		// SO_LINGER with a positive timeout asks for a graceful close:
+		// leave the loops running so that data the client has already
+		// written keeps draining into the endpoint, for up to the
+		// configured timeout.
+		deadline := time.Now().Add(linger.timeout)
+		for time.Now().Before(deadline) {
+			occupancy, ok := readSocketOccupancy(zx.Handle(eps.local), eps.loadEp())
+			if !ok || (occupancy.txBytesInZxSocket == 0 && occupancy.txBytesInGvisorQueue == 0) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
 	// Interrupt waits on notification channels. Notification reads
 	// are always combined with closing in a select statement.
 	close(eps.closing)
@@ -471,16 +885,84 @@ func (eps *endpointWithSocket) close(loopDone ...<-chan struct{}) {
 
 	eps.endpoint.ns.onRemoveEndpoint(key)
 
-	eps.ep.Close()
+	if linger.enabled && linger.timeout == 0 {
+		// SO_LINGER with a zero timeout asks for an abortive close:
+		// discard unsent data and reset the connection instead of
+		// closing it gracefully.
+		eps.loadEp().Abort()
+	} else {
+		eps.loadEp().Close()
+	}
+
+	switch atomic.SwapUint32(&eps.connSlot, connSlotNone) {
+	case connSlotHalfOpen:
+		eps.endpoint.ns.tcpConnLimits.release(true)
+	case connSlotEstablished:
+		eps.endpoint.ns.tcpConnLimits.release(false)
+	}
 
 	syslog.VLogTf(syslog.DebugVerbosity, "close", "%p", eps)
 }
 
+// zxSocketInfo mirrors zx_info_socket_t from zircon/syscalls/object.h;
+// syscall/zx does not provide a typed wrapper for ZX_INFO_SOCKET.
+type zxSocketInfo struct {
+	options        uint32
+	_              [4]uint8
+	rxBufMax       uint64
+	rxBufSize      uint64
+	rxBufAvailable uint64
+	txBufMax       uint64
+	txBufSize      uint64
+}
+
+// zxInfoSocketTopic is ZX_INFO_SOCKET from zircon/syscalls/object.h.
+const zxInfoSocketTopic = 22
+
+// socketOccupancy is a diagnostic snapshot of where a socket's buffered
+// bytes sit: still queued in the gVisor endpoint, or already in transit in
+// the zircon socket between the netstack and its client. Directions are
+// named from the client's point of view: rx is data headed to the client,
+// tx is data the client has written.
+type socketOccupancy struct {
+	rxBytesInZxSocket    uint64
+	txBytesInZxSocket    uint64
+	rxBytesInGvisorQueue uint64
+	txBytesInGvisorQueue uint64
+}
+
+// readSocketOccupancy reads the buffer occupancy of the endpoint whose data
+// plane is the zircon socket behind handle. The in-transit counts come from
+// the socket's kernel info: bytes loopRead has staged that the client has
+// not yet read, and bytes the client has written that loopWrite has not yet
+// drained. ok is false when handle is not a zircon socket; datagram sockets
+// carry their payloads over FIDL and have nothing in transit.
+func readSocketOccupancy(handle zx.Handle, ep tcpip.Endpoint) (socketOccupancy, bool) {
+	var info zxSocketInfo
+	if status := zx.Sys_object_get_info(handle, zxInfoSocketTopic, unsafe.Pointer(&info), uint(unsafe.Sizeof(info)), nil, nil); status != zx.ErrOk {
+		return socketOccupancy{}, false
+	}
+	// The netstack holds the local end of the socket: its transmit buffer
+	// carries received data toward the client, its receive buffer carries
+	// client writes toward the network.
+	occupancy := socketOccupancy{
+		rxBytesInZxSocket: info.txBufSize,
+		txBytesInZxSocket: info.rxBufSize,
+	}
+	if size, err := ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption); err == nil {
+		occupancy.rxBytesInGvisorQueue = uint64(size)
+	}
+	if size, err := ep.GetSockOptInt(tcpip.SendQueueSizeOption); err == nil {
+		occupancy.txBytesInGvisorQueue = uint64(size)
+	}
+	return occupancy, true
+}
+
 func (eps *endpointWithSocket) Listen(_ fidl.Context, backlog int16) (socket.StreamSocketListenResult, error) {
 	if backlog < 0 {
 		backlog = 0
 	}
-	if err := eps.ep.Listen(int(backlog)); err != nil {
+	if err := eps.loadEp().Listen(int(backlog)); err != nil {
 		return socket.StreamSocketListenResultWithErr(tcpipErrorToCode(err)), nil
 	}
 
@@ -490,7 +972,7 @@ func (eps *endpointWithSocket) Listen(_ fidl.Context, backlog int16) (socket.Str
 }
 
 func (eps *endpointWithSocket) Accept(fidl.Context) (int32, *endpointWithSocket, error) {
-	ep, wq, err := eps.endpoint.ep.Accept()
+	ep, wq, err := eps.endpoint.loadEp().Accept()
 	if err != nil {
 		return tcpipErrorToCode(err), nil, nil
 	}
@@ -499,7 +981,7 @@ func (eps *endpointWithSocket) Accept(fidl.Context) (int32, *endpointWithSocket,
 		// We lock here to ensure that no incoming connection changes readiness
 		// while we clear the signal.
 		eps.incoming.mu.Lock()
-		if eps.incoming.mu.asserted && eps.endpoint.ep.Readiness(waiter.EventIn) == 0 {
+		if eps.incoming.mu.asserted && eps.endpoint.loadEp().Readiness(waiter.EventIn) == 0 {
 			err = eps.local.Handle().SignalPeer(zxsocket.SignalIncoming, 0)
 			eps.incoming.mu.asserted = false
 		}
@@ -533,10 +1015,53 @@ func (eps *endpointWithSocket) Accept(fidl.Context) (int32, *endpointWithSocket,
 			syslog.VLogTf(syslog.DebugVerbosity, "accept", "%p: local=%+v, remote=%+v", eps, localAddr, remoteAddr)
 		}
 	}
+	if !eps.endpoint.ns.tcpConnLimits.tryAcquire(false) {
+		// The connection limit has been reached; reset the accepted connection
+		// and report nothing pending to the caller. Established connections
+		// are unaffected.
+		ep.Abort()
+		return tcpipErrorToCode(tcpip.ErrWouldBlock), nil, nil
+	}
 	{
 		ep, err := newEndpointWithSocket(ep, wq, eps.transProto, eps.netProto, eps.endpoint.ns)
-		return 0, ep, err
+		if err != nil {
+			eps.endpoint.ns.tcpConnLimits.release(false)
+			return 0, nil, err
+		}
+		atomic.StoreUint32(&ep.connSlot, connSlotEstablished)
+		return 0, ep, nil
+	}
+}
+
+func (eps *endpointWithSocket) Connect(ctx fidl.Context, sockaddr []uint8) (socket.BaseSocketConnectResult, error) {
+	if eps.transProto == tcp.ProtocolNumber && atomic.CompareAndSwapUint32(&eps.connSlot, connSlotNone, connSlotHalfOpen) {
+		if !eps.ns.tcpConnLimits.tryAcquire(true) {
+			atomic.StoreUint32(&eps.connSlot, connSlotNone)
+			// The connection limit has been reached; refuse the connection
+			// locally rather than sending a SYN.
+			return socket.BaseSocketConnectResultWithErr(tcpipErrorToCode(tcpip.ErrConnectionRefused)), nil
+		}
+	}
+	result, err := eps.endpoint.Connect(ctx, sockaddr)
+	if err == nil && result.Which() == socket.BaseSocketConnectResultErr {
+		if atomic.CompareAndSwapUint32(&eps.connSlot, connSlotHalfOpen, connSlotNone) {
+			eps.ns.tcpConnLimits.release(true)
+		}
 	}
+	return result, err
+}
+
+// loopWriteBufs recycles the staging buffers loopWrite reads zircon-socket
+// data into. A TCP endpoint takes ownership of the payload it is handed, so
+// TCP payloads are copied out of the staging buffer (sized to the data read
+// rather than the buffer's full capacity) before the write; datagram
+// payloads, which the endpoint consumes synchronously, are written in place.
+// Either way the staging buffer itself is always returned to the pool.
+var loopWriteBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 2048)
+		return &b
+	},
 }
 
 // loopWrite shuttles signals and data from the zircon socket to the tcpip.Endpoint.
@@ -552,17 +1077,17 @@ func (eps *endpointWithSocket) loopWrite() {
 	defer eps.wq.EventUnregister(&waitEntry)
 
 	for {
-		// TODO: obviously allocating for each read is silly. A quick hack we can
-		// do is store these in a ring buffer, as the lifecycle of this buffer.View
-		// starts here, and ends in nearby code we control in link.go.
-		v := make([]byte, 0, 2048)
-		n, err := eps.local.Read(v[:cap(v)], 0)
+		b := loopWriteBufs.Get().(*[]byte)
+		n, err := eps.local.Read(*b, 0)
 		if err != nil {
+			// The buffer was not handed to the endpoint; it is always safe
+			// to recycle.
+			loopWriteBufs.Put(b)
 			if err, ok := err.(*zx.Error); ok {
 				switch err.Status {
 				case zx.ErrBadState:
 					// Reading has been disabled for this socket endpoint.
-					if err := eps.ep.Shutdown(tcpip.ShutdownWrite); err != nil && err != tcpip.ErrNotConnected {
+					if err := eps.loadEp().Shutdown(tcpip.ShutdownWrite); err != nil && err != tcpip.ErrNotConnected {
 						panic(err)
 					}
 					return
@@ -588,10 +1113,18 @@ func (eps *endpointWithSocket) loopWrite() {
 			}
 			panic(err)
 		}
-		v = v[:n]
+		v := (*b)[:n]
+		if eps.transProto == tcp.ProtocolNumber {
+			// The endpoint takes ownership of the payload it is handed and
+			// releases it from link code outside our control, so give it a
+			// copy and recycle the staging buffer right away.
+			v = append([]byte(nil), v...)
+			loopWriteBufs.Put(b)
+			b = nil
+		}
 
 		for {
-			n, resCh, err := eps.ep.Write(tcpip.SlicePayload(v), tcpip.WriteOptions{})
+			n, resCh, err := eps.loadEp().Write(tcpip.SlicePayload(v), tcpip.WriteOptions{})
 			if resCh != nil {
 				if err != tcpip.ErrNoLinkAddress {
 					panic(fmt.Sprintf("err=%v inconsistent with presence of resCh", err))
@@ -646,6 +1179,9 @@ func (eps *endpointWithSocket) loopWrite() {
 			}
 			break
 		}
+		if b != nil {
+			loopWriteBufs.Put(b)
+		}
 	}
 }
 
@@ -678,13 +1214,72 @@ func (eps *endpointWithSocket) loopRead(inCh <-chan struct{}, initCh chan<- stru
 		}()
 	}
 
+	// writeToSocket writes v to the zircon socket in its entirety, blocking as
+	// needed; it returns false iff loopRead must exit.
+	writeToSocket := func(v []byte) bool {
+		for {
+			n, err := eps.local.Write(v, 0)
+			if err != nil {
+				if err, ok := err.(*zx.Error); ok {
+					switch err.Status {
+					case zx.ErrBadState:
+						// Writing has been disabled for this socket endpoint.
+						if err := eps.loadEp().Shutdown(tcpip.ShutdownRead); err != nil {
+							// An ErrNotConnected while connected is expected if there
+							// is pending data to be read and the connection has been
+							// reset by the other end of the endpoint. The endpoint will
+							// allow the pending data to be read without error but will
+							// return ErrNotConnected if Shutdown is called. Otherwise
+							// this is unexpected, panic.
+							if !(connected && err == tcpip.ErrNotConnected) {
+								panic(err)
+							}
+							syslog.InfoTf("loopRead", "%p: client shutdown a closed endpoint with %d bytes pending data; ep info: %+v", eps, len(v), eps.endpoint.loadEp().Info())
+						}
+						return false
+					case zx.ErrShouldWait:
+						obs, err := zxwait.Wait(zx.Handle(eps.local), sigs, zx.TimensecInfinite)
+						if err != nil {
+							panic(err)
+						}
+						switch {
+						case obs&zx.SignalSocketWriteDisabled != 0:
+							// The next Write will return zx.ErrBadState.
+							continue
+						case obs&zx.SignalSocketWritable != 0:
+							continue
+						case obs&localSignalClosing != 0:
+							// We're shutting down.
+							return false
+						}
+					}
+				}
+				panic(err)
+			}
+			if eps.transProto != tcp.ProtocolNumber {
+				if n < len(v) {
+					panic(fmt.Sprintf("UDP disallows short writes; saw: %d/%d", n, len(v)))
+				}
+			}
+			v = v[n:]
+			if len(v) == 0 {
+				return true
+			}
+			eps.loadEp().ModerateRecvBuf(n)
+		}
+	}
+
+	// pending holds stream data read from the endpoint but not yet written to
+	// the zircon socket because the receive low watermark has not been met.
+	var pending []byte
+
 	var sender tcpip.FullAddress
 	for {
 		var v []byte
 
 		for {
 			var err *tcpip.Error
-			v, _, err = eps.ep.Read(&sender)
+			v, _, err = eps.loadEp().Read(&sender)
 			if err == tcpip.ErrNotConnected {
 				if connected {
 					panic(fmt.Sprintf("connected endpoint returned %s", err))
@@ -702,7 +1297,7 @@ func (eps *endpointWithSocket) loopRead(inCh <-chan struct{}, initCh chan<- stru
 					// registered until the end of the function.
 					var err error
 					eps.incoming.mu.Lock()
-					if !eps.incoming.mu.asserted && eps.endpoint.ep.Readiness(waiter.EventIn) != 0 {
+					if !eps.incoming.mu.asserted && eps.endpoint.loadEp().Readiness(waiter.EventIn) != 0 {
 						err = eps.local.Handle().SignalPeer(0, zxsocket.SignalIncoming)
 						eps.incoming.mu.asserted = true
 					}
@@ -722,6 +1317,10 @@ func (eps *endpointWithSocket) loopRead(inCh <-chan struct{}, initCh chan<- stru
 					connected = true
 					eps.wq.EventUnregister(&outEntry)
 
+					if atomic.CompareAndSwapUint32(&eps.connSlot, connSlotHalfOpen, connSlotEstablished) {
+						eps.ns.tcpConnLimits.established()
+					}
+
 					signals |= zxsocket.SignalConnected
 				}
 
@@ -788,6 +1387,20 @@ func (eps *endpointWithSocket) loopRead(inCh <-chan struct{}, initCh chan<- stru
 					return
 				}
 			case tcpip.ErrClosedForReceive:
+				// The peer can send no more data. Drain anything still queued
+				// in the endpoint along with anything held below the receive
+				// low watermark, so that data sent just ahead of the FIN is
+				// delivered before EOF is signalled.
+				for {
+					extra, _, err := eps.loadEp().Read(&sender)
+					if err != nil {
+						break
+					}
+					pending = append(pending, extra...)
+				}
+				if len(pending) != 0 && !writeToSocket(pending) {
+					return
+				}
 				if err := eps.local.Shutdown(zx.SocketShutdownWrite); err != nil {
 					panic(err)
 				}
@@ -802,55 +1415,25 @@ func (eps *endpointWithSocket) loopRead(inCh <-chan struct{}, initCh chan<- stru
 			break
 		}
 
-		for {
-			n, err := eps.local.Write(v, 0)
-			if err != nil {
-				if err, ok := err.(*zx.Error); ok {
-					switch err.Status {
-					case zx.ErrBadState:
-						// Writing has been disabled for this socket endpoint.
-						if err := eps.ep.Shutdown(tcpip.ShutdownRead); err != nil {
-							// An ErrNotConnected while connected is expected if there
-							// is pending data to be read and the connection has been
-							// reset by the other end of the endpoint. The endpoint will
-							// allow the pending data to be read without error but will
-							// return ErrNotConnected if Shutdown is called. Otherwise
-							// this is unexpected, panic.
-							if !(connected && err == tcpip.ErrNotConnected) {
-								panic(err)
-							}
-							syslog.InfoTf("loopRead", "%p: client shutdown a closed endpoint with %d bytes pending data; ep info: %+v", eps, len(v), eps.endpoint.ep.Info())
-						}
-						return
-					case zx.ErrShouldWait:
-						obs, err := zxwait.Wait(zx.Handle(eps.local), sigs, zx.TimensecInfinite)
-						if err != nil {
-							panic(err)
-						}
-						switch {
-						case obs&zx.SignalSocketWriteDisabled != 0:
-							// The next Write will return zx.ErrBadState.
-							continue
-						case obs&zx.SignalSocketWritable != 0:
-							continue
-						case obs&localSignalClosing != 0:
-							// We're shutting down.
-							return
-						}
-					}
-				}
-				panic(err)
-			}
-			if eps.transProto != tcp.ProtocolNumber {
-				if n < len(v) {
-					panic(fmt.Sprintf("UDP disallows short writes; saw: %d/%d", n, len(v)))
+		if eps.transProto == tcp.ProtocolNumber {
+			eps.endpoint.mu.Lock()
+			lowat := int(eps.endpoint.mu.sockOptRcvLowat)
+			eps.endpoint.mu.Unlock()
+			if lowat > 1 {
+				// Writing to the zircon socket asserts its readable signal, so
+				// the receive low watermark is enforced by holding data back
+				// here until the watermark's worth of bytes is available.
+				pending = append(pending, v...)
+				if len(pending) < lowat {
+					continue
 				}
+				v = pending
+				pending = nil
 			}
-			v = v[n:]
-			if len(v) == 0 {
-				break
-			}
-			eps.ep.ModerateRecvBuf(n)
+		}
+
+		if !writeToSocket(v) {
+			return
 		}
 	}
 }
@@ -901,27 +1484,68 @@ func (s *datagramSocketImpl) Clone(ctx fidl.Context, flags uint32, object io.Nod
 }
 
 func (s *datagramSocketImpl) RecvMsg(_ fidl.Context, addrLen, dataLen, controlLen uint32, flags int16) (socket.DatagramSocketRecvMsgResult, error) {
-	s.mu.Lock()
-	var err *tcpip.Error
-	if len(s.mu.readView) == 0 {
-		// TODO(21106): do something with control messages.
-		s.mu.readView, _, err = s.ep.Read(&s.mu.sender)
-	}
-	v, sender := s.mu.readView, s.mu.sender
-	if flags&C.MSG_PEEK == 0 {
-		s.mu.readView = nil
-		s.mu.sender = tcpip.FullAddress{}
-	}
-	s.mu.Unlock()
-	if err != nil {
-		return socket.DatagramSocketRecvMsgResultWithErr(tcpipErrorToCode(err)), nil
+	// Reject flag bits that are not understood rather than silently
+	// ignoring them; a client passing an unsupported flag would otherwise
+	// misinterpret the result.
+	if flags&^(C.MSG_PEEK|C.MSG_TRUNC|C.MSG_DONTWAIT) != 0 {
+		return socket.DatagramSocketRecvMsgResultWithErr(C.EINVAL), nil
+	}
+
+	// Datagram reads do not normally block in the netstack — the client
+	// implements blocking by waiting for the incoming signal, and an empty
+	// socket yields EWOULDBLOCK. With SO_RCVTIMEO set the wait happens
+	// here instead so that it can be bounded; MSG_DONTWAIT suppresses it
+	// for a single call.
+	s.endpoint.mu.Lock()
+	rcvTimeo := s.endpoint.mu.sockOptRcvTimeo
+	s.endpoint.mu.Unlock()
+	var waitCh <-chan struct{}
+	var deadline <-chan time.Time
+	if rcvTimeo != 0 && flags&C.MSG_DONTWAIT == 0 {
+		// Register before reading so that a datagram arriving between the
+		// read and the wait is not missed.
+		entry, ch := waiter.NewChannelEntry(nil)
+		s.wq.EventRegister(&entry, waiter.EventIn)
+		defer s.wq.EventUnregister(&entry)
+		waitCh = ch
+		deadline = time.After(rcvTimeo)
+	}
+
+	var v buffer.View
+	var sender tcpip.FullAddress
+	var cmsgs tcpip.ControlMessages
+	for {
+		s.mu.Lock()
+		var err *tcpip.Error
+		if len(s.mu.readView) == 0 {
+			s.mu.readView, s.mu.control, err = s.loadEp().Read(&s.mu.sender)
+		}
+		v, sender, cmsgs = s.mu.readView, s.mu.sender, s.mu.control
+		if flags&C.MSG_PEEK == 0 {
+			s.mu.readView = nil
+			s.mu.sender = tcpip.FullAddress{}
+			s.mu.control = tcpip.ControlMessages{}
+		}
+		s.mu.Unlock()
+		if err == tcpip.ErrWouldBlock && waitCh != nil {
+			select {
+			case <-waitCh:
+				continue
+			case <-deadline:
+				return socket.DatagramSocketRecvMsgResultWithErr(C.EAGAIN), nil
+			}
+		}
+		if err != nil {
+			return socket.DatagramSocketRecvMsgResultWithErr(tcpipErrorToCode(err)), nil
+		}
+		break
 	}
 	{
 		var err error
 		// We lock here to ensure that no incoming data changes readiness while we
 		// clear the signal.
 		s.incoming.mu.Lock()
-		if s.endpointWithEvent.incoming.mu.asserted && s.endpoint.ep.Readiness(waiter.EventIn) == 0 {
+		if s.endpointWithEvent.incoming.mu.asserted && s.endpoint.loadEp().Readiness(waiter.EventIn) == 0 {
 			err = s.endpointWithEvent.local.SignalPeer(zxsocket.SignalIncoming, 0)
 			s.endpointWithEvent.incoming.mu.asserted = false
 		}
@@ -932,7 +1556,11 @@ func (s *datagramSocketImpl) RecvMsg(_ fidl.Context, addrLen, dataLen, controlLe
 	}
 	var addr []byte
 	if addrLen != 0 {
-		addr = encodeAddr(s.netProto, sender)
+		if s.linkLayer {
+			addr = encodeLinkAddr(s.netProto, sender)
+		} else {
+			addr = encodeAddr(s.netProto, sender)
+		}
 		if len(addr) > int(addrLen) {
 			addr = addr[:addrLen]
 		}
@@ -940,63 +1568,147 @@ func (s *datagramSocketImpl) RecvMsg(_ fidl.Context, addrLen, dataLen, controlLe
 	var truncated uint32
 	if t := len(v) - int(dataLen); t > 0 {
 		truncated = uint32(t)
+		if flags&C.MSG_TRUNC != 0 {
+			// With MSG_TRUNC Linux reports the full datagram length
+			// rather than the number of bytes dropped.
+			truncated = uint32(len(v))
+		}
 		v = v[:dataLen]
 	}
+	var control []byte
+	if controlLen != 0 {
+		// SO_TIMESTAMP and SO_TIMESTAMPNS are tracked here rather than in
+		// the endpoint, which reports a timestamp unconditionally.
+		s.endpoint.mu.Lock()
+		cmsgs.HasTimestamp = cmsgs.HasTimestamp && (s.endpoint.mu.sockOptTimestamp || s.endpoint.mu.sockOptTimestampNs)
+		timestampNs := s.endpoint.mu.sockOptTimestampNs
+		s.endpoint.mu.Unlock()
+		control = serializeControlMessages(cmsgs, timestampNs)
+		if len(control) > int(controlLen) {
+			control = control[:controlLen]
+		}
+	}
 	return socket.DatagramSocketRecvMsgResultWithResponse(socket.DatagramSocketRecvMsgResponse{
 		Addr:      addr,
 		Data:      v,
+		Control:   control,
 		Truncated: truncated,
 	}), nil
 }
 
-func (s *datagramSocketImpl) SendMsg(ctx fidl.Context, addr []uint8, data [][]uint8, control []uint8, flags int16) (socket.DatagramSocketSendMsgResult, error) {
-	dataLen := 0
-	for _, data := range data {
-		dataLen += len(data)
-	}
-	b := make([]byte, 0, dataLen)
-	for _, data := range data {
-		b = append(b, data...)
+// vectorPayload is a tcpip.Payloader over the segments of a scatter-gather
+// message. A single-segment message is passed through without copying;
+// a multi-segment message is flattened at most once, and only when the
+// endpoint asks for the payload, preserving single-datagram semantics.
+type vectorPayload struct {
+	data [][]uint8
+	flat []byte
+}
+
+var _ tcpip.Payloader = (*vectorPayload)(nil)
+
+func (v *vectorPayload) flatten() []byte {
+	if v.flat == nil {
+		switch len(v.data) {
+		case 0:
+			v.flat = make([]byte, 0)
+		case 1:
+			v.flat = v.data[0]
+		default:
+			size := 0
+			for _, d := range v.data {
+				size += len(d)
+			}
+			b := make([]byte, 0, size)
+			for _, d := range v.data {
+				b = append(b, d...)
+			}
+			v.flat = b
+		}
 	}
-	result, err := s.SendMsg2(ctx, addr, b, control, flags)
-	if err != nil {
-		return socket.DatagramSocketSendMsgResult{}, err
+	return v.flat
+}
+
+func (v *vectorPayload) FullPayload() ([]byte, *tcpip.Error) {
+	return v.flatten(), nil
+}
+
+func (v *vectorPayload) Payload(size int) ([]byte, *tcpip.Error) {
+	b := v.flatten()
+	if len(b) > size {
+		b = b[:size]
 	}
-	switch w := result.Which(); w {
-	case socket.DatagramSocketSendMsg2ResultResponse:
-		return socket.DatagramSocketSendMsgResultWithResponse(socket.DatagramSocketSendMsgResponse{
-			Len: result.Response.Len,
-		}), nil
-	case socket.DatagramSocketSendMsg2ResultErr:
-		return socket.DatagramSocketSendMsgResultWithErr(result.Err), nil
-	default:
-		panic(fmt.Sprintf("unexpected result type: %d", w))
+	return b, nil
+}
+
+func (s *datagramSocketImpl) SendMsg(_ fidl.Context, addr []uint8, data [][]uint8, control []uint8, flags int16) (socket.DatagramSocketSendMsgResult, error) {
+	n, code := s.sendPayload(addr, &vectorPayload{data: data}, flags)
+	if code != 0 {
+		return socket.DatagramSocketSendMsgResultWithErr(code), nil
 	}
+	return socket.DatagramSocketSendMsgResultWithResponse(socket.DatagramSocketSendMsgResponse{Len: n}), nil
 }
 
 func (s *datagramSocketImpl) SendMsg2(_ fidl.Context, addr []uint8, data []uint8, control []uint8, flags int16) (socket.DatagramSocketSendMsg2Result, error) {
+	n, code := s.sendPayload(addr, tcpip.SlicePayload(data), flags)
+	if code != 0 {
+		return socket.DatagramSocketSendMsg2ResultWithErr(code), nil
+	}
+	return socket.DatagramSocketSendMsg2ResultWithResponse(socket.DatagramSocketSendMsg2Response{Len: n}), nil
+}
+
+// sendPayload is the shared write path of SendMsg and SendMsg2. It returns
+// the number of bytes written and zero, or an errno.
+func (s *datagramSocketImpl) sendPayload(addr []uint8, p tcpip.Payloader, flags int16) (int64, int32) {
+	// Reject flag bits that are not understood rather than silently
+	// ignoring them.
+	if flags&^C.MSG_DONTWAIT != 0 {
+		return 0, C.EINVAL
+	}
 	var writeOpts tcpip.WriteOptions
 	if len(addr) != 0 {
 		addr, err := decodeAddr(addr)
 		if err != nil {
-			return socket.DatagramSocketSendMsg2ResultWithErr(tcpipErrorToCode(tcpip.ErrBadAddress)), nil
+			return 0, tcpipErrorToCode(tcpip.ErrBadAddress)
 		}
 		writeOpts.To = &addr
 	}
+	s.endpoint.mu.Lock()
+	sndTimeo := s.endpoint.mu.sockOptSndTimeo
+	s.endpoint.mu.Unlock()
+	var deadline <-chan time.Time
 	// TODO(https://fxbug.dev/21106): do something with control.
 	for {
-		n, resCh, err := s.ep.Write(tcpip.SlicePayload(data), writeOpts)
+		n, resCh, err := s.loadEp().Write(p, writeOpts)
 		if resCh != nil {
 			if err != tcpip.ErrNoLinkAddress {
 				panic(fmt.Sprintf("err=%v inconsistent with presence of resCh", err))
 			}
+			if flags&C.MSG_DONTWAIT != 0 {
+				// The write is blocked on link resolution;
+				// MSG_DONTWAIT turns that wait into EWOULDBLOCK for
+				// this single call.
+				return 0, C.EWOULDBLOCK
+			}
+			if sndTimeo != 0 {
+				// SO_SNDTIMEO bounds the wait for link resolution.
+				if deadline == nil {
+					deadline = time.After(sndTimeo)
+				}
+				select {
+				case <-resCh:
+					continue
+				case <-deadline:
+					return 0, C.EAGAIN
+				}
+			}
 			<-resCh
 			continue
 		}
 		if err != nil {
-			return socket.DatagramSocketSendMsg2ResultWithErr(tcpipErrorToCode(err)), nil
+			return 0, tcpipErrorToCode(err)
 		}
-		return socket.DatagramSocketSendMsg2ResultWithResponse(socket.DatagramSocketSendMsg2Response{Len: n}), nil
+		return n, 0
 	}
 }
 
@@ -1074,6 +1786,32 @@ func (s *streamSocketImpl) Describe(fidl.Context) (io.NodeInfo, error) {
 	return info, nil
 }
 
+// Shutdown closes one or both directions of a connected stream socket. Only
+// the zircon socket is driven here, from the peer end, exactly as if the
+// client had called zx_socket_shutdown on its handle: loopWrite drains any
+// data still buffered ahead of a SHUT_WR before propagating the shutdown to
+// the endpoint, and loopPoll propagates a SHUT_RD.
+func (s *streamSocketImpl) Shutdown(_ fidl.Context, how int16) (socket.StreamSocketShutdownResult, error) {
+	flags := zx.SocketShutdownRead | zx.SocketShutdownWrite
+	switch how {
+	case C.SHUT_RD:
+		flags = zx.SocketShutdownRead
+	case C.SHUT_WR:
+		flags = zx.SocketShutdownWrite
+	case C.SHUT_RDWR:
+	default:
+		return socket.StreamSocketShutdownResultWithErr(C.EINVAL), nil
+	}
+	if _, err := s.loadEp().GetRemoteAddress(); err != nil {
+		return socket.StreamSocketShutdownResultWithErr(tcpipErrorToCode(err)), nil
+	}
+	if err := s.peer.Shutdown(flags); err != nil {
+		return socket.StreamSocketShutdownResult{}, err
+	}
+	syslog.VLogTf(syslog.DebugVerbosity, "Shutdown", "%p: how=%d", s.endpointWithSocket, how)
+	return socket.StreamSocketShutdownResultWithResponse(socket.StreamSocketShutdownResponse{}), nil
+}
+
 func (s *streamSocketImpl) Accept(ctx fidl.Context, flags int16) (socket.StreamSocketAcceptResult, error) {
 	code, eps, err := s.endpointWithSocket.Accept(ctx)
 	if err != nil {
@@ -1105,6 +1843,9 @@ func (ns *Netstack) onAddEndpoint(handle zx.Handle, ep tcpip.Endpoint) {
 }
 
 func (ns *Netstack) onRemoveEndpoint(handle zx.Handle) {
+	if ep, ok := ns.endpoints.Load(handle); ok {
+		ns.multicastMemberships.removeEndpoint(ep)
+	}
 	ns.endpoints.Delete(handle)
 	ns.stats.SocketsDestroyed.Increment()
 }
@@ -1144,8 +1885,6 @@ func toNetProto(domain int16) (int32, tcpip.NetworkProtocolNumber) {
 		return 0, ipv4.ProtocolNumber
 	case C.AF_INET6:
 		return 0, ipv6.ProtocolNumber
-	case C.AF_PACKET:
-		return C.EPERM, 0
 	default:
 		return C.EPFNOSUPPORT, 0
 	}
@@ -1158,6 +1897,9 @@ func (cb callback) Callback(e *waiter.Entry) {
 }
 
 func (sp *providerImpl) Socket2(ctx fidl.Context, domain, typ, protocol int16) (socket.ProviderSocket2Result, error) {
+	if domain == C.AF_PACKET {
+		return sp.packetSocket(ctx, typ, protocol)
+	}
 	code, netProto := toNetProto(domain)
 	if code != 0 {
 		return socket.ProviderSocket2ResultWithErr(code), nil
@@ -1166,6 +1908,12 @@ func (sp *providerImpl) Socket2(ctx fidl.Context, domain, typ, protocol int16) (
 	if code != 0 {
 		return socket.ProviderSocket2ResultWithErr(code), nil
 	}
+	switch {
+	case transProto == icmp.ProtocolNumber4 && netProto != ipv4.ProtocolNumber,
+		transProto == icmp.ProtocolNumber6 && netProto != ipv6.ProtocolNumber:
+		// ICMP echo sockets are per-family; Linux rejects mismatches.
+		return socket.ProviderSocket2ResultWithErr(C.EPROTONOSUPPORT), nil
+	}
 	wq := new(waiter.Queue)
 	ep, err := sp.ns.stack.NewEndpoint(transProto, netProto, wq)
 	if err != nil {
@@ -1185,84 +1933,134 @@ func (sp *providerImpl) Socket2(ctx fidl.Context, domain, typ, protocol int16) (
 			S: socket.BaseSocketWithCtxInterface(streamSocketInterface),
 		}), nil
 	} else {
-		var localE, peerE zx.Handle
-		if status := zx.Sys_eventpair_create(0, &localE, &peerE); status != zx.ErrOk {
-			return socket.ProviderSocket2Result{}, &zx.Error{Status: status, Text: "zx.EventPair"}
-		}
-		localC, peerC, err := zx.NewChannel(0)
+		datagramSocketInterface, err := sp.newDatagramSocket(ctx, ep, wq, transProto, netProto, false)
 		if err != nil {
 			return socket.ProviderSocket2Result{}, err
 		}
-		s := &datagramSocketImpl{
-			endpointWithEvent: &endpointWithEvent{
-				endpoint: endpoint{
-					ep:         ep,
-					wq:         wq,
-					transProto: transProto,
-					netProto:   netProto,
-					ns:         sp.ns,
-				},
-				local: localE,
-				peer:  peerE,
+		return socket.ProviderSocket2ResultWithResponse(socket.ProviderSocket2Response{
+			S: socket.BaseSocketWithCtxInterface(datagramSocketInterface),
+		}), nil
+	}
+}
+
+// packetSocket creates an AF_PACKET socket delivering link-layer frames
+// through the datagram socket data plane. SOCK_RAW sockets see whole frames;
+// SOCK_DGRAM sockets see the payload with the link header stripped.
+func (sp *providerImpl) packetSocket(ctx fidl.Context, typ, protocol int16) (socket.ProviderSocket2Result, error) {
+	if !sp.ns.packetSocketsAllowed {
+		return socket.ProviderSocket2ResultWithErr(C.EPERM), nil
+	}
+	var cooked bool
+	switch typ & sockTypesMask {
+	case C.SOCK_RAW:
+	case C.SOCK_DGRAM:
+		cooked = true
+	default:
+		return socket.ProviderSocket2ResultWithErr(C.ESOCKTNOSUPPORT), nil
+	}
+	// The protocol is an ethertype in network byte order; ETH_P_ALL captures
+	// frames of every protocol.
+	netProto := tcpip.NetworkProtocolNumber(uint16(protocol)<<8 | uint16(protocol)>>8)
+	wq := new(waiter.Queue)
+	ep, err := sp.ns.stack.NewPacketEndpoint(cooked, netProto, wq)
+	if err != nil {
+		return socket.ProviderSocket2ResultWithErr(tcpipErrorToCode(err)), nil
+	}
+	datagramSocketInterface, err := sp.newDatagramSocket(ctx, ep, wq, 0, netProto, true)
+	if err != nil {
+		return socket.ProviderSocket2Result{}, err
+	}
+	return socket.ProviderSocket2ResultWithResponse(socket.ProviderSocket2Response{
+		S: socket.BaseSocketWithCtxInterface(datagramSocketInterface),
+	}), nil
+}
+
+// newDatagramSocket wires ep into the datagram socket data plane: an
+// eventpair for readiness signalling and a served DatagramSocket channel.
+func (sp *providerImpl) newDatagramSocket(ctx fidl.Context, ep tcpip.Endpoint, wq *waiter.Queue, transProto tcpip.TransportProtocolNumber, netProto tcpip.NetworkProtocolNumber, linkLayer bool) (socket.DatagramSocketWithCtxInterface, error) {
+	var localE, peerE zx.Handle
+	if status := zx.Sys_eventpair_create(0, &localE, &peerE); status != zx.ErrOk {
+		return socket.DatagramSocketWithCtxInterface{}, &zx.Error{Status: status, Text: "zx.EventPair"}
+	}
+	localC, peerC, err := zx.NewChannel(0)
+	if err != nil {
+		return socket.DatagramSocketWithCtxInterface{}, err
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: transProto,
+				netProto:   netProto,
+				ns:         sp.ns,
 			},
+			local:     localE,
+			peer:      peerE,
+			linkLayer: linkLayer,
+		},
+	}
+	s.storeEp(ep)
+
+	s.entry.Callback = callback(func(*waiter.Entry) {
+		var err error
+		s.endpointWithEvent.incoming.mu.Lock()
+		if !s.endpointWithEvent.incoming.mu.asserted && s.endpoint.loadEp().Readiness(waiter.EventIn) != 0 {
+			err = s.endpointWithEvent.local.SignalPeer(0, zxsocket.SignalIncoming)
+			s.endpointWithEvent.incoming.mu.asserted = true
 		}
+		s.endpointWithEvent.incoming.mu.Unlock()
+		if err != nil {
+			panic(err)
+		}
+	})
 
-		s.entry.Callback = callback(func(*waiter.Entry) {
-			var err error
-			s.endpointWithEvent.incoming.mu.Lock()
-			if !s.endpointWithEvent.incoming.mu.asserted && s.endpoint.ep.Readiness(waiter.EventIn) != 0 {
-				err = s.endpointWithEvent.local.SignalPeer(0, zxsocket.SignalIncoming)
-				s.endpointWithEvent.incoming.mu.asserted = true
-			}
-			s.endpointWithEvent.incoming.mu.Unlock()
-			if err != nil {
-				panic(err)
-			}
-		})
+	s.wq.EventRegister(&s.entry, waiter.EventIn)
 
-		s.wq.EventRegister(&s.entry, waiter.EventIn)
+	s.addConnection(ctx, io.NodeWithCtxInterfaceRequest{Channel: localC})
+	go func() {
+		s.wg.Wait()
 
-		s.addConnection(ctx, io.NodeWithCtxInterfaceRequest{Channel: localC})
-		go func() {
-			s.wg.Wait()
+		s.wq.EventUnregister(&s.entry)
 
-			s.wq.EventUnregister(&s.entry)
+		// Copy the handle before closing below; (*zx.Handle).Close sets the
+		// receiver to zx.HandleInvalid.
+		key := s.local
 
-			// Copy the handle before closing below; (*zx.Handle).Close sets the
-			// receiver to zx.HandleInvalid.
-			key := s.local
+		if err := s.local.Close(); err != nil {
+			panic(fmt.Sprintf("local.Close() = %s", err))
+		}
 
-			if err := s.local.Close(); err != nil {
-				panic(fmt.Sprintf("local.Close() = %s", err))
-			}
+		if err := s.peer.Close(); err != nil {
+			panic(fmt.Sprintf("peer.Close() = %s", err))
+		}
 
-			if err := s.peer.Close(); err != nil {
-				panic(fmt.Sprintf("peer.Close() = %s", err))
-			}
+		s.ns.onRemoveEndpoint(key)
 
-			s.ns.onRemoveEndpoint(key)
+		s.ns.rebindable.remove(s.endpointWithEvent)
 
-			s.ep.Close()
+		if id := s.reuseport.id; id != 0 {
+			s.ns.reuseportGroups.remove(s.reuseport.key, id)
+		}
 
-			syslog.VLogTf(syslog.DebugVerbosity, "close", "%p", s.endpointWithEvent)
-		}()
-		syslog.VLogTf(syslog.DebugVerbosity, "NewDatagram", "%p", s.endpointWithEvent)
-		datagramSocketInterface := socket.DatagramSocketWithCtxInterface{Channel: peerC}
+		s.loadEp().Close()
 
-		sp.ns.onAddEndpoint(localE, ep)
+		syslog.VLogTf(syslog.DebugVerbosity, "close", "%p", s.endpointWithEvent)
+	}()
+	syslog.VLogTf(syslog.DebugVerbosity, "NewDatagram", "%p", s.endpointWithEvent)
 
-		if err := s.endpointWithEvent.local.SignalPeer(0, zxsocket.SignalOutgoing); err != nil {
-			panic(fmt.Sprintf("local.SignalPeer(0, zxsocket.SignalOutgoing) = %s", err))
-		}
+	sp.ns.onAddEndpoint(localE, ep)
 
-		return socket.ProviderSocket2ResultWithResponse(socket.ProviderSocket2Response{
-			S: socket.BaseSocketWithCtxInterface(datagramSocketInterface),
-		}), nil
+	sp.ns.rebindable.add(s.endpointWithEvent)
+
+	if err := s.endpointWithEvent.local.SignalPeer(0, zxsocket.SignalOutgoing); err != nil {
+		panic(fmt.Sprintf("local.SignalPeer(0, zxsocket.SignalOutgoing) = %s", err))
 	}
+
+	return socket.DatagramSocketWithCtxInterface{Channel: peerC}, nil
 }
 
 func (sp *providerImpl) InterfaceIndexToName(_ fidl.Context, index uint64) (socket.ProviderInterfaceIndexToNameResult, error) {
-	if info, ok := sp.ns.stack.NICInfo()[tcpip.NICID(index)]; ok {
+	if info, ok := sp.ns.NICInfo()[tcpip.NICID(index)]; ok {
 		return socket.ProviderInterfaceIndexToNameResultWithResponse(socket.ProviderInterfaceIndexToNameResponse{
 			Name: info.Name,
 		}), nil
@@ -1271,7 +2069,7 @@ func (sp *providerImpl) InterfaceIndexToName(_ fidl.Context, index uint64) (sock
 }
 
 func (sp *providerImpl) InterfaceNameToIndex(_ fidl.Context, name string) (socket.ProviderInterfaceNameToIndexResult, error) {
-	for id, info := range sp.ns.stack.NICInfo() {
+	for id, info := range sp.ns.NICInfo() {
 		if info.Name == name {
 			return socket.ProviderInterfaceNameToIndexResultWithResponse(socket.ProviderInterfaceNameToIndexResponse{
 				Index: uint64(id),
@@ -1282,7 +2080,7 @@ func (sp *providerImpl) InterfaceNameToIndex(_ fidl.Context, name string) (socke
 }
 
 func (sp *providerImpl) GetInterfaceAddresses(fidl.Context) ([]socket.InterfaceAddresses, error) {
-	nicInfos := sp.ns.stack.NICInfo()
+	nicInfos := sp.ns.NICInfo()
 
 	resultInfos := make([]socket.InterfaceAddresses, 0, len(nicInfos))
 	for id, info := range nicInfos {
@@ -1346,6 +2144,98 @@ func (sp *providerImpl) GetInterfaceAddresses(fidl.Context) ([]socket.InterfaceA
 	return resultInfos, nil
 }
 
+// endpointInfo is a diagnostic summary of one live endpoint as reported by
+// EndpointInfos.
+type endpointInfo struct {
+	handle     zx.Handle
+	netProto   tcpip.NetworkProtocolNumber
+	transProto tcpip.TransportProtocolNumber
+	state      string
+	local      tcpip.FullAddress
+	remote     tcpip.FullAddress
+}
+
+// EndpointInfos enumerates the live endpoints with their connection tuples
+// and states, so that netstat-like diagnostics can list sockets without
+// scraping logs. It is not part of the fuchsia.posix.socket protocol.
+//
+// Entries are sorted by data-plane handle to ensure a deterministic result.
+func (sp *providerImpl) EndpointInfos() []endpointInfo {
+	var infos []endpointInfo
+	sp.ns.endpoints.Range(func(handle zx.Handle, ep tcpip.Endpoint) bool {
+		var common stack.TransportEndpointInfo
+		switch t := ep.Info().(type) {
+		case *tcp.EndpointInfo:
+			common = t.TransportEndpointInfo
+		case *stack.TransportEndpointInfo:
+			common = *t
+		default:
+			return true
+		}
+		var state string
+		switch common.TransProto {
+		case header.TCPProtocolNumber:
+			state = tcp.EndpointState(ep.State()).String()
+		case header.UDPProtocolNumber:
+			state = udp.EndpointState(ep.State()).String()
+		}
+		infos = append(infos, endpointInfo{
+			handle:     handle,
+			netProto:   common.NetProto,
+			transProto: common.TransProto,
+			state:      state,
+			local: tcpip.FullAddress{
+				Addr: common.ID.LocalAddress,
+				Port: common.ID.LocalPort,
+			},
+			remote: tcpip.FullAddress{
+				Addr: common.ID.RemoteAddress,
+				Port: common.ID.RemotePort,
+			},
+		})
+		return true
+	})
+	// Ensure a deterministic response.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].handle < infos[j].handle
+	})
+	return infos
+}
+
+func (sp *providerImpl) SelectSourceAddress(_ fidl.Context, dst fidlnet.IpAddress) (socket.ProviderSelectSourceAddressResult, error) {
+	var netProto tcpip.NetworkProtocolNumber
+	switch dst.Which() {
+	case fidlnet.IpAddressIpv4:
+		netProto = ipv4.ProtocolNumber
+	case fidlnet.IpAddressIpv6:
+		netProto = ipv6.ProtocolNumber
+	default:
+		return socket.ProviderSelectSourceAddressResultWithErr(C.EINVAL), nil
+	}
+	addr := fidlconv.ToTCPIPAddress(dst)
+
+	route, err := sp.ns.stack.FindRoute(0, "", addr, netProto, false /* multicastLoop */)
+	if err != nil {
+		// FindRoute fails both when the table has no matching route and when
+		// the matched route's interface has no usable source address;
+		// distinguish the two for the caller.
+		for _, rt := range sp.ns.stack.GetRouteTable() {
+			if rt.Destination.Contains(addr) {
+				return socket.ProviderSelectSourceAddressResultWithErr(C.EADDRNOTAVAIL), nil
+			}
+		}
+		return socket.ProviderSelectSourceAddressResultWithErr(C.EHOSTUNREACH), nil
+	}
+	defer route.Release()
+	if len(route.LocalAddress) == 0 {
+		return socket.ProviderSelectSourceAddressResultWithErr(C.EADDRNOTAVAIL), nil
+	}
+	return socket.ProviderSelectSourceAddressResultWithResponse(socket.ProviderSelectSourceAddressResponse{
+		Source: fidlconv.ToNetIpAddress(route.LocalAddress),
+		Index:  uint64(route.NICID()),
+	}), nil
+}
+
 func tcpipErrorToCode(err *tcpip.Error) int32 {
 	if err != tcpip.ErrConnectStarted {
 		if pc, file, line, ok := runtime.Caller(1); ok {
@@ -23,6 +23,15 @@ type Controller interface {
 	SetPromiscuousMode(bool) error
 }
 
+// TxQueueSteering is implemented by links that can steer outbound packets
+// between multiple transmit queues. Links that do not implement it have a
+// single transmit queue and ignore per-socket queue hints.
+type TxQueueSteering interface {
+	// NumTxQueues returns the number of transmit queues packets may be
+	// steered between.
+	NumTxQueues() uint32
+}
+
 func NewLoopbackController() Controller {
 	return &loopbackController{}
 }
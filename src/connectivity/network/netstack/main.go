@@ -48,6 +48,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
@@ -161,10 +162,12 @@ func Main() {
 	logLevel := syslog.InfoLevel
 
 	var syslogOutput bool
+	var packetSockets bool
 	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	flags.Var((*atomicBool)(&sniffer.LogPackets), "log-packets", "Enable packet logging")
 	flags.Var(&logLevel, "verbosity", "Set the logging verbosity")
 	flags.BoolVar(&syslogOutput, "syslog", false, "Write logs to syslog instead of stderr")
+	flags.BoolVar(&packetSockets, "packet-sockets", false, "Allow clients to open AF_PACKET sockets for link-layer capture")
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		panic(err)
 	}
@@ -205,6 +208,23 @@ func Main() {
 
 	ndpDisp := newNDPDispatcher()
 
+	ndpConfigs := tcpipstack.NDPConfigurations{
+		DupAddrDetectTransmits:        dadTransmits,
+		RetransmitTimer:               dadRetransmitTimer,
+		MaxRtrSolicitations:           maxRtrSolicitations,
+		RtrSolicitationInterval:       rtrSolicitationInterval,
+		MaxRtrSolicitationDelay:       maxRtrSolicitationDelay,
+		HandleRAs:                     true,
+		DiscoverDefaultRouters:        true,
+		DiscoverOnLinkPrefixes:        true,
+		AutoGenGlobalAddresses:        true,
+		AutoGenAddressConflictRetries: autoGenAddressConflictRetries,
+		AutoGenTempGlobalAddresses:    true,
+		MaxTempAddrValidLifetime:      maxTempAddrValidLifetime,
+		MaxTempAddrPreferredLifetime:  maxTempAddrPreferredLifetime,
+		RegenAdvanceDuration:          regenAdvanceDuration,
+	}
+
 	stk := tcpipstack.New(tcpipstack.Options{
 		NetworkProtocols: []tcpipstack.NetworkProtocol{
 			arp.NewProtocol(),
@@ -219,28 +239,15 @@ func Main() {
 		},
 		HandleLocal: true,
 
-		NDPConfigs: tcpipstack.NDPConfigurations{
-			DupAddrDetectTransmits:        dadTransmits,
-			RetransmitTimer:               dadRetransmitTimer,
-			MaxRtrSolicitations:           maxRtrSolicitations,
-			RtrSolicitationInterval:       rtrSolicitationInterval,
-			MaxRtrSolicitationDelay:       maxRtrSolicitationDelay,
-			HandleRAs:                     true,
-			DiscoverDefaultRouters:        true,
-			DiscoverOnLinkPrefixes:        true,
-			AutoGenGlobalAddresses:        true,
-			AutoGenAddressConflictRetries: autoGenAddressConflictRetries,
-			AutoGenTempGlobalAddresses:    true,
-			MaxTempAddrValidLifetime:      maxTempAddrValidLifetime,
-			MaxTempAddrPreferredLifetime:  maxTempAddrPreferredLifetime,
-			RegenAdvanceDuration:          regenAdvanceDuration,
-		},
-		NDPDisp: ndpDisp,
+		NDPConfigs: ndpConfigs,
+		NDPDisp:    ndpDisp,
 
-		// Raw sockets are typically used for implementing custom protocols. We intend
-		// to support custom protocols through structured FIDL APIs in the future, so
-		// disable raw sockets to prevent them from accidentally becoming load-bearing.
-		RawFactory: nil,
+		// Raw IP sockets are typically used for implementing custom protocols. We
+		// intend to support custom protocols through structured FIDL APIs in the
+		// future, so they are not exposed to clients. The factory is still
+		// registered because AF_PACKET capture sockets are created through it;
+		// those are gated separately on packetSocketsAllowed.
+		RawFactory: raw.EndpointFactory{},
 		OpaqueIIDOpts: tcpipstack.OpaqueInterfaceIdentifierOptions{
 			NICNameFromID: func(nicID tcpip.NICID, nicName string) string {
 				// As of writing, Netstack creates NICs with names so we return the name
@@ -272,6 +279,15 @@ func Main() {
 		dnsClient:    dns.NewClient(stk),
 		nameProvider: np,
 		stack:        stk,
+		ndpConfigs:   ndpConfigs,
+		// The netstack's direct clients are trusted platform components; allow
+		// them to mark sockets until per-client capabilities are available.
+		socketMarksAllowed: true,
+		// Packet sockets expose raw link-layer traffic, so they stay off
+		// unless the product configuration opts in through the command line
+		// (standing in for CAP_NET_RAW until per-client capabilities are
+		// available).
+		packetSocketsAllowed: packetSockets,
 	}
 
 	ns.netstackService.mu.proxies = make(map[*netstack.NetstackEventProxy]struct{})
@@ -290,6 +306,8 @@ func Main() {
 	dnsWatchers := newDnsServerWatcherCollection(ns.dnsClient)
 	ns.dnsClient.SetOnServersChanged(dnsWatchers.NotifyServersChanged)
 
+	ns.interfaceWatchers = newInterfaceWatcherCollection(ns)
+
 	socketProviderImpl := providerImpl{ns: ns}
 	ns.stats = stats{
 		Stats: stk.Stats(),
@@ -299,6 +317,8 @@ func Main() {
 		cobaltClient.Register(&statsObserver)
 	})
 	go statsObserver.run(context.Background(), time.Minute, &ns.stats, ns.stack)
+	ns.rateSampler = newInterfaceRateSampler(stk, defaultRateSampleInterval, defaultRateSampleWindow)
+	go ns.rateSampler.run(context.Background())
 	appCtx.OutgoingService.AddDiagnostics("counters", &component.DirectoryWrapper{
 		Directory: &inspectDirectory{
 			asService: (&inspectImpl{
@@ -0,0 +1,82 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// multicastMembership identifies a multicast group joined on a NIC.
+type multicastMembership struct {
+	nicID tcpip.NICID
+	group tcpip.Address
+}
+
+// multicastMembershipMap mirrors the multicast groups joined by each endpoint
+// as membership socket options pass through SetSockOpt. The stack performs
+// its own membership tracking but does not expose it, so the netstack keeps
+// this view for diagnostics.
+//
+// Memberships joined without an explicit NIC are recorded against NIC 0; the
+// stack resolves such joins to a NIC internally.
+type multicastMembershipMap struct {
+	mu struct {
+		sync.Mutex
+		endpoints map[tcpip.Endpoint]map[multicastMembership]struct{}
+	}
+}
+
+func (m *multicastMembershipMap) add(ep tcpip.Endpoint, membership multicastMembership) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mu.endpoints == nil {
+		m.mu.endpoints = make(map[tcpip.Endpoint]map[multicastMembership]struct{})
+	}
+	memberships, ok := m.mu.endpoints[ep]
+	if !ok {
+		memberships = make(map[multicastMembership]struct{})
+		m.mu.endpoints[ep] = memberships
+	}
+	memberships[membership] = struct{}{}
+}
+
+func (m *multicastMembershipMap) remove(ep tcpip.Endpoint, membership multicastMembership) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	memberships, ok := m.mu.endpoints[ep]
+	if !ok {
+		return
+	}
+	delete(memberships, membership)
+	if len(memberships) == 0 {
+		delete(m.mu.endpoints, ep)
+	}
+}
+
+// removeEndpoint drops all memberships recorded for ep; the stack leaves the
+// groups itself when the endpoint is closed.
+func (m *multicastMembershipMap) removeEndpoint(ep tcpip.Endpoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mu.endpoints, ep)
+}
+
+// nicMemberships returns the number of endpoints joined to each multicast
+// group on the given NIC.
+func (m *multicastMembershipMap) nicMemberships(nicid tcpip.NICID) map[tcpip.Address]uint32 {
+	counts := make(map[tcpip.Address]uint32)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, memberships := range m.mu.endpoints {
+		for membership := range memberships {
+			if membership.nicID == nicid {
+				counts[membership.group]++
+			}
+		}
+	}
+	return counts
+}
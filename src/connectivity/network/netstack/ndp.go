@@ -161,6 +161,12 @@ type ndpDispatcher struct {
 // stack.NDPDispatcher.OnDuplicateAddressDetectionStatus.
 func (n *ndpDispatcher) OnDuplicateAddressDetectionStatus(nicID tcpip.NICID, addr tcpip.Address, resolved bool, err *tcpip.Error) {
 	syslog.Infof("ndp: OnDuplicateAddressDetectionStatus(%d, %s, %t, %v)", nicID, addr, resolved, err)
+	if resolved {
+		n.ns.addressStates.set(nicID, addr, addressStateAssigned)
+	} else {
+		// The address failed DAD and has been removed from the NIC.
+		n.ns.addressStates.remove(nicID, addr)
+	}
 	n.addEvent(&ndpDuplicateAddressDetectionEvent{
 		ndpRouterAndDADEventCommon: ndpRouterAndDADEventCommon{
 			nicID: nicID,
@@ -209,21 +215,27 @@ func (n *ndpDispatcher) OnOnLinkPrefixInvalidated(nicID tcpip.NICID, prefix tcpi
 // auto-generated address.
 func (n *ndpDispatcher) OnAutoGenAddress(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWithPrefix) bool {
 	syslog.Infof("ndp: OnAutoGenAddress(%d, %s)", nicID, addrWithPrefix)
+	// Auto-generated addresses start out tentative; the DAD result is
+	// reported through OnDuplicateAddressDetectionStatus.
+	n.ns.addressStates.set(nicID, addrWithPrefix.Address, addressStateTentative)
 	n.addEvent(&ndpGeneratedAutoGenAddrEvent{ndpAutoGenAddrEventCommon: ndpAutoGenAddrEventCommon{nicID: nicID, addrWithPrefix: addrWithPrefix}})
 	return true
 }
 
 // OnAutoGenAddressDeprecated implements
 // stack.NDPDispatcher.OnAutoGenAddressDeprecated.
-func (*ndpDispatcher) OnAutoGenAddressDeprecated(tcpip.NICID, tcpip.AddressWithPrefix) {
-	// No need to do anything with this as deprecated addresses are still usable.
-	// stack.Stack will handle not returning deprecated addresses if more
-	// preferred addresses exist.
+func (n *ndpDispatcher) OnAutoGenAddressDeprecated(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWithPrefix) {
+	syslog.Infof("ndp: OnAutoGenAddressDeprecated(%d, %s)", nicID, addrWithPrefix)
+	// Deprecated addresses are still usable and stack.Stack will handle not
+	// returning them if more preferred addresses exist, so there is no event
+	// to handle; only the recorded address state changes.
+	n.ns.addressStates.set(nicID, addrWithPrefix.Address, addressStateDeprecated)
 }
 
 // OnAutoGenAddressInvalidated implements stack.NDPDispatcher.OnAutoGenAddressInvalidated.
 func (n *ndpDispatcher) OnAutoGenAddressInvalidated(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWithPrefix) {
 	syslog.Infof("ndp: OnAutoGenAddressInvalidated(%d, %s)", nicID, addrWithPrefix)
+	n.ns.addressStates.set(nicID, addrWithPrefix.Address, addressStateInvalid)
 	n.addEvent(&ndpInvalidatedAutoGenAddrEvent{ndpAutoGenAddrEventCommon: ndpAutoGenAddrEventCommon{nicID: nicID, addrWithPrefix: addrWithPrefix}})
 }
 
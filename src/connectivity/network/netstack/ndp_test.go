@@ -13,10 +13,12 @@ import (
 	"testing"
 	"time"
 
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/fidlconv"
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/util"
 
 	"fidl/fuchsia/cobalt"
 	"fidl/fuchsia/hardware/ethernet"
+	"fidl/fuchsia/net/stack"
 	"fidl/fuchsia/netstack"
 
 	networking_metrics "networking_metrics_golib"
@@ -176,6 +178,62 @@ func TestSendingOnInterfacesChangedEvent(t *testing.T) {
 	}
 }
 
+// Test that an address added while Duplicate Address Detection is enabled is
+// reported tentative until DAD resolves, after which it is reported assigned.
+func TestInterfaceAddressStateDAD(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ndpDisp := newNDPDispatcherForTest()
+	ns := newNetstackWithNDPDispatcher(t, ndpDisp)
+	ndpDisp.start(ctx)
+
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth("/path1", netstack.InterfaceConfig{Name: "name1"}, &eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test stack is created without NDP configurations so addresses would
+	// otherwise complete DAD (and become assigned) as soon as they are added.
+	if err := ns.stack.SetNDPConfigurations(ifs.nicid, tcpipstack.NDPConfigurations{
+		DupAddrDetectTransmits: dadTransmits,
+		RetransmitTimer:        dadRetransmitTimer,
+	}); err != nil {
+		t.Fatalf("SetNDPConfigurations(%d, _): %s", ifs.nicid, err)
+	}
+	if err := ifs.controller.Up(); err != nil {
+		t.Fatalf("ifs.controller.Up(): %s", err)
+	}
+
+	addr := fidlconv.ToNetIpAddress(testProtocolAddr1.AddressWithPrefix.Address)
+	if result := ns.getInterfaceAddressState(uint64(ifs.nicid), addr); result.Which() != stack.StackGetInterfaceAddressStateResultErr || result.Err != stack.ErrorNotFound {
+		t.Fatalf("got ns.getInterfaceAddressState(%d, %s) = %#v, want = %s", ifs.nicid, testProtocolAddr1.AddressWithPrefix.Address, result, stack.ErrorNotFound)
+	}
+
+	if found, err := ns.addInterfaceAddress(ifs.nicid, testProtocolAddr1); err != nil {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s): %s", ifs.nicid, testProtocolAddr1.AddressWithPrefix, err)
+	} else if !found {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s): NIC not found", ifs.nicid, testProtocolAddr1.AddressWithPrefix)
+	}
+
+	if result := ns.getInterfaceAddressState(uint64(ifs.nicid), addr); result.Which() != stack.StackGetInterfaceAddressStateResultResponse || result.Response.State != stack.AddressStateTentative {
+		t.Fatalf("got ns.getInterfaceAddressState(%d, %s) = %#v, want = %s", ifs.nicid, testProtocolAddr1.AddressWithPrefix.Address, result, stack.AddressStateTentative)
+	}
+
+	timeout := time.After(dadResolutionTimeout)
+	for {
+		result := ns.getInterfaceAddressState(uint64(ifs.nicid), addr)
+		if result.Which() == stack.StackGetInterfaceAddressStateResultResponse && result.Response.State == stack.AddressStateAssigned {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s to become assigned; last result = %#v", testProtocolAddr1.AddressWithPrefix.Address, result)
+		case <-time.After(incrementalTimeout):
+		}
+	}
+}
+
 // Test that attempting to invalidate a default router which we do not have a
 // route for is not an issue.
 func TestNDPInvalidateUnknownIPv6Router(t *testing.T) {
@@ -475,6 +533,49 @@ func TestNDPIPv6PrefixDiscovery(t *testing.T) {
 	}
 }
 
+// Test enabling and disabling the generation of IPv6 temporary (privacy
+// extension) SLAAC addresses on a NIC.
+func TestIPv6TemporaryAddressConfiguration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ndpDisp := newNDPDispatcherForTest()
+	ns := newNetstackWithNDPDispatcher(t, ndpDisp)
+	ndpDisp.start(ctx)
+
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth("/path1", netstack.InterfaceConfig{Name: "name1"}, &eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ifs.controller.Up(); err != nil {
+		t.Fatalf("ifs.controller.Up(): %s", err)
+	}
+
+	if err := ns.setIPv6TemporaryAddresses(ifs.nicid, true, maxTempAddrValidLifetime, maxTempAddrPreferredLifetime); err != nil {
+		t.Fatalf("ns.setIPv6TemporaryAddresses(%d, true, _, _): %s", ifs.nicid, err)
+	}
+
+	// The stack generates temporary addresses in response to Router
+	// Advertisements and notifies us of each generated address through the NDP
+	// dispatcher; generated addresses must be accepted so that the stack
+	// assigns them to the NIC and prefers them as a source for new
+	// connections.
+	if accept := ndpDisp.OnAutoGenAddress(ifs.nicid, testProtocolAddr1.AddressWithPrefix); !accept {
+		t.Fatalf("got OnAutoGenAddress(%d, %s) = false, want = true", ifs.nicid, testProtocolAddr1.AddressWithPrefix)
+	}
+	waitForEmptyQueue(ndpDisp)
+
+	if err := ns.setIPv6TemporaryAddresses(ifs.nicid, false, 0, 0); err != nil {
+		t.Fatalf("ns.setIPv6TemporaryAddresses(%d, false, _, _): %s", ifs.nicid, err)
+	}
+
+	// Configuring a NIC that does not exist should fail.
+	if err := ns.setIPv6TemporaryAddresses(ifs.nicid+1, true, maxTempAddrValidLifetime, maxTempAddrPreferredLifetime); err == nil {
+		t.Fatalf("got ns.setIPv6TemporaryAddresses(%d, true, _, _) = nil, want non-nil error", ifs.nicid+1)
+	}
+}
+
 // TestLinkDown tests that Recursive DNS Servers learned from NDP are
 // invalidated when a NIC is brought down.
 func TestLinkDown(t *testing.T) {
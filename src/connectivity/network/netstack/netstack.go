@@ -39,6 +39,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
 const (
@@ -319,10 +320,19 @@ type Netstack struct {
 	stack      *stack.Stack
 	routeTable routes.RouteTable
 
+	// ndpConfigs is the stack-wide default NDP configuration. Per-NIC
+	// overrides are derived from it so that settings unrelated to the
+	// override keep their defaults.
+	ndpConfigs stack.NDPConfigurations
+
 	mu struct {
 		sync.Mutex
 		transactionRequest *netstack.RouteTableTransactionWithCtxInterfaceRequest
 		countNIC           tcpip.NICID
+		// nicNames holds names assigned to NICs after creation. The stack
+		// does not support renaming a NIC, so renames are overlaid here and
+		// merged into the stack's view by NICInfo and name.
+		nicNames map[tcpip.NICID]string
 	}
 
 	stats stats
@@ -330,6 +340,61 @@ type Netstack struct {
 	filter *filter.Filter
 
 	endpoints endpointsMap
+
+	// multicastMemberships tracks the multicast groups joined through socket
+	// options so that they can be enumerated per NIC.
+	multicastMemberships multicastMembershipMap
+
+	// addressStates tracks the lifecycle state of the addresses assigned to
+	// each NIC, driven by the NDP dispatcher's callbacks.
+	addressStates addressStateMap
+
+	// tcpConnLimits caps the number of TCP connections carried by the stack;
+	// see tcpConnectionLimits.
+	tcpConnLimits tcpConnectionLimits
+
+	// tcpDelayedACK holds the delayed-ACK timeout applied to TCP connections
+	// created after it is set; see setTCPDelayedACKTimeout.
+	tcpDelayedACK struct {
+		mu struct {
+			sync.Mutex
+			timeout time.Duration
+		}
+	}
+
+	// reuseportGroups tracks datagram sockets sharing a local address via
+	// SO_REUSEPORT; see reuseportGroupMap.
+	reuseportGroups reuseportGroupMap
+
+	// rebindable tracks the datagram sockets that can be migrated to a new
+	// local address when the one they are bound to is replaced; see rebind.go.
+	rebindable rebindableEndpoints
+
+	// rateSampler computes per-NIC traffic rates over a sliding window; see
+	// interfaceRateSampler.
+	rateSampler *interfaceRateSampler
+
+	// directedBroadcast tracks per-NIC acceptance of IPv4 directed
+	// broadcasts; see broadcast.go.
+	directedBroadcast directedBroadcastState
+
+	// socketMarksAllowed controls whether clients may set SO_MARK on their
+	// sockets. Linux gates the option on CAP_NET_ADMIN; until per-client
+	// capabilities are plumbed through the socket provider this is a
+	// stack-wide policy decision.
+	socketMarksAllowed bool
+
+	// packetSocketsAllowed controls whether clients may open AF_PACKET
+	// sockets for link-layer capture. Linux gates packet sockets on
+	// CAP_NET_RAW; until per-client capabilities are plumbed through the
+	// socket provider this is a stack-wide policy decision, and the
+	// default is to refuse them with EPERM.
+	packetSocketsAllowed bool
+
+	// interfaceWatchers notifies fuchsia.net.stack.InterfaceWatchers of
+	// interface additions, removals and status changes; nil when the stack
+	// service is not served.
+	interfaceWatchers *interfaceWatcherCollection
 }
 
 // Each ifState tracks the state of a network interface.
@@ -368,6 +433,35 @@ type ifState struct {
 	bridgeable *bridge.BridgeableEndpoint
 
 	filterEndpoint *filter.Endpoint
+
+	// mtuEndpoint reports the interface's MTU and allows it to be lowered
+	// at runtime; see (*Netstack).setInterfaceMtu.
+	mtuEndpoint *mtuOverridingEndpoint
+}
+
+// mtuOverridingEndpoint wraps a link endpoint, substituting an
+// operator-configured MTU for the hardware one.
+type mtuOverridingEndpoint struct {
+	stack.LinkEndpoint
+
+	// mtu is accessed atomically; 0 means the hardware MTU is in effect.
+	mtu uint32
+}
+
+func (e *mtuOverridingEndpoint) MTU() uint32 {
+	if mtu := atomic.LoadUint32(&e.mtu); mtu != 0 {
+		return mtu
+	}
+	return e.LinkEndpoint.MTU()
+}
+
+// hardwareMTU returns the wrapped endpoint's MTU, ignoring any override.
+func (e *mtuOverridingEndpoint) hardwareMTU() uint32 {
+	return e.LinkEndpoint.MTU()
+}
+
+func (e *mtuOverridingEndpoint) setMTU(mtu uint32) {
+	atomic.StoreUint32(&e.mtu, mtu)
 }
 
 // defaultV4Route returns a default IPv4 route through gateway on the specified
@@ -415,14 +509,70 @@ func addressWithPrefixRoute(nicid tcpip.NICID, addr tcpip.AddressWithPrefix) tcp
 }
 
 func (ns *Netstack) name(nicid tcpip.NICID) string {
-	name := ns.stack.FindNICNameFromID(nicid)
+	ns.mu.Lock()
+	name, ok := ns.mu.nicNames[nicid]
+	ns.mu.Unlock()
+	if ok {
+		return name
+	}
+	name = ns.stack.FindNICNameFromID(nicid)
 	if len(name) == 0 {
 		name = fmt.Sprintf("unknown NIC(id=%d)", nicid)
 	}
 	return name
 }
 
+// Bounds accepted by setTCPDelayedACKTimeout. The lower bound keeps the
+// delayed-ACK timer meaningful; the upper bound matches the largest delay
+// Linux permits, beyond which peers may spuriously retransmit.
+const (
+	minTCPDelayedACKTimeout = 1 * time.Millisecond
+	maxTCPDelayedACKTimeout = 500 * time.Millisecond
+)
+
+// setTCPDelayedACKTimeout sets the delayed-ACK timeout for TCP connections
+// created after the call; established connections keep the timeout they were
+// created with.
+func (ns *Netstack) setTCPDelayedACKTimeout(timeout time.Duration) error {
+	if timeout < minTCPDelayedACKTimeout || timeout > maxTCPDelayedACKTimeout {
+		return fmt.Errorf("delayed-ACK timeout %s is outside [%s, %s]", timeout, minTCPDelayedACKTimeout, maxTCPDelayedACKTimeout)
+	}
+	if err := ns.stack.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.DelayedACKTimeout(timeout)); err != nil {
+		return fmt.Errorf("SetTransportProtocolOption(%d, tcp.DelayedACKTimeout(%s)): %s", tcp.ProtocolNumber, timeout, err)
+	}
+	ns.tcpDelayedACK.mu.Lock()
+	ns.tcpDelayedACK.mu.timeout = timeout
+	ns.tcpDelayedACK.mu.Unlock()
+	return nil
+}
+
+// tcpDelayedACKTimeout returns the timeout set with setTCPDelayedACKTimeout,
+// or 0 if the stack's default has not been overridden.
+func (ns *Netstack) tcpDelayedACKTimeout() time.Duration {
+	ns.tcpDelayedACK.mu.Lock()
+	defer ns.tcpDelayedACK.mu.Unlock()
+	return ns.tcpDelayedACK.mu.timeout
+}
+
+// NICInfo returns the stack's per-NIC information with any renames applied,
+// so that name-based lookups observe the current names.
+func (ns *Netstack) NICInfo() map[tcpip.NICID]stack.NICInfo {
+	nicInfos := ns.stack.NICInfo()
+	ns.mu.Lock()
+	for nicid, name := range ns.mu.nicNames {
+		if nicInfo, ok := nicInfos[nicid]; ok {
+			nicInfo.Name = name
+			nicInfos[nicid] = nicInfo
+		}
+	}
+	ns.mu.Unlock()
+	return nicInfos
+}
+
 func (ns *Netstack) onInterfacesChanged() {
+	if c := ns.interfaceWatchers; c != nil {
+		c.NotifyInterfacesChanged()
+	}
 	interfaces2 := ns.getNetInterfaces2()
 	connectivity.InferAndNotify(interfaces2)
 	// TODO(NET-2078): Switch to the new NetInterface struct once Chromium stops
@@ -493,6 +643,128 @@ func (ns *Netstack) DelRoute(r tcpip.Route) error {
 	return nil
 }
 
+// UpdateRouteMetric changes the metric of an existing route in place, so that
+// re-prioritizing a route does not require deleting and re-adding it with the
+// connectivity gap that entails. A metric of metricNotSet makes the route
+// track its interface's metric.
+func (ns *Netstack) UpdateRouteMetric(r tcpip.Route, metric routes.Metric) error {
+	syslog.Infof("updating route %s metric=%d", r, metric)
+
+	metricTracksInterface := false
+	if metric == metricNotSet {
+		metricTracksInterface = true
+
+		// The interface metric can only be read off a specific NIC; find it
+		// using the gateway address when the route doesn't name one.
+		if r.NIC == 0 {
+			nic, err := ns.routeTable.FindNIC(r.Gateway)
+			if err != nil {
+				return fmt.Errorf("error finding NIC for gateway %s: %w", r.Gateway, err)
+			}
+			r.NIC = nic
+		}
+
+		nicInfo, ok := ns.stack.NICInfo()[r.NIC]
+		if !ok {
+			return fmt.Errorf("error getting nicInfo for NIC %d, not in map", r.NIC)
+		}
+
+		ifs := nicInfo.Context.(*ifState)
+
+		ifs.mu.Lock()
+		metric = ifs.mu.metric
+		ifs.mu.Unlock()
+	}
+
+	if err := ns.routeTable.UpdateRouteMetric(r, metric, metricTracksInterface); err != nil {
+		return err
+	}
+
+	ns.stack.SetRouteTable(ns.routeTable.GetNetstackTable())
+	return nil
+}
+
+// ReplaceRoutes atomically replaces the static routes for the given
+// interface (or for all interfaces when nicid is 0) with the desired set.
+// New routes are installed before superseded ones are removed so that no
+// destination transiently loses its route, and the stack sees a single
+// route table update. Dynamic (e.g. DHCP-acquired) routes are preserved
+// unless the desired set includes their destination, in which case the
+// desired route replaces them. If any route fails validation, nothing is
+// applied.
+func (ns *Netstack) ReplaceRoutes(nicid tcpip.NICID, rs []tcpip.Route, metric routes.Metric) error {
+	metricTracksInterface := metric == metricNotSet
+
+	// Validate the whole set before mutating anything so that a bad route
+	// cannot leave the table half-swapped.
+	type pendingRoute struct {
+		route   tcpip.Route
+		metric  routes.Metric
+		enabled bool
+	}
+	pending := make([]pendingRoute, 0, len(rs))
+	for _, r := range rs {
+		if r.NIC == 0 {
+			r.NIC = nicid
+		}
+		if r.NIC == 0 {
+			nic, err := ns.routeTable.FindNIC(r.Gateway)
+			if err != nil {
+				return fmt.Errorf("error finding NIC for gateway %s: %w", r.Gateway, err)
+			}
+			r.NIC = nic
+		}
+		if nicid != 0 && r.NIC != nicid {
+			return fmt.Errorf("route %s is for NIC %d, not %d", r, r.NIC, nicid)
+		}
+
+		nicInfo, ok := ns.stack.NICInfo()[r.NIC]
+		if !ok {
+			return fmt.Errorf("error getting nicInfo for NIC %d, not in map", r.NIC)
+		}
+
+		ifs := nicInfo.Context.(*ifState)
+
+		m := metric
+		ifs.mu.Lock()
+		enabled := ifs.mu.state == link.StateStarted
+		if metricTracksInterface {
+			m = ifs.mu.metric
+		}
+		ifs.mu.Unlock()
+
+		pending = append(pending, pendingRoute{route: r, metric: m, enabled: enabled})
+	}
+
+	old := ns.routeTable.GetExtendedRouteTable()
+
+	// Install the new routes before removing the superseded ones.
+	desired := make(map[tcpip.Route]struct{}, len(pending))
+	for _, p := range pending {
+		desired[p.route] = struct{}{}
+		ns.routeTable.AddRoute(p.route, p.metric, metricTracksInterface, false /* dynamic */, p.enabled)
+	}
+	for _, er := range old {
+		if nicid != 0 && er.Route.NIC != nicid {
+			continue
+		}
+		if _, ok := desired[er.Route]; ok {
+			continue
+		}
+		// Dynamic routes follow their interface's DHCP lease, not the
+		// routing daemon; keep them unless explicitly replaced above.
+		if er.Dynamic {
+			continue
+		}
+		if err := ns.routeTable.DelRoute(er.Route); err != nil {
+			syslog.Warnf("error deleting superseded route %s: %s", er.Route, err)
+		}
+	}
+
+	ns.stack.SetRouteTable(ns.routeTable.GetNetstackTable())
+	return nil
+}
+
 // GetExtendedRouteTable returns a copy of the current extended route table.
 func (ns *Netstack) GetExtendedRouteTable() []routes.ExtendedRoute {
 	return ns.routeTable.GetExtendedRouteTable()
@@ -530,6 +802,9 @@ func (ns *Netstack) removeInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolA
 		return false, fmt.Errorf("error removing address %s from NIC ID %d: %s", addr.AddressWithPrefix, nic, err)
 	}
 
+	ns.addressStates.remove(nic, addr.AddressWithPrefix.Address)
+	ns.refreshDirectedBroadcast(nic)
+
 	ns.onInterfacesChanged()
 	return true, nil
 }
@@ -556,7 +831,17 @@ func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddr
 		}
 	}
 
+	// Record the address's initial state before handing it to the stack: an
+	// IPv6 address starts out tentative and the stack reports the DAD result
+	// synchronously from AddProtocolAddress when DAD is disabled.
+	state := addressStateAssigned
+	if addr.Protocol == ipv6.ProtocolNumber {
+		state = addressStateTentative
+	}
+	ns.addressStates.set(nic, addr.AddressWithPrefix.Address, state)
+
 	if err := ns.stack.AddProtocolAddress(nic, addr); err != nil {
+		ns.addressStates.remove(nic, addr.AddressWithPrefix.Address)
 		return false, fmt.Errorf("error adding address %s to NIC ID %d: %s", addr.AddressWithPrefix, nic, err)
 	}
 
@@ -564,6 +849,8 @@ func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddr
 		return false, fmt.Errorf("error adding subnet route %s to NIC ID %d: %w", route, nic, err)
 	}
 
+	ns.refreshDirectedBroadcast(nic)
+
 	ns.onInterfacesChanged()
 	return true, nil
 }
@@ -610,8 +897,15 @@ func (ifs *ifState) dhcpAcquired(oldAddr, newAddr tcpip.AddressWithPrefix, confi
 				if err := ifs.ns.AddRoutes(rs, metricNotSet, true /* dynamic */); err != nil {
 					syslog.Infof("error adding routes for DHCP address/gateway: %s", err)
 				}
+
+				if oldAddr != (tcpip.AddressWithPrefix{}) {
+					// Follow sockets bound specifically to the replaced address
+					// over to the new one.
+					ifs.ns.migrateEndpoints(oldAddr.Address, newAddr.Address)
+				}
 			}
 		}
+		ifs.ns.refreshDirectedBroadcast(ifs.nicid)
 		// Dispatch onInterfacesChanged on another goroutine to prevent a
 		// deadlock while holding ifState.mu since dhcpAcquired is called on
 		// cancellation.
@@ -817,6 +1111,55 @@ func (ns *Netstack) getDeviceName() string {
 	}
 }
 
+// abortNICEndpoints aborts all TCP connections associated with the NIC
+// identified by nicid, sending a RST to their peers. It is used during
+// interface teardown (e.g. failover) so that peers reconnect immediately
+// instead of waiting for the dead connections to time out.
+//
+// Aborting an endpoint does not release the client's handle to it. The
+// per-endpoint close machinery observes the abort as a hang-up event and runs
+// at most once, so aborting an endpoint that is concurrently being closed is
+// safe.
+func (ns *Netstack) abortNICEndpoints(nicid tcpip.NICID) {
+	var aborted int
+	ns.endpoints.Range(func(_ zx.Handle, ep tcpip.Endpoint) bool {
+		info, ok := ep.Info().(*tcp.EndpointInfo)
+		if !ok {
+			return true
+		}
+		if info.BindNICID != nicid && info.RegisterNICID != nicid {
+			return true
+		}
+		ep.Abort()
+		aborted++
+		return true
+	})
+	if aborted != 0 {
+		syslog.Infof("aborted %d TCP endpoints on NIC %d", aborted, nicid)
+	}
+}
+
+// setIPv6TemporaryAddresses enables or disables the generation of IPv6
+// temporary (privacy extension) SLAAC addresses, as described in RFC 4941, on
+// the NIC identified by nicid. maxValidLifetime and maxPreferredLifetime
+// bound the lifetimes of generated temporary addresses; values below the
+// minimums the stack accepts will be adjusted up.
+//
+// Updated configurations take effect when the next Router Advertisement with
+// an autonomous prefix is received. Temporary addresses that were generated
+// before generation was disabled are not removed; they age out as the
+// lifetimes they were assigned expire.
+func (ns *Netstack) setIPv6TemporaryAddresses(nicid tcpip.NICID, enabled bool, maxValidLifetime, maxPreferredLifetime time.Duration) error {
+	configs := ns.ndpConfigs
+	configs.AutoGenTempGlobalAddresses = enabled
+	configs.MaxTempAddrValidLifetime = maxValidLifetime
+	configs.MaxTempAddrPreferredLifetime = maxPreferredLifetime
+	if err := ns.stack.SetNDPConfigurations(nicid, configs); err != nil {
+		return fmt.Errorf("error setting NDP configurations to NIC ID %d: %s", nicid, err)
+	}
+	return nil
+}
+
 // TODO(stijlist): figure out a way to make it impossible to accidentally
 // enable DHCP on loopback interfaces.
 func (ns *Netstack) addLoopback() error {
@@ -944,6 +1287,8 @@ func (ns *Netstack) addEndpoint(
 	// Put sniffer as close as the NIC.
 	// A wrapper LinkEndpoint should encapsulate the underlying
 	// one, and manifest itself to 3rd party netstack.
+	ifs.mtuEndpoint = &mtuOverridingEndpoint{LinkEndpoint: ep}
+	ep = ifs.mtuEndpoint
 	ep = sniffer.New(ep)
 
 	if doFilter {
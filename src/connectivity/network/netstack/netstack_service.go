@@ -58,7 +58,7 @@ func interfaces2ListToInterfacesList(ifs2 []netstack.NetInterface2) []netstack.N
 }
 
 func (ns *Netstack) getNetInterfaces2() []netstack.NetInterface2 {
-	nicInfos := ns.stack.NICInfo()
+	nicInfos := ns.NICInfo()
 	interfaces := make([]netstack.NetInterface2, 0, len(nicInfos))
 	for _, nicInfo := range nicInfos {
 		ifs := nicInfo.Context.(*ifState)
@@ -5,14 +5,18 @@
 package netstack
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"sort"
+	"strings"
 	"syscall/zx"
+	"syscall/zx/zxwait"
 	"testing"
 	"time"
 
@@ -21,6 +25,7 @@ import (
 	fidlnet "fidl/fuchsia/net"
 	"fidl/fuchsia/net/stack"
 	"fidl/fuchsia/netstack"
+	"fidl/fuchsia/posix/socket"
 	ethernetext "fidlext/fuchsia/hardware/ethernet"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/dhcp"
@@ -40,6 +45,8 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	tcpipstack "gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -222,6 +229,3872 @@ func containsRoute(rs []tcpip.Route, r tcpip.Route) bool {
 	return false
 }
 
+// TestTxQueueHintRoundTrip tests that the SO_TXREHASH transmit-queue hint is
+// recorded on the endpoint and read back by the getter.
+func TestTxQueueHintRoundTrip(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET and
+	// C.SO_TXREHASH.
+	const (
+		solSocket  = 1
+		soTxrehash = 74
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, 3)
+	setResult, err := e.SetSockOpt(context.Background(), solSocket, soTxrehash, optVal)
+	if err != nil {
+		t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, soTxrehash, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soTxrehash, optVal, setResult.Err)
+	}
+
+	getResult, err := e.GetSockOpt(context.Background(), solSocket, soTxrehash)
+	if err != nil {
+		t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, soTxrehash, err)
+	}
+	if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soTxrehash, getResult.Err)
+	}
+	if got, want := binary.LittleEndian.Uint32(getResult.Response.Optval), uint32(3); got != want {
+		t.Errorf("got transmit-queue hint = %d, want = %d", got, want)
+	}
+}
+
+// TestUDPReusePort tests that binding two UDP sockets to the same port fails
+// the way Linux does without SO_REUSEPORT and succeeds once both sockets set
+// it.
+func TestUDPReusePort(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_REUSEADDR and C.SO_REUSEPORT.
+	const (
+		solSocket   = 1
+		soReuseaddr = 2
+		soReuseport = 15
+	)
+
+	ns := newNetstack(t)
+
+	newEndpoint := func() *endpoint {
+		t.Helper()
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint() = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		e := &endpoint{
+			wq:         wq,
+			transProto: udp.ProtocolNumber,
+			netProto:   ipv4.ProtocolNumber,
+			ns:         ns,
+		}
+		e.storeEp(ep)
+		return e
+	}
+
+	setAndCheck := func(e *endpoint, optName int16) {
+		t.Helper()
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, 1)
+		setResult, err := e.SetSockOpt(context.Background(), solSocket, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, optName, optVal, err)
+		}
+		if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, optName, optVal, setResult.Err)
+		}
+		getResult, err := e.GetSockOpt(context.Background(), solSocket, optName)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, optName, err)
+		}
+		if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, optName, getResult.Err)
+		}
+		if got, want := binary.LittleEndian.Uint32(getResult.Response.Optval), uint32(1); got != want {
+			t.Errorf("got option %d = %d, want = %d", optName, got, want)
+		}
+	}
+
+	addr := tcpip.FullAddress{Port: 8080}
+
+	// Without the option the second bind must fail.
+	first := newEndpoint()
+	if err := first.loadEp().Bind(addr); err != nil {
+		t.Fatalf("first.loadEp().Bind(%+v): %s", addr, err)
+	}
+	second := newEndpoint()
+	if err := second.loadEp().Bind(addr); err != tcpip.ErrPortInUse {
+		t.Fatalf("got second.loadEp().Bind(%+v) = %v, want = %s", addr, err, tcpip.ErrPortInUse)
+	}
+	first.loadEp().Close()
+	second.loadEp().Close()
+
+	// With SO_REUSEPORT set on both sockets, both binds must succeed.
+	third := newEndpoint()
+	setAndCheck(third, soReuseaddr)
+	setAndCheck(third, soReuseport)
+	fourth := newEndpoint()
+	setAndCheck(fourth, soReuseport)
+	if err := third.loadEp().Bind(addr); err != nil {
+		t.Fatalf("third.loadEp().Bind(%+v): %s", addr, err)
+	}
+	if err := fourth.loadEp().Bind(addr); err != nil {
+		t.Fatalf("fourth.loadEp().Bind(%+v): %s", addr, err)
+	}
+}
+
+// TestUDPBroadcast tests that a write to the limited broadcast address fails
+// with EACCES until SO_BROADCAST is set and succeeds afterwards.
+func TestUDPBroadcast(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_BROADCAST and C.EACCES.
+	const (
+		solSocket   = 1
+		soBroadcast = 6
+		eacces      = 13
+	)
+
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+	if err := ifs.controller.Up(); err != nil {
+		t.Fatalf("ifs.controller.Up(): %s", err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   "\xc0\xa8\x01\x02",
+			PrefixLen: 24,
+		},
+	}
+	if _, err := ns.addInterfaceAddress(ifs.nicid, protocolAddr); err != nil {
+		t.Fatalf("addInterfaceAddress(%d, %s): %s", ifs.nicid, protocolAddr.AddressWithPrefix, err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	bcast := tcpip.FullAddress{
+		NIC:  ifs.nicid,
+		Addr: header.IPv4Broadcast,
+		Port: 1234,
+	}
+
+	if _, _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &bcast}); err != tcpip.ErrBroadcastDisabled {
+		t.Fatalf("got ep.Write(_, {To: %+v}) = %v, want = %s", bcast, err, tcpip.ErrBroadcastDisabled)
+	}
+	if got, want := tcpipErrorToCode(tcpip.ErrBroadcastDisabled), int32(eacces); got != want {
+		t.Errorf("got tcpipErrorToCode(ErrBroadcastDisabled) = %d, want = %d", got, want)
+	}
+
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, 1)
+	setResult, err := e.SetSockOpt(context.Background(), solSocket, soBroadcast, optVal)
+	if err != nil {
+		t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, soBroadcast, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soBroadcast, optVal, setResult.Err)
+	}
+
+	if _, _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &bcast}); err != nil {
+		t.Fatalf("ep.Write(_, {To: %+v}): %s", bcast, err)
+	}
+}
+
+// TestTCPBufferSizeOptions tests that SO_RCVBUF and SO_SNDBUF round-trip
+// through the endpoint. The stack stores the requested size clamped to its
+// min/max; it does not apply Linux's doubling semantics, so reading back
+// returns exactly what was set when the value is in range.
+func TestTCPBufferSizeOptions(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET, C.SO_SNDBUF
+	// and C.SO_RCVBUF.
+	const (
+		solSocket = 1
+		soSndbuf  = 7
+		soRcvbuf  = 8
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: tcp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	for _, tc := range []struct {
+		name    string
+		optName int16
+	}{
+		{name: "SO_RCVBUF", optName: soRcvbuf},
+		{name: "SO_SNDBUF", optName: soSndbuf},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const want = 1 << 20
+
+			optVal := make([]byte, 4)
+			binary.LittleEndian.PutUint32(optVal, want)
+			setResult, err := e.SetSockOpt(context.Background(), solSocket, tc.optName, optVal)
+			if err != nil {
+				t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, tc.optName, optVal, err)
+			}
+			if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+				t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, tc.optName, optVal, setResult.Err)
+			}
+
+			getResult, err := e.GetSockOpt(context.Background(), solSocket, tc.optName)
+			if err != nil {
+				t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, tc.optName, err)
+			}
+			if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+				t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, tc.optName, getResult.Err)
+			}
+			if got := binary.LittleEndian.Uint32(getResult.Response.Optval); got != want {
+				t.Errorf("got %s = %d, want = %d", tc.name, got, want)
+			}
+		})
+	}
+}
+
+// TestTCPKeepaliveOptions tests that SO_KEEPALIVE enables keepalives and that
+// the TCP keepalive tuning options round-trip through the endpoint.
+func TestTCPKeepaliveOptions(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_KEEPALIVE, C.SOL_TCP, C.TCP_KEEPIDLE, C.TCP_KEEPINTVL and
+	// C.TCP_KEEPCNT.
+	const (
+		solSocket    = 1
+		soKeepalive  = 9
+		solTcp       = 6
+		tcpKeepidle  = 4
+		tcpKeepintvl = 5
+		tcpKeepcnt   = 6
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: tcp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(level, optName int16, v uint32) {
+		t.Helper()
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, v)
+		result, err := e.SetSockOpt(context.Background(), level, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", level, optName, optVal, err)
+		}
+		if result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", level, optName, optVal, result.Err)
+		}
+	}
+
+	get := func(level, optName int16) uint32 {
+		t.Helper()
+		result, err := e.GetSockOpt(context.Background(), level, optName)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", level, optName, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", level, optName, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	set(solSocket, soKeepalive, 1)
+	if got, want := get(solSocket, soKeepalive), uint32(1); got != want {
+		t.Errorf("got SO_KEEPALIVE = %d, want = %d", got, want)
+	}
+
+	// The keepalive times are expressed in seconds on the wire.
+	for _, tc := range []struct {
+		name    string
+		optName int16
+		value   uint32
+	}{
+		{name: "TCP_KEEPIDLE", optName: tcpKeepidle, value: 600},
+		{name: "TCP_KEEPINTVL", optName: tcpKeepintvl, value: 60},
+		{name: "TCP_KEEPCNT", optName: tcpKeepcnt, value: 5},
+	} {
+		set(solTcp, tc.optName, tc.value)
+		if got := get(solTcp, tc.optName); got != tc.value {
+			t.Errorf("got %s = %d, want = %d", tc.name, got, tc.value)
+		}
+	}
+}
+
+// TestTCPNoDelay tests that TCP_NODELAY round-trips through the endpoint,
+// including the inverted mapping to the stack's delay option.
+func TestTCPNoDelay(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_TCP and
+	// C.TCP_NODELAY.
+	const (
+		solTcp     = 6
+		tcpNodelay = 1
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: tcp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(v uint32) {
+		t.Helper()
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, v)
+		result, err := e.SetSockOpt(context.Background(), solTcp, tcpNodelay, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solTcp, tcpNodelay, optVal, err)
+		}
+		if result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", solTcp, tcpNodelay, optVal, result.Err)
+		}
+	}
+
+	get := func() uint32 {
+		t.Helper()
+		result, err := e.GetSockOpt(context.Background(), solTcp, tcpNodelay)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solTcp, tcpNodelay, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solTcp, tcpNodelay, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	for _, want := range []uint32{1, 0, 1} {
+		set(want)
+		if got := get(); got != want {
+			t.Errorf("got TCP_NODELAY = %d, want = %d", got, want)
+		}
+		// TCP_NODELAY=1 means Nagle's algorithm (the stack's delay option)
+		// is disabled.
+		if delay, err := ep.GetSockOptBool(tcpip.DelayOption); err != nil {
+			t.Fatalf("GetSockOptBool(DelayOption): %s", err)
+		} else if got, want := delay, want == 0; got != want {
+			t.Errorf("got DelayOption = %t, want = %t", got, want)
+		}
+	}
+}
+
+// TestMulticastTTLAndLoop tests that the multicast TTL/hop limit round-trips
+// — including Linux's quirk of accepting a single byte as well as a 4-byte
+// int for IP_MULTICAST_TTL — and that multicast loopback can be disabled.
+func TestMulticastTTLAndLoop(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_IP,
+	// C.IP_MULTICAST_TTL, C.IP_MULTICAST_LOOP, C.SOL_IPV6,
+	// C.IPV6_MULTICAST_HOPS and C.IPV6_MULTICAST_LOOP.
+	const (
+		solIp             = 0
+		ipMulticastTtl    = 33
+		ipMulticastLoop   = 34
+		solIpv6           = 41
+		ipv6MulticastHops = 18
+		ipv6MulticastLoop = 19
+	)
+
+	ns := newNetstack(t)
+
+	newEndpoint := func(netProto tcpip.NetworkProtocolNumber) *endpoint {
+		t.Helper()
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, netProto, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint() = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		e := &endpoint{
+			wq:         wq,
+			transProto: udp.ProtocolNumber,
+			netProto:   netProto,
+			ns:         ns,
+		}
+		e.storeEp(ep)
+		return e
+	}
+
+	set := func(e *endpoint, level, optName int16, optVal []byte) {
+		t.Helper()
+		result, err := e.SetSockOpt(context.Background(), level, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", level, optName, optVal, err)
+		}
+		if result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", level, optName, optVal, result.Err)
+		}
+	}
+
+	get := func(e *endpoint, level, optName int16) uint32 {
+		t.Helper()
+		result, err := e.GetSockOpt(context.Background(), level, optName)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", level, optName, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", level, optName, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	uint32Bytes := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, v)
+		return b
+	}
+
+	e4 := newEndpoint(ipv4.ProtocolNumber)
+
+	// Linux accepts both a single byte and a 4-byte int for
+	// IP_MULTICAST_TTL.
+	set(e4, solIp, ipMulticastTtl, uint32Bytes(5))
+	if got, want := get(e4, solIp, ipMulticastTtl), uint32(5); got != want {
+		t.Errorf("got IP_MULTICAST_TTL = %d, want = %d", got, want)
+	}
+	set(e4, solIp, ipMulticastTtl, []byte{7})
+	if got, want := get(e4, solIp, ipMulticastTtl), uint32(7); got != want {
+		t.Errorf("got IP_MULTICAST_TTL = %d, want = %d", got, want)
+	}
+
+	set(e4, solIp, ipMulticastLoop, uint32Bytes(0))
+	if got, want := get(e4, solIp, ipMulticastLoop), uint32(0); got != want {
+		t.Errorf("got IP_MULTICAST_LOOP = %d, want = %d", got, want)
+	}
+	set(e4, solIp, ipMulticastLoop, uint32Bytes(1))
+	if got, want := get(e4, solIp, ipMulticastLoop), uint32(1); got != want {
+		t.Errorf("got IP_MULTICAST_LOOP = %d, want = %d", got, want)
+	}
+
+	e6 := newEndpoint(ipv6.ProtocolNumber)
+
+	set(e6, solIpv6, ipv6MulticastHops, uint32Bytes(9))
+	if got, want := get(e6, solIpv6, ipv6MulticastHops), uint32(9); got != want {
+		t.Errorf("got IPV6_MULTICAST_HOPS = %d, want = %d", got, want)
+	}
+	set(e6, solIpv6, ipv6MulticastLoop, uint32Bytes(0))
+	if got, want := get(e6, solIpv6, ipv6MulticastLoop), uint32(0); got != want {
+		t.Errorf("got IPV6_MULTICAST_LOOP = %d, want = %d", got, want)
+	}
+}
+
+// TestRecvMsgTrunc tests that reading an oversized datagram into a small
+// buffer reports the dropped bytes, that MSG_TRUNC reports the original
+// datagram size instead, and that unknown flags are rejected with EINVAL.
+func TestRecvMsgTrunc(t *testing.T) {
+	// cgo is not available in tests; these match C.MSG_TRUNC, C.EAGAIN and
+	// C.EINVAL.
+	const (
+		msgTrunc = 0x20
+		eagain   = 11
+		einval   = 22
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+
+	const payload = "0123456789"
+	send := func() {
+		t.Helper()
+		if _, _, err := sender.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &local}); err != nil {
+			t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+		}
+	}
+
+	recv := func(flags int16) socket.DatagramSocketRecvMsgResponse {
+		t.Helper()
+		for {
+			result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 4 /* dataLen */, 0 /* controlLen */, flags)
+			if err != nil {
+				t.Fatalf("s.RecvMsg(...): %s", err)
+			}
+			if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+				if result.Err == eagain {
+					select {
+					case <-inCh:
+						continue
+					case <-time.After(5 * time.Second):
+						t.Fatal("timed out waiting for the packet to arrive")
+					}
+				}
+				t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+			}
+			return result.Response
+		}
+	}
+
+	send()
+	response := recv(0)
+	if got, want := string(response.Data), payload[:4]; got != want {
+		t.Errorf("got data = %q, want = %q", got, want)
+	}
+	if got, want := response.Truncated, uint32(len(payload)-4); got != want {
+		t.Errorf("got truncated = %d, want = %d", got, want)
+	}
+
+	send()
+	response = recv(msgTrunc)
+	if got, want := string(response.Data), payload[:4]; got != want {
+		t.Errorf("got data = %q, want = %q", got, want)
+	}
+	if got, want := response.Truncated, uint32(len(payload)); got != want {
+		t.Errorf("got truncated with MSG_TRUNC = %d, want = %d", got, want)
+	}
+
+	// An unknown flag bit is rejected.
+	result, err := s.RecvMsg(context.Background(), 0, 4, 0, 0x4 /* MSG_DONTROUTE */)
+	if err != nil {
+		t.Fatalf("s.RecvMsg(...): %s", err)
+	}
+	if result.Which() != socket.DatagramSocketRecvMsgResultErr {
+		t.Errorf("got s.RecvMsg(...) with an unknown flag = success, want Err(%d)", einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got s.RecvMsg(...) with an unknown flag = Err(%d), want Err(%d)", got, want)
+	}
+}
+
+// TestMsgDontWait tests that MSG_DONTWAIT makes a single call non-blocking: a
+// receive on an empty socket reports EWOULDBLOCK rather than rejecting the
+// flag, and a send blocked on link resolution returns EWOULDBLOCK instead of
+// waiting for the resolution to complete.
+func TestMsgDontWait(t *testing.T) {
+	// cgo is not available in tests; these match C.MSG_DONTWAIT, C.EAGAIN
+	// and C.EINVAL.
+	const (
+		msgDontWait = 0x40
+		eagain      = 11
+		einval      = 22
+	)
+
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+	if err := ifs.controller.Up(); err != nil {
+		t.Fatalf("ifs.controller.Up(): %s", err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   "\xc0\xa8\x01\x02",
+			PrefixLen: 24,
+		},
+	}
+	if _, err := ns.addInterfaceAddress(ifs.nicid, protocolAddr); err != nil {
+		t.Fatalf("addInterfaceAddress(%d, %s): %s", ifs.nicid, protocolAddr.AddressWithPrefix, err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: protocolAddr.AddressWithPrefix.Address}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", protocolAddr.AddressWithPrefix.Address, err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	// Nothing has been sent to the socket.
+	result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 4 /* dataLen */, 0 /* controlLen */, msgDontWait)
+	if err != nil {
+		t.Fatalf("s.RecvMsg(...): %s", err)
+	}
+	if result.Which() != socket.DatagramSocketRecvMsgResultErr {
+		t.Errorf("got s.RecvMsg(..., MSG_DONTWAIT) on an empty socket = success, want Err(%d)", eagain)
+	} else if got, want := result.Err, int32(eagain); got != want {
+		t.Errorf("got s.RecvMsg(..., MSG_DONTWAIT) on an empty socket = Err(%d), want Err(%d)", got, want)
+	}
+
+	// The destination is on-link but its link address is unknown, so the
+	// write is blocked on ARP resolution that never completes against the
+	// fake device.
+	to := encodeAddr(ipv4.ProtocolNumber, tcpip.FullAddress{
+		NIC:  ifs.nicid,
+		Addr: "\xc0\xa8\x01\x03",
+		Port: 1234,
+	})
+	sendResult, err := s.SendMsg2(context.Background(), to, []byte("hello"), nil, msgDontWait)
+	if err != nil {
+		t.Fatalf("s.SendMsg2(...): %s", err)
+	}
+	if sendResult.Which() != socket.DatagramSocketSendMsg2ResultErr {
+		t.Errorf("got s.SendMsg2(..., MSG_DONTWAIT) with an unresolved neighbor = success, want Err(%d)", eagain)
+	} else if got, want := sendResult.Err, int32(eagain); got != want {
+		t.Errorf("got s.SendMsg2(..., MSG_DONTWAIT) with an unresolved neighbor = Err(%d), want Err(%d)", got, want)
+	}
+
+	// An unknown flag bit is rejected.
+	sendResult, err = s.SendMsg2(context.Background(), to, []byte("hello"), nil, 0x4 /* MSG_DONTROUTE */)
+	if err != nil {
+		t.Fatalf("s.SendMsg2(...): %s", err)
+	}
+	if sendResult.Which() != socket.DatagramSocketSendMsg2ResultErr {
+		t.Errorf("got s.SendMsg2(...) with an unknown flag = success, want Err(%d)", einval)
+	} else if got, want := sendResult.Err, int32(einval); got != want {
+		t.Errorf("got s.SendMsg2(...) with an unknown flag = Err(%d), want Err(%d)", got, want)
+	}
+}
+
+// TestSORcvTimeo tests that SO_RCVTIMEO round-trips as a timeval and that a
+// receive on an empty socket waits out the timeout before reporting EAGAIN
+// instead of failing immediately.
+func TestSORcvTimeo(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_RCVTIMEO and C.EAGAIN.
+	const (
+		solSocket  = 1
+		soRcvtimeo = 20
+		eagain     = 11
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	// struct timeval: tv_sec and tv_usec, each a C long. 100ms.
+	timeout := 100 * time.Millisecond
+	optVal := make([]byte, 16)
+	binary.LittleEndian.PutUint64(optVal[8:], uint64(timeout/time.Microsecond))
+	setResult, err := s.SetSockOpt(context.Background(), solSocket, soRcvtimeo, optVal)
+	if err != nil {
+		t.Fatalf("s.SetSockOpt(_, %d, %d, %v): %s", solSocket, soRcvtimeo, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got s.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soRcvtimeo, optVal, setResult.Err)
+	}
+
+	getResult, err := s.GetSockOpt(context.Background(), solSocket, soRcvtimeo)
+	if err != nil {
+		t.Fatalf("s.GetSockOpt(_, %d, %d): %s", solSocket, soRcvtimeo, err)
+	}
+	if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got s.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soRcvtimeo, getResult.Err)
+	}
+	if got := getResult.Response.Optval; !bytes.Equal(got, optVal) {
+		t.Errorf("got SO_RCVTIMEO = %v, want = %v", got, optVal)
+	}
+
+	// Nothing has been sent to the socket: the receive must wait out the
+	// timeout and then report EAGAIN.
+	start := time.Now()
+	result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 4 /* dataLen */, 0 /* controlLen */, 0 /* flags */)
+	if err != nil {
+		t.Fatalf("s.RecvMsg(...): %s", err)
+	}
+	elapsed := time.Since(start)
+	if result.Which() != socket.DatagramSocketRecvMsgResultErr {
+		t.Errorf("got s.RecvMsg(...) on an empty socket = success, want Err(%d)", eagain)
+	} else if got, want := result.Err, int32(eagain); got != want {
+		t.Errorf("got s.RecvMsg(...) on an empty socket = Err(%d), want Err(%d)", got, want)
+	}
+	if elapsed < timeout {
+		t.Errorf("s.RecvMsg(...) returned after %s, want at least %s", elapsed, timeout)
+	}
+}
+
+// TestIPMulticastMembership tests that IP_ADD_MEMBERSHIP joins the group in
+// the stack and records the membership, that IP_DROP_MEMBERSHIP undoes both,
+// and that malformed structs are rejected with EINVAL.
+func TestIPMulticastMembership(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_IP,
+	// C.IP_ADD_MEMBERSHIP, C.IP_DROP_MEMBERSHIP and C.EINVAL.
+	const (
+		solIp            = 0
+		ipAddMembership  = 35
+		ipDropMembership = 36
+		einval           = 22
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	var nicid tcpip.NICID
+	for id := range ns.stack.NICInfo() {
+		nicid = id
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	group := tcpip.Address("\xe0\x00\x00\xfb")
+
+	// struct ip_mreq: imr_multiaddr followed by imr_interface.
+	mreq := make([]byte, 8)
+	copy(mreq, group)
+	copy(mreq[4:], ipv4Loopback)
+
+	setOpt := func(optName int16, optVal []byte) socket.BaseSocketSetSockOptResult {
+		t.Helper()
+		result, err := e.SetSockOpt(context.Background(), solIp, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solIp, optName, optVal, err)
+		}
+		return result
+	}
+
+	if result := setOpt(ipAddMembership, mreq); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got IP_ADD_MEMBERSHIP = Err(%d)", result.Err)
+	}
+	if got := ns.stack.CheckLocalAddress(nicid, ipv4.ProtocolNumber, group); got == 0 {
+		t.Errorf("got CheckLocalAddress(%d, %d, %s) = 0, want the group to be joined", nicid, ipv4.ProtocolNumber, group)
+	}
+	// The mreq form carries no interface index, so the membership is
+	// recorded against NIC 0 and the stack resolves the NIC itself.
+	if got, want := ns.multicastMemberships.nicMemberships(0)[group], uint32(1); got != want {
+		t.Errorf("got %d recorded memberships of %s, want = %d", got, group, want)
+	}
+
+	if result := setOpt(ipDropMembership, mreq); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got IP_DROP_MEMBERSHIP = Err(%d)", result.Err)
+	}
+	if got := ns.stack.CheckLocalAddress(nicid, ipv4.ProtocolNumber, group); got != 0 {
+		t.Errorf("got CheckLocalAddress(%d, %d, %s) = %d, want the group to be left", nicid, ipv4.ProtocolNumber, group, got)
+	}
+	if got, want := ns.multicastMemberships.nicMemberships(0)[group], uint32(0); got != want {
+		t.Errorf("got %d recorded memberships of %s, want = %d", got, group, want)
+	}
+
+	// A struct of the wrong size is rejected.
+	if result := setOpt(ipAddMembership, mreq[:5]); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got IP_ADD_MEMBERSHIP with a short struct = success, want Err(%d)", einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got IP_ADD_MEMBERSHIP with a short struct = Err(%d), want Err(%d)", got, want)
+	}
+}
+
+// TestSOLingerAbortiveClose tests that SO_LINGER round-trips and that an
+// enabled linger of zero turns close into an abortive reset observed by the
+// peer.
+func TestSOLingerAbortiveClose(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET and
+	// C.SO_LINGER.
+	const (
+		solSocket = 1
+		soLinger  = 13
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	lwq := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("Listen(1) = %s", err)
+	}
+	local, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+
+	// The closing side's data plane is a zircon socket so that close
+	// exercises the linger handling.
+	cwq := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, cwq, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatalf("newEndpointWithSocket(...): %s", err)
+	}
+
+	outEntry, outCh := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&outEntry, waiter.EventOut)
+	defer cwq.EventUnregister(&outEntry)
+	switch err := client.Connect(local); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		select {
+		case <-outCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for connect to complete")
+		}
+	default:
+		t.Fatalf("Connect(%+v) = %s", local, err)
+	}
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	lwq.EventRegister(&inEntry, waiter.EventIn)
+	defer lwq.EventUnregister(&inEntry)
+	var accepted tcpip.Endpoint
+	var awq *waiter.Queue
+	for {
+		var err *tcpip.Error
+		accepted, awq, err = listener.Accept()
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-inCh:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the connection to be accepted")
+			}
+		}
+		if err != nil {
+			t.Fatalf("Accept() = %s", err)
+		}
+		break
+	}
+	defer accepted.Close()
+
+	// SO_LINGER{1, 0}: closing must reset the connection.
+	optVal := make([]byte, 8)
+	binary.LittleEndian.PutUint32(optVal, 1)
+	setResult, err := eps.SetSockOpt(context.Background(), solSocket, soLinger, optVal)
+	if err != nil {
+		t.Fatalf("eps.SetSockOpt(_, %d, %d, %v): %s", solSocket, soLinger, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got eps.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soLinger, optVal, setResult.Err)
+	}
+	getResult, err := eps.GetSockOpt(context.Background(), solSocket, soLinger)
+	if err != nil {
+		t.Fatalf("eps.GetSockOpt(_, %d, %d): %s", solSocket, soLinger, err)
+	}
+	if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got eps.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soLinger, getResult.Err)
+	}
+	if got := getResult.Response.Optval; !bytes.Equal(got, optVal) {
+		t.Errorf("got SO_LINGER = %v, want = %v", got, optVal)
+	}
+
+	eps.close(eps.loopReadDone, eps.loopWriteDone, eps.loopPollDone)
+
+	aEntry, aCh := waiter.NewChannelEntry(nil)
+	awq.EventRegister(&aEntry, waiter.EventIn)
+	defer awq.EventUnregister(&aEntry)
+	for {
+		_, _, err := accepted.Read(nil)
+		switch err {
+		case tcpip.ErrWouldBlock:
+			select {
+			case <-aCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the peer to observe the reset")
+			}
+		case tcpip.ErrConnectionReset:
+			return
+		default:
+			t.Fatalf("got accepted.Read(nil) = %v, want = %s", err, tcpip.ErrConnectionReset)
+		}
+	}
+}
+
+// TestEndpointInfos tests that EndpointInfos reports the live endpoints with
+// their connection tuples and states, sorted by handle.
+func TestEndpointInfos(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	lwq := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(2); err != nil {
+		t.Fatalf("Listen(2) = %s", err)
+	}
+	local, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	lwq.EventRegister(&inEntry, waiter.EventIn)
+	defer lwq.EventUnregister(&inEntry)
+
+	// connect opens a connected stream socket; only sockets created through
+	// the socket layer are registered in ns.endpoints, so the listener and
+	// the accepted endpoints do not appear in EndpointInfos.
+	connect := func() {
+		t.Helper()
+		cwq := &waiter.Queue{}
+		client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, cwq)
+		if err != nil {
+			t.Fatalf("NewEndpoint() = %s", err)
+		}
+		eps, err := newEndpointWithSocket(client, cwq, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+		if err != nil {
+			t.Fatalf("newEndpointWithSocket(...): %s", err)
+		}
+		t.Cleanup(func() { eps.close(eps.loopReadDone, eps.loopWriteDone, eps.loopPollDone) })
+
+		outEntry, outCh := waiter.NewChannelEntry(nil)
+		cwq.EventRegister(&outEntry, waiter.EventOut)
+		defer cwq.EventUnregister(&outEntry)
+		switch err := client.Connect(local); err {
+		case nil:
+		case tcpip.ErrConnectStarted:
+			select {
+			case <-outCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for connect to complete")
+			}
+		default:
+			t.Fatalf("Connect(%+v) = %s", local, err)
+		}
+
+		for {
+			accepted, _, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-inCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the connection to be accepted")
+				}
+			}
+			if err != nil {
+				t.Fatalf("Accept() = %s", err)
+			}
+			t.Cleanup(accepted.Close)
+			break
+		}
+	}
+
+	connect()
+	connect()
+
+	sp := providerImpl{ns: ns}
+	infos := sp.EndpointInfos()
+	if got, want := len(infos), 2; got != want {
+		t.Fatalf("got len(sp.EndpointInfos()) = %d (%+v), want = %d", got, infos, want)
+	}
+	if !(infos[0].handle < infos[1].handle) {
+		t.Errorf("got handles %d, %d, want ascending order", infos[0].handle, infos[1].handle)
+	}
+	for i, info := range infos {
+		if got, want := info.transProto, tcp.ProtocolNumber; got != want {
+			t.Errorf("got infos[%d].transProto = %d, want = %d", i, got, want)
+		}
+		if got, want := info.netProto, ipv4.ProtocolNumber; got != want {
+			t.Errorf("got infos[%d].netProto = %d, want = %d", i, got, want)
+		}
+		if got, want := info.remote.Addr, local.Addr; got != want {
+			t.Errorf("got infos[%d].remote.Addr = %s, want = %s", i, got, want)
+		}
+		if got, want := info.remote.Port, local.Port; got != want {
+			t.Errorf("got infos[%d].remote.Port = %d, want = %d", i, got, want)
+		}
+		if got, want := info.local.Addr, ipv4Loopback; got != want {
+			t.Errorf("got infos[%d].local.Addr = %s, want = %s", i, got, want)
+		}
+		if info.local.Port == 0 {
+			t.Errorf("got infos[%d].local.Port = 0, want an ephemeral port", i)
+		}
+		if got, want := info.state, tcp.StateEstablished.String(); got != want {
+			t.Errorf("got infos[%d].state = %q, want = %q", i, got, want)
+		}
+	}
+}
+
+// TestUnicastTTLSocketOptions tests that IP_TTL and IPV6_UNICAST_HOPS set the
+// TTL/hop limit stamped on outgoing packets, that -1 (or 0 for v6) restores
+// the default, and that out-of-range values fail with EINVAL.
+func TestUnicastTTLSocketOptions(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_IP, C.IP_TTL,
+	// C.SOL_IPV6, C.IPV6_UNICAST_HOPS and C.EINVAL.
+	const (
+		solIp           = 0
+		ipTtl           = 2
+		solIpv6         = 41
+		ipv6UnicastHops = 16
+		einval          = 22
+	)
+
+	ns := newNetstack(t)
+
+	newEndpoint := func(netProto tcpip.NetworkProtocolNumber) *endpoint {
+		t.Helper()
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, netProto, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint() = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		e := &endpoint{
+			wq:         wq,
+			transProto: udp.ProtocolNumber,
+			netProto:   netProto,
+			ns:         ns,
+		}
+		e.storeEp(ep)
+		return e
+	}
+
+	set := func(e *endpoint, level, optName int16, v int32) socket.BaseSocketSetSockOptResult {
+		t.Helper()
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, uint32(v))
+		result, err := e.SetSockOpt(context.Background(), level, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", level, optName, optVal, err)
+		}
+		return result
+	}
+
+	get := func(e *endpoint, level, optName int16) int32 {
+		t.Helper()
+		result, err := e.GetSockOpt(context.Background(), level, optName)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", level, optName, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", level, optName, result.Err)
+		}
+		return int32(binary.LittleEndian.Uint32(result.Response.Optval))
+	}
+
+	for _, tc := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		level    int16
+		optName  int16
+		// The value that restores the default. Linux accepts -1 on both
+		// levels and additionally 0 for IPV6_UNICAST_HOPS.
+		resetValue int32
+		invalid    []int32
+	}{
+		{
+			name:       "IP_TTL",
+			netProto:   ipv4.ProtocolNumber,
+			level:      solIp,
+			optName:    ipTtl,
+			resetValue: -1,
+			invalid:    []int32{0, 256},
+		},
+		{
+			name:       "IPV6_UNICAST_HOPS",
+			netProto:   ipv6.ProtocolNumber,
+			level:      solIpv6,
+			optName:    ipv6UnicastHops,
+			resetValue: 0,
+			invalid:    []int32{-2, 256},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newEndpoint(tc.netProto)
+
+			if got, want := get(e, tc.level, tc.optName), int32(DefaultTTL); got != want {
+				t.Errorf("got default %s = %d, want = %d", tc.name, got, want)
+			}
+
+			if result := set(e, tc.level, tc.optName, 42); result.Which() == socket.BaseSocketSetSockOptResultErr {
+				t.Fatalf("got set %s = Err(%d)", tc.name, result.Err)
+			}
+			if got, want := get(e, tc.level, tc.optName), int32(42); got != want {
+				t.Errorf("got %s = %d, want = %d", tc.name, got, want)
+			}
+
+			if result := set(e, tc.level, tc.optName, tc.resetValue); result.Which() == socket.BaseSocketSetSockOptResultErr {
+				t.Fatalf("got set %s = Err(%d)", tc.name, result.Err)
+			}
+			if got, want := get(e, tc.level, tc.optName), int32(DefaultTTL); got != want {
+				t.Errorf("got %s after reset = %d, want = %d", tc.name, got, want)
+			}
+
+			for _, v := range tc.invalid {
+				result := set(e, tc.level, tc.optName, v)
+				if result.Which() != socket.BaseSocketSetSockOptResultErr {
+					t.Errorf("got set %s to %d = success, want Err(%d)", tc.name, v, einval)
+				} else if result.Err != einval {
+					t.Errorf("got set %s to %d = Err(%d), want Err(%d)", tc.name, v, result.Err, einval)
+				}
+			}
+		})
+	}
+}
+
+// TestBindToDeviceByIndex tests that SO_BINDTOIFINDEX binds a socket to the
+// NIC with the given index, that an index of zero clears the binding, and
+// that an unknown index is rejected.
+func TestBindToDeviceByIndex(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_BINDTOIFINDEX and C.ENODEV.
+	const (
+		solSocket       = 1
+		soBindtoifindex = 62
+		enodev          = 19
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	nicInfos := ns.stack.NICInfo()
+	if got := len(nicInfos); got != 1 {
+		t.Fatalf("got len(ns.stack.NICInfo()) = %d, want = 1", got)
+	}
+	var nicid tcpip.NICID
+	for id := range nicInfos {
+		nicid = id
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(index uint32) socket.BaseSocketSetSockOptResult {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, index)
+		result, err := e.SetSockOpt(context.Background(), solSocket, soBindtoifindex, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, soBindtoifindex, optVal, err)
+		}
+		return result
+	}
+	get := func() uint32 {
+		result, err := e.GetSockOpt(context.Background(), solSocket, soBindtoifindex)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, soBindtoifindex, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soBindtoifindex, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	if result := set(uint32(nicid)); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(%d) = Err(%d)", nicid, result.Err)
+	}
+	if got, want := get(), uint32(nicid); got != want {
+		t.Errorf("got bound device index = %d, want = %d", got, want)
+	}
+
+	if result := set(uint32(nicid) + 1); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(%d) = %#v, want = Err(%d)", nicid+1, result, enodev)
+	} else if got, want := result.Err, int32(enodev); got != want {
+		t.Errorf("got set(%d) = Err(%d), want = Err(%d)", nicid+1, got, want)
+	}
+
+	if result := set(0); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(0) = Err(%d)", result.Err)
+	}
+	if got, want := get(), uint32(0); got != want {
+		t.Errorf("got bound device index = %d, want = %d", got, want)
+	}
+}
+
+// TestBindToDeviceByName tests that SO_BINDTODEVICE pins a socket to the NIC
+// with the given name, that routes through other NICs are no longer usable
+// while bound, that an empty name clears the binding, and that an unknown
+// name is rejected with ENODEV.
+func TestBindToDeviceByName(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_BINDTODEVICE and C.ENODEV.
+	const (
+		solSocket      = 1
+		soBindtodevice = 25
+		enodev         = 19
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+	if err := ifs.controller.Up(); err != nil {
+		t.Fatalf("ifs.controller.Up(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(name string) socket.BaseSocketSetSockOptResult {
+		t.Helper()
+		optVal := append([]byte(name), 0)
+		result, err := e.SetSockOpt(context.Background(), solSocket, soBindtodevice, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %q): %s", solSocket, soBindtodevice, name, err)
+		}
+		return result
+	}
+
+	if result := set(testDeviceName); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(%q) = Err(%d)", testDeviceName, result.Err)
+	}
+	getResult, err := e.GetSockOpt(context.Background(), solSocket, soBindtodevice)
+	if err != nil {
+		t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, soBindtodevice, err)
+	}
+	if getResult.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soBindtodevice, getResult.Err)
+	}
+	if got, want := getResult.Response.Optval, append([]byte(testDeviceName), 0); !bytes.Equal(got, want) {
+		t.Errorf("got bound device name = %v, want = %v", got, want)
+	}
+
+	// The binding restricts routing to the named NIC: the loopback route is
+	// no longer usable.
+	to := tcpip.FullAddress{Addr: ipv4Loopback, Port: 1234}
+	if _, _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &to}); err == nil {
+		t.Errorf("got ep.Write(_, {To: %+v}) = nil while bound to %q, want an error", to, testDeviceName)
+	}
+
+	// An unknown name is rejected and the binding is left untouched.
+	if result := set("nosuchif0"); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(%q) = %#v, want = Err(%d)", "nosuchif0", result, enodev)
+	} else if got, want := result.Err, int32(enodev); got != want {
+		t.Errorf("got set(%q) = Err(%d), want = Err(%d)", "nosuchif0", got, want)
+	}
+
+	// An empty name clears the binding and the loopback route works again.
+	if result := set(""); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(%q) = Err(%d)", "", result.Err)
+	}
+	if _, _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &to}); err != nil {
+		t.Errorf("ep.Write(_, {To: %+v}) after clearing the binding: %s", to, err)
+	}
+}
+
+func TestTCPQuickAck(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_TCP, C.TCP_QUICKACK
+	// and C.EINVAL.
+	const (
+		solTcp      = 6
+		tcpQuickack = 12
+		einval      = 22
+	)
+
+	ns := newNetstack(t)
+
+	makeEndpoint := func(transProto tcpip.TransportProtocolNumber) *endpoint {
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(transProto, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(%d, %d, _) = %s", transProto, ipv4.ProtocolNumber, err)
+		}
+		t.Cleanup(ep.Close)
+		e := &endpoint{
+			wq:         wq,
+			transProto: transProto,
+			netProto:   ipv4.ProtocolNumber,
+			ns:         ns,
+		}
+		e.storeEp(ep)
+		return e
+	}
+
+	e := makeEndpoint(tcp.ProtocolNumber)
+
+	set := func(e *endpoint, v uint32) socket.BaseSocketSetSockOptResult {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, v)
+		result, err := e.SetSockOpt(context.Background(), solTcp, tcpQuickack, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solTcp, tcpQuickack, optVal, err)
+		}
+		return result
+	}
+
+	if result := set(e, 1); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(1) = Err(%d)", result.Err)
+	}
+	result, err := e.GetSockOpt(context.Background(), solTcp, tcpQuickack)
+	if err != nil {
+		t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solTcp, tcpQuickack, err)
+	}
+	if result.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solTcp, tcpQuickack, result.Err)
+	}
+	if got, want := binary.LittleEndian.Uint32(result.Response.Optval), uint32(1); got != want {
+		t.Errorf("got quickack = %d, want = %d", got, want)
+	}
+
+	// TCP_QUICKACK has no meaning on non-TCP sockets.
+	udpEp := makeEndpoint(udp.ProtocolNumber)
+	if result := set(udpEp, 1); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(1) = %#v, want = Err(%d)", result, einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got set(1) = Err(%d), want = Err(%d)", got, want)
+	}
+	if result, err := udpEp.GetSockOpt(context.Background(), solTcp, tcpQuickack); err != nil {
+		t.Fatalf("udpEp.GetSockOpt(_, %d, %d): %s", solTcp, tcpQuickack, err)
+	} else if result.Which() != socket.BaseSocketGetSockOptResultErr {
+		t.Errorf("got udpEp.GetSockOpt(_, %d, %d) = %#v, want = Err(%d)", solTcp, tcpQuickack, result, einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got udpEp.GetSockOpt(_, %d, %d) = Err(%d), want = Err(%d)", solTcp, tcpQuickack, got, want)
+	}
+}
+
+func TestTCPCongestionControl(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_TCP, C.TCP_CONGESTION
+	// and C.ENOENT.
+	const (
+		solTcp        = 6
+		tcpCongestion = 13
+		enoent        = 2
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: tcp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(name string) socket.BaseSocketSetSockOptResult {
+		// Pass a fixed-size, zero-padded buffer the way libc does.
+		optVal := make([]byte, tcpCANameMax)
+		copy(optVal, name)
+		result, err := e.SetSockOpt(context.Background(), solTcp, tcpCongestion, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %q): %s", solTcp, tcpCongestion, name, err)
+		}
+		return result
+	}
+	get := func() string {
+		result, err := e.GetSockOpt(context.Background(), solTcp, tcpCongestion)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solTcp, tcpCongestion, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solTcp, tcpCongestion, result.Err)
+		}
+		return strings.TrimRight(string(result.Response.Optval), "\x00")
+	}
+
+	// The stack registers reno and cubic; switching between them round-trips
+	// through the endpoint.
+	for _, name := range []string{"cubic", "reno"} {
+		if result := set(name); result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got set(%q) = Err(%d)", name, result.Err)
+		}
+		if got := get(); got != name {
+			t.Errorf("got congestion control = %q, want = %q", got, name)
+		}
+	}
+
+	// An algorithm the stack has not registered is rejected and leaves the
+	// previous setting in place.
+	if result := set("bogus"); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(%q) = %#v, want = Err(%d)", "bogus", result, enoent)
+	} else if got, want := result.Err, int32(enoent); got != want {
+		t.Errorf("got set(%q) = Err(%d), want = Err(%d)", "bogus", got, want)
+	}
+	if got, want := get(), "reno"; got != want {
+		t.Errorf("got congestion control = %q, want = %q", got, want)
+	}
+}
+
+func TestIPTOS(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_IP, C.IP_TOS and
+	// C.EINVAL.
+	const (
+		solIp  = 0
+		ipTos  = 1
+		einval = 22
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(v uint32) socket.BaseSocketSetSockOptResult {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, v)
+		result, err := e.SetSockOpt(context.Background(), solIp, ipTos, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solIp, ipTos, optVal, err)
+		}
+		return result
+	}
+
+	// DSCP EF (46) shifted into the upper six bits of the TOS byte.
+	const tos = 46 << 2
+	if result := set(tos); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(%d) = Err(%d)", tos, result.Err)
+	}
+	result, err := e.GetSockOpt(context.Background(), solIp, ipTos)
+	if err != nil {
+		t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solIp, ipTos, err)
+	}
+	if result.Which() == socket.BaseSocketGetSockOptResultErr {
+		t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solIp, ipTos, result.Err)
+	}
+	if got, want := binary.LittleEndian.Uint32(result.Response.Optval), uint32(tos); got != want {
+		t.Errorf("got TOS = %d, want = %d", got, want)
+	}
+
+	// TOS is a single byte on the wire; values that do not fit are rejected.
+	if result := set(256); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(256) = %#v, want = Err(%d)", result, einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got set(256) = Err(%d), want = Err(%d)", got, want)
+	}
+}
+
+func TestRecvCmsgBufSize(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET, C.SOL_IP,
+	// C.SO_TIMESTAMP, C.IP_RECVTOS and C.EINVAL.
+	const (
+		solSocket   = 1
+		solIp       = 0
+		soTimestamp = 29
+		ipRecvTos   = 13
+		einval      = 22
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	getSize := func() uint32 {
+		result, err := e.GetSockOpt(context.Background(), solSocket, soRecvCmsgBufSize)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, soRecvCmsgBufSize, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soRecvCmsgBufSize, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+	enable := func(level, optName int16) {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, 1)
+		result, err := e.SetSockOpt(context.Background(), level, optName, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", level, optName, optVal, err)
+		}
+		if result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got e.SetSockOpt(_, %d, %d, %v) = Err(%d)", level, optName, optVal, result.Err)
+		}
+	}
+
+	// With no cmsg options enabled, receives produce no control messages.
+	if got := getSize(); got != 0 {
+		t.Errorf("got control buffer size = %d with no cmsg options enabled, want = 0", got)
+	}
+
+	// The reported size grows by each enabled option's cmsg space and
+	// shrinks again when the option is disabled.
+	enable(solSocket, soTimestamp)
+	if got, want := getSize(), uint32(cmsgSpaceTimestamp); got != want {
+		t.Errorf("got control buffer size = %d with SO_TIMESTAMP enabled, want = %d", got, want)
+	}
+	enable(solIp, ipRecvTos)
+	if got, want := getSize(), uint32(cmsgSpaceTimestamp+cmsgSpaceTOS); got != want {
+		t.Errorf("got control buffer size = %d with SO_TIMESTAMP and IP_RECVTOS enabled, want = %d", got, want)
+	}
+
+	// The option is computed from the enabled cmsg options; writing it is
+	// rejected.
+	optVal := make([]byte, 4)
+	result, err := e.SetSockOpt(context.Background(), solSocket, soRecvCmsgBufSize, optVal)
+	if err != nil {
+		t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, soRecvCmsgBufSize, optVal, err)
+	}
+	if result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set = %#v, want = Err(%d)", result, einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got set = Err(%d), want = Err(%d)", got, want)
+	}
+}
+
+// TestRecvMsgControlMessageLayout enables every receive cmsg option an IPv4
+// datagram socket supports and checks that RecvMsg lays the control buffer
+// out the way CMSG_NXTHDR expects: messages in the documented order, each
+// header reporting the unpadded length, and each message padded to an 8 byte
+// boundary.
+func TestRecvMsgControlMessageLayout(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET, C.SOL_IP,
+	// C.SO_TIMESTAMP, C.SCM_TIMESTAMP, C.IP_RECVTOS, C.IP_TOS, C.IP_PKTINFO
+	// and C.EAGAIN.
+	const (
+		solSocket    = 1
+		solIp        = 0
+		soTimestamp  = 29
+		scmTimestamp = 29
+		ipRecvTos    = 13
+		ipTos        = 1
+		ipPktinfo    = 8
+		eagain       = 11
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	enable := func(level, optName int16) {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, 1)
+		result, err := s.SetSockOpt(context.Background(), level, optName, optVal)
+		if err != nil {
+			t.Fatalf("s.SetSockOpt(_, %d, %d, %v): %s", level, optName, optVal, err)
+		}
+		if result.Which() == socket.BaseSocketSetSockOptResultErr {
+			t.Fatalf("got s.SetSockOpt(_, %d, %d, %v) = Err(%d)", level, optName, optVal, result.Err)
+		}
+	}
+	enable(solSocket, soTimestamp)
+	enable(solIp, ipRecvTos)
+	enable(solIp, ipPktinfo)
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+	if _, _, err := sender.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &local}); err != nil {
+		t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+	}
+
+	var control []byte
+	for {
+		result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 1024 /* dataLen */, 256 /* controlLen */, 0 /* flags */)
+		if err != nil {
+			t.Fatalf("s.RecvMsg(...): %s", err)
+		}
+		if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+			if result.Err == eagain {
+				select {
+				case <-inCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the packet to arrive")
+				}
+			}
+			t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+		}
+		control = result.Response.Control
+		break
+	}
+
+	// Walk the buffer the way CMSG_NXTHDR does: a 16 byte header holding
+	// (cmsg_len, cmsg_level, cmsg_type) followed by the payload, with the
+	// next header at the 8 byte boundary past cmsg_len.
+	type cmsg struct {
+		level, typ uint32
+		data       []byte
+	}
+	var cmsgs []cmsg
+	for offset := 0; offset < len(control); {
+		if remaining := len(control) - offset; remaining < 16 {
+			t.Fatalf("got %d trailing bytes at offset %d, want a 16 byte cmsghdr", remaining, offset)
+		}
+		length := int(binary.LittleEndian.Uint64(control[offset:]))
+		if length < 16 || offset+length > len(control) {
+			t.Fatalf("got cmsg_len = %d at offset %d with %d bytes remaining", length, offset, len(control)-offset)
+		}
+		cmsgs = append(cmsgs, cmsg{
+			level: binary.LittleEndian.Uint32(control[offset+8:]),
+			typ:   binary.LittleEndian.Uint32(control[offset+12:]),
+			data:  control[offset+16 : offset+length],
+		})
+		offset += (length + 7) &^ 7
+	}
+
+	want := []struct {
+		level, typ uint32
+		dataLen    int
+	}{
+		{level: solSocket, typ: scmTimestamp, dataLen: 16},
+		{level: solIp, typ: ipTos, dataLen: 1},
+		{level: solIp, typ: ipPktinfo, dataLen: 12},
+	}
+	if got, want := len(cmsgs), len(want); got != want {
+		t.Fatalf("got %d control messages, want = %d", got, want)
+	}
+	for i, want := range want {
+		got := cmsgs[i]
+		if got.level != want.level || got.typ != want.typ || len(got.data) != want.dataLen {
+			t.Errorf("got cmsgs[%d] = (level=%d, type=%d, %d bytes), want = (level=%d, type=%d, %d bytes)",
+				i, got.level, got.typ, len(got.data), want.level, want.typ, want.dataLen)
+		}
+	}
+
+	// The pktinfo payload carries the interface index followed by the local
+	// and destination addresses; a loopback receive names the loopback NIC
+	// and 127.0.0.1 for both addresses.
+	if pktinfo := cmsgs[2].data; len(pktinfo) == 12 {
+		if got, want := tcpip.NICID(binary.LittleEndian.Uint32(pktinfo)), ns.stack.CheckLocalAddress(0, ipv4.ProtocolNumber, ipv4Loopback); got != want {
+			t.Errorf("got in_pktinfo.ipi_ifindex = %d, want = %d", got, want)
+		}
+		if got := tcpip.Address(pktinfo[4:8]); got != ipv4Loopback {
+			t.Errorf("got in_pktinfo.ipi_spec_dst = %s, want = %s", got, ipv4Loopback)
+		}
+		if got := tcpip.Address(pktinfo[8:12]); got != ipv4Loopback {
+			t.Errorf("got in_pktinfo.ipi_addr = %s, want = %s", got, ipv4Loopback)
+		}
+	}
+}
+
+// TestIPRecvTTL tests that with IP_RECVTTL enabled each received datagram
+// carries an IP_TTL control message holding the TTL the packet arrived with.
+func TestIPRecvTTL(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_IP, C.IP_RECVTTL,
+	// C.IP_TTL and C.EAGAIN.
+	const (
+		solIp     = 0
+		ipRecvTtl = 12
+		ipTtl     = 2
+		eagain    = 11
+	)
+	const sendTTL = 42
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, 1)
+	setResult, err := s.SetSockOpt(context.Background(), solIp, ipRecvTtl, optVal)
+	if err != nil {
+		t.Fatalf("s.SetSockOpt(_, SOL_IP, IP_RECVTTL, %v): %s", optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got s.SetSockOpt(_, SOL_IP, IP_RECVTTL, %v) = Err(%d)", optVal, setResult.Err)
+	}
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+	if err := sender.SetSockOptInt(tcpip.TTLOption, sendTTL); err != nil {
+		t.Fatalf("SetSockOptInt(TTLOption, %d) = %s", sendTTL, err)
+	}
+	if _, _, err := sender.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &local}); err != nil {
+		t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+	}
+
+	var control []byte
+	for {
+		result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 1024 /* dataLen */, 256 /* controlLen */, 0 /* flags */)
+		if err != nil {
+			t.Fatalf("s.RecvMsg(...): %s", err)
+		}
+		if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+			if result.Err == eagain {
+				select {
+				case <-inCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the packet to arrive")
+				}
+			}
+			t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+		}
+		control = result.Response.Control
+		break
+	}
+
+	// A single IP_TTL message is expected: a 16 byte cmsghdr followed by
+	// the TTL as an int.
+	if got, want := len(control), 24; got != want {
+		t.Fatalf("got len(control) = %d (% x), want = %d", got, control, want)
+	}
+	if got, want := binary.LittleEndian.Uint64(control), uint64(20); got != want {
+		t.Errorf("got cmsg_len = %d, want = %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(control[8:]), uint32(solIp); got != want {
+		t.Errorf("got cmsg_level = %d, want = %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(control[12:]), uint32(ipTtl); got != want {
+		t.Errorf("got cmsg_type = %d, want = %d", got, want)
+	}
+	// A datagram delivered locally is not forwarded, so it arrives with the
+	// TTL it was sent with.
+	if got, want := binary.LittleEndian.Uint32(control[16:]), uint32(sendTTL); got != want {
+		t.Errorf("got IP_TTL payload = %d, want = %d", got, want)
+	}
+}
+
+// TestSOReadableBytes tests the Fuchsia-local socket option backing the
+// FIONREAD ioctl: the reported count follows a datagram through delivery, a
+// MSG_PEEK read and a consuming read.
+func TestSOReadableBytes(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET, C.MSG_PEEK
+	// and C.EAGAIN.
+	const (
+		solSocket = 1
+		msgPeek   = 2
+		eagain    = 11
+	)
+	payload := []byte("readable")
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	getReadable := func() uint32 {
+		result, err := s.GetSockOpt(context.Background(), solSocket, soReadableBytes)
+		if err != nil {
+			t.Fatalf("s.GetSockOpt(_, SOL_SOCKET, soReadableBytes): %s", err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got s.GetSockOpt(_, SOL_SOCKET, soReadableBytes) = Err(%d)", result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	if got := getReadable(); got != 0 {
+		t.Errorf("got readable bytes = %d on an empty socket, want = 0", got)
+	}
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+	if _, _, err := sender.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &local}); err != nil {
+		t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+	}
+
+	select {
+	case <-inCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the packet to arrive")
+	}
+	if got, want := getReadable(), uint32(len(payload)); got != want {
+		t.Errorf("got readable bytes = %d after delivery, want = %d", got, want)
+	}
+
+	// A MSG_PEEK read holds the datagram on the socket rather than the
+	// endpoint; it must still be counted.
+	recv := func(flags int16) {
+		result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 1024 /* dataLen */, 0 /* controlLen */, flags)
+		if err != nil {
+			t.Fatalf("s.RecvMsg(..., %d): %s", flags, err)
+		}
+		if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+			t.Fatalf("got s.RecvMsg(..., %d) = Err(%d)", flags, result.Err)
+		}
+		if got, want := len(result.Response.Data), len(payload); got != want {
+			t.Fatalf("got len(data) = %d, want = %d", got, want)
+		}
+	}
+	recv(msgPeek)
+	if got, want := getReadable(), uint32(len(payload)); got != want {
+		t.Errorf("got readable bytes = %d after MSG_PEEK, want = %d", got, want)
+	}
+
+	recv(0)
+	if got := getReadable(); got != 0 {
+		t.Errorf("got readable bytes = %d after a consuming read, want = 0", got)
+	}
+}
+
+// TestUDPConnectAFUnspec tests that connecting a datagram socket to an
+// AF_UNSPEC address dissolves its association: the peer address is gone and
+// sends once again require an explicit destination.
+func TestUDPConnectAFUnspec(t *testing.T) {
+	// cgo is not available in tests; these match C.ENOTCONN and
+	// C.EDESTADDRREQ.
+	const (
+		enotconn     = 107
+		edestaddrreq = 89
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	sinkWQ := &waiter.Queue{}
+	sink, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, sinkWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sink.Close()
+	if err := sink.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	remote, err := sink.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	connect := func(sockaddr []uint8) socket.BaseSocketConnectResult {
+		result, err := s.Connect(context.Background(), sockaddr)
+		if err != nil {
+			t.Fatalf("s.Connect(_, % x): %s", sockaddr, err)
+		}
+		return result
+	}
+	if result := connect(encodeAddr(ipv4.ProtocolNumber, remote)); result.Which() == socket.BaseSocketConnectResultErr {
+		t.Fatalf("got s.Connect(_, {%+v}) = Err(%d)", remote, result.Err)
+	}
+	if result, err := s.GetPeerName(context.Background()); err != nil {
+		t.Fatalf("s.GetPeerName(_): %s", err)
+	} else if result.Which() == socket.BaseSocketGetPeerNameResultErr {
+		t.Fatalf("got s.GetPeerName(_) = Err(%d) while connected", result.Err)
+	}
+
+	// Only the family tag matters; the bytes that follow it are ignored.
+	if result := connect([]byte{0, 0, 0xde, 0xad, 0xbe, 0xef}); result.Which() == socket.BaseSocketConnectResultErr {
+		t.Fatalf("got s.Connect(_, AF_UNSPEC) = Err(%d)", result.Err)
+	}
+	if result, err := s.GetPeerName(context.Background()); err != nil {
+		t.Fatalf("s.GetPeerName(_): %s", err)
+	} else if result.Which() != socket.BaseSocketGetPeerNameResultErr {
+		t.Errorf("got s.GetPeerName(_) = %#v after disconnect, want = Err(%d)", result, enotconn)
+	} else if got, want := result.Err, int32(enotconn); got != want {
+		t.Errorf("got s.GetPeerName(_) = Err(%d) after disconnect, want = Err(%d)", got, want)
+	}
+
+	// Sends without a destination no longer have an implicit one.
+	if result, err := s.SendMsg2(context.Background(), nil, []byte("hello"), nil, 0); err != nil {
+		t.Fatalf("s.SendMsg2(...): %s", err)
+	} else if result.Which() != socket.DatagramSocketSendMsg2ResultErr {
+		t.Errorf("got s.SendMsg2(...) = %#v, want = Err(%d)", result, edestaddrreq)
+	} else if got, want := result.Err, int32(edestaddrreq); got != want {
+		t.Errorf("got s.SendMsg2(...) = Err(%d), want = Err(%d)", got, want)
+	}
+	if result, err := s.SendMsg2(context.Background(), encodeAddr(ipv4.ProtocolNumber, remote), []byte("hello"), nil, 0); err != nil {
+		t.Fatalf("s.SendMsg2(...): %s", err)
+	} else if result.Which() == socket.DatagramSocketSendMsg2ResultErr {
+		t.Errorf("got s.SendMsg2(..., {%+v}, ...) = Err(%d)", remote, result.Err)
+	}
+}
+
+// TestPacketSocket tests AF_PACKET capture sockets: socket creation reports
+// EPERM while packet sockets are disallowed, and once allowed a raw packet
+// socket observes traffic on the loopback interface with a sockaddr_ll
+// sender address.
+func TestPacketSocket(t *testing.T) {
+	// cgo is not available in tests; these match C.AF_PACKET, C.SOCK_RAW,
+	// C.EPERM and C.EAGAIN. ETH_P_ALL is already in host byte order here.
+	const (
+		afPacket = 17
+		sockRaw  = 3
+		ethPAll  = 3
+		eperm    = 1
+		eagain   = 11
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	sp := providerImpl{ns: ns}
+	result, err := sp.Socket2(context.Background(), afPacket, sockRaw, 0)
+	if err != nil {
+		t.Fatalf("sp.Socket2(_, AF_PACKET, SOCK_RAW, 0): %s", err)
+	}
+	if result.Which() != socket.ProviderSocket2ResultErr {
+		t.Errorf("got sp.Socket2(_, AF_PACKET, SOCK_RAW, 0) = success, want Err(%d)", eperm)
+	} else if got, want := result.Err, int32(eperm); got != want {
+		t.Errorf("got sp.Socket2(_, AF_PACKET, SOCK_RAW, 0) = Err(%d), want Err(%d)", got, want)
+	}
+
+	ns.packetSocketsAllowed = true
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewPacketEndpoint(false /* cooked */, ethPAll, wq)
+	if err != nil {
+		t.Fatalf("NewPacketEndpoint(false, ETH_P_ALL, _) = %s", err)
+	}
+	defer ep.Close()
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:       wq,
+				netProto: ethPAll,
+				ns:       ns,
+			},
+			linkLayer: true,
+		},
+	}
+	s.storeEp(ep)
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	// Generate traffic for the packet socket to observe: a UDP datagram
+	// sent to ourselves over loopback.
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+	if err := sender.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := sender.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	payload := []byte("packet socket probe")
+	if _, _, err := sender.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &local}); err != nil {
+		t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		result, err := s.RecvMsg(context.Background(), 128 /* addrLen */, 65536 /* dataLen */, 0 /* controlLen */, 0 /* flags */)
+		if err != nil {
+			t.Fatalf("s.RecvMsg(...): %s", err)
+		}
+		if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+			if result.Err == eagain {
+				select {
+				case <-inCh:
+					continue
+				case <-timeout:
+					t.Fatal("timed out waiting for the frame to be captured")
+				}
+			}
+			t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+		}
+		response := result.Response
+		if !bytes.Contains(response.Data, payload) {
+			// Unrelated traffic; keep looking.
+			continue
+		}
+
+		// The sender address is a sockaddr_ll naming the loopback NIC.
+		addr := response.Addr
+		if len(addr) < 12 {
+			t.Fatalf("got %d byte sender address (% x), want a sockaddr_ll", len(addr), addr)
+		}
+		if got, want := binary.LittleEndian.Uint16(addr), uint16(afPacket); got != want {
+			t.Errorf("got sll_family = %d, want = %d", got, want)
+		}
+		nicid := ns.stack.CheckLocalAddress(0, ipv4.ProtocolNumber, ipv4Loopback)
+		if got, want := binary.LittleEndian.Uint32(addr[4:]), uint32(nicid); got != want {
+			t.Errorf("got sll_ifindex = %d, want = %d", got, want)
+		}
+		break
+	}
+}
+
+// TestSocketGetAttr tests that GetAttr identifies sockets via the mode bits
+// so that fstat on a socket fd reports S_IFSOCK, and that SetAttr accepts the
+// mutable fields as a no-op.
+func TestSocketGetAttr(t *testing.T) {
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	status, attr, err := s.GetAttr(context.Background())
+	if err != nil {
+		t.Fatalf("s.GetAttr(_): %s", err)
+	}
+	if status != int32(zx.ErrOk) {
+		t.Fatalf("got s.GetAttr(_) = %s", zx.Status(status))
+	}
+	if got, want := attr.Mode, uint32(io.ModeTypeSocket); got != want {
+		t.Errorf("got attr.Mode = %#o, want = %#o", got, want)
+	}
+	if attr.ContentSize != 0 || attr.StorageSize != 0 {
+		t.Errorf("got sizes = %d/%d, want = 0/0", attr.ContentSize, attr.StorageSize)
+	}
+
+	if status, err := s.SetAttr(context.Background(), io.NodeAttributeFlagModificationTime, io.NodeAttributes{}); err != nil || status != int32(zx.ErrOk) {
+		t.Errorf("got s.SetAttr(_, MODIFICATION_TIME, {}) = %s, %v, want = %s, nil", zx.Status(status), err, zx.ErrOk)
+	}
+	if status, err := s.SetAttr(context.Background(), 1<<31, io.NodeAttributes{}); err != nil || status != int32(zx.ErrInvalidArgs) {
+		t.Errorf("got s.SetAttr(_, 1<<31, {}) = %s, %v, want = %s, nil", zx.Status(status), err, zx.ErrInvalidArgs)
+	}
+}
+
+// TestICMPEchoLoopback pings the loopback interface through a datagram ICMP
+// socket: an echo request sent with SendMsg2 comes back as an echo reply with
+// the ident rewritten to the socket's and the sequence and payload intact.
+func TestICMPEchoLoopback(t *testing.T) {
+	// cgo is not available in tests; this matches C.EAGAIN.
+	const eagain = 11
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: icmp.ProtocolNumber4,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	// An echo request: type 8, code 0, followed by the checksum, ident and
+	// sequence. The stack fills in the checksum and rewrites the ident to
+	// the socket's, as Linux does.
+	echo := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+	to := encodeAddr(ipv4.ProtocolNumber, tcpip.FullAddress{Addr: ipv4Loopback})
+	sendResult, err := s.SendMsg2(context.Background(), to, echo, nil, 0)
+	if err != nil {
+		t.Fatalf("s.SendMsg2(...): %s", err)
+	}
+	if sendResult.Which() == socket.DatagramSocketSendMsg2ResultErr {
+		t.Fatalf("got s.SendMsg2(...) = Err(%d)", sendResult.Err)
+	}
+	if got, want := sendResult.Response.Len, int64(len(echo)); got != want {
+		t.Errorf("got s.SendMsg2(...) = %d, want = %d", got, want)
+	}
+
+	var response socket.DatagramSocketRecvMsgResponse
+	for {
+		result, err := s.RecvMsg(context.Background(), 128 /* addrLen */, 1024 /* dataLen */, 0 /* controlLen */, 0 /* flags */)
+		if err != nil {
+			t.Fatalf("s.RecvMsg(...): %s", err)
+		}
+		if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+			if result.Err == eagain {
+				select {
+				case <-inCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the echo reply")
+				}
+			}
+			t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+		}
+		response = result.Response
+		break
+	}
+
+	reply := response.Data
+	if len(reply) != len(echo) {
+		t.Fatalf("got %d byte echo reply (% x), want %d bytes", len(reply), reply, len(echo))
+	}
+	if reply[0] != 0 || reply[1] != 0 {
+		t.Errorf("got reply type/code = %d/%d, want = 0/0", reply[0], reply[1])
+	}
+	if got, want := binary.BigEndian.Uint16(reply[4:]), local.Port; got != want {
+		t.Errorf("got reply ident = %d, want the socket's ident %d", got, want)
+	}
+	if got, want := string(reply[6:8]), string(echo[6:8]); got != want {
+		t.Errorf("got reply sequence = % x, want = % x", got, want)
+	}
+	if got, want := string(reply[8:]), string(echo[8:]); got != want {
+		t.Errorf("got reply payload = %q, want = %q", got, want)
+	}
+
+	// The sender address is a sockaddr_in naming the loopback address.
+	addr := response.Addr
+	if len(addr) < 8 {
+		t.Fatalf("got %d byte sender address (% x), want a sockaddr_in", len(addr), addr)
+	}
+	if got, want := binary.LittleEndian.Uint16(addr), uint16(2 /* AF_INET */); got != want {
+		t.Errorf("got sender family = %d, want = %d", got, want)
+	}
+	if got := tcpip.Address(addr[4:8]); got != ipv4Loopback {
+		t.Errorf("got sender address = %s, want = %s", got, ipv4Loopback)
+	}
+}
+
+// TestSOTimestampNs tests that with SO_TIMESTAMPNS enabled each received
+// datagram carries an SCM_TIMESTAMPNS control message holding a well-formed
+// timespec, and that the timestamps of successive datagrams do not go
+// backwards.
+func TestSOTimestampNs(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET,
+	// C.SO_TIMESTAMPNS, C.SCM_TIMESTAMPNS and C.EAGAIN.
+	const (
+		solSocket      = 1
+		soTimestampNs  = 35
+		scmTimestampNs = 35
+		eagain         = 11
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, 1)
+	setResult, err := s.SetSockOpt(context.Background(), solSocket, soTimestampNs, optVal)
+	if err != nil {
+		t.Fatalf("s.SetSockOpt(_, %d, %d, %v): %s", solSocket, soTimestampNs, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got s.SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soTimestampNs, optVal, setResult.Err)
+	}
+
+	inEntry, inCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&inEntry, waiter.EventIn)
+	defer wq.EventUnregister(&inEntry)
+
+	senderWQ := &waiter.Queue{}
+	sender, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, senderWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sender.Close()
+
+	// recv returns the timestamp from the single SCM_TIMESTAMPNS control
+	// message attached to the next datagram.
+	recv := func() int64 {
+		t.Helper()
+		for {
+			result, err := s.RecvMsg(context.Background(), 0 /* addrLen */, 1024 /* dataLen */, 256 /* controlLen */, 0 /* flags */)
+			if err != nil {
+				t.Fatalf("s.RecvMsg(...): %s", err)
+			}
+			if result.Which() == socket.DatagramSocketRecvMsgResultErr {
+				if result.Err == eagain {
+					select {
+					case <-inCh:
+						continue
+					case <-time.After(5 * time.Second):
+						t.Fatal("timed out waiting for the packet to arrive")
+					}
+				}
+				t.Fatalf("got s.RecvMsg(...) = Err(%d)", result.Err)
+			}
+			control := result.Response.Control
+			// A single cmsg: a 16 byte header followed by a 16 byte
+			// timespec.
+			if len(control) != 32 {
+				t.Fatalf("got %d control bytes, want 32", len(control))
+			}
+			if got, want := binary.LittleEndian.Uint32(control[8:]), uint32(solSocket); got != want {
+				t.Fatalf("got cmsg_level = %d, want = %d", got, want)
+			}
+			if got, want := binary.LittleEndian.Uint32(control[12:]), uint32(scmTimestampNs); got != want {
+				t.Fatalf("got cmsg_type = %d, want = %d", got, want)
+			}
+			sec := int64(binary.LittleEndian.Uint64(control[16:]))
+			nsec := int64(binary.LittleEndian.Uint64(control[24:]))
+			if nsec < 0 || nsec >= int64(time.Second) {
+				t.Fatalf("got tv_nsec = %d, want in [0, 1e9)", nsec)
+			}
+			return sec*int64(time.Second) + nsec
+		}
+	}
+
+	send := func() {
+		t.Helper()
+		if _, _, err := sender.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &local}); err != nil {
+			t.Fatalf("sender.Write(_, {To: %+v}) = %s", local, err)
+		}
+	}
+
+	send()
+	first := recv()
+	send()
+	second := recv()
+	if second < first {
+		t.Errorf("timestamps went backwards: got %d then %d", first, second)
+	}
+}
+
+func TestSOPriority(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET, C.SO_PRIORITY
+	// and C.EPERM.
+	const (
+		solSocket  = 1
+		soPriority = 12
+		eperm      = 1
+	)
+
+	ns := newNetstack(t)
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	e := endpoint{
+		wq:         wq,
+		transProto: udp.ProtocolNumber,
+		netProto:   ipv4.ProtocolNumber,
+		ns:         ns,
+	}
+	e.storeEp(ep)
+
+	set := func(v uint32) socket.BaseSocketSetSockOptResult {
+		optVal := make([]byte, 4)
+		binary.LittleEndian.PutUint32(optVal, v)
+		result, err := e.SetSockOpt(context.Background(), solSocket, soPriority, optVal)
+		if err != nil {
+			t.Fatalf("e.SetSockOpt(_, %d, %d, %v): %s", solSocket, soPriority, optVal, err)
+		}
+		return result
+	}
+	get := func() uint32 {
+		result, err := e.GetSockOpt(context.Background(), solSocket, soPriority)
+		if err != nil {
+			t.Fatalf("e.GetSockOpt(_, %d, %d): %s", solSocket, soPriority, err)
+		}
+		if result.Which() == socket.BaseSocketGetSockOptResultErr {
+			t.Fatalf("got e.GetSockOpt(_, %d, %d) = Err(%d)", solSocket, soPriority, result.Err)
+		}
+		return binary.LittleEndian.Uint32(result.Response.Optval)
+	}
+
+	if got := get(); got != 0 {
+		t.Errorf("got initial priority = %d, want = 0", got)
+	}
+
+	// Priorities in the unprivileged range round-trip.
+	if result := set(soPriorityMax); result.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got set(%d) = Err(%d)", soPriorityMax, result.Err)
+	}
+	if got, want := get(), uint32(soPriorityMax); got != want {
+		t.Errorf("got priority = %d, want = %d", got, want)
+	}
+
+	// Linux gates priorities above the unprivileged range on CAP_NET_ADMIN;
+	// rejection must not clobber the stored value.
+	if result := set(soPriorityMax + 1); result.Which() != socket.BaseSocketSetSockOptResultErr {
+		t.Errorf("got set(%d) = %#v, want = Err(%d)", soPriorityMax+1, result, eperm)
+	} else if got, want := result.Err, int32(eperm); got != want {
+		t.Errorf("got set(%d) = Err(%d), want = Err(%d)", soPriorityMax+1, got, want)
+	}
+	if got, want := get(), uint32(soPriorityMax); got != want {
+		t.Errorf("got priority = %d after rejected set, want = %d", got, want)
+	}
+}
+
+func TestTCPConnectionLimits(t *testing.T) {
+	var limits tcpConnectionLimits
+	limits.set(2, 1)
+
+	// Connections below the limits are admitted.
+	if !limits.tryAcquire(true) {
+		t.Fatal("got limits.tryAcquire(true) = false, want = true")
+	}
+	// Only one half-open connection is allowed at a time.
+	if limits.tryAcquire(true) {
+		t.Error("got limits.tryAcquire(true) = true, want = false")
+	}
+	if got, want := limits.dropped.Value(), uint64(1); got != want {
+		t.Errorf("got limits.dropped.Value() = %d, want = %d", got, want)
+	}
+
+	// Completing the handshake frees the half-open slot but the connection
+	// still counts against the total.
+	limits.established()
+	if !limits.tryAcquire(true) {
+		t.Fatal("got limits.tryAcquire(true) = false, want = true")
+	}
+	limits.established()
+
+	// The total limit is reached; new connections are refused while the
+	// established ones survive.
+	if limits.tryAcquire(false) {
+		t.Error("got limits.tryAcquire(false) = true, want = false")
+	}
+	if got, want := limits.dropped.Value(), uint64(2); got != want {
+		t.Errorf("got limits.dropped.Value() = %d, want = %d", got, want)
+	}
+
+	// Releasing an established connection admits a new one.
+	limits.release(false)
+	if !limits.tryAcquire(false) {
+		t.Fatal("got limits.tryAcquire(false) = false, want = true")
+	}
+
+	// A limit of zero means unlimited.
+	limits.set(0, 0)
+	for i := 0; i < 10; i++ {
+		if !limits.tryAcquire(true) {
+			t.Fatalf("got limits.tryAcquire(true) = false with no limit set, want = true")
+		}
+	}
+}
+
+func TestUDPReusePortGroup(t *testing.T) {
+	ns := newNetstack(t)
+
+	const port = 53
+
+	makeEndpoint := func() tcpip.Endpoint {
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(%d, %d, _) = %s", udp.ProtocolNumber, ipv4.ProtocolNumber, err)
+		}
+		t.Cleanup(ep.Close)
+		if err := ep.SetSockOptBool(tcpip.ReusePortOption, true); err != nil {
+			t.Fatalf("SetSockOptBool(tcpip.ReusePortOption, true) = %s", err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Port: port}); err != nil {
+			t.Fatalf("Bind({Port: %d}) = %s", port, err)
+		}
+		return ep
+	}
+
+	key := reuseportKey{
+		netProto:   ipv4.ProtocolNumber,
+		transProto: udp.ProtocolNumber,
+		port:       port,
+	}
+
+	eps := make([]tcpip.Endpoint, 3)
+	ids := make([]uint64, 3)
+	for i := range eps {
+		eps[i] = makeEndpoint()
+		ids[i] = ns.reuseportGroups.add(key, eps[i])
+	}
+
+	flow := func(srcPort uint16) tcpip.FullAddress {
+		return tcpip.FullAddress{Addr: "\xc0\xa8\x01\x01", Port: srcPort}
+	}
+
+	// Datagrams spread across all members of the group.
+	const flows = 128
+	chosen := make(map[uint16]tcpip.Endpoint, flows)
+	hits := make(map[tcpip.Endpoint]int)
+	for p := uint16(0); p < flows; p++ {
+		ep := ns.reuseportGroups.selectMember(key, flow(p))
+		if ep == nil {
+			t.Fatalf("got selectMember(%+v) = nil for source port %d", key, p)
+		}
+		chosen[p] = ep
+		hits[ep]++
+	}
+	for i, ep := range eps {
+		if hits[ep] == 0 {
+			t.Errorf("member %d received no flows out of %d", i, flows)
+		}
+	}
+
+	// Removing a member redistributes only the flows it was receiving;
+	// flows reaching the surviving members are undisturbed.
+	ns.reuseportGroups.remove(key, ids[1])
+	for p := uint16(0); p < flows; p++ {
+		ep := ns.reuseportGroups.selectMember(key, flow(p))
+		if before := chosen[p]; before == eps[1] {
+			if ep == eps[1] {
+				t.Errorf("flow with source port %d still maps to the removed member", p)
+			}
+		} else if ep != before {
+			t.Errorf("flow with source port %d moved between surviving members", p)
+		}
+	}
+
+	ns.reuseportGroups.remove(key, ids[0])
+	ns.reuseportGroups.remove(key, ids[2])
+	if ep := ns.reuseportGroups.selectMember(key, flow(0)); ep != nil {
+		t.Errorf("got selectMember on an empty group = %p, want = nil", ep)
+	}
+}
+
+func TestDHCPRebindMigratesEndpoints(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	nicInfos := ns.stack.NICInfo()
+	if got := len(nicInfos); got != 1 {
+		t.Fatalf("got len(ns.stack.NICInfo()) = %d, want = 1", got)
+	}
+	var nicid tcpip.NICID
+	for id := range nicInfos {
+		nicid = id
+	}
+
+	oldAddr := tcpip.Address("\xc0\xa8\x01\x01")
+	newAddr := tcpip.Address("\xc0\xa8\x01\x02")
+	for _, addr := range []tcpip.Address{oldAddr, newAddr} {
+		if err := ns.stack.AddAddress(nicid, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s) = %s", nicid, ipv4.ProtocolNumber, addr, err)
+		}
+	}
+
+	makeSocket := func(bind tcpip.FullAddress) *endpointWithEvent {
+		wq := &waiter.Queue{}
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(%d, %d, _) = %s", udp.ProtocolNumber, ipv4.ProtocolNumber, err)
+		}
+		if err := ep.Bind(bind); err != nil {
+			t.Fatalf("Bind(%+v) = %s", bind, err)
+		}
+		epe := &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		}
+		epe.storeEp(ep)
+		ns.rebindable.add(epe)
+		t.Cleanup(func() {
+			ns.rebindable.remove(epe)
+			epe.loadEp().Close()
+		})
+		return epe
+	}
+
+	bound := makeSocket(tcpip.FullAddress{Addr: oldAddr, Port: 1234})
+	wildcard := makeSocket(tcpip.FullAddress{Port: 5555})
+	connected := makeSocket(tcpip.FullAddress{Addr: oldAddr, Port: 1235})
+	if err := connected.loadEp().Connect(tcpip.FullAddress{Addr: ipv4Loopback, Port: 9}); err != nil {
+		t.Fatalf("Connect({%s, 9}) = %s", ipv4Loopback, err)
+	}
+
+	// Simulate a DHCP rebind handing out newAddr in place of oldAddr.
+	ns.migrateEndpoints(oldAddr, newAddr)
+
+	if local, err := bound.loadEp().GetLocalAddress(); err != nil {
+		t.Fatalf("bound.loadEp().GetLocalAddress() = %s", err)
+	} else if local.Addr != newAddr || local.Port != 1234 {
+		t.Errorf("got bound local address = %+v, want = {%s, 1234}", local, newAddr)
+	}
+
+	// Wildcard binds follow interface addresses by construction and must not
+	// acquire a specific address.
+	if local, err := wildcard.loadEp().GetLocalAddress(); err != nil {
+		t.Fatalf("wildcard.loadEp().GetLocalAddress() = %s", err)
+	} else if len(local.Addr) != 0 || local.Port != 5555 {
+		t.Errorf("got wildcard local address = %+v, want = {<unspecified>, 5555}", local)
+	}
+
+	// Connected sockets cannot move; their peer association names the old
+	// address.
+	if local, err := connected.loadEp().GetLocalAddress(); err != nil {
+		t.Fatalf("connected.loadEp().GetLocalAddress() = %s", err)
+	} else if local.Addr == newAddr {
+		t.Errorf("got connected local address = %+v, want unchanged", local)
+	}
+}
+
+func TestInterfaceRateSampler(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	var nicid tcpip.NICID
+	for id := range ns.stack.NICInfo() {
+		nicid = id
+	}
+
+	sampler := newInterfaceRateSampler(ns.stack, time.Second, 5*time.Second)
+
+	if _, ok := sampler.rates(nicid); ok {
+		t.Error("got rates for a NIC that has never been sampled")
+	}
+
+	start := time.Now()
+	sampler.sampleAt(start)
+
+	// A single sample is not enough to compute rates.
+	if rates, ok := sampler.rates(nicid); !ok {
+		t.Fatal("got no rates for a sampled NIC")
+	} else if rates.valid {
+		t.Errorf("got rates.valid = true with a single sample, want = false")
+	} else if rates.rxBytesPerSecond != 0 || rates.txBytesPerSecond != 0 {
+		t.Errorf("got nonzero rates = %+v with a single sample", rates)
+	}
+
+	// Push a known rate through the NIC's counters: 1000 bytes and 10
+	// packets received, 500 bytes and 5 packets sent, per second.
+	info := ns.stack.NICInfo()[nicid]
+	for i := 1; i <= 2; i++ {
+		info.Stats.Rx.Bytes.IncrementBy(1000)
+		info.Stats.Rx.Packets.IncrementBy(10)
+		info.Stats.Tx.Bytes.IncrementBy(500)
+		info.Stats.Tx.Packets.IncrementBy(5)
+		sampler.sampleAt(start.Add(time.Duration(i) * time.Second))
+	}
+
+	rates, ok := sampler.rates(nicid)
+	if !ok {
+		t.Fatal("got no rates for a sampled NIC")
+	}
+	if !rates.valid {
+		t.Fatal("got rates.valid = false with multiple samples, want = true")
+	}
+	for _, c := range []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{"rxBytesPerSecond", rates.rxBytesPerSecond, 1000},
+		{"rxPacketsPerSecond", rates.rxPacketsPerSecond, 10},
+		{"txBytesPerSecond", rates.txBytesPerSecond, 500},
+		{"txPacketsPerSecond", rates.txPacketsPerSecond, 5},
+	} {
+		if c.got != c.want {
+			t.Errorf("got rates.%s = %d, want = %d", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestDirectedBroadcast(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	var nicid tcpip.NICID
+	for id := range ns.stack.NICInfo() {
+		nicid = id
+	}
+
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address("\xc0\xa8\x01\x01"),
+			PrefixLen: 24,
+		},
+	}
+	if found, err := ns.addInterfaceAddress(nicid, addr); err != nil || !found {
+		t.Fatalf("got ns.addInterfaceAddress(%d, %+v) = (%t, %v), want = (true, nil)", nicid, addr, found, err)
+	}
+	bcast := tcpip.Address("\xc0\xa8\x01\xff")
+
+	isLocal := func() bool {
+		return ns.stack.CheckLocalAddress(nicid, ipv4.ProtocolNumber, bcast) != 0
+	}
+
+	// Default off: the broadcast address is not delivered locally.
+	if isLocal() {
+		t.Errorf("got broadcast address %s local with directed broadcast disabled", bcast)
+	}
+	if enabled, found := ns.getInterfaceDirectedBroadcast(nicid); !found || enabled {
+		t.Errorf("got ns.getInterfaceDirectedBroadcast(%d) = (%t, %t), want = (false, true)", nicid, enabled, found)
+	}
+
+	if !ns.setInterfaceDirectedBroadcast(nicid, true) {
+		t.Fatalf("got ns.setInterfaceDirectedBroadcast(%d, true) = false, want = true", nicid)
+	}
+	if !isLocal() {
+		t.Errorf("got broadcast address %s not local with directed broadcast enabled", bcast)
+	}
+	if enabled, found := ns.getInterfaceDirectedBroadcast(nicid); !found || !enabled {
+		t.Errorf("got ns.getInterfaceDirectedBroadcast(%d) = (%t, %t), want = (true, true)", nicid, enabled, found)
+	}
+
+	// Addresses added while the setting is enabled are covered too.
+	addr2 := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address("\x0a\x00\x00\x01"),
+			PrefixLen: 8,
+		},
+	}
+	if found, err := ns.addInterfaceAddress(nicid, addr2); err != nil || !found {
+		t.Fatalf("got ns.addInterfaceAddress(%d, %+v) = (%t, %v), want = (true, nil)", nicid, addr2, found, err)
+	}
+	if bcast2 := tcpip.Address("\x0a\xff\xff\xff"); ns.stack.CheckLocalAddress(nicid, ipv4.ProtocolNumber, bcast2) == 0 {
+		t.Errorf("got broadcast address %s not local after adding %+v with directed broadcast enabled", bcast2, addr2)
+	}
+
+	if !ns.setInterfaceDirectedBroadcast(nicid, false) {
+		t.Fatalf("got ns.setInterfaceDirectedBroadcast(%d, false) = false, want = true", nicid)
+	}
+	if isLocal() {
+		t.Errorf("got broadcast address %s local after disabling directed broadcast", bcast)
+	}
+
+	if ns.setInterfaceDirectedBroadcast(nicid+42, true) {
+		t.Errorf("got ns.setInterfaceDirectedBroadcast(%d, true) = true for an unknown NIC, want = false", nicid+42)
+	}
+	if _, found := ns.getInterfaceDirectedBroadcast(nicid + 42); found {
+		t.Errorf("got ns.getInterfaceDirectedBroadcast(%d) found for an unknown NIC", nicid+42)
+	}
+}
+
+func TestReplaceRoutes(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	var nicid tcpip.NICID
+	for id := range ns.stack.NICInfo() {
+		nicid = id
+	}
+
+	contains := func(route tcpip.Route) bool {
+		for _, er := range ns.GetExtendedRouteTable() {
+			if er.Route == route {
+				return true
+			}
+		}
+		return false
+	}
+
+	staticRoute := addressWithPrefixRoute(nicid, tcpip.AddressWithPrefix{
+		Address:   tcpip.Address("\xc0\xa8\x01\x01"),
+		PrefixLen: 24,
+	})
+	if err := ns.AddRoute(staticRoute, metricNotSet, false /* dynamic */); err != nil {
+		t.Fatalf("ns.AddRoute(%s, _, false): %s", staticRoute, err)
+	}
+	dynamicRoute := defaultV4Route(nicid, ipv4Loopback)
+	if err := ns.AddRoute(dynamicRoute, metricNotSet, true /* dynamic */); err != nil {
+		t.Fatalf("ns.AddRoute(%s, _, true): %s", dynamicRoute, err)
+	}
+
+	// A swap containing an invalid route is rejected with nothing applied.
+	newRoute := addressWithPrefixRoute(nicid, tcpip.AddressWithPrefix{
+		Address:   tcpip.Address("\x0a\x00\x00\x01"),
+		PrefixLen: 8,
+	})
+	badRoute := addressWithPrefixRoute(nicid+42, tcpip.AddressWithPrefix{
+		Address:   tcpip.Address("\x0a\x01\x00\x01"),
+		PrefixLen: 8,
+	})
+	before := ns.GetExtendedRouteTable()
+	if err := ns.ReplaceRoutes(0, []tcpip.Route{newRoute, badRoute}, metricNotSet); err == nil {
+		t.Fatal("got ns.ReplaceRoutes(_) = nil, want an error for a route on an unknown NIC")
+	}
+	if got, want := len(ns.GetExtendedRouteTable()), len(before); got != want {
+		t.Errorf("got %d routes after rejected swap, want = %d", got, want)
+	}
+	if contains(newRoute) {
+		t.Errorf("got route %s in table after rejected swap", newRoute)
+	}
+
+	// A valid swap replaces the NIC's static routes but preserves the
+	// dynamic route.
+	if err := ns.ReplaceRoutes(nicid, []tcpip.Route{newRoute}, metricNotSet); err != nil {
+		t.Fatalf("ns.ReplaceRoutes(%d, [%s], _): %s", nicid, newRoute, err)
+	}
+	if !contains(newRoute) {
+		t.Errorf("got route %s missing from table after swap", newRoute)
+	}
+	if contains(staticRoute) {
+		t.Errorf("got superseded static route %s in table after swap", staticRoute)
+	}
+	if !contains(dynamicRoute) {
+		t.Errorf("got dynamic route %s missing from table after swap", dynamicRoute)
+	}
+}
+
+// TestAbortNICEndpoints tests that aborting a NIC's endpoints resets TCP
+// connections established through that NIC.
+func TestAbortNICEndpoints(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	nicInfos := ns.stack.NICInfo()
+	if got := len(nicInfos); got != 1 {
+		t.Fatalf("got len(ns.stack.NICInfo()) = %d, want = 1", got)
+	}
+	var nicid tcpip.NICID
+	for id := range nicInfos {
+		nicid = id
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("listener.Bind(%s) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("listener.Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("listener.GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eps.close()
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		t.Fatalf("client.Connect(%+v) = %s", listenAddr, err)
+	}
+	if _, err := client.GetRemoteAddress(); err != nil {
+		t.Fatalf("client.GetRemoteAddress() = %s", err)
+	}
+
+	server, serverWQ, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-listenCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting to accept the connection")
+				}
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		t.Fatalf("listener.Accept() = %s", err)
+	}
+	defer server.Close()
+
+	serverEntry, serverCh := waiter.NewChannelEntry(nil)
+	serverWQ.EventRegister(&serverEntry, waiter.EventIn|waiter.EventHUp|waiter.EventErr)
+	defer serverWQ.EventUnregister(&serverEntry)
+
+	ns.abortNICEndpoints(nicid)
+
+	// The abort is observed as a hang-up by the client's close machinery.
+	select {
+	case <-eps.closing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the aborted endpoint to start closing")
+	}
+
+	// The abort sends a RST to the server.
+	for {
+		_, _, err := server.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-serverCh:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the connection to reset")
+			}
+		}
+		if err != tcpip.ErrConnectionReset {
+			t.Fatalf("got server.Read(nil) = (_, _, %v), want = (_, _, %s)", err, tcpip.ErrConnectionReset)
+		}
+		break
+	}
+}
+
+// TestReceiveLowWatermark tests that a stream socket with SO_RCVLOWAT set does
+// not become readable until the watermark's worth of bytes has been received.
+func TestReceiveLowWatermark(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET and
+	// C.SO_RCVLOWAT.
+	const (
+		solSocket  = 1
+		soRcvlowat = 18
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("listener.Bind(%s) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("listener.Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("listener.GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eps.close()
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		t.Fatalf("client.Connect(%+v) = %s", listenAddr, err)
+	}
+
+	server, _, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-listenCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting to accept the connection")
+				}
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		t.Fatalf("listener.Accept() = %s", err)
+	}
+	defer server.Close()
+
+	below := []byte("data")
+	above := []byte("more")
+	lowat := uint32(len(below) + len(above))
+
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, lowat)
+	setResult, err := eps.endpoint.SetSockOpt(context.Background(), solSocket, soRcvlowat, optVal)
+	if err != nil {
+		t.Fatalf("SetSockOpt(_, %d, %d, %v): %s", solSocket, soRcvlowat, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soRcvlowat, optVal, setResult.Err)
+	}
+
+	if _, err := server.Write(tcpip.SlicePayload(below), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("server.Write(%q) = %s", below, err)
+	}
+
+	// Fewer bytes than the watermark must not make the socket readable.
+	switch _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketReadable, zx.Sys_deadline_after(zx.Duration(50*time.Millisecond.Nanoseconds()))); err := err.(type) {
+	case *zx.Error:
+		if err.Status != zx.ErrTimedOut {
+			t.Fatalf("got zxwait.Wait(eps.peer, zx.SignalSocketReadable, _) = %s, want = %s", err, zx.ErrTimedOut)
+		}
+	default:
+		t.Fatalf("got zxwait.Wait(eps.peer, zx.SignalSocketReadable, _) = %v, want = %s", err, zx.ErrTimedOut)
+	}
+
+	if _, err := server.Write(tcpip.SlicePayload(above), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("server.Write(%q) = %s", above, err)
+	}
+
+	// Crossing the watermark makes the data visible all at once.
+	if _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketReadable, zx.Sys_deadline_after(zx.Duration((5 * time.Second).Nanoseconds()))); err != nil {
+		t.Fatalf("timed out waiting for the watermark to be crossed: %s", err)
+	}
+	b := make([]byte, lowat+1)
+	n, err := eps.peer.Read(b, 0)
+	if err != nil {
+		t.Fatalf("eps.peer.Read() = %s", err)
+	}
+	if got, want := string(b[:n]), string(below)+string(above); got != want {
+		t.Errorf("got eps.peer.Read() = %q, want = %q", got, want)
+	}
+}
+
+// TestHalfCloseDeliversTail tests that when the peer sends data and then
+// closes, the data is delivered before EOF is signalled rather than being
+// lost — including data held back below the receive low watermark, which can
+// never be crossed once the peer has sent its FIN.
+func TestHalfCloseDeliversTail(t *testing.T) {
+	// cgo is not available in tests; these match C.SOL_SOCKET and
+	// C.SO_RCVLOWAT.
+	const (
+		solSocket  = 1
+		soRcvlowat = 18
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("listener.Bind(%s) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("listener.Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("listener.GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eps.close()
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		t.Fatalf("client.Connect(%+v) = %s", listenAddr, err)
+	}
+
+	server, _, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-listenCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting to accept the connection")
+				}
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		t.Fatalf("listener.Accept() = %s", err)
+	}
+	defer server.Close()
+
+	// A watermark above the payload size ensures the data is held back in
+	// the read loop when the FIN arrives.
+	tail := []byte("goodbye")
+	optVal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(optVal, uint32(len(tail))+1)
+	setResult, err := eps.endpoint.SetSockOpt(context.Background(), solSocket, soRcvlowat, optVal)
+	if err != nil {
+		t.Fatalf("SetSockOpt(_, %d, %d, %v): %s", solSocket, soRcvlowat, optVal, err)
+	}
+	if setResult.Which() == socket.BaseSocketSetSockOptResultErr {
+		t.Fatalf("got SetSockOpt(_, %d, %d, %v) = Err(%d)", solSocket, soRcvlowat, optVal, setResult.Err)
+	}
+
+	if _, err := server.Write(tcpip.SlicePayload(tail), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("server.Write(%q) = %s", tail, err)
+	}
+	server.Close()
+
+	if _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketReadable, zx.Sys_deadline_after(zx.Duration((5 * time.Second).Nanoseconds()))); err != nil {
+		t.Fatalf("timed out waiting for the tail to be delivered: %s", err)
+	}
+	b := make([]byte, len(tail)+1)
+	n, err := eps.peer.Read(b, 0)
+	if err != nil {
+		t.Fatalf("eps.peer.Read() = %s", err)
+	}
+	if got, want := string(b[:n]), string(tail); got != want {
+		t.Errorf("got eps.peer.Read() = %q, want = %q", got, want)
+	}
+
+	// With the tail consumed the next read must report EOF.
+	if _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketPeerWriteDisabled, zx.Sys_deadline_after(zx.Duration((5 * time.Second).Nanoseconds()))); err != nil {
+		t.Fatalf("timed out waiting for the EOF to be signalled: %s", err)
+	}
+	switch _, err := eps.peer.Read(b, 0); err := err.(type) {
+	case *zx.Error:
+		if err.Status != zx.ErrBadState {
+			t.Errorf("got eps.peer.Read() = %s, want = %s", err, zx.ErrBadState)
+		}
+	default:
+		t.Errorf("got eps.peer.Read() = %v, want = %s", err, zx.ErrBadState)
+	}
+}
+
+// TestStreamShutdown tests half-closing a stream socket: after SHUT_WR the
+// peer sees the data sent before the shutdown followed by EOF, while the
+// reverse direction keeps working, and shutting down an unconnected socket
+// reports ENOTCONN.
+func TestStreamShutdown(t *testing.T) {
+	// cgo is not available in tests; these match C.SHUT_WR, C.EINVAL and
+	// C.ENOTCONN.
+	const (
+		shutWr   = 1
+		einval   = 22
+		enotconn = 107
+		badHow   = 3
+	)
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("listener.Bind(%s) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("listener.Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("listener.GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eps.close()
+	s := &streamSocketImpl{endpointWithSocket: eps}
+
+	// A socket that was never connected cannot be shut down.
+	result, err := s.Shutdown(context.Background(), shutWr)
+	if err != nil {
+		t.Fatalf("s.Shutdown(_, SHUT_WR): %s", err)
+	}
+	if result.Which() != socket.StreamSocketShutdownResultErr {
+		t.Errorf("got s.Shutdown(_, SHUT_WR) on an unconnected socket = success, want Err(%d)", enotconn)
+	} else if got, want := result.Err, int32(enotconn); got != want {
+		t.Errorf("got s.Shutdown(_, SHUT_WR) on an unconnected socket = Err(%d), want Err(%d)", got, want)
+	}
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		t.Fatalf("client.Connect(%+v) = %s", listenAddr, err)
+	}
+
+	server, serverWQ, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-listenCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting to accept the connection")
+				}
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		t.Fatalf("listener.Accept() = %s", err)
+	}
+	defer server.Close()
+	serverEntry, serverCh := waiter.NewChannelEntry(nil)
+	serverWQ.EventRegister(&serverEntry, waiter.EventIn)
+	defer serverWQ.EventUnregister(&serverEntry)
+
+	// An unknown how is rejected.
+	result, err = s.Shutdown(context.Background(), badHow)
+	if err != nil {
+		t.Fatalf("s.Shutdown(_, %d): %s", badHow, err)
+	}
+	if result.Which() != socket.StreamSocketShutdownResultErr {
+		t.Errorf("got s.Shutdown(_, %d) = success, want Err(%d)", badHow, einval)
+	} else if got, want := result.Err, int32(einval); got != want {
+		t.Errorf("got s.Shutdown(_, %d) = Err(%d), want Err(%d)", badHow, got, want)
+	}
+
+	// Data written before the shutdown must still reach the peer, followed
+	// by EOF.
+	ping := []byte("ping")
+	if _, err := eps.peer.Write(ping, 0); err != nil {
+		t.Fatalf("eps.peer.Write(%q) = %s", ping, err)
+	}
+	result, err = s.Shutdown(context.Background(), shutWr)
+	if err != nil {
+		t.Fatalf("s.Shutdown(_, SHUT_WR): %s", err)
+	}
+	if result.Which() == socket.StreamSocketShutdownResultErr {
+		t.Fatalf("got s.Shutdown(_, SHUT_WR) = Err(%d)", result.Err)
+	}
+
+	var sender tcpip.FullAddress
+	var received []byte
+	for {
+		v, _, err := server.Read(&sender)
+		switch err {
+		case nil:
+			received = append(received, v...)
+			continue
+		case tcpip.ErrWouldBlock:
+			select {
+			case <-serverCh:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for EOF; received %q so far", received)
+			}
+		case tcpip.ErrClosedForReceive:
+			// EOF.
+		default:
+			t.Fatalf("server.Read() = %s", err)
+		}
+		break
+	}
+	if got, want := string(received), string(ping); got != want {
+		t.Errorf("got data before EOF = %q, want = %q", got, want)
+	}
+
+	// Further client writes fail; the write direction is gone.
+	switch _, err := eps.peer.Write(ping, 0); err := err.(type) {
+	case *zx.Error:
+		if err.Status != zx.ErrBadState {
+			t.Errorf("got eps.peer.Write(...) after SHUT_WR = %s, want = %s", err, zx.ErrBadState)
+		}
+	default:
+		t.Errorf("got eps.peer.Write(...) after SHUT_WR = %v, want = %s", err, zx.ErrBadState)
+	}
+
+	// The reverse direction is unaffected.
+	pong := []byte("pong")
+	if _, err := server.Write(tcpip.SlicePayload(pong), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("server.Write(%q) = %s", pong, err)
+	}
+	if _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketReadable, zx.Sys_deadline_after(zx.Duration((5 * time.Second).Nanoseconds()))); err != nil {
+		t.Fatalf("timed out waiting for the reverse direction: %s", err)
+	}
+	b := make([]byte, len(pong)+1)
+	n, err := eps.peer.Read(b, 0)
+	if err != nil {
+		t.Fatalf("eps.peer.Read() = %s", err)
+	}
+	if got, want := string(b[:n]), string(pong); got != want {
+		t.Errorf("got eps.peer.Read() = %q, want = %q", got, want)
+	}
+}
+
+// BenchmarkLoopWriteTCP measures shuttling stream payloads from the zircon
+// socket into the TCP endpoint, the only transport that reaches loopWrite in
+// production. The write loop stages reads in recycled buffers and hands the
+// endpoint a copy sized to the data, so allocations should stay proportional
+// to the bytes moved rather than the staging buffer capacity.
+func BenchmarkLoopWriteTCP(b *testing.B) {
+	stk := tcpipstack.New(tcpipstack.Options{
+		NetworkProtocols: []tcpipstack.NetworkProtocol{
+			arp.NewProtocol(),
+			ipv4.NewProtocol(),
+			ipv6.NewProtocol(),
+		},
+		TransportProtocols: []tcpipstack.TransportProtocol{
+			tcp.NewProtocol(),
+			udp.NewProtocol(),
+		},
+	})
+	ns := &Netstack{
+		stack:     stk,
+		dnsClient: dns.NewClient(stk),
+	}
+	if err := ns.addLoopback(); err != nil {
+		b.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		b.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		b.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		b.Fatalf("Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		b.Fatalf("GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		b.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer eps.close()
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		b.Fatalf("Connect(%+v) = %s", listenAddr, err)
+	}
+
+	server, serverWQ, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				<-listenCh
+				continue
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		b.Fatalf("Accept() = %s", err)
+	}
+	defer server.Close()
+
+	// Drain the server side so the client's send window never closes.
+	serverEntry, serverCh := waiter.NewChannelEntry(nil)
+	serverWQ.EventRegister(&serverEntry, waiter.EventIn)
+	defer serverWQ.EventUnregister(&serverEntry)
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		for {
+			switch _, _, err := server.Read(nil); err {
+			case nil:
+			case tcpip.ErrWouldBlock:
+				<-serverCh
+			default:
+				return
+			}
+		}
+	}()
+
+	payload := make([]byte, 2048)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for {
+			if _, err := eps.peer.Write(payload, 0); err != nil {
+				if err, ok := err.(*zx.Error); ok && err.Status == zx.ErrShouldWait {
+					if _, err := zxwait.Wait(zx.Handle(eps.peer), zx.SignalSocketWritable, zx.TimensecInfinite); err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				b.Fatal(err)
+			}
+			break
+		}
+	}
+	b.StopTimer()
+
+	// Send EOF so the drain goroutine observes the end of the stream once it
+	// has consumed everything in flight.
+	if err := eps.peer.Shutdown(zx.SocketShutdownWrite); err != nil {
+		b.Fatal(err)
+	}
+	<-drainDone
+}
+
+func BenchmarkSendMsgSegments(b *testing.B) {
+	stk := tcpipstack.New(tcpipstack.Options{
+		NetworkProtocols: []tcpipstack.NetworkProtocol{
+			arp.NewProtocol(),
+			ipv4.NewProtocol(),
+			ipv6.NewProtocol(),
+		},
+		TransportProtocols: []tcpipstack.TransportProtocol{
+			tcp.NewProtocol(),
+			udp.NewProtocol(),
+		},
+	})
+	ns := &Netstack{
+		stack:     stk,
+		dnsClient: dns.NewClient(stk),
+	}
+	if err := ns.addLoopback(); err != nil {
+		b.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	sinkWQ := &waiter.Queue{}
+	sink, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, sinkWQ)
+	if err != nil {
+		b.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer sink.Close()
+	if err := sink.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		b.Fatalf("Bind({%s}) = %s", ipv4Loopback, err)
+	}
+	local, err := sink.GetLocalAddress()
+	if err != nil {
+		b.Fatalf("GetLocalAddress() = %s", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		b.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(local); err != nil {
+		b.Fatalf("Connect(%+v) = %s", local, err)
+	}
+	s := &datagramSocketImpl{
+		endpointWithEvent: &endpointWithEvent{
+			endpoint: endpoint{
+				wq:         wq,
+				transProto: udp.ProtocolNumber,
+				netProto:   ipv4.ProtocolNumber,
+				ns:         ns,
+			},
+		},
+	}
+	s.storeEp(ep)
+
+	segments := make([][]uint8, 16)
+	size := 0
+	for i := range segments {
+		segments[i] = make([]uint8, 64)
+		size += len(segments[i])
+	}
+	b.SetBytes(int64(size))
+
+	b.Run("flatten", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			flat := make([]byte, 0, size)
+			for _, segment := range segments {
+				flat = append(flat, segment...)
+			}
+			result, err := s.SendMsg2(nil, nil, flat, nil, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if result.Which() != socket.DatagramSocketSendMsg2ResultResponse {
+				b.Fatalf("SendMsg2(...) = %d", result.Err)
+			}
+		}
+	})
+
+	b.Run("vectorized", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			result, err := s.SendMsg(nil, nil, segments, nil, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if result.Which() != socket.DatagramSocketSendMsgResultResponse {
+				b.Fatalf("SendMsg(...) = %d", result.Err)
+			}
+		}
+	})
+}
+
+func TestZirconSocketOccupancy(t *testing.T) {
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+
+	listenWQ := &waiter.Queue{}
+	listener, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: ipv4Loopback}); err != nil {
+		t.Fatalf("listener.Bind(%s) = %s", ipv4Loopback, err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("listener.Listen(1) = %s", err)
+	}
+	listenAddr, err := listener.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("listener.GetLocalAddress() = %s", err)
+	}
+	listenEntry, listenCh := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&listenEntry, waiter.EventIn)
+	defer listenWQ.EventUnregister(&listenEntry)
+
+	clientWQ := &waiter.Queue{}
+	client, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint() = %s", err)
+	}
+	eps, err := newEndpointWithSocket(client, clientWQ, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eps.close()
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	clientWQ.EventRegister(&connectEntry, waiter.EventOut)
+	defer clientWQ.EventUnregister(&connectEntry)
+	switch err := client.Connect(listenAddr); err {
+	case nil:
+	case tcpip.ErrConnectStarted:
+		<-connectCh
+	default:
+		t.Fatalf("client.Connect(%+v) = %s", listenAddr, err)
+	}
+
+	server, _, err := func() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+		for {
+			server, serverWQ, err := listener.Accept()
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-listenCh:
+					continue
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting to accept the connection")
+				}
+			}
+			return server, serverWQ, err
+		}
+	}()
+	if err != nil {
+		t.Fatalf("listener.Accept() = %s", err)
+	}
+	defer server.Close()
+
+	occupancy, ok := readSocketOccupancy(zx.Handle(eps.local), eps.loadEp())
+	if !ok {
+		t.Fatal("got readSocketOccupancy(eps.local, _) = _, false, want _, true")
+	}
+	if occupancy != (socketOccupancy{}) {
+		t.Errorf("got readSocketOccupancy(eps.local, _) = %+v, want all zeros", occupancy)
+	}
+
+	// Write without the client reading; the bytes travel through the gVisor
+	// receive queue and settle in the zircon socket, where the in-transit
+	// count must observe them.
+	msg := []byte("in transit")
+	if _, err := server.Write(tcpip.SlicePayload(msg), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("server.Write(%q) = %s", msg, err)
+	}
+	for start := time.Now(); ; {
+		occupancy, ok := readSocketOccupancy(zx.Handle(eps.local), eps.loadEp())
+		if !ok {
+			t.Fatal("got readSocketOccupancy(eps.local, _) = _, false, want _, true")
+		}
+		if occupancy.rxBytesInZxSocket == uint64(len(msg)) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for the in-transit count to reach %d; last read %+v", len(msg), occupancy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A handle that is not a zircon socket has no occupancy to read; this is
+	// the datagram socket case, whose data plane is an eventpair and FIDL.
+	var localE, peerE zx.Handle
+	if status := zx.Sys_eventpair_create(0, &localE, &peerE); status != zx.ErrOk {
+		t.Fatalf("zx.Sys_eventpair_create(0, _, _) = %s", status)
+	}
+	defer localE.Close()
+	defer peerE.Close()
+	if occupancy, ok := readSocketOccupancy(localE, eps.loadEp()); ok {
+		t.Errorf("got readSocketOccupancy(eventpair, _) = %+v, true, want _, false", occupancy)
+	}
+}
+
 func TestEndpoint_Close(t *testing.T) {
 	ns := newNetstack(t)
 	wq := &waiter.Queue{}
@@ -727,6 +4600,120 @@ func TestUniqueFallbackNICNames(t *testing.T) {
 	}
 }
 
+func TestSetInterfaceName(t *testing.T) {
+	ns := newNetstack(t)
+
+	d1 := deviceForAddEth(ethernet.Info{}, t)
+	ifs1, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: "vnic1"}, &d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d2 := deviceForAddEth(ethernet.Info{}, t)
+	ifs2, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: "vnic2"}, &d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := ns.setInterfaceName(uint64(ifs2.nicid)+1, "newname"); result.Which() != stack.StackSetInterfaceNameResultErr || result.Err != stack.ErrorNotFound {
+		t.Errorf("got ns.setInterfaceName(%d, %q) = %#v, want = %s", uint64(ifs2.nicid)+1, "newname", result, stack.ErrorNotFound)
+	}
+
+	// An empty name, a name beyond the FIDL length limit, and another NIC's
+	// name are all rejected.
+	for _, name := range []string{"", "0123456789abcdef", "vnic2"} {
+		if result := ns.setInterfaceName(uint64(ifs1.nicid), name); result.Which() != stack.StackSetInterfaceNameResultErr || result.Err != stack.ErrorInvalidArgs {
+			t.Errorf("got ns.setInterfaceName(%d, %q) = %#v, want = %s", ifs1.nicid, name, result, stack.ErrorInvalidArgs)
+		}
+	}
+
+	if result := ns.setInterfaceName(uint64(ifs1.nicid), "renamed"); result.Which() != stack.StackSetInterfaceNameResultResponse {
+		t.Fatalf("got ns.setInterfaceName(%d, %q) = %#v, want response", ifs1.nicid, "renamed", result)
+	}
+
+	if got, want := ns.name(ifs1.nicid), "renamed"; got != want {
+		t.Errorf("got ns.name(%d) = %q, want = %q", ifs1.nicid, got, want)
+	}
+	if got, want := ns.NICInfo()[ifs1.nicid].Name, "renamed"; got != want {
+		t.Errorf("got ns.NICInfo()[%d].Name = %q, want = %q", ifs1.nicid, got, want)
+	}
+
+	sp := providerImpl{ns: ns}
+	if result, err := sp.InterfaceNameToIndex(context.Background(), "renamed"); err != nil {
+		t.Fatalf("sp.InterfaceNameToIndex(_, %q): %s", "renamed", err)
+	} else if result.Which() != socket.ProviderInterfaceNameToIndexResultResponse || result.Response.Index != uint64(ifs1.nicid) {
+		t.Errorf("got sp.InterfaceNameToIndex(_, %q) = %#v, want index = %d", "renamed", result, ifs1.nicid)
+	}
+	if result, err := sp.InterfaceNameToIndex(context.Background(), "vnic1"); err != nil {
+		t.Fatalf("sp.InterfaceNameToIndex(_, %q): %s", "vnic1", err)
+	} else if result.Which() != socket.ProviderInterfaceNameToIndexResultErr {
+		t.Errorf("got sp.InterfaceNameToIndex(_, %q) = %#v, want error; the old name should no longer resolve", "vnic1", result)
+	}
+	if result, err := sp.InterfaceIndexToName(context.Background(), uint64(ifs1.nicid)); err != nil {
+		t.Fatalf("sp.InterfaceIndexToName(_, %d): %s", ifs1.nicid, err)
+	} else if result.Which() != socket.ProviderInterfaceIndexToNameResultResponse || result.Response.Name != "renamed" {
+		t.Errorf("got sp.InterfaceIndexToName(_, %d) = %#v, want name = %q", ifs1.nicid, result, "renamed")
+	}
+}
+
+func TestSelectSourceAddress(t *testing.T) {
+	// cgo is not available in tests; this matches C.EHOSTUNREACH.
+	const ehostunreach = 113
+
+	ns := newNetstack(t)
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback(): %s", err)
+	}
+	var nicid tcpip.NICID
+	for id := range ns.stack.NICInfo() {
+		nicid = id
+	}
+
+	globalAddr := tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	globalDest := tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+
+	// Two candidate v6 sources: a link-local and a global address.
+	for _, addr := range []tcpip.Address{testLinkLocalV6Addr1, globalAddr} {
+		if err := ns.stack.AddAddress(nicid, ipv6.ProtocolNumber, addr); err != nil {
+			t.Fatalf("ns.stack.AddAddress(%d, ipv6, %s): %s", nicid, addr, err)
+		}
+	}
+	route := addressWithPrefixRoute(nicid, tcpip.AddressWithPrefix{
+		Address:   globalDest,
+		PrefixLen: 64,
+	})
+	if err := ns.AddRoute(route, metricNotSet, false /* dynamic */); err != nil {
+		t.Fatalf("ns.AddRoute(%s, _, false): %s", route, err)
+	}
+
+	sp := providerImpl{ns: ns}
+	result, err := sp.SelectSourceAddress(context.Background(), fidlconv.ToNetIpAddress(globalDest))
+	if err != nil {
+		t.Fatalf("sp.SelectSourceAddress(_, %s): %s", globalDest, err)
+	}
+	if result.Which() != socket.ProviderSelectSourceAddressResultResponse {
+		t.Fatalf("got sp.SelectSourceAddress(_, %s) = %#v, want response", globalDest, result)
+	}
+	// Scope rules prefer the global candidate for a global destination over
+	// the link-local one.
+	if got, want := result.Response.Source, fidlconv.ToNetIpAddress(globalAddr); got != want {
+		t.Errorf("got sp.SelectSourceAddress(_, %s).Source = %#v, want = %#v", globalDest, got, want)
+	}
+	if got, want := result.Response.Index, uint64(nicid); got != want {
+		t.Errorf("got sp.SelectSourceAddress(_, %s).Index = %d, want = %d", globalDest, got, want)
+	}
+
+	// A destination with no matching route is unreachable.
+	unroutedDest := tcpip.Address("\xcb\x00\x71\x01")
+	result, err = sp.SelectSourceAddress(context.Background(), fidlconv.ToNetIpAddress(unroutedDest))
+	if err != nil {
+		t.Fatalf("sp.SelectSourceAddress(_, %s): %s", unroutedDest, err)
+	}
+	if result.Which() != socket.ProviderSelectSourceAddressResultErr || result.Err != ehostunreach {
+		t.Errorf("got sp.SelectSourceAddress(_, %s) = %#v, want = Err(%d)", unroutedDest, result, ehostunreach)
+	}
+}
+
 func TestStaticIPConfiguration(t *testing.T) {
 	ns := newNetstack(t)
 
@@ -842,10 +4829,13 @@ func newNetstackWithStackNDPDispatcher(t *testing.T, ndpDisp tcpipstack.NDPDispa
 			ipv6.NewProtocol(),
 		},
 		TransportProtocols: []tcpipstack.TransportProtocol{
+			icmp.NewProtocol4(),
+			icmp.NewProtocol6(),
 			tcp.NewProtocol(),
 			udp.NewProtocol(),
 		},
-		NDPDisp: ndpDisp,
+		RawFactory: raw.EndpointFactory{},
+		NDPDisp:    ndpDisp,
 	})
 	ns := &Netstack{
 		stack: stk,
@@ -0,0 +1,164 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"fmt"
+	"sort"
+
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/routes"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// networkStateVersion identifies the layout of NetworkState. It is recorded
+// in exported snapshots so that a snapshot produced by a different layout is
+// rejected on import instead of being misread. Bump it whenever fields are
+// added, removed or change meaning.
+const networkStateVersion = 1
+
+// InterfaceAddress records one address assigned to a NIC.
+type InterfaceAddress struct {
+	NICID             tcpip.NICID
+	Protocol          tcpip.NetworkProtocolNumber
+	AddressWithPrefix tcpip.AddressWithPrefix
+}
+
+// StaticNeighbor records one static neighbor table entry.
+type StaticNeighbor struct {
+	NICID    tcpip.NICID
+	Addr     tcpip.Address
+	LinkAddr tcpip.LinkAddress
+}
+
+// NetworkState is a snapshot of the L3 configuration: NIC addresses, the
+// extended route table, static neighbor entries and DNS servers. It holds
+// only plain values so it can be handed to any encoder for storage.
+type NetworkState struct {
+	Version    int
+	Addresses  []InterfaceAddress
+	Routes     []routes.ExtendedRoute
+	Neighbors  []StaticNeighbor
+	DNSServers []tcpip.Address
+}
+
+// ExportNetworkState captures the current L3 configuration. Entries are
+// sorted so that two exports of the same state compare equal.
+//
+// Only static neighbor entries are captured; dynamic ones are rediscovered.
+// Similarly, dynamically learned DNS servers are exported but can only be
+// restored as default servers.
+func (ns *Netstack) ExportNetworkState() NetworkState {
+	state := NetworkState{Version: networkStateVersion}
+	for nicid, info := range ns.stack.NICInfo() {
+		for _, protocolAddr := range info.ProtocolAddresses {
+			// The ARP protocol registers a placeholder address on every NIC
+			// it is enabled on; it is not part of the L3 configuration.
+			if protocolAddr.Protocol == arp.ProtocolNumber {
+				continue
+			}
+			state.Addresses = append(state.Addresses, InterfaceAddress{
+				NICID:             nicid,
+				Protocol:          protocolAddr.Protocol,
+				AddressWithPrefix: protocolAddr.AddressWithPrefix,
+			})
+		}
+		neighbors, err := ns.stack.Neighbors(nicid)
+		if err != nil {
+			// Neighbor discovery is not enabled on this NIC.
+			continue
+		}
+		for _, n := range neighbors {
+			if n.State != stack.Static {
+				continue
+			}
+			state.Neighbors = append(state.Neighbors, StaticNeighbor{
+				NICID:    nicid,
+				Addr:     n.Addr,
+				LinkAddr: n.LinkAddr,
+			})
+		}
+	}
+	sort.Slice(state.Addresses, func(i, j int) bool {
+		if state.Addresses[i].NICID != state.Addresses[j].NICID {
+			return state.Addresses[i].NICID < state.Addresses[j].NICID
+		}
+		return state.Addresses[i].AddressWithPrefix.Address < state.Addresses[j].AddressWithPrefix.Address
+	})
+	sort.Slice(state.Neighbors, func(i, j int) bool {
+		if state.Neighbors[i].NICID != state.Neighbors[j].NICID {
+			return state.Neighbors[i].NICID < state.Neighbors[j].NICID
+		}
+		return state.Neighbors[i].Addr < state.Neighbors[j].Addr
+	})
+	state.Routes = ns.GetExtendedRouteTable()
+	for _, s := range ns.dnsClient.GetServersCache() {
+		state.DNSServers = append(state.DNSServers, s.Address.Addr)
+	}
+	return state
+}
+
+// ImportNetworkState re-applies a snapshot produced by ExportNetworkState.
+// Each entry is validated individually: entries that cannot be applied (e.g.
+// a route referencing a NIC that doesn't exist) are skipped and reported, and
+// the remaining entries are applied regardless. Entries already present are
+// left alone, so importing the same snapshot twice is a no-op.
+//
+// The returned error is non-nil only when the snapshot as a whole cannot be
+// used, i.e. when its version is not understood.
+func (ns *Netstack) ImportNetworkState(state NetworkState) ([]error, error) {
+	if state.Version != networkStateVersion {
+		return nil, fmt.Errorf("unsupported network state version %d; want %d", state.Version, networkStateVersion)
+	}
+
+	var unapplied []error
+	for _, addr := range state.Addresses {
+		nicInfo, ok := ns.stack.NICInfo()[addr.NICID]
+		if !ok {
+			unapplied = append(unapplied, fmt.Errorf("address %s references unknown NIC %d", addr.AddressWithPrefix, addr.NICID))
+			continue
+		}
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          addr.Protocol,
+			AddressWithPrefix: addr.AddressWithPrefix,
+		}
+		if a, found := findAddress(nicInfo.ProtocolAddresses, protocolAddr); found && a.AddressWithPrefix.PrefixLen == addr.AddressWithPrefix.PrefixLen {
+			continue
+		}
+		if _, err := ns.addInterfaceAddress(addr.NICID, protocolAddr); err != nil {
+			unapplied = append(unapplied, fmt.Errorf("address %s on NIC %d: %w", addr.AddressWithPrefix, addr.NICID, err))
+		}
+	}
+
+	for _, er := range state.Routes {
+		metric := er.Metric
+		if er.MetricTracksInterface {
+			metric = metricNotSet
+		}
+		// AddRoute validates the NIC and replaces an existing route rather
+		// than duplicating it.
+		if err := ns.AddRoute(er.Route, metric, er.Dynamic); err != nil {
+			unapplied = append(unapplied, fmt.Errorf("route %s: %w", er.Route, err))
+		}
+	}
+
+	for _, n := range state.Neighbors {
+		if _, ok := ns.stack.NICInfo()[n.NICID]; !ok {
+			unapplied = append(unapplied, fmt.Errorf("neighbor %s references unknown NIC %d", n.Addr, n.NICID))
+			continue
+		}
+		if err := ns.stack.AddStaticNeighbor(n.NICID, n.Addr, n.LinkAddr); err != nil {
+			unapplied = append(unapplied, fmt.Errorf("neighbor %s (%s) on NIC %d: %s", n.Addr, n.LinkAddr, n.NICID, err))
+		}
+	}
+
+	if len(state.DNSServers) != 0 {
+		ns.dnsClient.SetDefaultServers(state.DNSServers)
+	}
+
+	return unapplied, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"reflect"
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/routes"
+
+	"fidl/fuchsia/hardware/ethernet"
+	"fidl/fuchsia/netstack"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestNetworkStateRoundTrip(t *testing.T) {
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   "\x0a\x00\x00\x01",
+			PrefixLen: 24,
+		},
+	}
+	if _, err := ns.addInterfaceAddress(ifs.nicid, protocolAddr); err != nil {
+		t.Fatalf("addInterfaceAddress(%d, %s): %s", ifs.nicid, protocolAddr.AddressWithPrefix, err)
+	}
+	defaultRoute := tcpip.Route{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     "\x0a\x00\x00\xfe",
+		NIC:         ifs.nicid,
+	}
+	if err := ns.AddRoute(defaultRoute, metricNotSet, false); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", defaultRoute, err)
+	}
+	dnsServers := []tcpip.Address{"\x08\x08\x08\x08"}
+	ns.dnsClient.SetDefaultServers(dnsServers)
+
+	state := ns.ExportNetworkState()
+	if state.Version != networkStateVersion {
+		t.Errorf("got state.Version = %d, want = %d", state.Version, networkStateVersion)
+	}
+
+	// Restore the snapshot onto a fresh netstack with a matching NIC.
+	clone := newNetstack(t)
+	cloneEth := deviceForAddEth(ethernet.Info{}, t)
+	cloneIfs, err := clone.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &cloneEth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+	if cloneIfs.nicid != ifs.nicid {
+		t.Fatalf("got NIC ID %d on the fresh netstack, want %d; the snapshot references NICs by ID", cloneIfs.nicid, ifs.nicid)
+	}
+
+	unapplied, err := clone.ImportNetworkState(state)
+	if err != nil {
+		t.Fatalf("ImportNetworkState(_): %s", err)
+	}
+	if len(unapplied) != 0 {
+		t.Fatalf("ImportNetworkState(_) failed to apply entries: %v", unapplied)
+	}
+	if got := clone.ExportNetworkState(); !reflect.DeepEqual(got, state) {
+		t.Errorf("round trip mismatch: got %+v, want %+v", got, state)
+	}
+
+	// Importing the same snapshot again must be a no-op.
+	unapplied, err = clone.ImportNetworkState(state)
+	if err != nil {
+		t.Fatalf("ImportNetworkState(_): %s", err)
+	}
+	if len(unapplied) != 0 {
+		t.Fatalf("repeated ImportNetworkState(_) failed to apply entries: %v", unapplied)
+	}
+	if got := clone.ExportNetworkState(); !reflect.DeepEqual(got, state) {
+		t.Errorf("state changed after repeated import: got %+v, want %+v", got, state)
+	}
+}
+
+func TestImportNetworkStateErrors(t *testing.T) {
+	ns := newNetstack(t)
+	eth := deviceForAddEth(ethernet.Info{}, t)
+	ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: testDeviceName}, &eth)
+	if err != nil {
+		t.Fatalf("addEth(%q, _): %s", testTopoPath, err)
+	}
+
+	// An unknown version is rejected wholesale.
+	bad := NetworkState{Version: networkStateVersion + 1}
+	if _, err := ns.ImportNetworkState(bad); err == nil {
+		t.Errorf("got ImportNetworkState(%+v) = nil, want version error", bad)
+	}
+
+	// Entries referencing a NIC that doesn't exist are reported without
+	// blocking the valid ones.
+	unknownNIC := ifs.nicid + 42
+	state := NetworkState{
+		Version: networkStateVersion,
+		Addresses: []InterfaceAddress{
+			{
+				NICID:    unknownNIC,
+				Protocol: ipv4.ProtocolNumber,
+				AddressWithPrefix: tcpip.AddressWithPrefix{
+					Address:   "\x0a\x00\x00\x02",
+					PrefixLen: 24,
+				},
+			},
+		},
+		Routes: []routes.ExtendedRoute{
+			{
+				Route: tcpip.Route{
+					Destination: header.IPv4EmptySubnet,
+					Gateway:     "\x0a\x00\x00\xfe",
+					NIC:         ifs.nicid,
+				},
+				MetricTracksInterface: true,
+			},
+		},
+	}
+	unapplied, err := ns.ImportNetworkState(state)
+	if err != nil {
+		t.Fatalf("ImportNetworkState(_): %s", err)
+	}
+	if len(unapplied) != 1 {
+		t.Errorf("got %d unapplied entries (%v), want 1", len(unapplied), unapplied)
+	}
+	rt := ns.GetExtendedRouteTable()
+	if len(rt) != 1 || rt[0].Route != state.Routes[0].Route {
+		t.Errorf("got route table %+v, want the single route %s", rt, state.Routes[0].Route)
+	}
+}
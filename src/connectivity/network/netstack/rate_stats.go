@@ -0,0 +1,133 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	defaultRateSampleInterval = time.Second
+	defaultRateSampleWindow   = 5 * time.Second
+)
+
+// rateSample is one observation of a NIC's cumulative traffic counters.
+type rateSample struct {
+	timestamp time.Time
+
+	rxBytes, rxPackets, txBytes, txPackets uint64
+}
+
+// interfaceRates holds a NIC's traffic rates over the sampling window.
+type interfaceRates struct {
+	// valid is false until enough samples have been collected to compute
+	// rates, e.g. shortly after boot or after the NIC appeared; the rates
+	// are zero in that case.
+	valid bool
+
+	rxBytesPerSecond, rxPacketsPerSecond, txBytesPerSecond, txPacketsPerSecond uint64
+}
+
+// interfaceRateSampler periodically samples each NIC's traffic counters and
+// computes rates over a sliding window, saving clients from diffing counter
+// snapshots themselves.
+type interfaceRateSampler struct {
+	stack *stack.Stack
+
+	// interval is the time between samples; the window is expressed as the
+	// number of samples retained per NIC.
+	interval   time.Duration
+	maxSamples int
+
+	mu struct {
+		sync.Mutex
+		samples map[tcpip.NICID][]rateSample
+	}
+}
+
+func newInterfaceRateSampler(s *stack.Stack, interval, window time.Duration) *interfaceRateSampler {
+	sampler := &interfaceRateSampler{
+		stack:      s,
+		interval:   interval,
+		maxSamples: int(window/interval) + 1,
+	}
+	sampler.mu.samples = make(map[tcpip.NICID][]rateSample)
+	return sampler
+}
+
+// run samples the stack's NICs every interval until ctx is cancelled.
+func (s *interfaceRateSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sampleAt(now)
+		}
+	}
+}
+
+// sampleAt records one sample per NIC, dropping samples that have aged out
+// of the window and state for NICs that no longer exist.
+func (s *interfaceRateSampler) sampleAt(now time.Time) {
+	nicInfos := s.stack.NICInfo()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nicid := range s.mu.samples {
+		if _, ok := nicInfos[nicid]; !ok {
+			delete(s.mu.samples, nicid)
+		}
+	}
+	for nicid, info := range nicInfos {
+		samples := append(s.mu.samples[nicid], rateSample{
+			timestamp: now,
+			rxBytes:   info.Stats.Rx.Bytes.Value(),
+			rxPackets: info.Stats.Rx.Packets.Value(),
+			txBytes:   info.Stats.Tx.Bytes.Value(),
+			txPackets: info.Stats.Tx.Packets.Value(),
+		})
+		if len(samples) > s.maxSamples {
+			samples = samples[len(samples)-s.maxSamples:]
+		}
+		s.mu.samples[nicid] = samples
+	}
+}
+
+// rates returns the NIC's traffic rates over the window, or false if the
+// NIC has never been sampled.
+func (s *interfaceRateSampler) rates(nicid tcpip.NICID) (interfaceRates, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples, ok := s.mu.samples[nicid]
+	if !ok {
+		return interfaceRates{}, false
+	}
+	if len(samples) < 2 {
+		return interfaceRates{}, true
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.timestamp.Sub(first.timestamp).Seconds()
+	if elapsed <= 0 {
+		return interfaceRates{}, true
+	}
+	perSecond := func(first, last uint64) uint64 {
+		return uint64(float64(last-first) / elapsed)
+	}
+	return interfaceRates{
+		valid:              true,
+		rxBytesPerSecond:   perSecond(first.rxBytes, last.rxBytes),
+		rxPacketsPerSecond: perSecond(first.rxPackets, last.rxPackets),
+		txBytesPerSecond:   perSecond(first.txBytes, last.txBytes),
+		txPacketsPerSecond: perSecond(first.txPackets, last.txPackets),
+	}, true
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"sync"
+
+	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// Rebinding support for sockets whose local address disappears, e.g. when a
+// DHCP renewal hands out a different address.
+//
+// The stack does not support rebinding an endpoint in place, so migration
+// replaces the socket's stack endpoint with a fresh one bound to the new
+// address on the same port. Only unconnected datagram sockets can be
+// migrated: a connected socket's peer association names the old address, and
+// stream listeners cannot transplant their accept queue. Wildcard-bound
+// sockets hold no specific address and follow interface addresses by
+// construction, so they need no migration.
+
+// rebindableEndpoints tracks the datagram sockets eligible for migration.
+type rebindableEndpoints struct {
+	mu struct {
+		sync.Mutex
+		eps map[*endpointWithEvent]struct{}
+	}
+}
+
+func (r *rebindableEndpoints) add(epe *endpointWithEvent) {
+	r.mu.Lock()
+	if r.mu.eps == nil {
+		r.mu.eps = make(map[*endpointWithEvent]struct{})
+	}
+	r.mu.eps[epe] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *rebindableEndpoints) remove(epe *endpointWithEvent) {
+	r.mu.Lock()
+	delete(r.mu.eps, epe)
+	r.mu.Unlock()
+}
+
+// migrateEndpoints rebinds unconnected datagram sockets bound specifically
+// to oldAddr over to newAddr, preserving their bound port. Sockets that
+// cannot move keep the stale address and fail on use, leaving recovery to
+// their owner.
+func (ns *Netstack) migrateEndpoints(oldAddr, newAddr tcpip.Address) {
+	ns.rebindable.mu.Lock()
+	eps := make([]*endpointWithEvent, 0, len(ns.rebindable.mu.eps))
+	for epe := range ns.rebindable.mu.eps {
+		eps = append(eps, epe)
+	}
+	ns.rebindable.mu.Unlock()
+
+	for _, epe := range eps {
+		local, err := epe.loadEp().GetLocalAddress()
+		if err != nil || local.Addr != oldAddr {
+			continue
+		}
+		if err := epe.rebind(newAddr); err != nil {
+			_ = syslog.Warnf("failed to migrate socket bound to %+v to %s: %s", local, newAddr, err)
+		} else {
+			syslog.Infof("migrated socket bound to %+v to %s", local, newAddr)
+		}
+	}
+}
+
+// rebind atomically replaces the receiver's stack endpoint with one bound to
+// newAddr on the same port. The waiter queue is shared between the two
+// endpoints, so event registrations carry over. Readers observe the swap
+// through loadEp's atomic load; an in-flight send may still have loaded the
+// old endpoint and fail as if the address had been removed. The receive lock
+// serializes concurrent rebinds.
+func (epe *endpointWithEvent) rebind(newAddr tcpip.Address) *tcpip.Error {
+	if _, err := epe.loadEp().GetRemoteAddress(); err == nil {
+		// Connected sockets cannot move; see the package comment above.
+		return tcpip.ErrAlreadyConnected
+	}
+	local, err := epe.loadEp().GetLocalAddress()
+	if err != nil {
+		return err
+	}
+	if len(local.Addr) == 0 {
+		// Wildcard binds follow interface addresses by construction.
+		return nil
+	}
+	ep, err := epe.ns.stack.NewEndpoint(epe.transProto, epe.netProto, epe.wq)
+	if err != nil {
+		return err
+	}
+	local.Addr = newAddr
+	if err := ep.Bind(local); err != nil {
+		ep.Close()
+		return err
+	}
+
+	epe.mu.Lock()
+	old := epe.loadEp()
+	epe.storeEp(ep)
+	epe.mu.Unlock()
+
+	epe.ns.endpoints.Store(epe.local, ep)
+	if id := epe.reuseport.id; id != 0 {
+		epe.ns.reuseportGroups.remove(epe.reuseport.key, id)
+		epe.reuseport.key.addr = newAddr
+		epe.reuseport.id = epe.ns.reuseportGroups.add(epe.reuseport.key, ep)
+	}
+	old.Close()
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// reuseportKey identifies the local address shared by a group of datagram
+// sockets bound with SO_REUSEPORT.
+type reuseportKey struct {
+	netProto   tcpip.NetworkProtocolNumber
+	transProto tcpip.TransportProtocolNumber
+	addr       tcpip.Address
+	port       uint16
+}
+
+// reuseportMember is a single socket in a reuseport group.
+type reuseportMember struct {
+	id uint64
+	ep tcpip.Endpoint
+}
+
+// reuseportGroupMap tracks the datagram sockets bound to each shared local
+// address so that incoming datagrams can be distributed across them.
+//
+// Distribution uses rendezvous (highest random weight) hashing of the flow:
+// each flow consistently reaches the same member, and removing a member
+// redistributes only the flows that member was receiving.
+type reuseportGroupMap struct {
+	mu struct {
+		sync.Mutex
+		nextID uint64
+		groups map[reuseportKey][]reuseportMember
+	}
+}
+
+// add inserts ep into the group identified by key and returns a nonzero
+// handle to be passed to remove when the socket is destroyed.
+func (r *reuseportGroupMap) add(key reuseportKey, ep tcpip.Endpoint) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.groups == nil {
+		r.mu.groups = make(map[reuseportKey][]reuseportMember)
+	}
+	r.mu.nextID++
+	id := r.mu.nextID
+	r.mu.groups[key] = append(r.mu.groups[key], reuseportMember{id: id, ep: ep})
+	return id
+}
+
+// remove deletes the member identified by id from the group identified by
+// key. Removing a member that is not present is a no-op.
+func (r *reuseportGroupMap) remove(key reuseportKey, id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := r.mu.groups[key]
+	for i, m := range members {
+		if m.id == id {
+			members = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(r.mu.groups, key)
+	} else {
+		r.mu.groups[key] = members
+	}
+}
+
+// selectMember returns the endpoint that should receive a datagram sent to
+// key from src, or nil if the group is empty or absent.
+func (r *reuseportGroupMap) selectMember(key reuseportKey, src tcpip.FullAddress) tcpip.Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var best tcpip.Endpoint
+	var bestWeight uint64
+	for _, m := range r.mu.groups[key] {
+		if w := reuseportWeight(key, src, m.id); best == nil || w > bestWeight {
+			best, bestWeight = m.ep, w
+		}
+	}
+	return best
+}
+
+// reuseportWeight hashes a flow together with a member's identity; for each
+// flow the member with the highest weight wins. Because each member's weight
+// is independent of the other members, removing one never changes the winner
+// among those remaining.
+func reuseportWeight(key reuseportKey, src tcpip.FullAddress, id uint64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint16(b[:2], src.Port)
+	binary.BigEndian.PutUint16(b[2:4], key.port)
+	h.Write([]byte(src.Addr))
+	h.Write([]byte(key.addr))
+	h.Write(b[:4])
+	binary.BigEndian.PutUint64(b[:], id)
+	h.Write(b[:])
+	return h.Sum64()
+}
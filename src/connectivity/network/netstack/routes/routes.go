@@ -253,6 +253,36 @@ func (rt *RouteTable) UpdateMetricByInterface(nicid tcpip.NICID, metric Metric)
 	rt.dumpLocked()
 }
 
+// UpdateRouteMetric changes the metric of the route matching the given route
+// in place and re-sorts the table. Like DelRoute, only the non-zero fields of
+// the route are matched. Returns ErrNoSuchRoute when no route matches.
+func (rt *RouteTable) UpdateRouteMetric(route tcpip.Route, metric Metric, tracksInterface bool) error {
+	syslog.VLogTf(syslog.DebugVerbosity, tag, "RouteTable:Updating route %s to metric:%d, trackIf=%t", route, metric, tracksInterface)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for i := range rt.mu.routes {
+		er := &rt.mu.routes[i]
+		// Match all fields that are non-zero.
+		if er.Route.Destination == route.Destination {
+			if route.NIC == 0 || route.NIC == er.Route.NIC {
+				if len(route.Gateway) == 0 || route.Gateway == er.Route.Gateway {
+					er.Metric = metric
+					er.MetricTracksInterface = tracksInterface
+
+					rt.sortRouteTableLocked()
+
+					rt.dumpLocked()
+					return nil
+				}
+			}
+		}
+	}
+
+	return ErrNoSuchRoute
+}
+
 // UpdateRoutesByInterface applies an action to the routes pointing to an interface.
 func (rt *RouteTable) UpdateRoutesByInterface(nicid tcpip.NICID, action Action) {
 	syslog.VLogTf(syslog.DebugVerbosity, tag, "RouteTable:Update route table for routes to nic-%d with action:%d", nicid, action)
@@ -414,6 +414,45 @@ func TestUpdateMetricByInterface(t *testing.T) {
 	})
 }
 
+func TestUpdateRouteMetric(t *testing.T) {
+	t.Run("Update-metric-resorts-table", func(t *testing.T) {
+		r0 := createRoute(0, "0.0.0.0/0", "192.168.1.1")
+		r1 := createRoute(1, "0.0.0.0/0", "192.168.100.10")
+
+		// Initially r0 has the lower metric and is ahead in the table.
+		tb := routes.RouteTable{}
+		tb.AddRoute(r0, 100, false, true, true)
+		tb.AddRoute(r1, 200, false, true, true)
+
+		// Lowering r1's metric promotes it without removing either route.
+		if err := tb.UpdateRouteMetric(r1, 50, false); err != nil {
+			t.Fatalf("got UpdateRouteMetric(%s, 50, false) = %s, want = nil", r1, err)
+		}
+		tableGot := tb.GetExtendedRouteTable()
+		if got, want := len(tableGot), 2; got != want {
+			t.Fatalf("got len(table) = %d, want = %d", got, want)
+		}
+		if got, want := tableGot[0].Route, r1; got != want {
+			t.Errorf("got = %s, want = %s", got, want)
+		}
+		if got, want := tableGot[0].Metric, routes.Metric(50); got != want {
+			t.Errorf("got metric = %d, want = %d", got, want)
+		}
+		if got, want := tableGot[1].Route, r0; got != want {
+			t.Errorf("got = %s, want = %s", got, want)
+		}
+	})
+
+	t.Run("Update-absent-route-fails", func(t *testing.T) {
+		tb := routes.RouteTable{}
+		tb.Set(testRouteTable)
+		absent := createRoute(1, "203.0.113.0/24", "192.168.1.1")
+		if err := tb.UpdateRouteMetric(absent, 50, false); err != routes.ErrNoSuchRoute {
+			t.Errorf("got UpdateRouteMetric(%s, 50, false) = %v, want = %v", absent, err, routes.ErrNoSuchRoute)
+		}
+	})
+}
+
 func TestUpdateRoutesByInterface(t *testing.T) {
 	for nicid := tcpip.NICID(1); nicid <= 4; nicid++ {
 		// Test the normal case where on DOWN netstack removes dynamic routes and
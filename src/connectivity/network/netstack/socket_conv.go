@@ -57,6 +57,11 @@ const (
 	maxTCPKeepIdle  = 32767
 	maxTCPKeepIntvl = 32767
 	maxTCPKeepCnt   = 127
+
+	// Maximum length of a congestion-control algorithm name for TCP_CONGESTION.
+	//
+	// https://github.com/torvalds/linux/blob/f2850dd5ee015bd7b77043f731632888887689c7/include/net/tcp.h#L1012
+	tcpCANameMax = 16
 )
 
 func boolToInt32(v bool) int32 {
@@ -196,7 +201,7 @@ func getSockOptSocket(ep tcpip.Endpoint, ns *Netstack, netProto tcpip.NetworkPro
 		if v == tcpip.BindToDeviceOption(0) {
 			return []byte(nil), nil
 		}
-		nicInfos := ns.stack.NICInfo()
+		nicInfos := ns.NICInfo()
 		for id, info := range nicInfos {
 			if tcpip.BindToDeviceOption(id) == v {
 				return append([]byte(info.Name), 0), nil
@@ -204,6 +209,13 @@ func getSockOptSocket(ep tcpip.Endpoint, ns *Netstack, netProto tcpip.NetworkPro
 		}
 		return nil, tcpip.ErrUnknownDevice
 
+	case C.SO_BINDTOIFINDEX:
+		var v tcpip.BindToDeviceOption
+		if err := ep.GetSockOpt(&v); err != nil {
+			return nil, err
+		}
+		return int32(v), nil
+
 	case C.SO_BROADCAST:
 		v, err := ep.GetSockOptBool(tcpip.BroadcastOption)
 		if err != nil {
@@ -247,6 +259,8 @@ func getSockOptSocket(ep tcpip.Endpoint, ns *Netstack, netProto tcpip.NetworkPro
 func getSockOptTCP(ep tcpip.Endpoint, name int16) (interface{}, *tcpip.Error) {
 	switch name {
 	case C.TCP_NODELAY:
+		// TCP_NODELAY is the inverse of the stack's delay option:
+		// TCP_NODELAY=1 means Nagle's algorithm is disabled.
 		v, err := ep.GetSockOptBool(tcpip.DelayOption)
 		if err != nil {
 			return nil, err
@@ -315,8 +329,6 @@ func getSockOptTCP(ep tcpip.Endpoint, name int16) (interface{}, *tcpip.Error) {
 		if err := ep.GetSockOpt(&v); err != nil {
 			return nil, err
 		}
-		// https://github.com/torvalds/linux/blob/f2850dd5ee015bd7b77043f731632888887689c7/include/net/tcp.h#L1012
-		tcpCANameMax := 16
 		// TODO(fxb/41621): should we change getsocketopt fidl to pass optlen?
 		b := []byte(v)
 		// Linux uses min(optlen, TCP_CA_NAME_MAX) for length of returned name.
@@ -376,6 +388,19 @@ func getSockOptIPv6(ep tcpip.Endpoint, name int16) (interface{}, *tcpip.Error) {
 		}
 		return int32(v), nil
 
+	case C.IPV6_UNICAST_HOPS:
+		v, err := ep.GetSockOptInt(tcpip.HopLimitOption)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fill in default value, if needed.
+		if v == 0 {
+			v = DefaultTTL
+		}
+
+		return int32(v), nil
+
 	case C.IPV6_MULTICAST_IF:
 		var v tcpip.MulticastInterfaceOption
 		if err := ep.GetSockOpt(&v); err != nil {
@@ -405,6 +430,13 @@ func getSockOptIPv6(ep tcpip.Endpoint, name int16) (interface{}, *tcpip.Error) {
 		}
 		return boolToInt32(v), nil
 
+	case C.IPV6_RECVHOPLIMIT:
+		v, err := ep.GetSockOptBool(tcpip.ReceiveHopLimitOption)
+		if err != nil {
+			return nil, err
+		}
+		return boolToInt32(v), nil
+
 	default:
 		syslog.Infof("unimplemented getsockopt: SOL_IPV6 name=%d", name)
 
@@ -469,6 +501,13 @@ func getSockOptIP(ep tcpip.Endpoint, name int16) (interface{}, *tcpip.Error) {
 		}
 		return boolToInt32(v), nil
 
+	case C.IP_RECVTTL:
+		v, err := ep.GetSockOptBool(tcpip.ReceiveTTLOption)
+		if err != nil {
+			return nil, err
+		}
+		return boolToInt32(v), nil
+
 	case C.IP_PKTINFO:
 		v, err := ep.GetSockOptBool(tcpip.ReceiveIPPacketInfoOption)
 		if err != nil {
@@ -492,10 +531,10 @@ func SetSockOpt(ep tcpip.Endpoint, ns *Netstack, level, name int16, optVal []uin
 		return setSockOptTCP(ep, name, optVal)
 
 	case C.SOL_IPV6:
-		return setSockOptIPv6(ep, name, optVal)
+		return setSockOptIPv6(ep, ns, name, optVal)
 
 	case C.SOL_IP:
-		return setSockOptIP(ep, name, optVal)
+		return setSockOptIP(ep, ns, name, optVal)
 
 	case C.SOL_UDP,
 		C.SOL_ICMPV6,
@@ -552,7 +591,7 @@ func setSockOptSocket(ep tcpip.Endpoint, ns *Netstack, name int16, optVal []byte
 			return ep.SetSockOpt(tcpip.BindToDeviceOption(0))
 		}
 		name := string(optVal[:n])
-		nicInfos := ns.stack.NICInfo()
+		nicInfos := ns.NICInfo()
 		for id, info := range nicInfos {
 			if name == info.Name {
 				return ep.SetSockOpt(tcpip.BindToDeviceOption(id))
@@ -560,6 +599,20 @@ func setSockOptSocket(ep tcpip.Endpoint, ns *Netstack, name int16, optVal []byte
 		}
 		return tcpip.ErrUnknownDevice
 
+	case C.SO_BINDTOIFINDEX:
+		if len(optVal) < sizeOfInt32 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		v := binary.LittleEndian.Uint32(optVal)
+		if v == 0 {
+			return ep.SetSockOpt(tcpip.BindToDeviceOption(0))
+		}
+		if _, ok := ns.stack.NICInfo()[tcpip.NICID(v)]; !ok {
+			return tcpip.ErrUnknownDevice
+		}
+		return ep.SetSockOpt(tcpip.BindToDeviceOption(v))
+
 	case C.SO_BROADCAST:
 		if len(optVal) < sizeOfInt32 {
 			return tcpip.ErrInvalidOptionValue
@@ -614,6 +667,8 @@ func setSockOptTCP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		}
 
 		v := binary.LittleEndian.Uint32(optVal)
+		// TCP_NODELAY is the inverse of the stack's delay option:
+		// TCP_NODELAY=1 means Nagle's algorithm is disabled.
 		return ep.SetSockOptBool(tcpip.DelayOption, v == 0)
 
 	case C.TCP_CORK:
@@ -630,6 +685,8 @@ func setSockOptTCP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		}
 
 		v := binary.LittleEndian.Uint32(optVal)
+		// Like on Linux, quickack is not permanent; the stack may clear it
+		// again once it has sent immediate acknowledgements.
 		return ep.SetSockOptBool(tcpip.QuickAckOption, v != 0)
 
 	case C.TCP_MAXSEG:
@@ -688,6 +745,16 @@ func setSockOptTCP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		return ep.SetSockOpt(tcpip.TCPUserTimeoutOption(time.Millisecond * time.Duration(v)))
 
 	case C.TCP_CONGESTION:
+		// Linux reads at most TCP_CA_NAME_MAX bytes and stops at the first
+		// NUL, so clients may pass a fixed-size, zero-padded buffer. The
+		// stack validates the name against its registered algorithms and
+		// fails with ENOENT when it is unknown.
+		if len(optVal) > tcpCANameMax {
+			optVal = optVal[:tcpCANameMax]
+		}
+		if i := bytes.IndexByte(optVal, 0); i != -1 {
+			optVal = optVal[:i]
+		}
 		return ep.SetSockOpt(tcpip.CongestionControlOption(optVal))
 
 	case C.TCP_DEFER_ACCEPT:
@@ -713,7 +780,7 @@ func setSockOptTCP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 }
 
 // setSockOptIPv6 implements SetSockOpt when level is SOL_IPV6.
-func setSockOptIPv6(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
+func setSockOptIPv6(ep tcpip.Endpoint, ns *Netstack, name int16, optVal []byte) *tcpip.Error {
 	switch name {
 	case C.IPV6_V6ONLY:
 		if len(optVal) < sizeOfInt32 {
@@ -735,9 +802,17 @@ func setSockOptIPv6(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		}
 		switch name {
 		case C.IPV6_ADD_MEMBERSHIP:
-			return ep.SetSockOpt(tcpip.AddMembershipOption(o))
+			if err := ep.SetSockOpt(tcpip.AddMembershipOption(o)); err != nil {
+				return err
+			}
+			ns.multicastMemberships.add(ep, multicastMembership{nicID: o.NIC, group: o.MulticastAddr})
+			return nil
 		case C.IPV6_DROP_MEMBERSHIP:
-			return ep.SetSockOpt(tcpip.RemoveMembershipOption(o))
+			if err := ep.SetSockOpt(tcpip.RemoveMembershipOption(o)); err != nil {
+				return err
+			}
+			ns.multicastMemberships.remove(ep, multicastMembership{nicID: o.NIC, group: o.MulticastAddr})
+			return nil
 		default:
 			panic("unreachable")
 		}
@@ -751,6 +826,27 @@ func setSockOptIPv6(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 			NIC: tcpip.NICID(v),
 		})
 
+	case C.IPV6_UNICAST_HOPS:
+		if len(optVal) < sizeOfInt32 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		v, err := parseIntOrChar(optVal)
+		if err != nil {
+			return err
+		}
+
+		// Linux allows -1 to mean the default hop limit; 0 restores it too.
+		if v == -1 {
+			v = 0
+		}
+
+		if v < 0 || v > 255 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		return ep.SetSockOptInt(tcpip.HopLimitOption, int(v))
+
 	case C.IPV6_MULTICAST_HOPS:
 		if len(optVal) < sizeOfInt32 {
 			return tcpip.ErrInvalidOptionValue
@@ -824,6 +920,17 @@ func setSockOptIPv6(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		}
 		return ep.SetSockOptBool(tcpip.ReceiveTClassOption, v != 0)
 
+	case C.IPV6_RECVHOPLIMIT:
+		// Like IPV6_RECVTCLASS, linux requires at least an int here.
+		if len(optVal) < sizeOfInt32 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		v, err := parseIntOrChar(optVal)
+		if err != nil {
+			return err
+		}
+		return ep.SetSockOptBool(tcpip.ReceiveHopLimitOption, v != 0)
+
 	default:
 		syslog.Infof("unimplemented setsockopt: SOL_IPV6 name=%d optVal=%x", name, optVal)
 
@@ -847,7 +954,7 @@ func parseIntOrChar(buf []byte) (int32, *tcpip.Error) {
 }
 
 // setSockOptIP implements SetSockOpt when level is SOL_IP.
-func setSockOptIP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
+func setSockOptIP(ep tcpip.Endpoint, ns *Netstack, name int16, optVal []byte) *tcpip.Error {
 	switch name {
 	case C.IP_MULTICAST_TTL:
 		v, err := parseIntOrChar(optVal)
@@ -906,10 +1013,18 @@ func setSockOptIP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 
 			switch name {
 			case C.IP_ADD_MEMBERSHIP:
-				return ep.SetSockOpt(tcpip.AddMembershipOption(o))
+				if err := ep.SetSockOpt(tcpip.AddMembershipOption(o)); err != nil {
+					return err
+				}
+				ns.multicastMemberships.add(ep, multicastMembership{nicID: o.NIC, group: o.MulticastAddr})
+				return nil
 
 			case C.IP_DROP_MEMBERSHIP:
-				return ep.SetSockOpt(tcpip.RemoveMembershipOption(o))
+				if err := ep.SetSockOpt(tcpip.RemoveMembershipOption(o)); err != nil {
+					return err
+				}
+				ns.multicastMemberships.remove(ep, multicastMembership{nicID: o.NIC, group: o.MulticastAddr})
+				return nil
 
 			default:
 				panic("unreachable")
@@ -967,6 +1082,10 @@ func setSockOptIP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		if err != nil {
 			return err
 		}
+		// TOS is a single byte on the wire; reject values that do not fit.
+		if v < 0 || v > math.MaxUint8 {
+			return tcpip.ErrInvalidOptionValue
+		}
 		return ep.SetSockOptInt(tcpip.IPv4TOSOption, int(v))
 
 	case C.IP_RECVTOS:
@@ -976,6 +1095,13 @@ func setSockOptIP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		}
 		return ep.SetSockOptBool(tcpip.ReceiveTOSOption, v != 0)
 
+	case C.IP_RECVTTL:
+		v, err := parseIntOrChar(optVal)
+		if err != nil {
+			return err
+		}
+		return ep.SetSockOptBool(tcpip.ReceiveTTLOption, v != 0)
+
 	case C.IP_PKTINFO:
 		if len(optVal) == 0 {
 			return nil
@@ -1005,7 +1131,6 @@ func setSockOptIP(ep tcpip.Endpoint, name int16, optVal []byte) *tcpip.Error {
 		C.IP_RECVERR,
 		C.IP_RECVOPTS,
 		C.IP_RECVORIGDSTADDR,
-		C.IP_RECVTTL,
 		C.IP_RETOPTS,
 		C.IP_TRANSPARENT,
 		C.IP_UNBLOCK_SOURCE,
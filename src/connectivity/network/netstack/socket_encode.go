@@ -21,7 +21,9 @@ import (
 
 // #cgo CFLAGS: -D_GNU_SOURCE
 // #cgo CFLAGS: -I${SRCDIR}/../../../../zircon/third_party/ulib/musl/include/
+// #include <net/if_arp.h>
 // #include <netinet/in.h>
+// #include <netpacket/packet.h>
 import "C"
 
 // copyAsBytes exists because of a combination of issues:
@@ -171,6 +173,85 @@ func (v *C.struct_sockaddr_storage) Encode(netProto tcpip.NetworkProtocolNumber,
 	}
 }
 
+// Control messages are laid out as musl's CMSG_* macros expect on a 64-bit
+// kernel: a 16 byte cmsghdr (size_t cmsg_len, int cmsg_level, int cmsg_type)
+// followed by the payload, with each message padded to an 8 byte boundary
+// (CMSG_ALIGN) so that CMSG_NXTHDR can step from one message to the next.
+const (
+	cmsgHdrSize = 16
+	cmsgAlignTo = 8
+)
+
+func cmsgAlign(n int) int {
+	return (n + cmsgAlignTo - 1) &^ (cmsgAlignTo - 1)
+}
+
+// appendCmsg appends a single control message to buf.
+func appendCmsg(buf []byte, level, typ int32, data []byte) []byte {
+	msg := make([]byte, cmsgAlign(cmsgHdrSize+len(data)))
+	binary.LittleEndian.PutUint64(msg, uint64(cmsgHdrSize+len(data)))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(level))
+	binary.LittleEndian.PutUint32(msg[12:], uint32(typ))
+	copy(msg[cmsgHdrSize:], data)
+	return append(buf, msg...)
+}
+
+// serializeControlMessages encodes the control messages attached to a
+// received packet into a control buffer. POSIX leaves the order of control
+// messages unspecified, but clients commonly hardcode a layout, so they are
+// emitted in a stable, documented order: SCM_TIMESTAMP (or SCM_TIMESTAMPNS
+// when timestampNs is set), then IP_TOS, then IP_TTL, then IPV6_TCLASS, then
+// IPV6_HOPLIMIT, then IP_PKTINFO.
+func serializeControlMessages(cmsgs tcpip.ControlMessages, timestampNs bool) []byte {
+	var buf []byte
+	if cmsgs.HasTimestamp {
+		if timestampNs {
+			// A struct timespec; both fields are 64 bits on a 64-bit
+			// kernel.
+			payload := make([]byte, 16)
+			binary.LittleEndian.PutUint64(payload, uint64(cmsgs.Timestamp/1e9))
+			binary.LittleEndian.PutUint64(payload[8:], uint64(cmsgs.Timestamp%1e9))
+			buf = appendCmsg(buf, C.SOL_SOCKET, C.SCM_TIMESTAMPNS, payload)
+		} else {
+			// A struct timeval; both fields are 64 bits on a 64-bit
+			// kernel.
+			payload := make([]byte, 16)
+			binary.LittleEndian.PutUint64(payload, uint64(cmsgs.Timestamp/1e9))
+			binary.LittleEndian.PutUint64(payload[8:], uint64(cmsgs.Timestamp%1e9/1e3))
+			buf = appendCmsg(buf, C.SOL_SOCKET, C.SCM_TIMESTAMP, payload)
+		}
+	}
+	if cmsgs.HasTOS {
+		buf = appendCmsg(buf, C.SOL_IP, C.IP_TOS, []byte{cmsgs.TOS})
+	}
+	if cmsgs.HasTTL {
+		// Unlike IP_TOS, Linux emits the TTL as an int.
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, uint32(cmsgs.TTL))
+		buf = appendCmsg(buf, C.SOL_IP, C.IP_TTL, payload)
+	}
+	if cmsgs.HasTClass {
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, cmsgs.TClass)
+		buf = appendCmsg(buf, C.SOL_IPV6, C.IPV6_TCLASS, payload)
+	}
+	if cmsgs.HasHopLimit {
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, uint32(cmsgs.HopLimit))
+		buf = appendCmsg(buf, C.SOL_IPV6, C.IPV6_HOPLIMIT, payload)
+	}
+	if cmsgs.HasIPPacketInfo {
+		// A struct in_pktinfo: interface index, then the local (spec_dst)
+		// and destination header addresses.
+		payload := make([]byte, 12)
+		binary.LittleEndian.PutUint32(payload, uint32(cmsgs.PacketInfo.NIC))
+		copy(payload[4:], cmsgs.PacketInfo.LocalAddr)
+		copy(payload[8:], cmsgs.PacketInfo.DestinationAddr)
+		buf = appendCmsg(buf, C.SOL_IP, C.IP_PKTINFO, payload)
+	}
+	return buf
+}
+
 func decodeAddr(addr []uint8) (tcpip.FullAddress, error) {
 	var sockaddrStorage C.struct_sockaddr_storage
 	if err := sockaddrStorage.Unmarshal(addr); err != nil {
@@ -184,3 +265,19 @@ func encodeAddr(netProto tcpip.NetworkProtocolNumber, addr tcpip.FullAddress) []
 	n := v.Encode(netProto, addr)
 	return (*[C.sizeof_struct_sockaddr_storage]byte)(unsafe.Pointer(&v))[:n]
 }
+
+// encodeLinkAddr encodes the sender of a frame received on an AF_PACKET
+// socket as a sockaddr_ll. netProto is the socket's ethertype, carried in
+// sll_protocol in network byte order as Linux does.
+func encodeLinkAddr(netProto tcpip.NetworkProtocolNumber, addr tcpip.FullAddress) []uint8 {
+	var v C.struct_sockaddr_ll
+	v.sll_family = C.AF_PACKET
+	v.sll_protocol = C.ushort(uint16(netProto)<<8 | uint16(netProto)>>8)
+	v.sll_ifindex = C.int(addr.NIC)
+	v.sll_hatype = C.ARPHRD_ETHER
+	v.sll_halen = C.uchar(len(addr.Addr))
+	for i := 0; i < len(addr.Addr) && i < len(v.sll_addr); i++ {
+		v.sll_addr[i] = C.uchar(addr.Addr[i])
+	}
+	return (*[C.sizeof_struct_sockaddr_ll]byte)(unsafe.Pointer(&v))[:]
+}
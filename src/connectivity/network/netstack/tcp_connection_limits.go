@@ -0,0 +1,86 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package netstack
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// tcpConnectionLimits bounds the number of TCP connections carried by the
+// netstack so that memory consumption stays bounded under a SYN flood. A
+// limit of zero means unlimited.
+type tcpConnectionLimits struct {
+	mu struct {
+		sync.Mutex
+
+		// maxConnections caps the total number of connections, both
+		// established and half-open; maxHalfOpen additionally caps the
+		// connections that have not yet completed their handshake.
+		maxConnections uint32
+		maxHalfOpen    uint32
+
+		connections uint32
+		halfOpen    uint32
+	}
+
+	// dropped counts connections refused because a limit was reached.
+	dropped tcpip.StatCounter
+}
+
+func (l *tcpConnectionLimits) set(maxConnections, maxHalfOpen uint32) {
+	l.mu.Lock()
+	l.mu.maxConnections = maxConnections
+	l.mu.maxHalfOpen = maxHalfOpen
+	l.mu.Unlock()
+}
+
+func (l *tcpConnectionLimits) get() (maxConnections, maxHalfOpen uint32) {
+	l.mu.Lock()
+	maxConnections = l.mu.maxConnections
+	maxHalfOpen = l.mu.maxHalfOpen
+	l.mu.Unlock()
+	return maxConnections, maxHalfOpen
+}
+
+// tryAcquire reserves a slot for a connection, half-open if halfOpen is set.
+// It returns false and counts a drop if a limit has been reached; existing
+// connections are unaffected.
+func (l *tcpConnectionLimits) tryAcquire(halfOpen bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mu.maxConnections != 0 && l.mu.connections >= l.mu.maxConnections {
+		l.dropped.Increment()
+		return false
+	}
+	if halfOpen && l.mu.maxHalfOpen != 0 && l.mu.halfOpen >= l.mu.maxHalfOpen {
+		l.dropped.Increment()
+		return false
+	}
+	l.mu.connections++
+	if halfOpen {
+		l.mu.halfOpen++
+	}
+	return true
+}
+
+// established marks a half-open connection's handshake as complete; the
+// connection continues to count against the total limit until released.
+func (l *tcpConnectionLimits) established() {
+	l.mu.Lock()
+	l.mu.halfOpen--
+	l.mu.Unlock()
+}
+
+// release returns a slot reserved with tryAcquire.
+func (l *tcpConnectionLimits) release(halfOpen bool) {
+	l.mu.Lock()
+	l.mu.connections--
+	if halfOpen {
+		l.mu.halfOpen--
+	}
+	l.mu.Unlock()
+}
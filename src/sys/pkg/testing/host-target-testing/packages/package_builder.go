@@ -5,6 +5,7 @@
 package packages
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,30 +14,58 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"go.fuchsia.dev/fuchsia/garnet/go/src/merkle"
 	"go.fuchsia.dev/fuchsia/src/sys/pkg/bin/pm/build"
-	"go.fuchsia.dev/fuchsia/src/sys/pkg/bin/pm/pkg"
 	"go.fuchsia.dev/fuchsia/src/sys/pkg/bin/pm/repo"
 )
 
 type PackageBuilder struct {
-	Name     string
-	Version  string
-	Cache    string
-	Contents map[string]string
+	Name    string
+	Version string
+	// ABIRevision is the ABI revision the source package declared, or empty.
+	// It is carried through Publish unchanged.
+	ABIRevision string
+	// Subpackages holds the subpackage references the source package
+	// declared, carried through Publish unchanged.
+	Subpackages []SubpackageRef
+	Cache       string
+	Contents    map[string]string
+	// Merkles holds the merkle root of each content entry whose hash was
+	// computed while staging, keyed like Contents, so the staged file does
+	// not need to be re-read to hash it.
+	Merkles map[string]string
 }
 
-func parsePackageJSON(path string) (string, string, error) {
+// SubpackageRef names a subpackage and the merkle root it resolves to.
+type SubpackageRef struct {
+	Name   string `json:"name"`
+	Merkle string `json:"merkle"`
+}
+
+// packageJSON mirrors the meta/package file. It extends pkg.Package with the
+// ABI revision and subpackage references that newer packages carry, so a
+// rebuild does not silently drop them. The extra fields are omitted when
+// empty, keeping the output for packages without them unchanged.
+type packageJSON struct {
+	Name        string          `json:"name"`
+	Version     string          `json:"version"`
+	ABIRevision string          `json:"abi_revision,omitempty"`
+	Subpackages []SubpackageRef `json:"subpackages,omitempty"`
+}
+
+func parsePackageJSON(path string) (packageJSON, error) {
+	var packageInfo packageJSON
 	jsonData, err := ioutil.ReadFile(path)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read file at %s. %w", path, err)
+		return packageInfo, fmt.Errorf("failed to read file at %s. %w", path, err)
 	}
-	var packageInfo pkg.Package
 	if err := json.Unmarshal(jsonData, &packageInfo); err != nil {
-		return "", "", fmt.Errorf("failed to unmarshal json data. %w", err)
+		return packageInfo, fmt.Errorf("failed to unmarshal json data. %w", err)
 	}
-	return packageInfo.Name, packageInfo.Version, nil
+	return packageInfo, nil
 }
 
 // NewPackage returns a PackageBuilder
@@ -51,7 +80,8 @@ func NewPackageBuilder() *PackageBuilder {
 		Name:     "",
 		Version:  "",
 		Cache:    tempDir,
-		Contents: make(map[string]string)}
+		Contents: make(map[string]string),
+		Merkles:  make(map[string]string)}
 }
 
 // NewPackageFromDir returns a PackageBuilder that initializes from the `dir` package directory.
@@ -68,13 +98,15 @@ func NewPackageBuilderFromDir(dir string) (*PackageBuilder, error) {
 			pkg.Contents[relativePath] = path
 
 			if strings.HasSuffix(path, "meta/package") {
-				// Grab the package name and version from the package JSON.
-				name, version, err := parsePackageJSON(path)
+				// Grab the package metadata from the package JSON.
+				packageInfo, err := parsePackageJSON(path)
 				if err != nil {
 					return fmt.Errorf("failed to parse package manifest. %w", err)
 				}
-				pkg.Name = name
-				pkg.Version = version
+				pkg.Name = packageInfo.Name
+				pkg.Version = packageInfo.Version
+				pkg.ABIRevision = packageInfo.ABIRevision
+				pkg.Subpackages = packageInfo.Subpackages
 			}
 		}
 		return nil
@@ -94,6 +126,56 @@ func (p *PackageBuilder) Close() {
 	os.RemoveAll(p.Cache)
 }
 
+// Clone returns a new PackageBuilder with the same name, version and
+// contents, staged in its own cache, so that mutating either builder's
+// resources does not affect the other. Entries pointing at files outside the
+// cache (e.g. the directory the builder was initialized from) are referenced
+// as-is; entries staged in the cache are copied, since each builder's Close
+// deletes only its own cache.
+func (p *PackageBuilder) Clone() (*PackageBuilder, error) {
+	clone := NewPackageBuilder()
+	clone.Name = p.Name
+	clone.Version = p.Version
+	clone.ABIRevision = p.ABIRevision
+	clone.Subpackages = append([]SubpackageRef(nil), p.Subpackages...)
+	for relativePath, sourcePath := range p.Contents {
+		if !strings.HasPrefix(sourcePath, p.Cache+"/") {
+			clone.Contents[relativePath] = sourcePath
+			continue
+		}
+		destPath := filepath.Join(clone.Cache, relativePath)
+		if err := copyFile(destPath, sourcePath); err != nil {
+			clone.Close()
+			return nil, fmt.Errorf("failed to copy %s to %s. %w", sourcePath, destPath, err)
+		}
+		clone.Contents[relativePath] = destPath
+	}
+	for relativePath, hash := range p.Merkles {
+		clone.Merkles[relativePath] = hash
+	}
+	return clone, nil
+}
+
+func copyFile(destPath string, sourcePath string) error {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s. %w", sourcePath, err)
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create parent directories for %s. %w", destPath, err)
+	}
+	dst, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s. %w", destPath, err)
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // Add a resource to the package at the given path.
 func (p *PackageBuilder) AddResource(path string, contents io.Reader) error {
 	if _, ok := p.Contents[path]; ok {
@@ -114,6 +196,122 @@ func (p *PackageBuilder) AddResource(path string, contents io.Reader) error {
 	return nil
 }
 
+// UpdateResource replaces the contents of an existing resource at the given
+// path. The new contents are staged in the cache, even when the resource
+// previously referenced a file outside it, so the original file is left
+// untouched. Use AddResource to create a resource that does not exist yet.
+func (p *PackageBuilder) UpdateResource(path string, contents io.Reader) error {
+	if _, ok := p.Contents[path]; !ok {
+		return fmt.Errorf("no resource exists at path %s", path)
+	}
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("failed to read file. %w", err)
+	}
+	tempPath := filepath.Join(p.Cache, path)
+	if err := os.MkdirAll(filepath.Dir(tempPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create parent directories for %s. %w", tempPath, err)
+	}
+	if err = ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write data to %s. %w", tempPath, err)
+	}
+	p.Contents[path] = tempPath
+	// Any hash recorded while staging the old contents is stale now.
+	delete(p.Merkles, path)
+	return nil
+}
+
+// RemoveResource removes the resource at the given path from the package, so
+// it does not appear in the next Publish. It is an error to remove a resource
+// that does not exist, or to remove meta/package or meta/contents, which
+// Publish manages itself. Files referenced outside the cache are left in
+// place; only staged copies are deleted.
+func (p *PackageBuilder) RemoveResource(path string) error {
+	if path == "meta/package" || path == "meta/contents" {
+		return fmt.Errorf("%s is managed by Publish and cannot be removed", path)
+	}
+	sourcePath, ok := p.Contents[path]
+	if !ok {
+		return fmt.Errorf("no resource exists at path %s", path)
+	}
+	if strings.HasPrefix(sourcePath, p.Cache+"/") {
+		if err := os.Remove(sourcePath); err != nil {
+			return fmt.Errorf("failed to remove staged file %s. %w", sourcePath, err)
+		}
+	}
+	delete(p.Contents, path)
+	delete(p.Merkles, path)
+	return nil
+}
+
+// AddResourcesFromDir adds every file under `dir` to the package, rooted at
+// `prefix`, so a file at `<dir>/a/b` becomes the resource `<prefix>/a/b`. The
+// files are referenced in place rather than copied into the staging directory,
+// matching NewPackageBuilderFromDir. If any of the resulting paths already
+// exist in the package, no resources are added and the returned error lists
+// every collision.
+func (p *PackageBuilder) AddResourcesFromDir(prefix string, dir string) error {
+	entries := make(map[string]string)
+	var collisions []string
+	err := filepath.Walk(dir, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("walk of %s failed. %w", dir, err)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath := path.Join(prefix, strings.Replace(walkPath, dir+"/", "", 1))
+		if _, ok := p.Contents[relativePath]; ok {
+			collisions = append(collisions, relativePath)
+			return nil
+		}
+		entries[relativePath] = walkPath
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error when walking the directory. %w", err)
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return fmt.Errorf("resources already exist at paths: %s", strings.Join(collisions, ", "))
+	}
+	for relativePath, sourcePath := range entries {
+		p.Contents[relativePath] = sourcePath
+	}
+	return nil
+}
+
+// AddStreamedResource adds a resource to the package at the given path,
+// streaming contents to the staging directory without buffering it in memory.
+// The resource's merkle root is computed as the data streams through and is
+// recorded in Merkles so the staged file does not need to be re-read to hash
+// it.
+func (p *PackageBuilder) AddStreamedResource(path string, contents io.Reader) error {
+	if _, ok := p.Contents[path]; ok {
+		return fmt.Errorf("a resource already exists at path %s", path)
+	}
+	tempPath := filepath.Join(p.Cache, path)
+	if err := os.MkdirAll(filepath.Dir(tempPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create parent directories for %s. %w", tempPath, err)
+	}
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s. %w", tempPath, err)
+	}
+	var tree merkle.Tree
+	_, err = tree.ReadFrom(io.TeeReader(contents, f))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to stage data to %s. %w", tempPath, err)
+	}
+	p.Contents[path] = tempPath
+	p.Merkles[path] = hex.EncodeToString(tree.Root())
+	return nil
+}
+
 func tempConfig(dir string, name string, version string) (*build.Config, error) {
 	cfg := &build.Config{
 		OutputDir:    filepath.Join(dir, "output"),
@@ -129,50 +327,60 @@ func tempConfig(dir string, name string, version string) (*build.Config, error)
 	return cfg, nil
 }
 
-// Publish the package to the repository.
-func (p *PackageBuilder) Publish(pkgRepo *Repository) error {
+// Publish the package to the repository. Returns the merkle root of the
+// published package's meta.far, which is how the package is addressed in the
+// repository's metadata.
+func (p *PackageBuilder) Publish(pkgRepo *Repository) (string, error) {
 	// Open repository
 	// Repository.Dir contains a trailing `repository` in the path that we don't want.
 	repoDir := path.Dir(pkgRepo.Dir)
 	pmRepo, err := repo.New(repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to open repository at %s. %w", pkgRepo.Dir, err)
+		return "", fmt.Errorf("failed to open repository at %s. %w", pkgRepo.Dir, err)
 	}
 	// Create Config.
 	dir, err := ioutil.TempDir("", "pm-temp-config")
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory for the config")
+		return "", fmt.Errorf("failed to create temp directory for the config")
 	}
 	defer os.RemoveAll(dir)
 
 	cfg, err := tempConfig(dir, p.Name, p.Version)
 	if err != nil {
-		return fmt.Errorf("failed to create temp config to fill with our data. %w", err)
+		return "", fmt.Errorf("failed to create temp config to fill with our data. %w", err)
 	}
 	pack, err := cfg.Package()
 	if err != nil {
-		return fmt.Errorf("failed to create package for the given config. %w", err)
+		return "", fmt.Errorf("failed to create package for the given config. %w", err)
 	}
 	pkgPath := filepath.Join(filepath.Dir(cfg.ManifestPath), "package")
 	if err := os.MkdirAll(filepath.Join(pkgPath, "meta"), os.ModePerm); err != nil {
-		return fmt.Errorf("failed to make parent dirs for meta/package. %w", err)
+		return "", fmt.Errorf("failed to make parent dirs for meta/package. %w", err)
 	}
 	pkgJSON := filepath.Join(pkgPath, "meta", "package")
-	b, err := json.Marshal(&pack)
+	// Carry the source package's ABI revision and subpackage references into
+	// the rebuilt meta/package rather than dropping them.
+	metaPkg := packageJSON{
+		Name:        pack.Name,
+		Version:     pack.Version,
+		ABIRevision: p.ABIRevision,
+		Subpackages: p.Subpackages,
+	}
+	b, err := json.Marshal(&metaPkg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal package into JSON. %w", err)
+		return "", fmt.Errorf("failed to marshal package into JSON. %w", err)
 	}
 	if err := ioutil.WriteFile(pkgJSON, b, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to write JSON to package file. %w", err)
+		return "", fmt.Errorf("failed to write JSON to package file. %w", err)
 	}
 	mfst, err := os.Create(cfg.ManifestPath)
 	if err != nil {
-		return fmt.Errorf("failed to create package manifest path. %w", err)
+		return "", fmt.Errorf("failed to create package manifest path. %w", err)
 	}
 	defer mfst.Close()
 
 	if _, err := fmt.Fprintf(mfst, "meta/package=%s\n", pkgJSON); err != nil {
-		return fmt.Errorf("failed to write package JSON to file. %w", err)
+		return "", fmt.Errorf("failed to write package JSON to file. %w", err)
 	}
 
 	// Fill config with our contents.
@@ -181,41 +389,136 @@ func (p *PackageBuilder) Publish(pkgRepo *Repository) error {
 			continue
 		}
 		if _, err := fmt.Fprintf(mfst, "%s=%s\n", relativePath, sourcePath); err != nil {
-			return fmt.Errorf("failed to record entry '%s' as '%s' into manifest. %w", p.Name, sourcePath, err)
+			return "", fmt.Errorf("failed to record entry '%s' as '%s' into manifest. %w", p.Name, sourcePath, err)
 		}
 	}
 
 	// Save changes to config.
 	if err := build.Update(cfg); err != nil {
-		return fmt.Errorf("failed to update config. %w", err)
+		return "", fmt.Errorf("failed to update config. %w", err)
 	}
 	if _, err := build.Seal(cfg); err != nil {
-		return fmt.Errorf("failed to seal config. %w", err)
+		return "", fmt.Errorf("failed to seal config. %w", err)
 	}
 
 	outputManifest, err := cfg.OutputManifest()
 	if err != nil {
-		return fmt.Errorf("failed to output manifest. %w", err)
+		return "", fmt.Errorf("failed to output manifest. %w", err)
+	}
+
+	metaMerkle := ""
+	for _, blob := range outputManifest.Blobs {
+		if blob.Path == "meta/" {
+			metaMerkle = blob.Merkle.String()
+		}
+	}
+	if metaMerkle == "" {
+		return "", fmt.Errorf("did not find meta.far in the output manifest")
 	}
 
 	outputManifestPath := path.Join(cfg.OutputDir, "package_manifest.json")
 
 	content, err := json.Marshal(outputManifest)
 	if err != nil {
-		return fmt.Errorf("failed to convert manifest to JSON. %w", err)
+		return "", fmt.Errorf("failed to convert manifest to JSON. %w", err)
 	}
 	if err := ioutil.WriteFile(outputManifestPath, content, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to write manifest JSON to %s. %w", outputManifestPath, err)
+		return "", fmt.Errorf("failed to write manifest JSON to %s. %w", outputManifestPath, err)
 	}
 	defer os.RemoveAll(filepath.Dir(cfg.OutputDir))
 
 	// Publish new config to repo.
 	_, err = pmRepo.PublishManifest(outputManifestPath)
 	if err != nil {
-		return fmt.Errorf("failed to publish manifest. %w", err)
+		return "", fmt.Errorf("failed to publish manifest. %w", err)
 	}
 	if err = pmRepo.CommitUpdates(true); err != nil {
-		return fmt.Errorf("failed to commit updates to repo. %w", err)
+		return "", fmt.Errorf("failed to commit updates to repo. %w", err)
 	}
-	return nil
+	return metaMerkle, nil
+}
+
+// PackageDiff describes how the contents of two packages differ. Paths under
+// meta/ are reported separately from data blobs: meta/package and
+// meta/contents change whenever anything else in the package does, so folding
+// them into the data diff would hide the effect of a targeted change.
+type PackageDiff struct {
+	// Added holds the data paths present only in the new package.
+	Added []string
+	// Removed holds the data paths present only in the old package.
+	Removed []string
+	// Changed holds the data paths present in both packages whose content
+	// hashes differ.
+	Changed []string
+	// MetaChanged holds the meta/ paths that were added, removed, or whose
+	// content hashes differ.
+	MetaChanged []string
+}
+
+// DiffPackages compares the contents of two packages by content hash and
+// reports which paths an update from oldPkg to newPkg would add, remove, or
+// change. This predicts which blobs an OTA between the two would fetch.
+func DiffPackages(oldPkg *PackageBuilder, newPkg *PackageBuilder) (PackageDiff, error) {
+	var diff PackageDiff
+
+	oldHashes, err := contentHashes(oldPkg)
+	if err != nil {
+		return diff, fmt.Errorf("failed to hash contents of package %s. %w", oldPkg.Name, err)
+	}
+	newHashes, err := contentHashes(newPkg)
+	if err != nil {
+		return diff, fmt.Errorf("failed to hash contents of package %s. %w", newPkg.Name, err)
+	}
+
+	record := func(relativePath string, bucket *[]string) {
+		if strings.HasPrefix(relativePath, "meta/") {
+			diff.MetaChanged = append(diff.MetaChanged, relativePath)
+			return
+		}
+		*bucket = append(*bucket, relativePath)
+	}
+
+	for relativePath, newHash := range newHashes {
+		oldHash, ok := oldHashes[relativePath]
+		if !ok {
+			record(relativePath, &diff.Added)
+		} else if oldHash != newHash {
+			record(relativePath, &diff.Changed)
+		}
+	}
+	for relativePath := range oldHashes {
+		if _, ok := newHashes[relativePath]; !ok {
+			record(relativePath, &diff.Removed)
+		}
+	}
+
+	for _, bucket := range [][]string{diff.Added, diff.Removed, diff.Changed, diff.MetaChanged} {
+		sort.Strings(bucket)
+	}
+	return diff, nil
+}
+
+// contentHashes computes the merkle root of each content entry, keyed by the
+// entry's path in the package. Entries whose hash was computed while staging
+// are not re-read.
+func contentHashes(p *PackageBuilder) (map[string]string, error) {
+	hashes := make(map[string]string, len(p.Contents))
+	for relativePath, sourcePath := range p.Contents {
+		if hash, ok := p.Merkles[relativePath]; ok {
+			hashes[relativePath] = hash
+			continue
+		}
+		f, err := os.Open(sourcePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s. %w", sourcePath, err)
+		}
+		var tree merkle.Tree
+		_, err = tree.ReadFrom(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s. %w", sourcePath, err)
+		}
+		hashes[relativePath] = hex.EncodeToString(tree.Root())
+	}
+	return hashes, nil
 }
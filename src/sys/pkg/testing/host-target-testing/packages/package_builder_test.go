@@ -5,8 +5,11 @@ package packages
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"go.fuchsia.dev/fuchsia/garnet/go/src/far"
+	"go.fuchsia.dev/fuchsia/garnet/go/src/merkle"
 	"go.fuchsia.dev/fuchsia/src/sys/pkg/bin/pm/build"
 	"go.fuchsia.dev/fuchsia/src/sys/pkg/bin/pm/repo"
 	"io/ioutil"
@@ -14,6 +17,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -170,6 +174,110 @@ func TestAddResource(t *testing.T) {
 	}
 }
 
+func TestAddResourcesFromDir(t *testing.T) {
+	pkgBuilder := NewPackageBuilder()
+	defer pkgBuilder.Close()
+
+	srcDir, err := ioutil.TempDir("", "pkg-test-resources")
+	if err != nil {
+		t.Fatalf("Failed to create directory. %s", err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	files := map[string]string{
+		"a":            "contents of a",
+		"nested/b":     "contents of b",
+		"nested/dir/c": "contents of c",
+	}
+	for name, data := range files {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory for %s. %s", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write %s. %s", name, err)
+		}
+	}
+
+	if err := pkgBuilder.AddResourcesFromDir("data/extra", srcDir); err != nil {
+		t.Fatalf("Failed to add resources from %s. %s", srcDir, err)
+	}
+
+	for name, data := range files {
+		key := path.Join("data/extra", name)
+		sourcePath, ok := pkgBuilder.Contents[key]
+		if !ok {
+			t.Fatalf("Resource %s failed to be added.", key)
+		}
+		got, err := ioutil.ReadFile(sourcePath)
+		if err != nil {
+			t.Fatalf("Failed to read contents of %s. %s", key, err)
+		}
+		if string(got) != data {
+			t.Fatalf("%s expects to have %s, but has %s", key, data, got)
+		}
+	}
+	if len(pkgBuilder.Contents) != len(files) {
+		t.Fatalf("Package contents has %d files, should have %d", len(pkgBuilder.Contents), len(files))
+	}
+
+	// Adding the same directory again collides on every path and adds nothing.
+	before := len(pkgBuilder.Contents)
+	if err := pkgBuilder.AddResourcesFromDir("data/extra", srcDir); err == nil {
+		t.Fatalf("Adding the same directory twice should have failed.")
+	}
+	if len(pkgBuilder.Contents) != before {
+		t.Fatalf("Package contents has %d files after a failed add, should have %d", len(pkgBuilder.Contents), before)
+	}
+}
+
+func TestAddStreamedResource(t *testing.T) {
+	pkgBuilder := NewPackageBuilder()
+	defer pkgBuilder.Close()
+
+	newResource := "blah/z"
+
+	if err := pkgBuilder.AddStreamedResource(newResource, bytes.NewReader([]byte(newResource))); err != nil {
+		t.Fatalf("Failed to add resource %s. %s", newResource, err)
+	}
+
+	// Confirm the file and contents were added.
+	path, ok := pkgBuilder.Contents[newResource]
+	if !ok {
+		t.Fatalf("Test resource %s failed to be added.", newResource)
+	}
+	newData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read contents of %s. %s", newResource, err)
+	}
+	if string(newData) != newResource {
+		t.Fatalf("%s expects to have %s, but has %s", newResource, newResource, string(newData))
+	}
+
+	// Confirm the hash computed while streaming matches a fresh hash of the
+	// staged file.
+	storedMerkle, ok := pkgBuilder.Merkles[newResource]
+	if !ok {
+		t.Fatalf("Test resource %s has no stored merkle.", newResource)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s. %s", path, err)
+	}
+	defer f.Close()
+	var tree merkle.Tree
+	if _, err := tree.ReadFrom(f); err != nil {
+		t.Fatalf("Failed to hash %s. %s", path, err)
+	}
+	if freshMerkle := hex.EncodeToString(tree.Root()); storedMerkle != freshMerkle {
+		t.Fatalf("Stored merkle %s does not match fresh merkle %s", storedMerkle, freshMerkle)
+	}
+
+	if err := pkgBuilder.AddStreamedResource(newResource, bytes.NewReader([]byte(newResource))); err == nil {
+		t.Fatalf("Resource %s should have failed to be added twice.", newResource)
+	}
+}
+
 func TestPublish(t *testing.T) {
 	parentDir := filepath.Join("", "omaha-pkg-test-publish")
 	if err := os.MkdirAll(parentDir, 0755); err != nil {
@@ -204,12 +312,22 @@ func TestPublish(t *testing.T) {
 	pkgBuilder.AddResource(newResource, bytes.NewReader([]byte(newResource)))
 
 	// Update repo with updated package.
-	if err := pkgBuilder.Publish(pkgRepo); err != nil {
+	publishedMerkle, err := pkgBuilder.Publish(pkgRepo)
+	if err != nil {
 		t.Fatalf("Publishing package failed. %s", err)
 	}
 
 	pkgRepo, err = NewRepository(path.Dir(pkgRepo.Dir))
 
+	// The returned merkle matches the repository's targets metadata.
+	target, ok := pkgRepo.targets.Targets[fullPkgName]
+	if !ok {
+		t.Fatalf("Targets metadata does not contain '%s'.", fullPkgName)
+	}
+	if target.Custom.Merkle != publishedMerkle {
+		t.Fatalf("Publish returned merkle %s, but targets metadata has %s", publishedMerkle, target.Custom.Merkle)
+	}
+
 	// Confirm that the package is published and updated.
 	pkg, err = pkgRepo.OpenPackage(fullPkgName)
 	if err != nil {
@@ -223,3 +341,302 @@ func TestPublish(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateResource(t *testing.T) {
+	parentDir := filepath.Join("", "omaha-pkg-test-update-resource")
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory %s, %s", parentDir, err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	pkgRepo, expandDir, err := CreateAndExpandPackage(parentDir)
+	if err != nil {
+		t.Fatalf("Failed to create and expand package. %s", err)
+	}
+
+	pkgBuilder, err := NewPackageBuilderFromDir(expandDir)
+	if err != nil {
+		t.Fatalf("Failed to parse package from %s. %s", expandDir, err)
+	}
+	defer pkgBuilder.Close()
+
+	newResource := "blah/z"
+
+	// Updating a resource that doesn't exist yet fails.
+	if err := pkgBuilder.UpdateResource(newResource, bytes.NewReader([]byte("nope"))); err == nil {
+		t.Fatalf("Updating nonexistent resource %s should have failed.", newResource)
+	}
+
+	// Add the resource, then replace its contents.
+	if err := pkgBuilder.AddResource(newResource, bytes.NewReader([]byte("original"))); err != nil {
+		t.Fatalf("Failed to add resource %s. %s", newResource, err)
+	}
+	if err := pkgBuilder.UpdateResource(newResource, bytes.NewReader([]byte("updated"))); err != nil {
+		t.Fatalf("Failed to update resource %s. %s", newResource, err)
+	}
+
+	if _, err := pkgBuilder.Publish(pkgRepo); err != nil {
+		t.Fatalf("Publishing package failed. %s", err)
+	}
+
+	pkgRepo, err = NewRepository(path.Dir(pkgRepo.Dir))
+	if err != nil {
+		t.Fatalf("Failed to read repo. %s", err)
+	}
+
+	fullPkgName := fmt.Sprintf("%s/%s", pkgBuilder.Name, pkgBuilder.Version)
+	pkg, err := pkgRepo.OpenPackage(fullPkgName)
+	if err != nil {
+		t.Fatalf("Repo does not contain '%s'. %s", fullPkgName, err)
+	}
+	if data, err := pkg.ReadFile(newResource); err != nil {
+		t.Fatalf("%s should be in package.", newResource)
+	} else if string(data) != "updated" {
+		t.Fatalf("%s should have value updated but is %s", newResource, data)
+	}
+}
+
+func TestRemoveResource(t *testing.T) {
+	parentDir := filepath.Join("", "omaha-pkg-test-remove-resource")
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory %s, %s", parentDir, err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	pkgRepo, expandDir, err := CreateAndExpandPackage(parentDir)
+	if err != nil {
+		t.Fatalf("Failed to create and expand package. %s", err)
+	}
+
+	pkgBuilder, err := NewPackageBuilderFromDir(expandDir)
+	if err != nil {
+		t.Fatalf("Failed to parse package from %s. %s", expandDir, err)
+	}
+	defer pkgBuilder.Close()
+
+	// The meta files managed by Publish cannot be removed.
+	for _, managed := range []string{"meta/package", "meta/contents"} {
+		if err := pkgBuilder.RemoveResource(managed); err == nil {
+			t.Fatalf("Removing %s should have failed.", managed)
+		}
+	}
+	if err := pkgBuilder.RemoveResource("blah/z"); err == nil {
+		t.Fatalf("Removing nonexistent resource blah/z should have failed.")
+	}
+
+	removedResource := build.TestFiles[0]
+	if err := pkgBuilder.RemoveResource(removedResource); err != nil {
+		t.Fatalf("Failed to remove resource %s. %s", removedResource, err)
+	}
+	if _, ok := pkgBuilder.Contents[removedResource]; ok {
+		t.Fatalf("Resource %s should no longer be in the package contents.", removedResource)
+	}
+
+	if _, err := pkgBuilder.Publish(pkgRepo); err != nil {
+		t.Fatalf("Publishing package failed. %s", err)
+	}
+
+	pkgRepo, err = NewRepository(path.Dir(pkgRepo.Dir))
+	if err != nil {
+		t.Fatalf("Failed to read repo. %s", err)
+	}
+
+	fullPkgName := fmt.Sprintf("%s/%s", pkgBuilder.Name, pkgBuilder.Version)
+	pkg, err := pkgRepo.OpenPackage(fullPkgName)
+	if err != nil {
+		t.Fatalf("Repo does not contain '%s'. %s", fullPkgName, err)
+	}
+	if _, err := pkg.ReadFile(removedResource); err == nil {
+		t.Fatalf("%s should not be found in the published package.", removedResource)
+	}
+}
+
+func TestClone(t *testing.T) {
+	pkgBuilder := NewPackageBuilder()
+	defer pkgBuilder.Close()
+	pkgBuilder.Name = "foo"
+	pkgBuilder.Version = "0"
+
+	sharedResource := "data/shared"
+	if err := pkgBuilder.AddResource(sharedResource, bytes.NewReader([]byte("original"))); err != nil {
+		t.Fatalf("Failed to add resource %s. %s", sharedResource, err)
+	}
+
+	clone, err := pkgBuilder.Clone()
+	if err != nil {
+		t.Fatalf("Failed to clone package. %s", err)
+	}
+
+	if clone.Name != pkgBuilder.Name || clone.Version != pkgBuilder.Version {
+		t.Fatalf("Clone is %s/%s, should be %s/%s", clone.Name, clone.Version, pkgBuilder.Name, pkgBuilder.Version)
+	}
+	if clone.Cache == pkgBuilder.Cache {
+		t.Fatalf("Clone shares cache %s with the original.", clone.Cache)
+	}
+
+	// Mutate the clone: overwrite the shared resource and add a new one.
+	if err := ioutil.WriteFile(clone.Contents[sharedResource], []byte("mutated"), 0644); err != nil {
+		t.Fatalf("Failed to overwrite %s in the clone. %s", sharedResource, err)
+	}
+	cloneResource := "data/clone-only"
+	if err := clone.AddResource(cloneResource, bytes.NewReader([]byte(cloneResource))); err != nil {
+		t.Fatalf("Failed to add resource %s to the clone. %s", cloneResource, err)
+	}
+
+	// The original is unchanged.
+	data, err := ioutil.ReadFile(pkgBuilder.Contents[sharedResource])
+	if err != nil {
+		t.Fatalf("Failed to read contents of %s. %s", sharedResource, err)
+	}
+	if string(data) != "original" {
+		t.Fatalf("%s should have value original but is %s", sharedResource, data)
+	}
+	if _, ok := pkgBuilder.Contents[cloneResource]; ok {
+		t.Fatalf("Resource %s added to the clone should not appear in the original.", cloneResource)
+	}
+
+	// Closing the clone must not delete the original's staged files.
+	clone.Close()
+	if _, err := os.Stat(pkgBuilder.Contents[sharedResource]); err != nil {
+		t.Fatalf("Original's staged file for %s is gone after closing the clone. %s", sharedResource, err)
+	}
+}
+
+func TestPublishPreservesABIRevision(t *testing.T) {
+	parentDir := filepath.Join("", "omaha-pkg-test-abi-revision")
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory %s, %s", parentDir, err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	repoDir, err := ioutil.TempDir(parentDir, "repo")
+	if err != nil {
+		t.Fatalf("Failed to create directory. %s", err)
+	}
+	pkgRepo, _, err := CreateTestPackage(repoDir)
+	if err != nil {
+		t.Fatalf("Failed to create test package. %s", err)
+	}
+
+	// Lay out a source package whose meta/package declares an ABI revision
+	// and a subpackage reference.
+	srcDir, err := ioutil.TempDir(parentDir, "src")
+	if err != nil {
+		t.Fatalf("Failed to create directory. %s", err)
+	}
+	sourceJSON := packageJSON{
+		Name:        "abi-pkg",
+		Version:     "0",
+		ABIRevision: "0xECCEA2F70ACD6FC0",
+		Subpackages: []SubpackageRef{{
+			Name:   "sub-pkg",
+			Merkle: "0000000000000000000000000000000000000000000000000000000000000000",
+		}},
+	}
+	b, err := json.Marshal(&sourceJSON)
+	if err != nil {
+		t.Fatalf("Failed to marshal package JSON. %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(srcDir, "meta"), 0755); err != nil {
+		t.Fatalf("Failed to create meta directory. %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "meta", "package"), b, 0644); err != nil {
+		t.Fatalf("Failed to write meta/package. %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(srcDir, "data"), 0755); err != nil {
+		t.Fatalf("Failed to create data directory. %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "data", "a"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write data/a. %s", err)
+	}
+
+	pkgBuilder, err := NewPackageBuilderFromDir(srcDir)
+	if err != nil {
+		t.Fatalf("Failed to parse package from %s. %s", srcDir, err)
+	}
+	defer pkgBuilder.Close()
+
+	if pkgBuilder.ABIRevision != sourceJSON.ABIRevision {
+		t.Fatalf("Builder has ABI revision %q, should be %q", pkgBuilder.ABIRevision, sourceJSON.ABIRevision)
+	}
+	if !reflect.DeepEqual(pkgBuilder.Subpackages, sourceJSON.Subpackages) {
+		t.Fatalf("Builder has subpackages %+v, should be %+v", pkgBuilder.Subpackages, sourceJSON.Subpackages)
+	}
+
+	if _, err := pkgBuilder.Publish(pkgRepo); err != nil {
+		t.Fatalf("Publishing package failed. %s", err)
+	}
+
+	pkgRepo, err = NewRepository(path.Dir(pkgRepo.Dir))
+	if err != nil {
+		t.Fatalf("Failed to read repo. %s", err)
+	}
+	pkg, err := pkgRepo.OpenPackage("abi-pkg/0")
+	if err != nil {
+		t.Fatalf("Repo does not contain 'abi-pkg/0'. %s", err)
+	}
+	// meta/package lives inside the meta.far rather than in meta/contents, so
+	// it has to be read through a far reader on the meta.far blob.
+	blob, err := pkgRepo.OpenBlob(pkg.merkle)
+	if err != nil {
+		t.Fatalf("Failed to open meta.far blob. %s", err)
+	}
+	defer blob.Close()
+	farReader, err := far.NewReader(blob)
+	if err != nil {
+		t.Fatalf("Failed to open reader on blob. %s", err)
+	}
+	defer farReader.Close()
+	data, err := farReader.ReadFile("meta/package")
+	if err != nil {
+		t.Fatalf("Failed to read meta/package from the published package. %s", err)
+	}
+	var published packageJSON
+	if err := json.Unmarshal(data, &published); err != nil {
+		t.Fatalf("Failed to unmarshal published meta/package. %s", err)
+	}
+	if published.ABIRevision != sourceJSON.ABIRevision {
+		t.Fatalf("Published package has ABI revision %q, should be %q", published.ABIRevision, sourceJSON.ABIRevision)
+	}
+	if !reflect.DeepEqual(published.Subpackages, sourceJSON.Subpackages) {
+		t.Fatalf("Published package has subpackages %+v, should be %+v", published.Subpackages, sourceJSON.Subpackages)
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	oldPkg := NewPackageBuilder()
+	defer oldPkg.Close()
+	newPkg := NewPackageBuilder()
+	defer newPkg.Close()
+
+	addResource := func(pkg *PackageBuilder, path string, data string) {
+		if err := pkg.AddResource(path, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("Failed to add resource %s. %s", path, err)
+		}
+	}
+
+	addResource(oldPkg, "data/unchanged", "same contents")
+	addResource(oldPkg, "data/changed", "before")
+	addResource(oldPkg, "data/removed", "going away")
+	addResource(oldPkg, "meta/package", `{"name":"foo","version":"0"}`)
+
+	addResource(newPkg, "data/unchanged", "same contents")
+	addResource(newPkg, "data/changed", "after")
+	addResource(newPkg, "data/added", "brand new")
+	addResource(newPkg, "meta/package", `{"name":"foo","version":"1"}`)
+
+	diff, err := DiffPackages(oldPkg, newPkg)
+	if err != nil {
+		t.Fatalf("Failed to diff packages. %s", err)
+	}
+
+	expected := PackageDiff{
+		Added:       []string{"data/added"},
+		Removed:     []string{"data/removed"},
+		Changed:     []string{"data/changed"},
+		MetaChanged: []string{"meta/package"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Package diff is %+v, should be %+v", diff, expected)
+	}
+}
@@ -41,6 +41,14 @@ func (c Config) GetInt(key ConfigKey) int {
 	panic("")
 }
 
+func (c Config) GetString(key ConfigKey) string {
+	if val, ok := c.Get(key).(string); ok {
+		return val
+	}
+	log.Fatalf("key %s is type %T, expected string", key, c.Get(key))
+	panic("")
+}
+
 type GidlFile struct {
 	Filename   string
 	Gen        func(Config) (string, error)
@@ -0,0 +1,38 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "byte_vector_with_handles.gen.test.fidl",
+		Gen:      fidlGenByteVectorWithHandles,
+		Definitions: []config.Definition{
+			{
+				Comment: `A bulk byte payload carried alongside a small number of handles, sized to
+	show whether bindings keep the byte copy fast path when handles are present.`,
+				Config: config.Config{
+					"size":        4096,
+					"num_handles": 8,
+				},
+			},
+		},
+	})
+}
+
+func fidlGenByteVectorWithHandles(config config.Config) (string, error) {
+	size := config.GetInt("size")
+	numHandles := config.GetInt("num_handles")
+	return fmt.Sprintf(`
+struct ByteVectorWithHandles%[2]d {
+	vector<uint8>:%[1]d bytes;
+	vector<handle>:%[2]d handles;
+};`, size, numHandles), nil
+}
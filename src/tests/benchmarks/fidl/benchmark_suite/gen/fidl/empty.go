@@ -0,0 +1,33 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"gen/config"
+	"gen/fidl/util"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "empty.gen.test.fidl",
+		Gen:      fidlGenEmpty,
+		Definitions: []config.Definition{
+			{},
+		},
+	})
+}
+
+func fidlGenEmpty(config config.Config) (string, error) {
+	return `
+struct EmptyStruct {
+};
+
+struct EmptyTableStruct {
+	EmptyTable value;
+};
+
+table EmptyTable {
+};`, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+	"gen/types"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "method_call.gen.test.fidl",
+		Gen:      fidlGenMethodCall,
+		Definitions: []config.Definition{
+			{
+				Config: config.Config{
+					"size": 16,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 256,
+				},
+				// Dart has a 256 argument limit and all struct fields are passed into
+				// the constructor.
+				Denylist: []config.Binding{config.Dart},
+			},
+		},
+	})
+}
+
+func fidlGenMethodCall(config config.Config) (string, error) {
+	size := config.GetInt("size")
+	return fmt.Sprintf(`
+struct MethodCallRequest%[1]d {
+%[2]s
+};
+
+struct MethodCallResponse%[1]d {
+%[2]s
+};
+
+protocol MethodCall%[1]d {
+    Echo(MethodCallRequest%[1]d request) -> (MethodCallResponse%[1]d response);
+};`, size, util.StructFields(types.Uint8, "field", size)), nil
+}
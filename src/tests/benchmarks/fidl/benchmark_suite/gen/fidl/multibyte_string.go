@@ -0,0 +1,38 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "multibyte_string.gen.test.fidl",
+		Gen:      fidlGenMultibyteString,
+		Definitions: []config.Definition{
+			{
+				Config: config.Config{
+					"size": 256,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 4096,
+				},
+			},
+		},
+	})
+}
+
+func fidlGenMultibyteString(config config.Config) (string, error) {
+	size := config.GetInt("size")
+	return fmt.Sprintf(`
+struct MultibyteString%[1]d {
+	string:%[1]d value;
+};`, size), nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+	"strings"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "nested_vectors.gen.test.fidl",
+		Gen:      fidlGenNestedVectors,
+		Definitions: []config.Definition{
+			{
+				Comment: `Nested to the wire format's out-of-line recursion limit of 32.`,
+				Config: config.Config{
+					"depth": 32,
+				},
+			},
+		},
+	})
+}
+
+func nestedVectorsType(depth int) string {
+	var builder strings.Builder
+	for i := 0; i < depth; i++ {
+		builder.WriteString("vector<")
+	}
+	builder.WriteString("uint8")
+	builder.WriteString(strings.Repeat(">", depth))
+	return builder.String()
+}
+
+func fidlGenNestedVectors(config config.Config) (string, error) {
+	depth := config.GetInt("depth")
+	return fmt.Sprintf(`
+struct NestedVectors%[1]d {
+	%[2]s value;
+};`, depth, nestedVectorsType(depth)), nil
+}
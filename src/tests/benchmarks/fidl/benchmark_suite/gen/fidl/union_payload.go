@@ -0,0 +1,63 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "union_payload.gen.test.fidl",
+		Gen:      fidlGenUnionPayload,
+		Definitions: []config.Definition{
+			{
+				Config: config.Config{
+					"size": 1,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 4,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 8,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 16,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 256,
+				},
+			},
+			{
+				Config: config.Config{
+					"size": 4096,
+				},
+				Denylist: []config.Binding{config.HLCPP, config.LLCPP, config.Rust, config.Walker},
+			},
+		},
+	})
+}
+
+func fidlGenUnionPayload(config config.Config) (string, error) {
+	size := config.GetInt("size")
+	return fmt.Sprintf(`
+struct UnionPayload%[1]dStruct {
+	UnionPayload%[1]d u;
+};
+
+union UnionPayload%[1]d {
+	array<uint8>:%[1]d data;
+};`, size), nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/fidl/util"
+)
+
+func init() {
+	util.Register(config.FidlFile{
+		Filename: "vector_of_vectors.gen.test.fidl",
+		Gen:      fidlGenVectorOfVectors,
+		Definitions: []config.Definition{
+			{
+				Config: config.Config{
+					"name": "Int32VectorOfVectors",
+					"type": "int32",
+				},
+			},
+		},
+	})
+}
+
+func fidlGenVectorOfVectors(config config.Config) (string, error) {
+	name := config.GetString("name")
+	typ := config.GetString("type")
+	return fmt.Sprintf(`
+struct %[1]s {
+	vector<vector<%[2]s>> values;
+};`, name, typ), nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+	"gen/types"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "byte_vector_with_handles.gen.gidl",
+		Gen:      gidlGenByteVectorWithHandles,
+		Benchmarks: []config.Benchmark{
+			{
+				Name: "ByteVectorWithHandles/4096/0",
+				Comment: `4096 byte vector in a struct that can also carry handles, as the
+			baseline for handle-carrying variants`,
+				Config: config.Config{
+					"size":        4096,
+					"num_handles": 0,
+				},
+				// The walker and reference modes operate on encoded bytes
+				// without a handle table.
+				Denylist: []config.Binding{config.Walker, config.Reference},
+			},
+			// TODO(fxb/36441): GIDL cannot express handle values yet. Add 1-
+			// and 8-handle variants once it can, so the per-handle cost on
+			// top of the bulk byte copy is visible.
+		},
+	})
+}
+
+func gidlGenByteVectorWithHandles(conf config.Config) (string, error) {
+	size := conf.GetInt("size")
+	numHandles := conf.GetInt("num_handles")
+	if numHandles != 0 {
+		return "", fmt.Errorf("GIDL cannot express handle values yet (fxb/36441); got num_handles = %d", numHandles)
+	}
+
+	return fmt.Sprintf(`
+ByteVectorWithHandles8{
+	bytes: [
+%[1]s
+	],
+	handles: [],
+}`, util.List(size, util.SequentialHexValues(types.Uint8, 0))), nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "empty.gen.gidl",
+		Gen:      gidlGenEmpty,
+		Benchmarks: []config.Benchmark{
+			{
+				Name:    "EmptyStruct",
+				Comment: `Struct with no fields, measuring the fixed per-message overhead that anchors every other benchmark against a floor`,
+				Config: config.Config{
+					"kind": "struct",
+				},
+			},
+			{
+				Name:    "EmptyTable",
+				Comment: `Table with no fields, measuring the fixed overhead of the table envelope`,
+				Config: config.Config{
+					"kind": "table",
+				},
+			},
+		},
+	})
+}
+
+func gidlGenEmpty(conf config.Config) (string, error) {
+	switch kind := conf.GetString("kind"); kind {
+	case "struct":
+		return `
+EmptyStruct{}`, nil
+	case "table":
+		return `
+EmptyTableStruct{
+	value: EmptyTable{},
+}`, nil
+	default:
+		return "", fmt.Errorf("unknown kind: %s", kind)
+	}
+}
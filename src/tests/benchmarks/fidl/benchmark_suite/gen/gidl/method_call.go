@@ -0,0 +1,70 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+	"gen/types"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "method_call.gen.gidl",
+		Gen:      gidlGenMethodCall,
+		Benchmarks: []config.Benchmark{
+			{
+				Name:    "MethodCall/Request/16",
+				Comment: `Request of a two-way method with a 16 uint8 field payload`,
+				Config: config.Config{
+					"size":      16,
+					"direction": "Request",
+				},
+				// The walker and reference mechanisms measure standalone values and
+				// cannot dispatch a method.
+				Denylist: []config.Binding{config.Walker, config.Reference},
+			},
+			{
+				Name:    "MethodCall/Response/16",
+				Comment: `Response of a two-way method with a 16 uint8 field payload`,
+				Config: config.Config{
+					"size":      16,
+					"direction": "Response",
+				},
+				Denylist: []config.Binding{config.Walker, config.Reference},
+			},
+			{
+				Name:    "MethodCall/Request/256",
+				Comment: `Request of a two-way method with a 256 uint8 field payload`,
+				Config: config.Config{
+					"size":      256,
+					"direction": "Request",
+				},
+				// Dart has a 256 argument limit and all struct fields are passed into
+				// the constructor.
+				Denylist: []config.Binding{config.Walker, config.Reference, config.Dart},
+			},
+			{
+				Name:    "MethodCall/Response/256",
+				Comment: `Response of a two-way method with a 256 uint8 field payload`,
+				Config: config.Config{
+					"size":      256,
+					"direction": "Response",
+				},
+				Denylist: []config.Binding{config.Walker, config.Reference, config.Dart},
+			},
+		},
+	})
+}
+
+func gidlGenMethodCall(conf config.Config) (string, error) {
+	size := conf.GetInt("size")
+	direction := conf.GetString("direction")
+	return fmt.Sprintf(`
+MethodCall%[1]s%[2]d{
+%[3]s
+}`, direction, size, util.Fields(1, size, "field", util.SequentialValues(types.Uint8, 0))), nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+	"strconv"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "multibyte_string.gen.gidl",
+		Gen:      gidlGenMultibyteString,
+		Benchmarks: []config.Benchmark{
+			{
+				Name:    "MultibyteString/256/Ascii",
+				Comment: `256 byte string of 1-byte runes, the UTF-8 validation fast path`,
+				Config: config.Config{
+					"size":       256,
+					"complexity": util.StringAscii,
+				},
+			},
+			{
+				Name:    "MultibyteString/256/Mixed",
+				Comment: `256 byte string mixing 1- to 4-byte runes`,
+				Config: config.Config{
+					"size":       256,
+					"complexity": util.StringMixed,
+				},
+			},
+			{
+				Name: "MultibyteString/256/All4Byte",
+				Comment: `256 byte string of 4-byte runes including the boundary
+			code points U+10000 and U+10FFFF`,
+				Config: config.Config{
+					"size":       256,
+					"complexity": util.StringAll4Byte,
+				},
+			},
+			{
+				Name:    "MultibyteString/4096/Ascii",
+				Comment: `4096 byte string of 1-byte runes, the UTF-8 validation fast path`,
+				Config: config.Config{
+					"size":       4096,
+					"complexity": util.StringAscii,
+				},
+			},
+			{
+				Name:    "MultibyteString/4096/Mixed",
+				Comment: `4096 byte string mixing 1- to 4-byte runes`,
+				Config: config.Config{
+					"size":       4096,
+					"complexity": util.StringMixed,
+				},
+			},
+			{
+				Name: "MultibyteString/4096/All4Byte",
+				Comment: `4096 byte string of 4-byte runes including the boundary
+			code points U+10000 and U+10FFFF`,
+				Config: config.Config{
+					"size":       4096,
+					"complexity": util.StringAll4Byte,
+				},
+			},
+		},
+	})
+}
+
+// Only valid UTF-8 is generated here: the perf harness must never ingest
+// invalid encodings. Invalid-UTF-8 boundary cases are exercised by the
+// hand-written conformance suite instead.
+func gidlGenMultibyteString(conf config.Config) (string, error) {
+	size := conf.GetInt("size")
+	complexity := conf.GetString("complexity")
+
+	return fmt.Sprintf(`
+MultibyteString%[1]d{
+	value: %[2]s,
+}`, size, strconv.QuoteToASCII(util.UnicodeString(size, complexity))), nil
+}
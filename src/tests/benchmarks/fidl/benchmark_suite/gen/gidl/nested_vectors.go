@@ -0,0 +1,52 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "nested_vectors.gen.gidl",
+		Gen:      gidlGenNestedVectors,
+		Benchmarks: []config.Benchmark{
+			{
+				Name: "NestedVectors/Depth32",
+				Comment: `Vector nested to the wire format's out-of-line recursion limit of 32,
+with a single element per level. Exercises the depth bookkeeping itself
+rather than element throughput. HLCPP, LLCPP, Rust, Dart and the walker
+all handle the full depth of 32.`,
+				Config: config.Config{
+					"depth": 32,
+				},
+				// Go runs into a stack overflow before reaching depth 32.
+				// See optional_struct_tree.go.
+				Denylist: []config.Binding{config.Go},
+			},
+		},
+	})
+}
+
+func nestedVectorsValueString(depth int) string {
+	if depth == 1 {
+		return `[
+	1,
+]`
+	}
+	return fmt.Sprintf(`[
+	%s,
+]`, nestedVectorsValueString(depth-1))
+}
+
+func gidlGenNestedVectors(conf config.Config) (string, error) {
+	depth := conf.GetInt("depth")
+	return fmt.Sprintf(`
+NestedVectors%[1]d{
+	value: %[2]s,
+}`, depth, nestedVectorsValueString(depth)), nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "union_first_set.gen.gidl",
+		Gen:      gidlGenUnionFirstSet,
+		Benchmarks: []config.Benchmark{
+			{
+				Name: "Union/FirstSet/16",
+				Comment: `Union with 16 possible tags that has 1st tag set.
+			Companion to Union/LastSet/16: the difference between the two
+			isolates the cost of scanning to a high ordinal on decode`,
+				Config: config.Config{
+					"size": 16,
+				},
+			},
+			{
+				Name: "Union/FirstSet/256",
+				Comment: `Union with 256 possible tags that has 1st tag set.
+			Companion to Union/LastSet/256: the difference between the two
+			isolates the cost of scanning to a high ordinal on decode`,
+				Config: config.Config{
+					"size": 256,
+				},
+			},
+		},
+	})
+}
+
+func gidlGenUnionFirstSet(conf config.Config) (string, error) {
+	size := conf.GetInt("size")
+	return fmt.Sprintf(`
+Union%[1]dStruct{
+	u: Union%[1]d{
+		field1: 1,
+	},
+}`, size), nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+	"gen/types"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "union_payload.gen.gidl",
+		Gen:      gidlGenUnionPayload,
+		Benchmarks: []config.Benchmark{
+			{
+				Name:    "UnionPayload/Inline/1",
+				Comment: `1 byte union payload in an 8 byte envelope, all padding`,
+				Config: config.Config{
+					"size": 1,
+				},
+			},
+			{
+				Name:    "UnionPayload/Inline/4",
+				Comment: `4 byte union payload in an 8 byte envelope, half padding`,
+				Config: config.Config{
+					"size": 4,
+				},
+			},
+			{
+				Name:    "UnionPayload/Inline/8",
+				Comment: `8 byte union payload that exactly fills its envelope`,
+				Config: config.Config{
+					"size": 8,
+				},
+			},
+			{
+				Name:    "UnionPayload/OutOfLine/16",
+				Comment: `16 byte union payload, too wide for inline envelope storage`,
+				Config: config.Config{
+					"size": 16,
+				},
+			},
+			{
+				Name:    "UnionPayload/OutOfLine/256",
+				Comment: `256 byte union payload stored out of line`,
+				Config: config.Config{
+					"size": 256,
+				},
+			},
+			{
+				Name: "UnionPayload/OutOfLine/4096",
+				Comment: `
+			4096 byte union payload stored out of line
+			Disabled on HLCPP / LLCPP due to clang performance issues`,
+				Config: config.Config{
+					"size": 4096,
+				},
+				Denylist: []config.Binding{config.HLCPP, config.LLCPP, config.Rust, config.Walker},
+			},
+		},
+	})
+}
+
+func gidlGenUnionPayload(conf config.Config) (string, error) {
+	size := conf.GetInt("size")
+
+	return fmt.Sprintf(`
+UnionPayload%[1]dStruct{
+	u: UnionPayload%[1]d{
+		data: [
+%[2]s
+		],
+	},
+}`, size, util.List(size, util.SequentialHexValues(types.Uint8, 0))), nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// String complexity levels, controlling how many bytes each encoded rune
+// occupies. UTF-8 validation cost depends on content, so benchmarks vary
+// the rune width rather than only the byte length.
+const (
+	// Every rune is a single byte.
+	StringAscii = "ascii"
+	// A deterministic mix of 1-, 2-, 3- and 4-byte runes.
+	StringMixed = "mixed"
+	// Every rune is 4 bytes, including the boundary code points U+10000
+	// and U+10FFFF; the remainder when the length is not a multiple of 4
+	// is padded with ASCII.
+	StringAll4Byte = "all-4-byte"
+)
+
+// Runes cycled through by UnicodeString, per complexity level. Only valid
+// UTF-8 is ever produced: invalid-encoding cases belong to the conformance
+// suite, not to generated benchmark inputs.
+var (
+	mixedRunes    = []rune{'a', 'é', '€', '\U0001f600'}
+	all4ByteRunes = []rune{'\U00010000', '\U00010330', '\U0001f600', '\U0010ffff'}
+)
+
+// UnicodeString generates a deterministic valid-UTF-8 string of exactly
+// size bytes at the given complexity level.
+func UnicodeString(size int, complexity string) string {
+	switch complexity {
+	case StringAscii:
+		return asciiString(size)
+	case StringMixed:
+		return runeString(size, mixedRunes)
+	case StringAll4Byte:
+		return runeString(size, all4ByteRunes)
+	default:
+		panic(fmt.Sprintf("unknown string complexity %q", complexity))
+	}
+}
+
+func asciiString(size int) string {
+	var builder strings.Builder
+	for i := 0; i < size; i++ {
+		builder.WriteByte(byte('a' + i%26))
+	}
+	return builder.String()
+}
+
+// runeString cycles through runes until fewer bytes remain than the next
+// rune occupies, then pads to the exact size with ASCII.
+func runeString(size int, runes []rune) string {
+	var builder strings.Builder
+	for i := 0; ; i++ {
+		r := runes[i%len(runes)]
+		if builder.Len()+len(string(r)) > size {
+			break
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String() + asciiString(size-builder.Len())
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package gidl
+
+import (
+	"fmt"
+	"gen/config"
+	"gen/gidl/util"
+	"gen/types"
+	"strings"
+)
+
+func init() {
+	util.Register(config.GidlFile{
+		Filename: "vector_of_vectors.gen.gidl",
+		Gen:      gidlGenVectorOfVectors,
+		Benchmarks: []config.Benchmark{
+			{
+				Name:    "VectorOfVectors/Int32/64x4",
+				Comment: `many small inner vectors: dominated by the fixed per-inner-vector overhead`,
+				Config: config.Config{
+					"name":  "Int32VectorOfVectors",
+					"type":  "int32",
+					"outer": 64,
+					"inner": 4,
+				},
+			},
+			{
+				Name:    "VectorOfVectors/Int32/16x16",
+				Comment: `square shape with the same total element count as the jagged shapes`,
+				Config: config.Config{
+					"name":  "Int32VectorOfVectors",
+					"type":  "int32",
+					"outer": 16,
+					"inner": 16,
+				},
+			},
+			{
+				Name:    "VectorOfVectors/Int32/4x64",
+				Comment: `few large inner vectors: dominated by element encode/decode cost`,
+				Config: config.Config{
+					"name":  "Int32VectorOfVectors",
+					"type":  "int32",
+					"outer": 4,
+					"inner": 64,
+				},
+			},
+		},
+	})
+}
+
+func gidlGenVectorOfVectors(conf config.Config) (string, error) {
+	name := conf.GetString("name")
+	typ := types.FidlType(conf.GetString("type"))
+	outer := conf.GetInt("outer")
+	inner := conf.GetInt("inner")
+
+	values := util.SequentialHexValues(typ, 0)
+	var builder strings.Builder
+	for i := 0; i < outer; i++ {
+		if i > 0 {
+			builder.WriteRune('\n')
+		}
+		builder.WriteString(fmt.Sprintf(`[
+%s
+],`, util.ListNoComments(inner, values)))
+	}
+
+	return fmt.Sprintf(`
+%[1]s{
+	values: [
+%[2]s
+	]
+}`, name, builder.String()), nil
+}
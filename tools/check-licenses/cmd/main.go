@@ -7,6 +7,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	"go.fuchsia.dev/fuchsia/tools/check-licenses/lib"
 )
@@ -21,6 +22,28 @@ func main() {
 		return
 	}
 	flag.StringVar(&config.Target, "target", config.Target, "Options: {all, <target>}")
+	checkPatternOverlaps := flag.Bool("check_pattern_overlaps", false, "Check the license pattern library for overlapping patterns instead of scanning a tree")
+	overlapAllowlist := flag.String("pattern_overlap_allowlist", "", "Comma-separated pattern=example pairs of intentional pattern overlaps")
+	flag.Parse()
+	if *checkPatternOverlaps {
+		allowlist, err := lib.ParseOverlapAllowlist(*overlapAllowlist)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		overlaps, err := lib.FindOverlaps(config.LicensePatternDir, allowlist)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		for _, overlap := range overlaps {
+			fmt.Println(overlap)
+		}
+		if len(overlaps) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 	if err := lib.Walk(&config); err != nil {
 		fmt.Println(err.Error())
 	}
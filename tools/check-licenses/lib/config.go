@@ -12,20 +12,21 @@ import (
 
 // Config values are populated from the the json file at the default or user-specified path
 type Config struct {
-	FilesRegex          []string `json:"filesRegex,omitempty"`
-	SkipDirs            []string `json:"skipDirs"`
-	SkipFiles           []string `json:"skipFiles"`
-	TextExtensionList   []string `json:"textExtensionList"`
-	MaxReadSize         int      `json:"maxReadSize"`
-	SeparatorWidth      int      `json:"separatorWidth"`
-	OutputFilePrefix    string   `json:"outputFilePrefix"`
-	OutputFileExtension string   `json:"outputFileExtension"`
-	Product             string   `json:"product"`
-	SingleLicenseFiles  []string `json:"singleLicenseFiles"`
-	LicensePatternDir   string   `json:"licensePatternDir"`
-	BaseDir             string   `json:"baseDir"`
-	Target              string   `json:"target"`
-	LogLevel            string   `json:"logLevel"`
+	FilesRegex          []string          `json:"filesRegex,omitempty"`
+	SkipDirs            []string          `json:"skipDirs"`
+	SkipFiles           []string          `json:"skipFiles"`
+	TextExtensionList   []string          `json:"textExtensionList"`
+	MaxReadSize         int               `json:"maxReadSize"`
+	SeparatorWidth      int               `json:"separatorWidth"`
+	OutputFilePrefix    string            `json:"outputFilePrefix"`
+	OutputFileExtension string            `json:"outputFileExtension"`
+	Product             string            `json:"product"`
+	SingleLicenseFiles  []string          `json:"singleLicenseFiles"`
+	LicensePatternDir   string            `json:"licensePatternDir"`
+	BaseDir             string            `json:"baseDir"`
+	Target              string            `json:"target"`
+	LogLevel            string            `json:"logLevel"`
+	ExpectedLicenses    []ExpectedLicense `json:"expectedLicenses,omitempty"`
 	TextExtensions      map[string]bool
 }
 
@@ -0,0 +1,91 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExpectedLicense maps a directory glob to the license category files beneath it are expected to carry
+type ExpectedLicense struct {
+	DirGlob  string `json:"dirGlob"`
+	Category string `json:"category"`
+}
+
+// ExpectedMismatch records a file whose detected license differs from the category its directory expects
+type ExpectedMismatch struct {
+	Path     string
+	Expected string
+	// Detected lists the categories of the licenses found in the file; it is empty when no license matched
+	Detected []string
+}
+
+// expectedLicenseChecker flags files under an expected-license directory whose license header
+// is either missing or belongs to a different category, catching accidental license contamination
+type expectedLicenseChecker struct {
+	expectations []ExpectedLicense
+	mismatches   []ExpectedMismatch
+}
+
+func newExpectedLicenseChecker(config *Config) *expectedLicenseChecker {
+	return &expectedLicenseChecker{expectations: config.ExpectedLicenses}
+}
+
+// expectationFor returns the expected license category for path, walking the file's ancestor
+// directories from deepest to shallowest so that the most specific glob wins
+func (checker *expectedLicenseChecker) expectationFor(path string) (string, bool) {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		for _, expected := range checker.expectations {
+			if ok, err := filepath.Match(expected.DirGlob, dir); err == nil && ok {
+				return expected.Category, true
+			}
+		}
+	}
+	return "", false
+}
+
+// check records a mismatch if path is under an expected-license directory and none of the matched
+// licenses belongs to the expected category
+func (checker *expectedLicenseChecker) check(path string, matched []*License, metrics *Metrics) {
+	expected, ok := checker.expectationFor(path)
+	if !ok {
+		return
+	}
+	detected := make([]string, 0, len(matched))
+	for _, license := range matched {
+		if license.category == expected {
+			return
+		}
+		detected = append(detected, license.category)
+	}
+	sort.Strings(detected)
+	metrics.increment("num_expected_license_mismatch")
+	checker.mismatches = append(checker.mismatches, ExpectedMismatch{
+		Path:     path,
+		Expected: expected,
+		Detected: detected,
+	})
+}
+
+// results returns the recorded mismatches sorted by path so output is deterministic
+func (checker *expectedLicenseChecker) results() []ExpectedMismatch {
+	sort.Slice(checker.mismatches, func(i, j int) bool {
+		return checker.mismatches[i].Path < checker.mismatches[j].Path
+	})
+	return checker.mismatches
+}
+
+func (checker *expectedLicenseChecker) print() {
+	for _, mismatch := range checker.results() {
+		if len(mismatch.Detected) == 0 {
+			fmt.Printf("License mismatch: %s: expected %s, no license matched\n", mismatch.Path, mismatch.Expected)
+		} else {
+			fmt.Printf("License mismatch: %s: expected %s, detected %s\n", mismatch.Path, mismatch.Expected, strings.Join(mismatch.Detected, ", "))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+)
+
+func TestExpectedLicensesExpectationFor(t *testing.T) {
+	checker := expectedLicenseChecker{
+		expectations: []ExpectedLicense{
+			{DirGlob: "third_party/*", Category: "bsd.lic"},
+		},
+	}
+	category, found := checker.expectationFor("third_party/foo/bar.c")
+	if !found {
+		t.Errorf("%v(): no expectation found for third_party/foo/bar.c", t.Name())
+	}
+	want := "bsd.lic"
+	if category != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), category, want)
+	}
+	if _, found := checker.expectationFor("src/foo/bar.c"); found {
+		t.Errorf("%v(): unexpected expectation found for src/foo/bar.c", t.Name())
+	}
+}
+
+func TestExpectedLicensesCheck(t *testing.T) {
+	metrics := getMetrics()
+	checker := expectedLicenseChecker{
+		expectations: []ExpectedLicense{
+			{DirGlob: "third_party/*", Category: "bsd.lic"},
+		},
+	}
+	bsd := &License{category: "bsd.lic"}
+	gpl := &License{category: "gpl.lic"}
+	checker.check("third_party/foo/ok.c", []*License{bsd}, metrics)
+	checker.check("third_party/foo/wrong.c", []*License{gpl}, metrics)
+	checker.check("third_party/foo/missing.c", nil, metrics)
+	checker.check("src/foo/unwatched.c", []*License{gpl}, metrics)
+	results := checker.results()
+	if num_mismatches, want := len(results), 2; num_mismatches != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), num_mismatches, want)
+	}
+	// results are sorted by path for deterministic output
+	if want := "third_party/foo/missing.c"; results[0].Path != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), results[0].Path, want)
+	}
+	if num_detected, want := len(results[0].Detected), 0; num_detected != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), num_detected, want)
+	}
+	if want := "third_party/foo/wrong.c"; results[1].Path != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), results[1].Path, want)
+	}
+	if want := "gpl.lic"; len(results[1].Detected) != 1 || results[1].Detected[0] != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), results[1].Detected, want)
+	}
+	if num_mismatches, want := metrics.values["num_expected_license_mismatch"], uint(2); num_mismatches != want {
+		t.Errorf("%v(): got %v, want %v", t.Name(), num_mismatches, want)
+	}
+}
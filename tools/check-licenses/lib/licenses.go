@@ -95,9 +95,10 @@ func (licenses *Licenses) MatchSingleLicenseFile(data []byte, base string, metri
 	}
 }
 
-// MatchFile returns true if any License matches input data
-func (licenses *Licenses) MatchFile(data []byte, path string, metrics *Metrics) bool {
+// MatchFile returns true if any License matches input data, along with the matching Licenses
+func (licenses *Licenses) MatchFile(data []byte, path string, metrics *Metrics) (bool, []*License) {
 	is_matched := false
+	var matched_licenses []*License
 	var wg sync.WaitGroup
 	wg.Add(len(licenses.licenses))
 	var sm sync.Map
@@ -113,6 +114,7 @@ func (licenses *Licenses) MatchFile(data []byte, path string, metrics *Metrics)
 		}
 		if matched := result.([]byte); matched != nil {
 			is_matched = true
+			matched_licenses = append(matched_licenses, license)
 			metrics.increment("num_licensed")
 			if len(license.matches) == 0 {
 				license.matches = append(license.matches, Match{
@@ -121,5 +123,5 @@ func (licenses *Licenses) MatchFile(data []byte, path string, metrics *Metrics)
 			license.matches[0].files = append(license.matches[0].files, path)
 		}
 	}
-	return is_matched
+	return is_matched, matched_licenses
 }
@@ -15,6 +15,7 @@ type Metrics struct {
 func (metrics *Metrics) Init() {
 	metrics.values = make(map[string]uint)
 	metrics.order = []string{
+		"num_expected_license_mismatch",
 		"num_extensions_excluded",
 		"num_licensed",
 		"num_non_single_license_files",
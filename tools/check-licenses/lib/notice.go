@@ -0,0 +1,86 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// noticeBlock groups every file covered by one distinct license text.
+// Licenses whose matched texts are identical are merged into a single block,
+// even when they live under different category names, so the text appears in
+// the NOTICE file only once.
+type noticeBlock struct {
+	categories []string
+	text       string
+	files      []string
+}
+
+// collectNoticeBlocks builds the deduplicated blocks for every license with
+// at least one match, sorted by category for stable output.
+func collectNoticeBlocks(licenses *Licenses) []*noticeBlock {
+	byText := make(map[string]*noticeBlock)
+	var blocks []*noticeBlock
+	for _, license := range licenses.licenses {
+		if len(license.matches) == 0 {
+			continue
+		}
+		text := string(license.matches[0].value)
+		block, found := byText[text]
+		if !found {
+			block = &noticeBlock{text: text}
+			byText[text] = block
+			blocks = append(blocks, block)
+		}
+		block.categories = append(block.categories, strings.TrimSuffix(license.category, ".lic"))
+		for _, match := range license.matches {
+			block.files = append(block.files, match.files...)
+		}
+	}
+	for _, block := range blocks {
+		sort.Strings(block.categories)
+		sort.Strings(block.files)
+		files := block.files[:0]
+		for i, file := range block.files {
+			if i == 0 || file != block.files[i-1] {
+				files = append(files, file)
+			}
+		}
+		block.files = files
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].categories[0] < blocks[j].categories[0]
+	})
+	return blocks
+}
+
+// saveToNoticeFile writes a consolidated NOTICE file: each distinct license
+// text once, followed by the sorted list of files it covers, with blocks
+// separated by a ruler of Config.SeparatorWidth dashes.
+func saveToNoticeFile(file io.Writer, licenses *Licenses, config *Config) error {
+	separator := strings.Repeat("-", config.SeparatorWidth)
+	for i, block := range collectNoticeBlocks(licenses) {
+		if i > 0 {
+			if _, err := fmt.Fprintf(file, "%s\n\n", separator); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(file, "%s:\n\n%s\n\n", strings.Join(block.categories, ", "), block.text); err != nil {
+			return err
+		}
+		for _, path := range block.files {
+			if _, err := fmt.Fprintf(file, "%s\n", path); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(file, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
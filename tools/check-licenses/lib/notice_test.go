@@ -0,0 +1,95 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNoticeMergesIdenticalTexts(t *testing.T) {
+	licenses := Licenses{
+		licenses: []*License{
+			{
+				pattern:  regexp.MustCompile("The BSD License"),
+				category: "bsd.lic",
+				matches: []Match{{
+					value: []byte("The BSD License"),
+					files: []string{"b/file.go", "a/file.go"},
+				}},
+			},
+			{
+				pattern:  regexp.MustCompile("The BSD License"),
+				category: "bsd_variant.lic",
+				matches: []Match{{
+					value: []byte("The BSD License"),
+					files: []string{"c/file.go", "a/file.go"},
+				}},
+			},
+			{
+				pattern:  regexp.MustCompile("The MIT License"),
+				category: "mit.lic",
+				matches: []Match{{
+					value: []byte("The MIT License"),
+					files: []string{"d/file.go"},
+				}},
+			},
+			{
+				pattern:  regexp.MustCompile("unused"),
+				category: "unused.lic",
+			},
+		},
+	}
+
+	blocks := collectNoticeBlocks(&licenses)
+	want := 2
+	if len(blocks) != want {
+		t.Fatalf("%v(): got %v blocks, want %v", t.Name(), len(blocks), want)
+	}
+	if got, want := strings.Join(blocks[0].categories, ","), "bsd,bsd_variant"; got != want {
+		t.Errorf("%v(): got categories %v, want %v", t.Name(), got, want)
+	}
+	if got, want := strings.Join(blocks[0].files, ","), "a/file.go,b/file.go,c/file.go"; got != want {
+		t.Errorf("%v(): got files %v, want %v", t.Name(), got, want)
+	}
+	if got, want := blocks[1].text, "The MIT License"; got != want {
+		t.Errorf("%v(): got text %v, want %v", t.Name(), got, want)
+	}
+}
+
+func TestNoticeSeparatorWidth(t *testing.T) {
+	licenses := Licenses{
+		licenses: []*License{
+			{
+				pattern:  regexp.MustCompile("license one"),
+				category: "one.lic",
+				matches:  []Match{{value: []byte("license one"), files: []string{"one.go"}}},
+			},
+			{
+				pattern:  regexp.MustCompile("license two"),
+				category: "two.lic",
+				matches:  []Match{{value: []byte("license two"), files: []string{"two.go"}}},
+			},
+		},
+	}
+	config := Config{SeparatorWidth: 8}
+
+	var buf bytes.Buffer
+	if err := saveToNoticeFile(&buf, &licenses, &config); err != nil {
+		t.Fatalf("%v(): got %v", t.Name(), err)
+	}
+	got := buf.String()
+	separator := strings.Repeat("-", config.SeparatorWidth)
+	if want := 1; strings.Count(got, separator) != want {
+		t.Errorf("%v(): got %v separators, want %v", t.Name(), strings.Count(got, separator), want)
+	}
+	for _, want := range []string{"license one", "one.go", "license two", "two.go"} {
+		if strings.Count(got, want) != 1 {
+			t.Errorf("%v(): got %v occurrences of %q, want 1", t.Name(), strings.Count(got, want), want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Overlap records two license patterns that both match the same canonical
+// license text. Overlapping patterns make classification order-dependent:
+// whichever pattern is tested first claims the file.
+type Overlap struct {
+	// Pattern is the category of the pattern that matched.
+	Pattern string
+	// Example is the category whose representative text it matched.
+	Example string
+}
+
+func (overlap Overlap) String() string {
+	return fmt.Sprintf("pattern %s also matches the example text for %s", overlap.Pattern, overlap.Example)
+}
+
+// OverlapAllowlist holds intentional overlaps that FindOverlaps should not
+// report.
+type OverlapAllowlist map[Overlap]bool
+
+// ParseOverlapAllowlist parses a comma-separated list of pattern=example
+// pairs, e.g. "fuchsia_bsd2.lic=fuchsia_bsd.lic". Whitespace around entries
+// is ignored; an empty string yields an empty allowlist.
+func ParseOverlapAllowlist(s string) (OverlapAllowlist, error) {
+	allowlist := make(OverlapAllowlist)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed allowlist entry %q, want pattern=example", entry)
+		}
+		allowlist[Overlap{
+			Pattern: strings.TrimSpace(parts[0]),
+			Example: strings.TrimSpace(parts[1]),
+		}] = true
+	}
+	return allowlist, nil
+}
+
+// FindOverlaps tests every license pattern in patternDir against the
+// representative example text of every other pattern and returns the
+// overlaps not covered by allowlist, sorted for stable output. Example
+// texts are read from the "examples" directory next to patternDir, named
+// after the pattern with a .txt extension; patterns without an example are
+// skipped. FindOverlaps operates on the pattern library alone and does not
+// scan a tree.
+func FindOverlaps(patternDir string, allowlist OverlapAllowlist) ([]Overlap, error) {
+	licenses, err := NewLicenses(patternDir)
+	if err != nil {
+		return nil, err
+	}
+	exampleDir := filepath.Join(filepath.Dir(filepath.Clean(patternDir)), "examples")
+	var overlaps []Overlap
+	for _, example := range licenses.licenses {
+		name := strings.TrimSuffix(example.category, filepath.Ext(example.category)) + ".txt"
+		data, err := ioutil.ReadFile(filepath.Join(exampleDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, license := range licenses.licenses {
+			if license.category == example.category {
+				continue
+			}
+			overlap := Overlap{Pattern: license.category, Example: example.category}
+			if license.pattern.Match(data) && !allowlist[overlap] {
+				overlaps = append(overlaps, overlap)
+			}
+		}
+	}
+	sort.Slice(overlaps, func(i, j int) bool {
+		if overlaps[i].Pattern != overlaps[j].Pattern {
+			return overlaps[i].Pattern < overlaps[j].Pattern
+		}
+		return overlaps[i].Example < overlaps[j].Example
+	})
+	return overlaps, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseOverlapAllowlist(t *testing.T) {
+	allowlist, err := ParseOverlapAllowlist(" a.lic=b.lic , c.lic=d.lic ")
+	if err != nil {
+		t.Errorf("error: ParseOverlapAllowlist: %v", err)
+	}
+	if len(allowlist) != 2 {
+		t.Errorf("got %v entries, want 2", len(allowlist))
+	}
+	if !allowlist[Overlap{Pattern: "a.lic", Example: "b.lic"}] {
+		t.Errorf("missing allowlist entry a.lic=b.lic")
+	}
+	if _, err := ParseOverlapAllowlist("a.lic"); err == nil {
+		t.Errorf("expected error for malformed entry")
+	}
+}
+
+func TestFindOverlaps(t *testing.T) {
+	folder := "overlap_golden"
+	patternDir := filepath.Join(folder, "patterns")
+	exampleDir := filepath.Join(folder, "examples")
+	os.MkdirAll(patternDir, 0700)
+	os.MkdirAll(exampleDir, 0700)
+	defer os.RemoveAll(folder)
+	files := map[string]string{
+		filepath.Join(patternDir, "broad.lic"):    "Copyright ACME",
+		filepath.Join(patternDir, "specific.lic"): "Copyright ACME. All rights reserved.",
+		filepath.Join(exampleDir, "broad.txt"):    "Copyright ACME",
+		filepath.Join(exampleDir, "specific.txt"): "Copyright ACME. All rights reserved.",
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("error: writing %v: %v", path, err)
+		}
+	}
+
+	overlaps, err := FindOverlaps(patternDir, nil)
+	if err != nil {
+		t.Fatalf("error: FindOverlaps: %v", err)
+	}
+	want := Overlap{Pattern: "broad.lic", Example: "specific.lic"}
+	if len(overlaps) != 1 || overlaps[0] != want {
+		t.Errorf("got %v, want [%v]", overlaps, want)
+	}
+
+	allowlist := OverlapAllowlist{want: true}
+	overlaps, err = FindOverlaps(patternDir, allowlist)
+	if err != nil {
+		t.Fatalf("error: FindOverlaps: %v", err)
+	}
+	if len(overlaps) != 0 {
+		t.Errorf("got %v with allowlist, want none", overlaps)
+	}
+}
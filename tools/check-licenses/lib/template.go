@@ -77,6 +77,11 @@ func saveToOutputFile(file *os.File, licenses *Licenses, config *Config, metrics
 		unused,
 		table_of_contents,
 	}
+	// The NOTICE format is assembled directly rather than via a template so
+	// that identical license texts can be merged into a single block.
+	if config.OutputFileExtension == "notice" {
+		return saveToNoticeFile(file, licenses, config)
+	}
 	templateStr := templates.TemplateTxt
 	switch config.OutputFileExtension {
 	case "txt":
@@ -25,12 +25,14 @@ func Walk(config *Config) error {
 			}
 		}
 	}
+	checker := newExpectedLicenseChecker(config)
 	for path := range file_tree.getFileIterator() {
-		if err := processFile(path, metrics, licenses, config, file_tree); err != nil {
+		if err := processFile(path, metrics, licenses, checker, config, file_tree); err != nil {
 			// error safe to ignore because eg. io.EOF means symlink hasn't been handled yet
 			fmt.Printf("warning: %s. Skipping file: %s.\n", err, path)
 		}
 	}
+	checker.print()
 	file, err := createOutputFile(config)
 	if err != nil {
 		return err
@@ -51,13 +53,14 @@ func processSingleLicenseFile(base string, metrics *Metrics, licenses *Licenses,
 	return nil
 }
 
-func processFile(path string, metrics *Metrics, licenses *Licenses, config *Config, file_tree *FileTree) error {
+func processFile(path string, metrics *Metrics, licenses *Licenses, checker *expectedLicenseChecker, config *Config, file_tree *FileTree) error {
 	fmt.Printf("visited file or dir: %q\n", path)
 	data, err := readFromFile(path, config.MaxReadSize)
 	if err != nil {
 		return err
 	}
-	is_matched := licenses.MatchFile(data, path, metrics)
+	is_matched, matched_licenses := licenses.MatchFile(data, path, metrics)
+	checker.check(path, matched_licenses, metrics)
 	if !is_matched {
 		project := file_tree.getProjectLicense(path)
 		if project == nil {
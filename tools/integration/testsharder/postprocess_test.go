@@ -32,10 +32,13 @@ func TestMultiplyShards(t *testing.T) {
 		Tags:       []string{},
 	}
 	makeTest := func(id int, os string) Test {
-		test := Test{build.Test{
-			Name: fmt.Sprintf("test%d", id),
-			OS:   os,
-		}, 1}
+		test := Test{
+			Test: build.Test{
+				Name: fmt.Sprintf("test%d", id),
+				OS:   os,
+			},
+			Runs: 1,
+		}
 		if os == "fuchsia" {
 			test.Name = fmt.Sprintf("fuchsia-pkg://fuchsia.com/test%d", id)
 		} else {
@@ -460,11 +463,13 @@ func TestWithTargetDuration(t *testing.T) {
 		input := []*Shard{{
 			Name: "env1",
 			Env:  env1,
-			Tests: []Test{{build.Test{
-				Name:       "test1",
-				OS:         "fuchsia",
-				PackageURL: "test1",
-			}, 5,
+			Tests: []Test{{
+				Test: build.Test{
+					Name:       "test1",
+					OS:         "fuchsia",
+					PackageURL: "test1",
+				},
+				Runs: 5,
 			}},
 		}}
 		actual := WithTargetDuration(input, 2, 0, 0, defaultDurations)
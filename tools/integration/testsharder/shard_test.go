@@ -46,7 +46,7 @@ func shard(env build.Environment, ids ...int) *Shard {
 func namedShard(env build.Environment, name string, ids ...int) *Shard {
 	var tests []Test
 	for _, id := range ids {
-		tests = append(tests, Test{spec(id, env).Test, 1})
+		tests = append(tests, Test{Test: spec(id, env).Test, Runs: 1})
 	}
 	return &Shard{
 		Name:  name,
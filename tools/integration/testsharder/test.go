@@ -13,4 +13,40 @@ type Test struct {
 
 	// Runs is the number of times this test should be run.
 	Runs int `json:"runs,omitempty"`
+
+	// Setup is an optional command that the local tester runs before the test
+	// in the same working directory and environment, e.g. to start a fixture
+	// the test depends on. If it fails, the test is recorded as failed without
+	// being run. Only supported for host tests.
+	Setup []string `json:"setup,omitempty"`
+
+	// Teardown is an optional command that the local tester runs after the
+	// test, even if the test failed or timed out. Only supported for host
+	// tests.
+	Teardown []string `json:"teardown,omitempty"`
+
+	// Realm identifies a test environment shared with other tests. The test
+	// runner sets the environment up once, runs all tests declaring the same
+	// realm as a group, and tears the environment down after the group. Only
+	// supported for fuchsia tests.
+	Realm string `json:"realm,omitempty"`
+
+	// MaxAttempts is the maximum number of times the test runner will run
+	// the test to get it to pass: a failing test is retried until it passes
+	// or the attempts are exhausted, and a retry that passes marks the test
+	// as flaked rather than failed. Zero or one means no retries.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// TimeoutSecs overrides the runner's global per-test timeout for this
+	// test alone, so that slow integration tests can get a longer budget
+	// without inflating the timeout of every other test. Zero means the
+	// global timeout applies.
+	TimeoutSecs int `json:"timeout_secs,omitempty"`
+
+	// TimeoutSignal names the signal the local tester sends to the test when
+	// its per-test timeout fires, so that the test dumps its state before
+	// being killed: "SIGQUIT" (the default, which makes the Go runtime print
+	// all goroutine stacks) or "SIGABRT" (conventional for other languages).
+	// Only supported for host tests.
+	TimeoutSignal string `json:"timeout_signal,omitempty"`
 }
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os/exec"
 	"syscall"
+	"time"
 
 	"go.fuchsia.dev/fuchsia/tools/lib/logger"
 )
@@ -22,6 +23,17 @@ type SubprocessRunner struct {
 	// Env is the environment of the subprocess, following the usual convention of a list of
 	// strings of the form "<environment variable name>=<value>".
 	Env []string
+
+	// DumpSignal, if non-zero, is sent to the process group when the context
+	// is canceled so that the process can dump its state to stderr before it
+	// dies (e.g. SIGQUIT makes the Go runtime print all goroutine stacks).
+	// The group is given DumpGracePeriod to flush and exit on its own before
+	// being killed; when DumpSignal is zero it is killed immediately.
+	DumpSignal syscall.Signal
+
+	// DumpGracePeriod bounds how long Run waits for the process to exit
+	// after sending DumpSignal.
+	DumpGracePeriod time.Duration
 }
 
 // Run runs a command until completion or until a context is canceled, in
@@ -53,6 +65,13 @@ func (r *SubprocessRunner) Run(ctx context.Context, command []string, stdout io.
 		return err
 	case <-ctx.Done():
 		// Negating the process ID means interpret it as a process group ID.
+		if r.DumpSignal != 0 {
+			syscall.Kill(-cmd.Process.Pid, r.DumpSignal)
+			select {
+			case <-done:
+			case <-time.After(r.DumpGracePeriod):
+			}
+		}
 		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 		return ctx.Err()
 	}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -66,6 +67,26 @@ func TestSubprocessRunner(t *testing.T) {
 			}
 		})
 
+		t.Run("should let the command dump state before being killed", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			r := SubprocessRunner{
+				DumpSignal:      syscall.SIGQUIT,
+				DumpGracePeriod: time.Second,
+			}
+			command := []string{"/bin/sh", "-c", "trap 'echo dumped >&2; exit 1' QUIT; sleep 5"}
+
+			stdout := new(bytes.Buffer)
+			stderr := new(bytes.Buffer)
+
+			if err := r.Run(ctx, command, stdout, stderr); err == nil {
+				t.Fatal("expected command to terminate early but it completed")
+			}
+			if stderrS := strings.TrimSpace(stderr.String()); stderrS != "dumped" {
+				t.Fatalf("expected the dump to reach stderr, but got %q", stderrS)
+			}
+		})
+
 		t.Run("should return an error if the command fails", func(t *testing.T) {
 			r := SubprocessRunner{}
 			command := []string{"not_a_command_12345"}
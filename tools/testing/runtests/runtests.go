@@ -27,6 +27,11 @@ const (
 
 	// TestFailure represents a failed test.
 	TestFailure TestResult = "FAIL"
+
+	// TestInfraFailure represents an infrastructure failure encountered while
+	// attempting to run a test; the test itself cannot be blamed and may be
+	// retried.
+	TestInfraFailure TestResult = "INFRA_FAIL"
 )
 
 // TestSummary is a summary of a suite of test runs. It represents the output
@@ -67,6 +72,14 @@ type TestDetails struct {
 	// Result is the result of the test.
 	Result TestResult `json:"result"`
 
+	// TimedOut is true iff the test was killed because its timeout fired,
+	// distinguishing hangs from assertion failures when triaging.
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// Flaked is true iff the test passed only on a retry after one or more
+	// failed attempts.
+	Flaked bool `json:"flaked,omitempty"`
+
 	// Cases is individual test case results.
 	Cases []testparser.TestCaseResult `json:"cases"`
 
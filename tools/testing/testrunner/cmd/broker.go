@@ -0,0 +1,307 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.fuchsia.dev/fuchsia/tools/integration/testsharder/lib"
+	"go.fuchsia.dev/fuchsia/tools/lib/logger"
+	"go.fuchsia.dev/fuchsia/tools/lib/osmisc"
+	"go.fuchsia.dev/fuchsia/tools/lib/runner"
+	"go.fuchsia.dev/fuchsia/tools/net/sshutil"
+	"go.fuchsia.dev/fuchsia/tools/testing/runtests"
+	"golang.org/x/crypto/ssh"
+)
+
+// A connection broker owns the SSH connection to the device and serves it to
+// consecutive testrunner invocations over a unix socket, so that running many
+// shards serially does not re-pay connection setup for each one. The protocol
+// is one command per connection: the client sends a brokerRequest, the broker
+// runs the command over the shared connection and replies with a
+// brokerResponse carrying the captured output.
+
+// brokerRequest asks the broker to run one command on the device.
+type brokerRequest struct {
+	Command []string `json:"command"`
+}
+
+// brokerResponse carries the result of running one command.
+type brokerResponse struct {
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+
+	// ExitStatus is the command's exit status: 0 on success, -1 if the
+	// command did not run to completion.
+	ExitStatus int `json:"exit_status"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// connBroker serves a shared device connection on a unix socket.
+type connBroker struct {
+	r        sshRunner
+	listener net.Listener
+
+	// mu serializes device access so that two shards cannot run on the
+	// device simultaneously.
+	mu sync.Mutex
+}
+
+// startConnBroker starts serving r's connection on a unix socket at
+// socketPath. A socket file left behind by a crashed broker would wedge every
+// later invocation, so if nothing answers behind an existing file the broker
+// removes it and takes its place.
+func startConnBroker(ctx context.Context, r sshRunner, socketPath string) (*connBroker, error) {
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a broker is already serving on %s", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale broker socket %s: %w", socketPath, err)
+		}
+		logger.Warningf(ctx, "removed stale broker socket %s", socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on broker socket %s: %w", socketPath, err)
+	}
+	b := &connBroker{r: r, listener: listener}
+	go b.serve(ctx)
+	return b, nil
+}
+
+func (b *connBroker) serve(ctx context.Context) {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			// Accept fails once the listener is closed; see Close.
+			return
+		}
+		go b.handle(ctx, conn)
+	}
+}
+
+func (b *connBroker) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var resp brokerResponse
+	var req brokerRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp = brokerResponse{ExitStatus: -1, Error: fmt.Sprintf("malformed broker request: %v", err)}
+	} else {
+		resp = b.run(ctx, req)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Errorf(ctx, "failed to send broker response: %v", err)
+	}
+}
+
+func (b *connBroker) run(ctx context.Context, req brokerRequest) brokerResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var stdout, stderr bytes.Buffer
+	err := b.r.Run(ctx, req.Command, &stdout, &stderr)
+	if sshutil.IsConnectionError(err) {
+		// The device may have rebooted; reconnect and retry the command once
+		// on the fresh connection.
+		logger.Errorf(ctx, "device connection lost; attempting to reconnect: %v", err)
+		if _, reconnErr := b.r.ReconnectIfNecessary(ctx); reconnErr != nil {
+			return brokerResponse{ExitStatus: -1, Error: fmt.Sprintf("failed to reconnect to the device: %v", reconnErr)}
+		}
+		stdout.Reset()
+		stderr.Reset()
+		err = b.r.Run(ctx, req.Command, &stdout, &stderr)
+	}
+	resp := brokerResponse{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	if err != nil {
+		resp.ExitStatus = -1
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			resp.ExitStatus = exitErr.Waitmsg.ExitStatus()
+		}
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// Close stops serving. Closing the listener also removes the socket file, so
+// a cleanly shut down broker leaves nothing behind; crashed brokers leave a
+// stale file that the next startConnBroker reclaims.
+func (b *connBroker) Close() error {
+	return b.listener.Close()
+}
+
+// runConnectionBroker connects to the device once and serves the connection
+// on socketPath until interrupted. Invocations started with
+// -connection-broker reuse it instead of dialing their own.
+func runConnectionBroker(ctx context.Context, nodename, sshKeyFile, socketPath string) error {
+	if nodename == "" || sshKeyFile == "" {
+		return fmt.Errorf("%q and %q must be set to start a connection broker", nodenameEnvVar, sshKeyEnvVar)
+	}
+	key, err := ioutil.ReadFile(sshKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read SSH key file: %v", err)
+	}
+	config, err := sshutil.DefaultSSHConfig(key)
+	if err != nil {
+		return fmt.Errorf("failed to create an SSH client config: %v", err)
+	}
+	client, err := sshutil.ConnectToNodeDeprecated(ctx, nodename, config)
+	if err != nil {
+		return fmt.Errorf("failed to establish an SSH connection: %v", err)
+	}
+	r := runner.NewSSHRunner(client, config)
+	b, err := startConnBroker(ctx, r, socketPath)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	logger.Debugf(ctx, "connection broker serving on %s", socketPath)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	if err := b.Close(); err != nil {
+		r.Close()
+		return err
+	}
+	return r.Close()
+}
+
+// brokerExitError is returned by brokerRunner.Run when the remote command ran
+// to completion with a non-zero exit status, standing in for ssh.ExitError
+// for commands run through a broker.
+type brokerExitError int
+
+func (e brokerExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", int(e))
+}
+
+// brokerRunner runs commands through a connection broker instead of a direct
+// device connection.
+type brokerRunner struct {
+	socketPath string
+}
+
+func (r *brokerRunner) Run(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", r.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the broker at %s: %w", r.socketPath, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(brokerRequest{Command: command}); err != nil {
+		return fmt.Errorf("failed to send broker request: %w", err)
+	}
+	var resp brokerResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read broker response: %w", err)
+	}
+	stdout.Write(resp.Stdout)
+	stderr.Write(resp.Stderr)
+	if resp.Error != "" {
+		if resp.ExitStatus > 0 {
+			return brokerExitError(resp.ExitStatus)
+		}
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// fuchsiaBrokerTester executes fuchsia tests through a connection broker
+// started with -start-connection-broker. Data sinks need a direct connection
+// to copy off the device, so runtests is not supported in this mode.
+type fuchsiaBrokerTester struct {
+	r              cmdRunner
+	localOutputDir string
+	perTestTimeout time.Duration
+}
+
+func newFuchsiaBrokerTester(socketPath, localOutputDir string, perTestTimeout time.Duration) *fuchsiaBrokerTester {
+	return &fuchsiaBrokerTester{
+		r:              &brokerRunner{socketPath: socketPath},
+		localOutputDir: localOutputDir,
+		perTestTimeout: perTestTimeout,
+	}
+}
+
+// Test runs a test through the broker's shared connection.
+func (t *fuchsiaBrokerTester) Test(ctx context.Context, test testsharder.Test, stdout io.Writer, stderr io.Writer) (runtests.DataSinkReference, error) {
+	timeout := testTimeout(test, t.perTestTimeout)
+	setCommand(&test, false, "", timeout)
+	err := t.r.Run(ctx, test.Command, stdout, stderr)
+	var exitErr brokerExitError
+	if timeout > 0 &&
+		(test.Command[0] == runTestComponentName || test.Command[0] == runTestSuiteName) &&
+		errors.As(err, &exitErr) && int(exitErr) == timeoutExitCode {
+		err = &timeoutError{timeout}
+	}
+	return nil, err
+}
+
+func (t *fuchsiaBrokerTester) CopySinks(ctx context.Context, sinks []runtests.DataSinkReference) error {
+	return nil
+}
+
+// RunBugreport runs `bugreport` on the device through the broker.
+func (t *fuchsiaBrokerTester) RunBugreport(ctx context.Context, bugreportFile string) error {
+	if bugreportFile == "" {
+		return nil
+	}
+	bugreportOutFile, err := osmisc.CreateFile(filepath.Join(t.localOutputDir, bugreportFile))
+	if err != nil {
+		return fmt.Errorf("failed to create bugreport output file: %w", err)
+	}
+	defer bugreportOutFile.Close()
+	return t.r.Run(ctx, []string{"/bin/bugreport"}, bugreportOutFile, os.Stderr)
+}
+
+// SnapshotInspect dumps the device's inspect data as JSON through the broker.
+func (t *fuchsiaBrokerTester) SnapshotInspect(ctx context.Context, snapshotFile string) error {
+	if snapshotFile == "" {
+		return nil
+	}
+	snapshotOutFile, err := osmisc.CreateFile(filepath.Join(t.localOutputDir, snapshotFile))
+	if err != nil {
+		return fmt.Errorf("failed to create inspect snapshot output file: %w", err)
+	}
+	defer snapshotOutFile.Close()
+	return t.r.Run(ctx, []string{"/bin/iquery", "--format=json", "--recursive"}, snapshotOutFile, os.Stderr)
+}
+
+// SetupRealm prepares the realm shared by a group of tests; as over a direct
+// connection, there is nothing to start ahead of time.
+func (t *fuchsiaBrokerTester) SetupRealm(ctx context.Context, realm string) error {
+	logger.Debugf(ctx, "running the next group of tests in realm %q", realm)
+	return nil
+}
+
+// TeardownRealm removes the persistent storage of the realm shared by a group
+// of tests.
+func (t *fuchsiaBrokerTester) TeardownRealm(ctx context.Context, realm string) error {
+	return t.r.Run(ctx, []string{"rm", "-rf", "/data/r/sys/r/" + realm}, os.Stdout, os.Stderr)
+}
+
+// Close is a no-op: the broker owns the device connection and outlives this
+// invocation by design.
+func (t *fuchsiaBrokerTester) Close() error {
+	return nil
+}
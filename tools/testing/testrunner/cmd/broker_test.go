@@ -0,0 +1,105 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/net/sshutil"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConnBroker(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "broker.sock")
+
+	t.Run("round trips a command", func(t *testing.T) {
+		runner := &fakeRunner{}
+		b, err := startConnBroker(ctx, runner, socketPath)
+		if err != nil {
+			t.Fatalf("startConnBroker returned error: %v", err)
+		}
+		defer b.Close()
+		client := &brokerRunner{socketPath: socketPath}
+		cmd := []string{"foo", "bar"}
+		if err := client.Run(ctx, cmd, ioutil.Discard, ioutil.Discard); err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+		if diff := cmp.Diff(cmd, runner.lastCmd); diff != "" {
+			t.Errorf("Unexpected command run (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("propagates command failure", func(t *testing.T) {
+		runner := &fakeRunner{runErrs: []error{fmt.Errorf("command failed")}}
+		b, err := startConnBroker(ctx, runner, socketPath)
+		if err != nil {
+			t.Fatalf("startConnBroker returned error: %v", err)
+		}
+		defer b.Close()
+		client := &brokerRunner{socketPath: socketPath}
+		if err := client.Run(ctx, []string{"foo"}, ioutil.Discard, ioutil.Discard); err == nil {
+			t.Errorf("Run got nil error, want non-nil error")
+		}
+	})
+
+	t.Run("reconnects after a connection error", func(t *testing.T) {
+		runner := &fakeRunner{runErrs: []error{sshutil.ConnectionError{}, nil}}
+		b, err := startConnBroker(ctx, runner, socketPath)
+		if err != nil {
+			t.Fatalf("startConnBroker returned error: %v", err)
+		}
+		defer b.Close()
+		client := &brokerRunner{socketPath: socketPath}
+		if err := client.Run(ctx, []string{"foo"}, ioutil.Discard, ioutil.Discard); err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+		if runner.reconnectIfNecessaryCalls != 1 {
+			t.Errorf("ReconnectIfNecessary() called wrong number of times. Got: %d, Want: 1", runner.reconnectIfNecessaryCalls)
+		}
+		if runner.runCalls != 2 {
+			t.Errorf("Run() called wrong number of times. Got: %d, Want: 2", runner.runCalls)
+		}
+	})
+
+	t.Run("reclaims a stale socket file", func(t *testing.T) {
+		if err := ioutil.WriteFile(socketPath, nil, 0o644); err != nil {
+			t.Fatalf("failed to write a stale socket file: %v", err)
+		}
+		runner := &fakeRunner{}
+		b, err := startConnBroker(ctx, runner, socketPath)
+		if err != nil {
+			t.Fatalf("startConnBroker returned error: %v", err)
+		}
+		defer b.Close()
+		client := &brokerRunner{socketPath: socketPath}
+		if err := client.Run(ctx, []string{"foo"}, ioutil.Discard, ioutil.Discard); err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+	})
+
+	t.Run("refuses to displace a live broker", func(t *testing.T) {
+		b, err := startConnBroker(ctx, &fakeRunner{}, socketPath)
+		if err != nil {
+			t.Fatalf("startConnBroker returned error: %v", err)
+		}
+		defer b.Close()
+		if _, err := startConnBroker(ctx, &fakeRunner{}, socketPath); err == nil {
+			t.Errorf("startConnBroker got nil error, want non-nil error")
+		}
+	})
+}
@@ -8,14 +8,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,6 +33,7 @@ import (
 	tap "go.fuchsia.dev/fuchsia/tools/testing/tap/lib"
 	testparser "go.fuchsia.dev/fuchsia/tools/testing/testparser/lib"
 	testrunner "go.fuchsia.dev/fuchsia/tools/testing/testrunner/lib"
+	"golang.org/x/crypto/ssh"
 )
 
 // Fuchsia-specific environment variables possibly exposed to the testrunner.
@@ -58,10 +63,57 @@ var (
 	// The output filename for the bugreport. This will be created in the outDir.
 	bugreportFile string
 
+	// Whether to skip bugreport collection entirely.
+	skipBugreport bool
+
+	// The output filename for the raw serial console log. This will be
+	// created in the outDir.
+	serialLogFile string
+
 	// Per-test timeout.
 	perTestTimeout time.Duration
+
+	// Whether to stop running tests after the first failure.
+	failFast bool
+
+	// Whether to capture a bugreport as soon as a test fails, named after the
+	// failing test, in addition to the end-of-run bugreport.
+	bugreportOnFailure bool
+
+	// The output filename for the flake report. This will be created in the outDir.
+	flakeReportFile string
+
+	// Command with which to wrap each local test invocation.
+	testWrapper string
+
+	// Whether to snapshot the device's inspect data when a test fails.
+	snapshotInspectOnFailure bool
+
+	// Maximum number of local tests to run concurrently.
+	localParallelism int
+
+	// Comma-separated names of the environment variables passed to local
+	// tests; empty means the whole host environment.
+	envAllowlist string
+
+	// Regular expression selecting the tests to run; the others are skipped.
+	testFilter string
+
+	// The compiled form of testFilter; nil when no filter is set.
+	testFilterRegexp *regexp.Regexp
+
+	// Socket path of a connection broker through which to run fuchsia tests.
+	connectionBrokerSocket string
+
+	// If set, serve a connection broker on this socket path instead of
+	// running tests.
+	startConnectionBroker string
 )
 
+// Successive failures snapshot inspect data at most this often so that a
+// cascade of failures does not stall the run.
+const inspectSnapshotInterval = time.Minute
+
 func usage() {
 	fmt.Printf(`testrunner [flags] tests-file
 
@@ -78,15 +130,26 @@ func init() {
 	flag.StringVar(&localWD, "C", "", "Working directory of local testing subprocesses; if unset the current working directory will be used.")
 	flag.BoolVar(&useRuntests, "use-runtests", false, "Whether to default to running fuchsia tests with runtests; if false, run_test_component will be used.")
 	flag.StringVar(&bugreportFile, "bugreport-output", "", "The output filename for the bugreport. This will be created in the output directory.")
-	// TODO(fxb/36480): Support different timeouts for different tests.
-	flag.DurationVar(&perTestTimeout, "per-test-timeout", 0, "Per-test timeout, applied to all tests. Ignored if <= 0.")
+	flag.StringVar(&serialLogFile, "serial-log-output", "", "The output filename for the raw serial console log, created in the output directory. Only applies when tests run over serial; captures crashes that happen outside a test boundary.")
+	flag.BoolVar(&skipBugreport, "skip-bugreport", false, "Whether to skip bugreport collection entirely, e.g. when the device is known to be too wedged to produce one.")
+	flag.DurationVar(&perTestTimeout, "per-test-timeout", 0, "Per-test timeout, applied to tests that do not set `timeout_secs` themselves. Ignored if <= 0.")
+	flag.BoolVar(&failFast, "fail-fast", false, "Whether to stop running tests after the first failure; bugreport and data sink collection still run before exiting.")
+	flag.BoolVar(&bugreportOnFailure, "bugreport-on-failure", false, "Whether to capture a bugreport as soon as the first test failure occurs, while the device state that caused it is still fresh. Capture errors do not fail the run.")
+	flag.StringVar(&flakeReportFile, "flake-report-output", "", "The output filename for a report of the tests with mixed outcomes across multiple runs. This will be created in the output directory. If unset, no report is produced.")
+	flag.StringVar(&testWrapper, "test-wrapper", "", "Command with which to prefix each local test invocation, e.g. \"strace -f\". The command must resolve on PATH. Only applies to host tests.")
+	flag.BoolVar(&snapshotInspectOnFailure, "snapshot-inspect-on-failure", true, "Whether to snapshot the device's inspect data when a test fails. Snapshots are rate-limited; disable to keep fast runs fast.")
+	flag.StringVar(&envAllowlist, "env-allowlist", "", "Comma-separated names of environment variables to pass through to local tests, in addition to the Fuchsia-specific ones. When empty, the entire host environment is passed through.")
+	flag.StringVar(&testFilter, "test-filter", "", "Regular expression matched against test names; tests that do not match are reported as skipped instead of being run.")
+	flag.IntVar(&localParallelism, "parallel", runtime.GOMAXPROCS(0), "Maximum number of local (host) tests to run concurrently. Fuchsia tests always run serially since they share the target device.")
+	flag.StringVar(&connectionBrokerSocket, "connection-broker", "", "Socket path of a connection broker started with -start-connection-broker; fuchsia tests run through its shared device connection instead of dialing a new one.")
+	flag.StringVar(&startConnectionBroker, "start-connection-broker", "", "Serve a connection broker on the given socket path instead of running tests, until interrupted. Consecutive invocations passing the path to -connection-broker reuse the device connection.")
 	flag.Usage = usage
 }
 
 func main() {
 	flag.Parse()
 
-	if help || flag.NArg() != 1 {
+	if help || (flag.NArg() != 1 && startConnectionBroker == "") {
 		flag.Usage()
 		flag.PrintDefaults()
 		return
@@ -95,6 +158,20 @@ func main() {
 	l := logger.NewLogger(logger.DebugLevel, color.NewColor(color.ColorAuto), os.Stdout, os.Stderr, "testrunner ")
 	ctx := logger.WithLogger(context.Background(), l)
 
+	if startConnectionBroker != "" {
+		if err := runConnectionBroker(ctx, os.Getenv(nodenameEnvVar), os.Getenv(sshKeyEnvVar), startConnectionBroker); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if testFilter != "" {
+		var err error
+		if testFilterRegexp, err = regexp.Compile(testFilter); err != nil {
+			log.Fatalf("invalid -test-filter pattern %q: %v", testFilter, err)
+		}
+	}
+
 	testsPath := flag.Arg(0)
 	tests, err := loadTests(testsPath)
 	if err != nil {
@@ -115,7 +192,7 @@ func main() {
 
 	tapProducer := tap.NewProducer(os.Stdout)
 	tapProducer.Plan(len(tests))
-	outputs, err := createTestOutputs(tapProducer, testOutdir)
+	outputs, err := createTestOutputs(tapProducer, testOutdir, flakeReportFile)
 	if err != nil {
 		log.Fatalf("failed to create test results object: %v", err)
 	}
@@ -156,6 +233,32 @@ func validateTest(test testsharder.Test) error {
 			return fmt.Errorf("one or more host tests missing the `path` field")
 		}
 	}
+	if test.Realm != "" && test.OS != "fuchsia" {
+		return fmt.Errorf("realms are only supported for fuchsia tests")
+	}
+	for _, command := range [][]string{test.Setup, test.Teardown} {
+		if len(command) == 0 {
+			continue
+		}
+		if test.OS == "fuchsia" {
+			return fmt.Errorf("setup and teardown commands are only supported for host tests")
+		}
+		if command[0] == "" {
+			return fmt.Errorf("one or more tests with an empty setup or teardown command")
+		}
+	}
+	if test.TimeoutSecs < 0 {
+		return fmt.Errorf("one or more tests with negative `timeout_secs` field")
+	}
+	switch test.TimeoutSignal {
+	case "":
+	case "SIGQUIT", "SIGABRT":
+		if test.OS == "fuchsia" {
+			return fmt.Errorf("timeout signals are only supported for host tests")
+		}
+	default:
+		return fmt.Errorf("one or more tests with unknown `timeout_signal` %q", test.TimeoutSignal)
+	}
 	return nil
 }
 
@@ -184,9 +287,63 @@ type tester interface {
 	Close() error
 	CopySinks(context.Context, []runtests.DataSinkReference) error
 	RunBugreport(context.Context, string) error
+	SnapshotInspect(context.Context, string) error
+	SetupRealm(context.Context, string) error
+	TeardownRealm(context.Context, string) error
+}
+
+// localTestEnv returns the environment for local test subprocesses: the full
+// host environment by default, or only the -env-allowlist variables (plus the
+// Fuchsia-specific ones) when an allowlist is set, so that CI can keep local
+// tests hermetic.
+func localTestEnv() []string {
+	if envAllowlist == "" {
+		return os.Environ()
+	}
+	allowed := map[string]bool{
+		nodenameEnvVar:     true,
+		sshKeyEnvVar:       true,
+		serialSocketEnvVar: true,
+		testOutdirEnvVar:   true,
+	}
+	for _, name := range strings.Split(envAllowlist, ",") {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i >= 0 && allowed[kv[:i]] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// filterTests partitions tests into those matching the given pattern and the
+// names of those excluded by it. A nil pattern matches everything.
+func filterTests(tests []testsharder.Test, re *regexp.Regexp) ([]testsharder.Test, []string) {
+	if re == nil {
+		return tests, nil
+	}
+	var matched []testsharder.Test
+	var skipped []string
+	for _, test := range tests {
+		if re.MatchString(test.Name) {
+			matched = append(matched, test)
+		} else {
+			skipped = append(skipped, test.Name)
+		}
+	}
+	return matched, skipped
 }
 
 func execute(ctx context.Context, tests []testsharder.Test, outputs *testOutputs, nodename, sshKeyFile, serialSocketPath string) error {
+	// Tests excluded by -test-filter are reported as skipped rather than
+	// silently dropped so that the TAP output still accounts for them.
+	tests, skipped := filterTests(tests, testFilterRegexp)
+	for _, name := range skipped {
+		outputs.recordSkip(name)
+	}
+
 	var localTests, fuchsiaTests []testsharder.Test
 	for _, test := range tests {
 		switch test.OS {
@@ -207,12 +364,20 @@ func execute(ctx context.Context, tests []testsharder.Test, outputs *testOutputs
 		}
 	}
 
-	localEnv := append(os.Environ(),
+	var wrapper []string
+	if testWrapper != "" {
+		wrapper = strings.Fields(testWrapper)
+		if _, err := exec.LookPath(wrapper[0]); err != nil {
+			return fmt.Errorf("failed to resolve test wrapper %q on PATH: %w", wrapper[0], err)
+		}
+	}
+
+	localEnv := append(localTestEnv(),
 		// Tell tests written in Rust to print stack on failures.
 		"RUST_BACKTRACE=1",
 	)
-	localTester := newSubprocessTester(localWD, localEnv, perTestTimeout)
-	if err := runTests(ctx, localTests, localTester, outputs); err != nil {
+	localTester := newSubprocessTester(localWD, localEnv, wrapper, perTestTimeout)
+	if err := runLocalTests(ctx, localTests, localTester, outputs); err != nil {
 		return err
 	}
 
@@ -224,13 +389,18 @@ func execute(ctx context.Context, tests []testsharder.Test, outputs *testOutputs
 
 	var t tester
 	var err error
-	if sshKeyFile != "" {
+	if connectionBrokerSocket != "" {
+		if useRuntests {
+			return fmt.Errorf("-use-runtests is not supported with -connection-broker: copying data sinks needs a direct connection")
+		}
+		t = newFuchsiaBrokerTester(connectionBrokerSocket, outputs.outDir, perTestTimeout)
+	} else if sshKeyFile != "" {
 		t, err = newFuchsiaSSHTester(ctx, nodename, sshKeyFile, outputs.outDir, useRuntests, perTestTimeout)
 	} else {
 		if serialSocketPath == "" {
 			return fmt.Errorf("%q must be set if %q and %q are not", serialSocketEnvVar, sshKeyEnvVar, nodenameEnvVar)
 		}
-		t, err = newFuchsiaSerialTester(ctx, serialSocketPath, perTestTimeout)
+		t, err = newFuchsiaSerialTester(ctx, serialSocketPath, perTestTimeout, outputs.outDir, serialLogFile)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to initialize fuchsia tester: %w", err)
@@ -239,25 +409,243 @@ func execute(ctx context.Context, tests []testsharder.Test, outputs *testOutputs
 	return runTests(ctx, fuchsiaTests, t, outputs)
 }
 
-func runTests(ctx context.Context, tests []testsharder.Test, t tester, outputs *testOutputs) error {
-	var sinks []runtests.DataSinkReference
-	for _, test := range tests {
-		for i := 0; i < test.Runs; i++ {
-			result, err := runTest(ctx, test, i, t)
-			if sshutil.IsConnectionError(err) {
-				return err
+// runLocalTests runs host tests, up to localParallelism of them at a time.
+// Local tests are independent of one another, so unlike fuchsia tests (which
+// share the target device and must stay serialized) they can run
+// concurrently; each test's output stays isolated in its own stdioBuffer.
+// Results are recorded in the order the tests appear so that the summary is
+// deterministic regardless of completion order.
+func runLocalTests(ctx context.Context, tests []testsharder.Test, t tester, outputs *testOutputs) error {
+	if localParallelism <= 1 || len(tests) <= 1 || failFast {
+		// -fail-fast has to observe failures as they happen to stop running
+		// later tests, so it takes the serial path.
+		return runTests(ctx, tests, t, outputs)
+	}
+
+	results := make([][]*testrunner.TestResult, len(tests))
+	errs := make([]error, len(tests))
+	sem := make(chan struct{}, localParallelism)
+	var wg sync.WaitGroup
+	for i, test := range tests {
+		wg.Add(1)
+		go func(i int, test testsharder.Test) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			maxAttempts := test.MaxAttempts
+			if maxAttempts < 1 {
+				maxAttempts = 1
+			}
+			runIndex := 0
+			for j := 0; j < test.Runs; j++ {
+				for attempt := 1; ; attempt++ {
+					result, err := runTest(ctx, test, runIndex, t)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					if result.Result == runtests.TestSuccess && attempt > 1 {
+						result.Flaked = true
+					}
+					results[i] = append(results[i], result)
+					runIndex++
+					if result.Result == runtests.TestSuccess || attempt >= maxAttempts {
+						break
+					}
+				}
 			}
+		}(i, test)
+	}
+	wg.Wait()
+
+	for i := range tests {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		for _, result := range results[i] {
 			if err := outputs.record(*result); err != nil {
 				return err
 			}
-			sinks = append(sinks, result.DataSinks)
+		}
+	}
+	return nil
+}
+
+func runTests(ctx context.Context, tests []testsharder.Test, t tester, outputs *testOutputs) error {
+	var sinks []runtests.DataSinkReference
+	var firstFailure string
+	failureBugreportTaken := false
+	var lastInspectSnapshot time.Time
+	for _, group := range groupTestsByRealm(tests) {
+		if group.realm != "" {
+			setupStart := time.Now()
+			if err := t.SetupRealm(ctx, group.realm); err != nil {
+				logger.Errorf(ctx, "failed to set up realm %q: %v", group.realm, err)
+				// The group's tests never ran, but they must still be
+				// accounted for; record an infra failure for each expected
+				// run rather than silently skipping them.
+				setupEnd := time.Now()
+				for _, test := range group.tests {
+					for i := 0; i < test.Runs; i++ {
+						if err := outputs.record(realmSetupFailureResult(test, i, err, setupStart, setupEnd)); err != nil {
+							return err
+						}
+					}
+				}
+				if failFast {
+					firstFailure = group.tests[0].Name
+					break
+				}
+				continue
+			}
+		}
+	testLoop:
+		for _, test := range group.tests {
+			maxAttempts := test.MaxAttempts
+			if maxAttempts < 1 {
+				maxAttempts = 1
+			}
+			// Each attempt of each run is recorded under its own index so
+			// that retries do not clobber one another's outputs.
+			runIndex := 0
+			for i := 0; i < test.Runs; i++ {
+				// A failing run is retried until it passes or its attempts
+				// are exhausted; a retry that passes marks the run as flaked
+				// rather than failed. Connection errors abort the whole run
+				// instead of being retried.
+				var result *testrunner.TestResult
+				for attempt := 1; ; attempt++ {
+					var err error
+					result, err = runTest(ctx, test, runIndex, t)
+					if sshutil.IsConnectionError(err) {
+						return err
+					}
+					if snapshotInspectOnFailure && result.Result != runtests.TestSuccess {
+						if now := time.Now(); now.Sub(lastInspectSnapshot) >= inspectSnapshotInterval {
+							lastInspectSnapshot = now
+							dest := inspectSnapshotName(test.Name, runIndex)
+							// Inspect data is best-effort; log and continue without it.
+							if err := t.SnapshotInspect(ctx, dest); err != nil {
+								logger.Errorf(ctx, "failed to snapshot inspect data after failure of %q: %v", test.Name, err)
+							} else {
+								result.InspectSnapshot = dest
+							}
+						}
+					}
+					if result.Result == runtests.TestSuccess && attempt > 1 {
+						result.Flaked = true
+					}
+					if err := outputs.record(*result); err != nil {
+						return err
+					}
+					sinks = append(sinks, result.DataSinks)
+					runIndex++
+					if result.Result == runtests.TestSuccess || attempt >= maxAttempts {
+						break
+					}
+					logger.Warningf(ctx, "test %q failed attempt %d of %d; retrying", test.Name, attempt, maxAttempts)
+				}
+				if result.Result != runtests.TestSuccess {
+					// Only the first failure triggers a capture so that a cascade
+					// of failures does not produce a bugreport apiece.
+					if bugreportOnFailure && !skipBugreport && !failureBugreportTaken {
+						failureBugreportTaken = true
+						if err := t.RunBugreport(ctx, failureBugreportName(test.Name)); err != nil {
+							logger.Errorf(ctx, "failed to capture bugreport after failure of %q: %v", test.Name, err)
+						}
+					}
+					if failFast {
+						firstFailure = test.Name
+						break testLoop
+					}
+				}
+			}
+		}
+		if group.realm != "" {
+			// Teardown is best-effort and runs even when failing fast so that
+			// the realm does not leak into later runs.
+			if err := t.TeardownRealm(ctx, group.realm); err != nil {
+				logger.Errorf(ctx, "failed to tear down realm %q: %v", group.realm, err)
+			}
+		}
+		if firstFailure != "" {
+			break
 		}
 	}
 	// TODO(ihuh): Combine the following functions into a single postprocess function.
-	if err := t.RunBugreport(ctx, bugreportFile); err != nil {
+	// Post-processing still runs when exiting early so that the failure
+	// remains debuggable.
+	// A wedged device often fails bugreport collection; that must not cost us
+	// the data sinks too, so the failure is logged rather than returned.
+	if !skipBugreport {
+		if err := t.RunBugreport(ctx, bugreportFile); err != nil {
+			logger.Warningf(ctx, "failed to collect bugreport: %v", err)
+		}
+	}
+	if err := t.CopySinks(ctx, sinks); err != nil {
 		return err
 	}
-	return t.CopySinks(ctx, sinks)
+	if firstFailure != "" {
+		return fmt.Errorf("stopping after first test failure (%q): -fail-fast is set", firstFailure)
+	}
+	return nil
+}
+
+// testGroup is a set of tests sharing a realm that is set up once for the
+// whole group. Tests without a realm form singleton groups and run exactly as
+// they would have without grouping.
+type testGroup struct {
+	realm string
+	tests []testsharder.Test
+}
+
+// groupTestsByRealm partitions tests into groups sharing a realm, preserving
+// the order in which tests (and realms) first appear.
+func groupTestsByRealm(tests []testsharder.Test) []testGroup {
+	var groups []testGroup
+	indexByRealm := make(map[string]int)
+	for _, test := range tests {
+		if test.Realm == "" {
+			groups = append(groups, testGroup{tests: []testsharder.Test{test}})
+			continue
+		}
+		i, ok := indexByRealm[test.Realm]
+		if !ok {
+			i = len(groups)
+			indexByRealm[test.Realm] = i
+			groups = append(groups, testGroup{realm: test.Realm})
+		}
+		groups[i].tests = append(groups[i].tests, test)
+	}
+	return groups
+}
+
+// realmSetupFailureResult records a test that could not run because setup of
+// its realm failed. The failure is the infrastructure's, not the test's.
+func realmSetupFailureResult(test testsharder.Test, runIndex int, setupErr error, startTime, endTime time.Time) testrunner.TestResult {
+	return testrunner.TestResult{
+		Name:      test.Name,
+		GNLabel:   test.Label,
+		Stdio:     []byte(fmt.Sprintf("failed to set up realm %q: %v", test.Realm, setupErr)),
+		Result:    runtests.TestInfraFailure,
+		StartTime: startTime,
+		EndTime:   endTime,
+		RunIndex:  runIndex,
+	}
+}
+
+// failureBugreportName derives a filesystem-friendly bugreport filename from
+// the name of a failing test.
+func failureBugreportName(testName string) string {
+	sanitized := strings.NewReplacer("/", "_", ":", "_").Replace(testName)
+	return fmt.Sprintf("bugreport-%s.zip", sanitized)
+}
+
+// inspectSnapshotName derives a filesystem-friendly filename for the inspect
+// snapshot captured after a failed run of a test.
+func inspectSnapshotName(testName string, runIndex int) string {
+	sanitized := strings.NewReplacer("/", "_", ":", "_").Replace(testName)
+	return fmt.Sprintf("inspect-%s-%d.json", sanitized, runIndex)
 }
 
 // stdioBuffer is a simple thread-safe wrapper around bytes.Buffer. It
@@ -297,10 +685,13 @@ func runTest(ctx context.Context, test testsharder.Test, runIndex int, t tester)
 	}
 
 	result := runtests.TestSuccess
+	var timedOut bool
 	startTime := time.Now()
 	dataSinks, err := t.Test(ctx, test, multistdout, multistderr)
 	if err != nil {
-		result = runtests.TestFailure
+		result = classifyTestErr(err)
+		var timeoutErr *timeoutError
+		timedOut = errors.As(err, &timeoutErr)
 		logger.Errorf(ctx, err.Error())
 		if sshutil.IsConnectionError(err) {
 			return nil, err
@@ -315,6 +706,7 @@ func runTest(ctx context.Context, test testsharder.Test, runIndex int, t tester)
 		GNLabel:   test.Label,
 		Stdio:     stdio.buf.Bytes(),
 		Result:    result,
+		TimedOut:  timedOut,
 		Cases:     testparser.Parse(stdout.Bytes()),
 		StartTime: startTime,
 		EndTime:   endTime,
@@ -322,3 +714,18 @@ func runTest(ctx context.Context, test testsharder.Test, runIndex int, t tester)
 		RunIndex:  runIndex,
 	}, nil
 }
+
+// classifyTestErr distinguishes failures of a test itself from failures of
+// the infrastructure running it, so that CI can retry infrastructure failures
+// without blaming the test. A test that ran to completion and exited non-zero
+// failed; anything else - a launch failure, a timeout, a device error that is
+// not a clean connection error - is an infrastructure failure.
+func classifyTestErr(err error) runtests.TestResult {
+	var exitErr *exec.ExitError
+	var sshExitErr *ssh.ExitError
+	var brokerExitErr brokerExitError
+	if errors.As(err, &exitErr) || errors.As(err, &sshExitErr) || errors.As(err, &brokerExitErr) {
+		return runtests.TestFailure
+	}
+	return runtests.TestInfraFailure
+}
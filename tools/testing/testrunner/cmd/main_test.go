@@ -8,8 +8,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"go.fuchsia.dev/fuchsia/tools/build/lib"
 	"go.fuchsia.dev/fuchsia/tools/integration/testsharder/lib"
@@ -17,26 +23,50 @@ import (
 	"go.fuchsia.dev/fuchsia/tools/testing/runtests"
 	tap "go.fuchsia.dev/fuchsia/tools/testing/tap/lib"
 	"go.fuchsia.dev/fuchsia/tools/testing/testrunner/lib"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
-	testFunc         = "Test"
-	copySinksFunc    = "CopySinks"
-	runBugreportFunc = "RunBugreport"
+	testFunc            = "Test"
+	copySinksFunc       = "CopySinks"
+	runBugreportFunc    = "RunBugreport"
+	snapshotInspectFunc = "SnapshotInspect"
+	setupRealmFunc      = "SetupRealm"
+	teardownRealmFunc   = "TeardownRealm"
 )
 
 type fakeTester struct {
-	testErr   error
-	runTest   func(testsharder.Test, io.Writer, io.Writer)
-	funcCalls []string
+	// mu guards the fields below; Test may be called from concurrent
+	// goroutines when exercising the parallel local path.
+	mu      sync.Mutex
+	testErr error
+	// testErrs, when non-nil, is consumed one error per Test call before
+	// falling back to testErr.
+	testErrs       []error
+	setupRealmErr  error
+	bugreportErr   error
+	runTest        func(testsharder.Test, io.Writer, io.Writer)
+	funcCalls      []string
+	bugreportFiles []string
+	inspectFiles   []string
+	realms         []string
 }
 
 func (t *fakeTester) Test(_ context.Context, test testsharder.Test, stdout, stderr io.Writer) (runtests.DataSinkReference, error) {
+	t.mu.Lock()
 	t.funcCalls = append(t.funcCalls, testFunc)
+	var err error
+	if len(t.testErrs) > 0 {
+		err = t.testErrs[0]
+		t.testErrs = t.testErrs[1:]
+	} else {
+		err = t.testErr
+	}
+	t.mu.Unlock()
 	if t.runTest != nil {
 		t.runTest(test, stdout, stderr)
 	}
-	return nil, t.testErr
+	return nil, err
 }
 
 func (t *fakeTester) Close() error {
@@ -48,14 +78,41 @@ func (t *fakeTester) CopySinks(_ context.Context, _ []runtests.DataSinkReference
 	return nil
 }
 
-func (t *fakeTester) RunBugreport(_ context.Context, _ string) error {
+func (t *fakeTester) RunBugreport(_ context.Context, bugreportFile string) error {
 	t.funcCalls = append(t.funcCalls, runBugreportFunc)
+	t.bugreportFiles = append(t.bugreportFiles, bugreportFile)
+	return t.bugreportErr
+}
+
+func (t *fakeTester) SnapshotInspect(_ context.Context, snapshotFile string) error {
+	t.funcCalls = append(t.funcCalls, snapshotInspectFunc)
+	t.inspectFiles = append(t.inspectFiles, snapshotFile)
 	return nil
 }
 
+func (t *fakeTester) SetupRealm(_ context.Context, realm string) error {
+	t.funcCalls = append(t.funcCalls, setupRealmFunc)
+	t.realms = append(t.realms, realm)
+	return t.setupRealmErr
+}
+
+func (t *fakeTester) TeardownRealm(_ context.Context, realm string) error {
+	t.funcCalls = append(t.funcCalls, teardownRealmFunc)
+	t.realms = append(t.realms, realm)
+	return nil
+}
+
+func newTestOutputs() *testOutputs {
+	return &testOutputs{
+		tap:        &tap.Producer{},
+		runResults: make(map[string][]runtests.TestResult),
+	}
+}
+
 func assertEqual(t1, t2 *testrunner.TestResult) bool {
 	return (t1.Name == t2.Name &&
 		t1.Result == t2.Result &&
+		t1.TimedOut == t2.TimedOut &&
 		t1.RunIndex == t2.RunIndex &&
 		string(t1.Stdio) == string(t2.Stdio))
 }
@@ -151,6 +208,66 @@ func TestValidateTest(t *testing.T) {
 				Runs: 5,
 			},
 			expectErr: false,
+		}, {
+			name: "valid per-test timeout",
+			test: testsharder.Test{
+				Test: build.Test{
+					Name: "test1",
+					OS:   "linux",
+					Path: "/foo/bar",
+				},
+				Runs:        1,
+				TimeoutSecs: 300,
+			},
+			expectErr: false,
+		}, {
+			name: "negative per-test timeout",
+			test: testsharder.Test{
+				Test: build.Test{
+					Name: "test1",
+					OS:   "linux",
+					Path: "/foo/bar",
+				},
+				Runs:        1,
+				TimeoutSecs: -1,
+			},
+			expectErr: true,
+		}, {
+			name: "valid timeout signal",
+			test: testsharder.Test{
+				Test: build.Test{
+					Name: "test1",
+					OS:   "linux",
+					Path: "/foo/bar",
+				},
+				Runs:          1,
+				TimeoutSignal: "SIGABRT",
+			},
+			expectErr: false,
+		}, {
+			name: "unknown timeout signal",
+			test: testsharder.Test{
+				Test: build.Test{
+					Name: "test1",
+					OS:   "linux",
+					Path: "/foo/bar",
+				},
+				Runs:          1,
+				TimeoutSignal: "SIGUSR1",
+			},
+			expectErr: true,
+		}, {
+			name: "timeout signal on a fuchsia test",
+			test: testsharder.Test{
+				Test: build.Test{
+					Name:       "test1",
+					OS:         "fuchsia",
+					PackageURL: "fuchsia-pkg://test1",
+				},
+				Runs:          1,
+				TimeoutSignal: "SIGQUIT",
+			},
+			expectErr: true,
 		},
 	}
 	for _, c := range cases {
@@ -163,6 +280,107 @@ func TestValidateTest(t *testing.T) {
 	}
 }
 
+func TestLocalTestEnv(t *testing.T) {
+	vars := map[string]string{
+		"TESTRUNNER_ALLOWED_VAR": "allowed",
+		"TESTRUNNER_SECRET_VAR":  "secret",
+		nodenameEnvVar:           "node",
+	}
+	for name, value := range vars {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(name)
+	}
+	contains := func(env []string, name string) bool {
+		for _, kv := range env {
+			if strings.HasPrefix(kv, name+"=") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// An empty allowlist preserves the historical pass-everything behavior.
+	env := localTestEnv()
+	for name := range vars {
+		if !contains(env, name) {
+			t.Errorf("%q missing from the default environment", name)
+		}
+	}
+
+	envAllowlist = "TESTRUNNER_ALLOWED_VAR"
+	defer func() { envAllowlist = "" }()
+	env = localTestEnv()
+	if !contains(env, "TESTRUNNER_ALLOWED_VAR") {
+		t.Errorf("allowlisted variable missing from the environment")
+	}
+	if contains(env, "TESTRUNNER_SECRET_VAR") {
+		t.Errorf("non-allowlisted variable present in the environment")
+	}
+	// The Fuchsia-specific variables always pass through.
+	if !contains(env, nodenameEnvVar) {
+		t.Errorf("%q missing from the environment", nodenameEnvVar)
+	}
+}
+
+func TestFilterTests(t *testing.T) {
+	tests := []testsharder.Test{
+		{Test: build.Test{Name: "host_x64/foo_test", OS: "linux", Path: "/foo"}, Runs: 1},
+		{Test: build.Test{Name: "host_x64/bar_test", OS: "linux", Path: "/bar"}, Runs: 1},
+		{Test: build.Test{Name: "fuchsia-pkg://foo/baz", OS: "fuchsia", PackageURL: "fuchsia-pkg://foo/baz"}, Runs: 1},
+	}
+	names := func(tests []testsharder.Test) []string {
+		var names []string
+		for _, test := range tests {
+			names = append(names, test.Name)
+		}
+		return names
+	}
+	cases := []struct {
+		name        string
+		pattern     string
+		wantMatched []string
+		wantSkipped []string
+	}{
+		{
+			name:        "nil pattern matches everything",
+			wantMatched: names(tests),
+		},
+		{
+			name:        "matches some",
+			pattern:     "foo",
+			wantMatched: []string{"host_x64/foo_test", "fuchsia-pkg://foo/baz"},
+			wantSkipped: []string{"host_x64/bar_test"},
+		},
+		{
+			name:        "matches all",
+			pattern:     ".*",
+			wantMatched: names(tests),
+		},
+		{
+			name:        "matches none",
+			pattern:     "does_not_exist",
+			wantSkipped: names(tests),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var re *regexp.Regexp
+			if c.pattern != "" {
+				re = regexp.MustCompile(c.pattern)
+			}
+			matched, skipped := filterTests(tests, re)
+			if got, want := strings.Join(names(matched), ","), strings.Join(c.wantMatched, ","); got != want {
+				t.Errorf("got matched tests %q, expected: %q", got, want)
+			}
+			if got, want := strings.Join(skipped, ","), strings.Join(c.wantSkipped, ","); got != want {
+				t.Errorf("got skipped tests %q, expected: %q", got, want)
+			}
+		})
+	}
+}
+
 func TestRunTest(t *testing.T) {
 	cases := []struct {
 		name           string
@@ -200,6 +418,19 @@ func TestRunTest(t *testing.T) {
 				Result: runtests.TestSuccess,
 			}},
 		},
+		{
+			name: "host test fail",
+			test: build.Test{
+				Name: "bar",
+				Path: "/foo/bar",
+				OS:   "linux",
+			},
+			testErr: &exec.ExitError{},
+			expectedResult: []*testrunner.TestResult{{
+				Name:   "bar",
+				Result: runtests.TestFailure,
+			}},
+		},
 		{
 			name: "fuchsia test fail",
 			test: build.Test{
@@ -208,12 +439,45 @@ func TestRunTest(t *testing.T) {
 				OS:         "fuchsia",
 				PackageURL: "fuchsia-pkg://foo/bar",
 			},
-			testErr: fmt.Errorf("test failed"),
+			testErr: &ssh.ExitError{},
 			expectedResult: []*testrunner.TestResult{{
 				Name:   "bar",
 				Result: runtests.TestFailure,
 			}},
 		},
+		{
+			name: "fuchsia test timeout is an infra failure",
+			test: build.Test{
+				Name:       "bar",
+				Path:       "/foo/bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			testErr: &timeoutError{time.Microsecond},
+			expectedResult: []*testrunner.TestResult{{
+				Name:     "bar",
+				Result:   runtests.TestInfraFailure,
+				TimedOut: true,
+			}},
+			// Simulate a test that hangs until its deadline fires.
+			runTestFunc: func(_ testsharder.Test, _, _ io.Writer) {
+				time.Sleep(time.Microsecond)
+			},
+		},
+		{
+			name: "fuchsia test infra failure",
+			test: build.Test{
+				Name:       "bar",
+				Path:       "/foo/bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			testErr: fmt.Errorf("device failed"),
+			expectedResult: []*testrunner.TestResult{{
+				Name:   "bar",
+				Result: runtests.TestInfraFailure,
+			}},
+		},
 		{
 			name: "fuchsia test ssh connection fail",
 			test: build.Test{
@@ -273,7 +537,7 @@ func TestRunTest(t *testing.T) {
 				c.runs = 1
 			}
 			for i := 0; i < c.runs; i++ {
-				result, err := runTest(context.Background(), testsharder.Test{c.test, c.runs}, i, tester)
+				result, err := runTest(context.Background(), testsharder.Test{Test: c.test, Runs: c.runs}, i, tester)
 
 				if err != c.expectedErr {
 					t.Errorf("got error: %v, expected: %v", err, c.expectedErr)
@@ -291,22 +555,24 @@ func TestRunTest(t *testing.T) {
 func TestRunTests(t *testing.T) {
 	tests := []testsharder.Test{
 		{
-			build.Test{
+			Test: build.Test{
 				Name:       "bar",
 				OS:         "fuchsia",
 				PackageURL: "fuchsia-pkg://foo/bar",
-			}, 2,
+			},
+			Runs: 2,
 		}, {
-			build.Test{
+			Test: build.Test{
 				Name:       "baz",
 				Path:       "/foo/baz",
 				OS:         "fuchsia",
 				PackageURL: "fuchsia-pkg://foo/baz",
-			}, 1,
+			},
+			Runs: 1,
 		},
 	}
 	tester := &fakeTester{}
-	err := runTests(context.Background(), tests, tester, &testOutputs{tap: &tap.Producer{}})
+	err := runTests(context.Background(), tests, tester, newTestOutputs())
 	if err != nil {
 		t.Errorf("got error: %v", err)
 	}
@@ -329,3 +595,387 @@ func TestRunTests(t *testing.T) {
 		t.Errorf("expected last calls to include %v, actual: %v", []string{runBugreportFunc, copySinksFunc}, lastCalls)
 	}
 }
+
+func TestRunLocalTestsInParallel(t *testing.T) {
+	oldParallelism := localParallelism
+	localParallelism = 2
+	defer func() { localParallelism = oldParallelism }()
+
+	// Each test blocks until the other is also running, so this test hangs
+	// unless the two really do run concurrently.
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	tester := &fakeTester{runTest: func(_ testsharder.Test, _, _ io.Writer) {
+		barrier.Done()
+		barrier.Wait()
+	}}
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name: "bar",
+				Path: "/foo/bar",
+				OS:   "linux",
+			},
+			Runs: 1,
+		}, {
+			Test: build.Test{
+				Name: "baz",
+				Path: "/foo/baz",
+				OS:   "linux",
+			},
+			Runs: 1,
+		},
+	}
+	outputs := newTestOutputs()
+	if err := runLocalTests(context.Background(), tests, tester, outputs); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// Results are recorded in input order no matter which test finished first.
+	var names []string
+	for _, details := range outputs.summary.Tests {
+		names = append(names, details.Name)
+	}
+	if got, want := strings.Join(names, ","), "bar,baz"; got != want {
+		t.Errorf("got recorded tests %q, expected: %q", got, want)
+	}
+}
+
+func TestRunTestsRetriesFailures(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs:        1,
+			MaxAttempts: 3,
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs:        1,
+			MaxAttempts: 3,
+		},
+	}
+	// The first test fails once and passes on retry; the second passes
+	// outright.
+	tester := &fakeTester{testErrs: []error{&ssh.ExitError{}, nil, nil}}
+	outputs := newTestOutputs()
+	if err := runTests(context.Background(), tests, tester, outputs); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	testCount := strings.Count(strings.Join(tester.funcCalls, ","), testFunc)
+	if testCount != 3 {
+		t.Errorf("ran %d tests, expected: 3", testCount)
+	}
+	type attempt struct {
+		name    string
+		result  runtests.TestResult
+		flaked  bool
+		outFile string
+	}
+	var attempts []attempt
+	for _, details := range outputs.summary.Tests {
+		attempts = append(attempts, attempt{details.Name, details.Result, details.Flaked, details.OutputFile})
+	}
+	expected := []attempt{
+		{"bar", runtests.TestFailure, false, filepath.Join("bar", "0", runtests.TestOutputFilename)},
+		{"bar", runtests.TestSuccess, true, filepath.Join("bar", "1", runtests.TestOutputFilename)},
+		{"baz", runtests.TestSuccess, false, filepath.Join("baz", "0", runtests.TestOutputFilename)},
+	}
+	if len(attempts) != len(expected) {
+		t.Fatalf("recorded attempts %v, expected: %v", attempts, expected)
+	}
+	for i := range expected {
+		if attempts[i] != expected[i] {
+			t.Errorf("recorded attempt %v, expected: %v", attempts[i], expected[i])
+		}
+	}
+}
+
+func TestRunTestsDoesNotRetryConnectionErrors(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs:        1,
+			MaxAttempts: 3,
+		},
+	}
+	tester := &fakeTester{testErrs: []error{sshutil.ConnectionError{}, nil, nil}}
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err == nil {
+		t.Errorf("expected connection error from runTests, got nil")
+	}
+	// A connection error aborts the run rather than burning retry attempts.
+	testCount := strings.Count(strings.Join(tester.funcCalls, ","), testFunc)
+	if testCount != 1 {
+		t.Errorf("ran %d tests, expected: 1", testCount)
+	}
+}
+
+func TestRunTestsFailFast(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs: 2,
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs: 1,
+		},
+	}
+	failFast = true
+	defer func() { failFast = false }()
+	tester := &fakeTester{testErr: fmt.Errorf("test failed")}
+	err := runTests(context.Background(), tests, tester, newTestOutputs())
+	if err == nil {
+		t.Errorf("expected failure from runTests, got nil")
+	}
+	funcCalls := strings.Join(tester.funcCalls, ",")
+	testCount := strings.Count(funcCalls, testFunc)
+	copySinksCount := strings.Count(funcCalls, copySinksFunc)
+	bugreportCount := strings.Count(funcCalls, runBugreportFunc)
+	// The first run of the first test fails, so no other runs should execute.
+	if testCount != 1 {
+		t.Errorf("ran %d tests, expected: 1", testCount)
+	}
+	// Post-processing should still happen so the failure is debuggable.
+	if copySinksCount != 1 {
+		t.Errorf("ran CopySinks %d times, expected: 1", copySinksCount)
+	}
+	if bugreportCount != 1 {
+		t.Errorf("ran RunBugreport %d times, expected: 1", bugreportCount)
+	}
+}
+
+func TestRunTestsBugreportFailureStillCopiesSinks(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs: 1,
+		},
+	}
+	tester := &fakeTester{bugreportErr: fmt.Errorf("bugreport failed")}
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// The bugreport failure is logged, not fatal; the data sinks must still
+	// be copied off the device.
+	funcCalls := strings.Join(tester.funcCalls, ",")
+	if copySinksCount := strings.Count(funcCalls, copySinksFunc); copySinksCount != 1 {
+		t.Errorf("ran CopySinks %d times, expected: 1", copySinksCount)
+	}
+}
+
+func TestRunTestsSkipBugreport(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs: 1,
+		},
+	}
+	skipBugreport = true
+	defer func() { skipBugreport = false }()
+	tester := &fakeTester{testErr: fmt.Errorf("test failed")}
+	bugreportOnFailure = true
+	defer func() { bugreportOnFailure = false }()
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	funcCalls := strings.Join(tester.funcCalls, ",")
+	if bugreportCount := strings.Count(funcCalls, runBugreportFunc); bugreportCount != 0 {
+		t.Errorf("ran RunBugreport %d times, expected: 0", bugreportCount)
+	}
+	if copySinksCount := strings.Count(funcCalls, copySinksFunc); copySinksCount != 1 {
+		t.Errorf("ran CopySinks %d times, expected: 1", copySinksCount)
+	}
+}
+
+func TestRunTestsBugreportOnFailure(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "foo/bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs: 2,
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs: 1,
+		},
+	}
+	bugreportOnFailure = true
+	defer func() { bugreportOnFailure = false }()
+	tester := &fakeTester{testErr: fmt.Errorf("test failed")}
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// One capture for the first failure plus the end-of-run bugreport; later
+	// failures must not trigger further captures.
+	expected := []string{"bugreport-foo_bar.zip", bugreportFile}
+	if len(tester.bugreportFiles) != len(expected) {
+		t.Fatalf("ran RunBugreport with %v, expected: %v", tester.bugreportFiles, expected)
+	}
+	for i := range expected {
+		if tester.bugreportFiles[i] != expected[i] {
+			t.Errorf("ran RunBugreport with %v, expected: %v", tester.bugreportFiles, expected)
+		}
+	}
+}
+
+func TestRunTestsSnapshotInspectOnFailure(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "foo/bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs: 2,
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs: 1,
+		},
+	}
+	snapshotInspectOnFailure = true
+	defer func() { snapshotInspectOnFailure = false }()
+	tester := &fakeTester{testErr: fmt.Errorf("test failed")}
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// Only the first failure snapshots inspect data; the later failures fall
+	// within the rate-limiting interval.
+	expected := []string{"inspect-foo_bar-0.json"}
+	if len(tester.inspectFiles) != len(expected) {
+		t.Fatalf("ran SnapshotInspect with %v, expected: %v", tester.inspectFiles, expected)
+	}
+	for i := range expected {
+		if tester.inspectFiles[i] != expected[i] {
+			t.Errorf("ran SnapshotInspect with %v, expected: %v", tester.inspectFiles, expected)
+		}
+	}
+}
+
+func TestRunTestsGroupsByRealm(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs:  1,
+			Realm: "env1",
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs: 1,
+		}, {
+			Test: build.Test{
+				Name:       "qux",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/qux",
+			},
+			Runs:  1,
+			Realm: "env1",
+		},
+	}
+	tester := &fakeTester{}
+	if err := runTests(context.Background(), tests, tester, newTestOutputs()); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// The realm is set up once for both of its tests, even though another
+	// test sits between them; the realmless test runs on its own.
+	expectedCalls := []string{setupRealmFunc, testFunc, testFunc, teardownRealmFunc, testFunc, runBugreportFunc, copySinksFunc}
+	if got, want := strings.Join(tester.funcCalls, ","), strings.Join(expectedCalls, ","); got != want {
+		t.Errorf("got calls %v, expected: %v", got, want)
+	}
+	if got, want := strings.Join(tester.realms, ","), "env1,env1"; got != want {
+		t.Errorf("got realms %v, expected: %v", got, want)
+	}
+}
+
+func TestRunTestsRealmSetupFailure(t *testing.T) {
+	tests := []testsharder.Test{
+		{
+			Test: build.Test{
+				Name:       "bar",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/bar",
+			},
+			Runs:  2,
+			Realm: "env1",
+		}, {
+			Test: build.Test{
+				Name:       "baz",
+				Path:       "/foo/baz",
+				OS:         "fuchsia",
+				PackageURL: "fuchsia-pkg://foo/baz",
+			},
+			Runs: 1,
+		},
+	}
+	tester := &fakeTester{setupRealmErr: fmt.Errorf("setup failed")}
+	outputs := newTestOutputs()
+	if err := runTests(context.Background(), tests, tester, outputs); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	// The realm's tests never run and its teardown is skipped, but the
+	// realmless test still runs.
+	expectedCalls := []string{setupRealmFunc, testFunc, runBugreportFunc, copySinksFunc}
+	if got, want := strings.Join(tester.funcCalls, ","), strings.Join(expectedCalls, ","); got != want {
+		t.Errorf("got calls %v, expected: %v", got, want)
+	}
+	// Every expected run of the realm's tests is recorded as an infra
+	// failure rather than silently skipped.
+	var infraFailures int
+	for _, details := range outputs.summary.Tests {
+		if details.Name == "bar" {
+			if details.Result != runtests.TestInfraFailure {
+				t.Errorf("got result %v for %q, expected: %v", details.Result, details.Name, runtests.TestInfraFailure)
+			}
+			infraFailures++
+		}
+	}
+	if infraFailures != 2 {
+		t.Errorf("recorded %d infra failures for the realm's tests, expected: 2", infraFailures)
+	}
+}
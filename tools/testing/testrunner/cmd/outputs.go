@@ -25,18 +25,48 @@ type testOutputs struct {
 	outDir  string
 	summary runtests.TestSummary
 	tap     *tap.Producer
+
+	// flakeReportFile names the file within outDir that the flake report is
+	// written to; no report is produced when empty.
+	flakeReportFile string
+	// runResults holds the result of each recorded run of each test, indexed
+	// by run, from which the flake report is derived.
+	runResults map[string][]runtests.TestResult
 }
 
-func createTestOutputs(producer *tap.Producer, outDir string) (*testOutputs, error) {
+func createTestOutputs(producer *tap.Producer, outDir string, flakeReportFile string) (*testOutputs, error) {
 	return &testOutputs{
-		outDir: outDir,
-		tap:    producer,
+		outDir:          outDir,
+		tap:             producer,
+		flakeReportFile: flakeReportFile,
+		runResults:      make(map[string][]runtests.TestResult),
 	}, nil
 }
 
+// testFlakeReport describes the mixed outcomes of a single flaky test across
+// its runs.
+type testFlakeReport struct {
+	// PassCount is the number of runs that passed.
+	PassCount int `json:"pass_count"`
+	// FailCount is the number of runs that did not pass.
+	FailCount int `json:"fail_count"`
+	// FailedRuns holds the run indices of the runs that did not pass.
+	FailedRuns []int `json:"failed_runs"`
+	// RunResults holds the result of each run, indexed by run.
+	RunResults []runtests.TestResult `json:"run_results"`
+}
+
+// sanitizeOutputName maps a test name to a filesystem-friendly relative path.
+// Slashes are kept as directory separators so that an archived output
+// directory stays browsable, but the ":" and "#" of package URLs are not
+// meaningful on every filesystem and are dropped or replaced.
+func sanitizeOutputName(name string) string {
+	return strings.NewReplacer(":", "", "#", "_").Replace(name)
+}
+
 // Record writes the test result to initialized outputs.
 func (o *testOutputs) record(result testrunner.TestResult) error {
-	outputRelPath := filepath.Join(result.Name, strconv.Itoa(result.RunIndex), runtests.TestOutputFilename)
+	outputRelPath := filepath.Join(sanitizeOutputName(result.Name), strconv.Itoa(result.RunIndex), runtests.TestOutputFilename)
 	// Strip any leading //.
 	outputRelPath = strings.TrimLeft(outputRelPath, "//")
 
@@ -50,13 +80,24 @@ func (o *testOutputs) record(result testrunner.TestResult) error {
 		GNLabel:        result.GNLabel,
 		OutputFile:     outputRelPath,
 		Result:         result.Result,
+		TimedOut:       result.TimedOut,
+		Flaked:         result.Flaked,
 		Cases:          result.Cases,
 		StartTime:      result.StartTime,
 		DurationMillis: duration.Milliseconds(),
 		DataSinks:      runtests.DataSinkMap(result.DataSinks),
 	})
 
+	// Runs of a given test are recorded in run order.
+	o.runResults[result.Name] = append(o.runResults[result.Name], result.Result)
+
 	desc := fmt.Sprintf("%s (%v)", result.Name, duration)
+	if result.Result == runtests.TestInfraFailure {
+		desc += " [infra failure]"
+	}
+	if result.TimedOut {
+		desc += " [timed out]"
+	}
 	o.tap.Ok(result.Result == runtests.TestSuccess, desc)
 
 	if o.outDir != "" {
@@ -73,6 +114,36 @@ func (o *testOutputs) record(result testrunner.TestResult) error {
 	return nil
 }
 
+// recordSkip reports a test that was excluded by the test filter as skipped
+// in the TAP output without running it; skipped tests do not appear in the
+// summary.
+func (o *testOutputs) recordSkip(name string) {
+	o.tap.Skip().Ok(true, name)
+}
+
+// flakeReport returns the tests with mixed outcomes across their runs, keyed
+// by test name. The report is empty when no test is flaky.
+func (o *testOutputs) flakeReport() map[string]testFlakeReport {
+	report := make(map[string]testFlakeReport)
+	for name, results := range o.runResults {
+		var flake testFlakeReport
+		for i, result := range results {
+			if result == runtests.TestSuccess {
+				flake.PassCount++
+			} else {
+				flake.FailCount++
+				flake.FailedRuns = append(flake.FailedRuns, i)
+			}
+		}
+		if flake.PassCount == 0 || flake.FailCount == 0 {
+			continue
+		}
+		flake.RunResults = results
+		report[name] = flake
+	}
+	return report
+}
+
 // Close stops the recording of test outputs; it must be called to finalize them.
 func (o *testOutputs) Close() error {
 	if o.outDir == "" {
@@ -88,6 +159,23 @@ func (o *testOutputs) Close() error {
 		return fmt.Errorf("failed to create file: %v", err)
 	}
 	defer s.Close()
-	_, err = io.Copy(s, bytes.NewBuffer(summaryBytes))
+	if _, err := io.Copy(s, bytes.NewBuffer(summaryBytes)); err != nil {
+		return err
+	}
+
+	if o.flakeReportFile == "" {
+		return nil
+	}
+	reportBytes, err := json.Marshal(o.flakeReport())
+	if err != nil {
+		return err
+	}
+	reportPath := filepath.Join(o.outDir, o.flakeReportFile)
+	r, err := osmisc.CreateFile(reportPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer r.Close()
+	_, err = io.Copy(r, bytes.NewBuffer(reportBytes))
 	return err
 }
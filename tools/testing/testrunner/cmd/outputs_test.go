@@ -27,6 +27,7 @@ func TestRecordingOfOutputs(t *testing.T) {
 			Name:      "test_a",
 			GNLabel:   "//a/b/c:test_a(//toolchain)",
 			Result:    runtests.TestFailure,
+			TimedOut:  true,
 			StartTime: start,
 			EndTime:   start.Add(5 * time.Millisecond),
 			DataSinks: runtests.DataSinkReference{
@@ -71,7 +72,7 @@ func TestRecordingOfOutputs(t *testing.T) {
 	var buf bytes.Buffer
 	producer := tap.NewProducer(&buf)
 	producer.Plan(len(results))
-	o, err := createTestOutputs(producer, outDir)
+	o, err := createTestOutputs(producer, outDir, "")
 	if err != nil {
 		t.Fatalf("failed to create a test outputs object: %v", err)
 	}
@@ -85,6 +86,7 @@ func TestRecordingOfOutputs(t *testing.T) {
 			GNLabel:        "//a/b/c:test_a(//toolchain)",
 			OutputFile:     outputFileA,
 			Result:         runtests.TestFailure,
+			TimedOut:       true,
 			StartTime:      start,
 			DurationMillis: 5,
 			DataSinks: runtests.DataSinkMap{
@@ -164,7 +166,7 @@ func TestRecordingOfOutputs(t *testing.T) {
 	expectedTAPOutput := strings.TrimSpace(`
 TAP version 13
 1..2
-not ok 1 test_a (5ms)
+not ok 1 test_a (5ms) [timed out]
 ok 2 test_b (10ms)
 `)
 	actualTAPOutput := strings.TrimSpace(buf.String())
@@ -187,3 +189,136 @@ ok 2 test_b (10ms)
 		t.Fatalf("unexpected contents from out dir:\nexpected: %#v\nactual: %#v\n", expectedContents, outDirContents)
 	}
 }
+
+func TestRecordSanitizesOutputPaths(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "testrunner_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	outDir := filepath.Join(dataDir, "out")
+
+	producer := tap.NewProducer(ioutil.Discard)
+	producer.Plan(1)
+	o, err := createTestOutputs(producer, outDir, "")
+	if err != nil {
+		t.Fatalf("failed to create a test outputs object: %v", err)
+	}
+	defer o.Close()
+
+	start := time.Unix(0, 0)
+	result := testrunner.TestResult{
+		Name:      "fuchsia-pkg://example.com/pkg#meta/test.cmx",
+		Result:    runtests.TestSuccess,
+		StartTime: start,
+		EndTime:   start.Add(5 * time.Millisecond),
+		RunIndex:  1,
+		Stdio:     []byte("STDIO"),
+	}
+	if err := o.record(result); err != nil {
+		t.Fatalf("failed to record result of %q: %v", result.Name, err)
+	}
+
+	// The package URL's ":" and "#" must not survive into the path, while its
+	// slashes still produce a browsable directory hierarchy.
+	wantRelPath := filepath.Join("fuchsia-pkg", "example.com", "pkg_meta", "test.cmx", "1", runtests.TestOutputFilename)
+	if got := o.summary.Tests[0].OutputFile; got != wantRelPath {
+		t.Errorf("got output file %q, expected: %q", got, wantRelPath)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(outDir, wantRelPath))
+	if err != nil {
+		t.Fatalf("failed to read stdio file: %v", err)
+	}
+	if got, want := string(b), "STDIO"; got != want {
+		t.Errorf("got stdio contents %q, expected: %q", got, want)
+	}
+}
+
+func TestFlakeReport(t *testing.T) {
+	start := time.Unix(0, 0)
+	result := func(name string, runIndex int, result runtests.TestResult) testrunner.TestResult {
+		return testrunner.TestResult{
+			Name:      name,
+			Result:    result,
+			StartTime: start,
+			EndTime:   start.Add(5 * time.Millisecond),
+			RunIndex:  runIndex,
+		}
+	}
+	results := []testrunner.TestResult{
+		result("test_flaky", 0, runtests.TestSuccess),
+		result("test_flaky", 1, runtests.TestFailure),
+		result("test_flaky", 2, runtests.TestSuccess),
+		result("test_stable", 0, runtests.TestSuccess),
+		result("test_stable", 1, runtests.TestSuccess),
+		result("test_broken", 0, runtests.TestFailure),
+		result("test_broken", 1, runtests.TestFailure),
+	}
+
+	outDir, err := ioutil.TempDir("", "testrunner_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+
+	flakeReportFile := "flake_report.json"
+	producer := tap.NewProducer(ioutil.Discard)
+	producer.Plan(len(results))
+	o, err := createTestOutputs(producer, outDir, flakeReportFile)
+	if err != nil {
+		t.Fatalf("failed to create a test outputs object: %v", err)
+	}
+	defer o.Close()
+
+	for _, result := range results {
+		if err := o.record(result); err != nil {
+			t.Fatalf("failed to record result of %q: %v", result.Name, err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("failed to close test outputs: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(outDir, flakeReportFile))
+	if err != nil {
+		t.Fatalf("failed to read flake report: %v", err)
+	}
+	var report map[string]testFlakeReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("failed to unmarshal flake report: %v", err)
+	}
+	expected := map[string]testFlakeReport{
+		"test_flaky": {
+			PassCount:  2,
+			FailCount:  1,
+			FailedRuns: []int{1},
+			RunResults: []runtests.TestResult{runtests.TestSuccess, runtests.TestFailure, runtests.TestSuccess},
+		},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("unexpected flake report:\nexpected: %#v\nactual: %#v\n", expected, report)
+	}
+
+	// A report with no flaky tests is empty, not absent.
+	if report := o.flakeReport(); len(report) != len(expected) {
+		t.Errorf("got %d flaky tests, want %d", len(report), len(expected))
+	}
+	emptyOutputs, err := createTestOutputs(producer, outDir, flakeReportFile)
+	if err != nil {
+		t.Fatalf("failed to create a test outputs object: %v", err)
+	}
+	defer emptyOutputs.Close()
+	if err := emptyOutputs.record(result("test_stable", 0, runtests.TestSuccess)); err != nil {
+		t.Fatalf("failed to record result: %v", err)
+	}
+	if err := emptyOutputs.Close(); err != nil {
+		t.Fatalf("failed to close test outputs: %v", err)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(outDir, flakeReportFile))
+	if err != nil {
+		t.Fatalf("failed to read flake report: %v", err)
+	}
+	if got, want := string(b), "{}"; got != want {
+		t.Errorf("got flake report %q, want %q", got, want)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"go.fuchsia.dev/fuchsia/tools/integration/testsharder/lib"
@@ -54,6 +55,16 @@ func (e *timeoutError) Error() string {
 	return fmt.Sprintf("test killed because timeout reached (%v)", e.timeout)
 }
 
+// testTimeout returns the timeout to enforce for a single test: the test's
+// own `timeout_secs` when present, falling back to the global per-test
+// timeout otherwise.
+func testTimeout(test testsharder.Test, perTestTimeout time.Duration) time.Duration {
+	if test.TimeoutSecs > 0 {
+		return time.Duration(test.TimeoutSecs) * time.Second
+	}
+	return perTestTimeout
+}
+
 // For testability
 type cmdRunner interface {
 	Run(ctx context.Context, command []string, stdout, stderr io.Writer) error
@@ -77,21 +88,27 @@ type dataSinkCopier interface {
 type subprocessTester struct {
 	r              cmdRunner
 	perTestTimeout time.Duration
+
+	// wrapper, if non-empty, is prefixed to each test invocation so that the
+	// test runs under it (e.g. strace or a leak checker). It does not apply
+	// to setup and teardown commands.
+	wrapper []string
 }
 
 // NewSubprocessTester returns a SubprocessTester that can execute tests
 // locally with a given working directory and environment.
-func newSubprocessTester(dir string, env []string, perTestTimeout time.Duration) *subprocessTester {
+func newSubprocessTester(dir string, env, wrapper []string, perTestTimeout time.Duration) *subprocessTester {
 	return &subprocessTester{
 		r: &runner.SubprocessRunner{
 			Dir: dir,
 			Env: env,
 		},
 		perTestTimeout: perTestTimeout,
+		wrapper:        wrapper,
 	}
 }
 
-func (t *subprocessTester) Test(ctx context.Context, test testsharder.Test, stdout io.Writer, stderr io.Writer) (runtests.DataSinkReference, error) {
+func (t *subprocessTester) Test(ctx context.Context, test testsharder.Test, stdout io.Writer, stderr io.Writer) (_ runtests.DataSinkReference, err error) {
 	command := test.Command
 	if len(test.Command) == 0 {
 		if test.Path == "" {
@@ -99,18 +116,68 @@ func (t *subprocessTester) Test(ctx context.Context, test testsharder.Test, stdo
 		}
 		command = []string{test.Path}
 	}
-	if t.perTestTimeout > 0 {
+	if len(t.wrapper) > 0 {
+		command = append(append([]string{}, t.wrapper...), command...)
+	}
+	if len(test.Teardown) > 0 {
+		// Teardown always runs, even if setup or the test failed or timed
+		// out, so it is scheduled before setup runs. It uses the outer
+		// context so that a test timeout does not skip cleanup.
+		defer func() {
+			fmt.Fprintf(stdout, "==== teardown: %s\n", strings.Join(test.Teardown, " "))
+			if teardownErr := t.r.Run(ctx, test.Teardown, stdout, stderr); teardownErr != nil && err == nil {
+				err = fmt.Errorf("teardown command failed for test %q: %w", test.Name, teardownErr)
+			}
+		}()
+	}
+	if len(test.Setup) > 0 {
+		fmt.Fprintf(stdout, "==== setup: %s\n", strings.Join(test.Setup, " "))
+		if setupErr := t.r.Run(ctx, test.Setup, stdout, stderr); setupErr != nil {
+			return nil, fmt.Errorf("setup command failed for test %q: %w", test.Name, setupErr)
+		}
+	}
+	testCtx := ctx
+	timeout := testTimeout(test, t.perTestTimeout)
+	r := t.r
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, t.perTestTimeout)
+		testCtx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
+		// On timeout, have the runner trigger a stack dump and give the test
+		// a moment to flush it to stderr (and thus into the test's Stdio)
+		// before the process group is killed, so that the hang is
+		// actionable. The dump settings go on a per-call copy of the runner,
+		// since tests may run concurrently and must not clobber each other's
+		// signals. Runners injected for testing kill immediately.
+		if sr, ok := t.r.(*runner.SubprocessRunner); ok {
+			srCopy := *sr
+			srCopy.DumpSignal = timeoutDumpSignal(test)
+			srCopy.DumpGracePeriod = dumpGracePeriod
+			r = &srCopy
+		}
 	}
-	err := t.r.Run(ctx, command, stdout, stderr)
+	err = r.Run(testCtx, command, stdout, stderr)
 	if err == context.DeadlineExceeded {
-		return nil, &timeoutError{t.perTestTimeout}
+		return nil, &timeoutError{timeout}
 	}
 	return nil, err
 }
 
+// dumpGracePeriod bounds how long a timed-out test may take to write its
+// stack dump before its process group is killed.
+const dumpGracePeriod = 10 * time.Second
+
+// timeoutDumpSignal returns the signal sent to a timed-out test to make it
+// dump its state before it is killed. The right signal depends on the
+// language: SIGQUIT makes the Go runtime print all goroutine stacks, while
+// SIGABRT is conventional elsewhere.
+func timeoutDumpSignal(test testsharder.Test) syscall.Signal {
+	if test.TimeoutSignal == "SIGABRT" {
+		return syscall.SIGABRT
+	}
+	return syscall.SIGQUIT
+}
+
 func (t *subprocessTester) CopySinks(ctx context.Context, sinks []runtests.DataSinkReference) error {
 	return nil
 }
@@ -119,6 +186,18 @@ func (t *subprocessTester) RunBugreport(ctx context.Context, bugreportFile strin
 	return nil
 }
 
+func (t *subprocessTester) SnapshotInspect(ctx context.Context, snapshotFile string) error {
+	return nil
+}
+
+func (t *subprocessTester) SetupRealm(ctx context.Context, realm string) error {
+	return nil
+}
+
+func (t *subprocessTester) TeardownRealm(ctx context.Context, realm string) error {
+	return nil
+}
+
 func (t *subprocessTester) Close() error {
 	return nil
 }
@@ -184,7 +263,7 @@ func (t *fuchsiaSSHTester) reconnectIfNecessary(ctx context.Context) error {
 }
 
 func (t *fuchsiaSSHTester) isTimeoutError(test testsharder.Test, err error) bool {
-	if t.perTestTimeout <= 0 || (
+	if testTimeout(test, t.perTestTimeout) <= 0 || (
 	// We only know how to interpret the exit codes of these test runners.
 	test.Command[0] != runTestComponentName && test.Command[0] != runTestSuiteName) {
 		return false
@@ -197,7 +276,7 @@ func (t *fuchsiaSSHTester) isTimeoutError(test testsharder.Test, err error) bool
 
 // Test runs a test over SSH.
 func (t *fuchsiaSSHTester) Test(ctx context.Context, test testsharder.Test, stdout io.Writer, stderr io.Writer) (runtests.DataSinkReference, error) {
-	setCommand(&test, t.useRuntests, dataOutputDir, t.perTestTimeout)
+	setCommand(&test, t.useRuntests, dataOutputDir, testTimeout(test, t.perTestTimeout))
 	var testErr error
 	const maxReconnectAttempts = 3
 	retry.Retry(ctx, retry.WithMaxAttempts(t.connectionErrorRetryBackoff, maxReconnectAttempts), func() error {
@@ -224,7 +303,7 @@ func (t *fuchsiaSSHTester) Test(ctx context.Context, test testsharder.Test, stdo
 	}
 
 	if t.isTimeoutError(test, testErr) {
-		testErr = &timeoutError{t.perTestTimeout}
+		testErr = &timeoutError{testTimeout(test, t.perTestTimeout)}
 	}
 
 	var sinkErr error
@@ -276,6 +355,39 @@ func (t *fuchsiaSSHTester) RunBugreport(ctx context.Context, bugreportFile strin
 	return err
 }
 
+// SnapshotInspect dumps the device's inspect data as JSON.
+func (t *fuchsiaSSHTester) SnapshotInspect(ctx context.Context, snapshotFile string) error {
+	if snapshotFile == "" {
+		return nil
+	}
+	snapshotOutFile, err := osmisc.CreateFile(filepath.Join(t.localOutputDir, snapshotFile))
+	if err != nil {
+		return fmt.Errorf("failed to create inspect snapshot output file: %w", err)
+	}
+	defer snapshotOutFile.Close()
+	startTime := time.Now()
+	err = t.r.Run(ctx, []string{"/bin/iquery", "--format=json", "--recursive"}, snapshotOutFile, os.Stderr)
+	logger.Debugf(ctx, "snapshotted inspect data in %v", time.Now().Sub(startTime))
+	return err
+}
+
+// SetupRealm prepares the realm shared by a group of tests. run-test-component
+// creates the realm when the first test launches into it, so there is nothing
+// to start ahead of time.
+func (t *fuchsiaSSHTester) SetupRealm(ctx context.Context, realm string) error {
+	logger.Debugf(ctx, "running the next group of tests in realm %q", realm)
+	return nil
+}
+
+// TeardownRealm removes the persistent storage of the realm shared by a group
+// of tests so that its state does not leak into later groups.
+func (t *fuchsiaSSHTester) TeardownRealm(ctx context.Context, realm string) error {
+	startTime := time.Now()
+	err := t.r.Run(ctx, []string{"rm", "-rf", "/data/r/sys/r/" + realm}, os.Stdout, os.Stderr)
+	logger.Debugf(ctx, "tore down realm %q in %v", realm, time.Now().Sub(startTime))
+	return err
+}
+
 // Close terminates the underlying SSH connection. The object is no longer
 // usable after calling this method.
 func (t *fuchsiaSSHTester) Close() error {
@@ -291,29 +403,52 @@ type fuchsiaSerialTester struct {
 	socket         io.ReadWriteCloser
 	perTestTimeout time.Duration
 	localOutputDir string
+
+	// serialLog mirrors everything read from the serial socket, so that
+	// crashes that happen outside a test boundary are still captured. It is
+	// nil when capture was not requested.
+	serialLog *os.File
 }
 
-func newFuchsiaSerialTester(ctx context.Context, serialSocketPath string, perTestTimeout time.Duration) (*fuchsiaSerialTester, error) {
+func newFuchsiaSerialTester(ctx context.Context, serialSocketPath string, perTestTimeout time.Duration, localOutputDir, serialLogFile string) (*fuchsiaSerialTester, error) {
 	socket, err := net.Dial("unix", serialSocketPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open serial socket connection: %v", err)
 	}
+	t := &fuchsiaSerialTester{
+		socket:         socket,
+		perTestTimeout: perTestTimeout,
+		localOutputDir: localOutputDir,
+	}
+	if serialLogFile != "" {
+		t.serialLog, err = osmisc.CreateFile(filepath.Join(localOutputDir, serialLogFile))
+		if err != nil {
+			socket.Close()
+			return nil, fmt.Errorf("failed to create serial log file: %w", err)
+		}
+	}
 	// Wait until the system has had a chance to boot and then look for the
 	// cursor, which should indicate that the console is ready for
 	// user-input.
-	m := iomisc.NewSequenceMatchingReader(socket, serialConsoleCursor)
+	m := iomisc.NewSequenceMatchingReader(t.reader(), serialConsoleCursor)
 	if _, err = iomisc.ReadUntilMatch(ctx, m, nil); err != nil {
 		return nil, fmt.Errorf("failed to find cursor: %v", err)
 	}
 
-	return &fuchsiaSerialTester{
-		socket:         socket,
-		perTestTimeout: perTestTimeout,
-	}, nil
+	return t, nil
+}
+
+// reader returns the stream of bytes read from the serial socket, teed into
+// the serial log when capture is enabled.
+func (t *fuchsiaSerialTester) reader() io.Reader {
+	if t.serialLog != nil {
+		return io.TeeReader(t.socket, t.serialLog)
+	}
+	return t.socket
 }
 
 func (t *fuchsiaSerialTester) Test(ctx context.Context, test testsharder.Test, stdout, stderr io.Writer) (runtests.DataSinkReference, error) {
-	setCommand(&test, true, dataOutputDir, t.perTestTimeout)
+	setCommand(&test, true, dataOutputDir, testTimeout(test, t.perTestTimeout))
 	cmd := strings.Join(test.Command, " ")
 	logger.Debugf(ctx, "starting: %s\n", cmd)
 	// The UART kernel driver expects a command to be followed by \r\n.
@@ -321,7 +456,7 @@ func (t *fuchsiaSerialTester) Test(ctx context.Context, test testsharder.Test, s
 		return nil, fmt.Errorf("failed to write to serial socket: %v", err)
 	}
 
-	success, err := runtests.TestPassed(ctx, t.socket)
+	success, err := runtests.TestPassed(ctx, t.reader())
 
 	if err != nil {
 		return nil, err
@@ -339,9 +474,27 @@ func (t *fuchsiaSerialTester) RunBugreport(ctx context.Context, bugreportFile st
 	return nil
 }
 
-// Close terminates the underlying Serial socket connection. The object is no
-// longer usable after calling this method.
+func (t *fuchsiaSerialTester) SnapshotInspect(ctx context.Context, snapshotFile string) error {
+	return nil
+}
+
+func (t *fuchsiaSerialTester) SetupRealm(ctx context.Context, realm string) error {
+	return nil
+}
+
+func (t *fuchsiaSerialTester) TeardownRealm(ctx context.Context, realm string) error {
+	return nil
+}
+
+// Close flushes the serial log and terminates the underlying Serial socket
+// connection. The object is no longer usable after calling this method.
 func (t *fuchsiaSerialTester) Close() error {
+	if t.serialLog != nil {
+		if err := t.serialLog.Close(); err != nil {
+			t.socket.Close()
+			return err
+		}
+	}
 	return t.socket.Close()
 }
 
@@ -374,6 +527,9 @@ func setCommand(test *testsharder.Test, useRuntests bool, remoteOutputDir string
 		} else {
 			// See fxbug.dev/49735 for background on --restrict-logs.
 			test.Command = []string{runTestComponentName, "--restrict-logs"}
+			if test.Realm != "" {
+				test.Command = append(test.Command, fmt.Sprintf("--realm-label=%s", test.Realm))
+			}
 			if timeout > 0 {
 				test.Command = append(test.Command, fmt.Sprintf("--timeout=%d", int64(timeout.Seconds())))
 			}
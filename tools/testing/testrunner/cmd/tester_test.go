@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,11 +31,13 @@ type fakeRunner struct {
 	runErrs                   []error
 	runCalls                  int
 	lastCmd                   []string
+	cmds                      [][]string
 }
 
 func (r *fakeRunner) Run(ctx context.Context, command []string, stdout, stderr io.Writer) error {
 	r.runCalls++
 	r.lastCmd = command
+	r.cmds = append(r.cmds, command)
 	if r.runErrs == nil {
 		return nil
 	}
@@ -56,10 +60,49 @@ func (r *fakeRunner) ReconnectIfNecessary(ctx context.Context) (*ssh.Client, err
 	return nil, err
 }
 
+func TestTestTimeout(t *testing.T) {
+	cases := []struct {
+		name        string
+		timeoutSecs int
+		global      time.Duration
+		want        time.Duration
+	}{
+		{
+			name:   "global timeout by default",
+			global: time.Minute,
+			want:   time.Minute,
+		},
+		{
+			name:        "per-test timeout wins over the global one",
+			timeoutSecs: 90,
+			global:      time.Minute,
+			want:        90 * time.Second,
+		},
+		{
+			name:        "per-test timeout applies without a global one",
+			timeoutSecs: 5,
+			want:        5 * time.Second,
+		},
+		{
+			name: "no timeout",
+			want: 0,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := testsharder.Test{TimeoutSecs: c.timeoutSecs}
+			if got := testTimeout(test, c.global); got != c.want {
+				t.Errorf("got testTimeout(%d, %v) = %v, want: %v", c.timeoutSecs, c.global, got, c.want)
+			}
+		})
+	}
+}
+
 func TestSubprocessTester(t *testing.T) {
 	cases := []struct {
 		name    string
 		test    build.Test
+		wrapper []string
 		runErrs []error
 		wantErr bool
 		wantCmd []string
@@ -94,6 +137,15 @@ func TestSubprocessTester(t *testing.T) {
 			wantErr: true,
 			wantCmd: []string{"foo", "bar"},
 		},
+		{
+			name: "wrapper prefixes the command",
+			test: build.Test{
+				Command: []string{"foo", "bar"},
+			},
+			wrapper: []string{"strace", "-f"},
+			wantErr: false,
+			wantCmd: []string{"strace", "-f", "foo", "bar"},
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -101,7 +153,8 @@ func TestSubprocessTester(t *testing.T) {
 				runErrs: c.runErrs,
 			}
 			tester := subprocessTester{
-				r: runner,
+				r:       runner,
+				wrapper: c.wrapper,
 			}
 			defer func() {
 				if err := tester.Close(); err != nil {
@@ -119,6 +172,67 @@ func TestSubprocessTester(t *testing.T) {
 	}
 }
 
+func TestSubprocessTesterSetupTeardown(t *testing.T) {
+	cases := []struct {
+		name     string
+		wrapper  []string
+		runErrs  []error
+		wantErr  bool
+		wantCmds [][]string
+	}{
+		{
+			name:     "setup and teardown run around the test",
+			wantCmds: [][]string{{"setup"}, {"test"}, {"teardown"}},
+		},
+		{
+			name:     "setup failure skips the test but not teardown",
+			runErrs:  []error{fmt.Errorf("setup failed"), nil},
+			wantErr:  true,
+			wantCmds: [][]string{{"setup"}, {"teardown"}},
+		},
+		{
+			name:     "teardown runs even if the test fails",
+			runErrs:  []error{nil, fmt.Errorf("test failed"), nil},
+			wantErr:  true,
+			wantCmds: [][]string{{"setup"}, {"test"}, {"teardown"}},
+		},
+		{
+			name:     "teardown failure fails the test",
+			runErrs:  []error{nil, nil, fmt.Errorf("teardown failed")},
+			wantErr:  true,
+			wantCmds: [][]string{{"setup"}, {"test"}, {"teardown"}},
+		},
+		{
+			name:     "wrapper applies only to the test command",
+			wrapper:  []string{"strace"},
+			wantCmds: [][]string{{"setup"}, {"strace", "test"}, {"teardown"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			runner := &fakeRunner{
+				runErrs: c.runErrs,
+			}
+			tester := subprocessTester{
+				r:       runner,
+				wrapper: c.wrapper,
+			}
+			test := testsharder.Test{
+				Test:     build.Test{Command: []string{"test"}},
+				Setup:    []string{"setup"},
+				Teardown: []string{"teardown"},
+			}
+			_, err := tester.Test(context.Background(), test, ioutil.Discard, ioutil.Discard)
+			if gotErr := (err != nil); gotErr != c.wantErr {
+				t.Errorf("tester.Test got error: %v, want error: %t", err, c.wantErr)
+			}
+			if diff := cmp.Diff(c.wantCmds, runner.cmds); diff != "" {
+				t.Errorf("Unexpected commands run (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 type fakeDataSinkCopier struct{}
 
 func (*fakeDataSinkCopier) GetReference() (runtests.DataSinkReference, error) {
@@ -298,6 +412,57 @@ func TestSerialTester(t *testing.T) {
 
 }
 
+func TestSerialTesterCapturesSerialLog(t *testing.T) {
+	ctx := context.Background()
+	serial, socket := serialAndSocket()
+	defer socket.Close()
+	defer serial.Close()
+
+	logFile, err := ioutil.TempFile("", "serial_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(logFile.Name())
+
+	tester := fuchsiaSerialTester{socket: socket, serialLog: logFile}
+	test := testsharder.Test{
+		Test: build.Test{
+			Path: "foo",
+		},
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := tester.Test(ctx, test, ioutil.Discard, ioutil.Discard)
+		errs <- err
+	}()
+
+	// The write to the socket will block until we read from serial.
+	buff := make([]byte, len("runtests --output /data/infra/testrunner foo\r\n"))
+	if _, err := io.ReadFull(serial, buff); err != nil {
+		t.Errorf("error reading from serial: %v", err)
+	}
+	if _, err := io.WriteString(serial, runtests.SuccessSignature); err != nil {
+		t.Errorf("failed to write %s to serial", runtests.SuccessSignature)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("test unexpectedly failed: %v", err)
+	}
+
+	// Everything the tester read from the socket must also land in the
+	// serial log, flushed by Close.
+	if err := tester.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+	b, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatalf("failed to read serial log: %v", err)
+	}
+	if !strings.Contains(string(b), runtests.SuccessSignature) {
+		t.Errorf("serial log %q does not contain %q", b, runtests.SuccessSignature)
+	}
+}
+
 func TestSetCommand(t *testing.T) {
 	cases := []struct {
 		name        string
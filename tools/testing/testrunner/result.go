@@ -22,12 +22,24 @@ type TestResult struct {
 	// Result describes whether the test passed or failed.
 	Result runtests.TestResult
 
+	// TimedOut is true when the test was killed because its per-test timeout
+	// fired, distinguishing hangs from ordinary failures.
+	TimedOut bool
+
+	// Flaked is true when this run passed only on a retry after one or more
+	// failed attempts.
+	Flaked bool
+
 	// Cases describes individual test cases.
 	Cases []testparser.TestCaseResult
 
 	// DataSinks gives the data sinks attached to a test.
 	DataSinks runtests.DataSinkReference
 
+	// InspectSnapshot is the path, relative to the output directory, of the
+	// inspect snapshot captured after a failure of this test, if any.
+	InspectSnapshot string
+
 	// RunIndex is the index of this test run among all the runs of the same test.
 	RunIndex int
 
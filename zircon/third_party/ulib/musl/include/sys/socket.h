@@ -217,6 +217,8 @@ struct linger {
 #define SO_DETACH_BPF SO_DETACH_FILTER
 #define SO_ATTACH_REUSEPORT_CBPF 51
 #define SO_ATTACH_REUSEPORT_EBPF 52
+#define SO_BINDTOIFINDEX 62
+#define SO_TXREHASH 74
 
 #ifndef SOL_SOCKET
 #define SOL_SOCKET 1